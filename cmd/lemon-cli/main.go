@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ardanlabs/conf/v2"
+	"github.com/denismitr/lemon-server/pkg/command"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const usage = `usage: lemon-cli [flags] query "<LQL query>"
+
+examples:
+  lemon-cli query 'FIND IN users WHERE key PREFIX "u:" AND tag.age >= 18 ORDER BY key DESC LIMIT 50'
+  lemon-cli query 'EXPLAIN FIND IN users WHERE tag.city = "Oslo"'`
+
+// cli holds the flags of the client, the command and its arguments follow them
+type cli struct {
+	Addr      string        `conf:"default:localhost:3099,help:Address of the lemon server"`
+	Token     string        `conf:"mask,help:Bearer token to authenticate with"`
+	Timeout   time.Duration `conf:"default:30s,help:Timeout of the command, including all pages"`
+	ValueMode string        `conf:"default:typed,help:How values are returned. Supported values typed|bytes"`
+	PageSize  uint32        `conf:"help:Number of documents read per request, capped by the server"`
+	Args      conf.Args
+}
+
+func main() {
+	var args cli
+	if help, err := conf.Parse("LEMON_CLI", &args); err != nil {
+		if errors.Is(err, conf.ErrHelpWanted) {
+			fmt.Println(help)
+			fmt.Println(usage)
+			return
+		}
+		log.Fatal(err.Error())
+	}
+
+	if err := run(args); err != nil {
+		log.Fatal(err.Error())
+	}
+}
+
+func run(args cli) error {
+	if args.Args.Num(0) != "query" || len(args.Args) != 2 {
+		return errors.New(usage)
+	}
+
+	mode, ok := command.ValueMode_value["VALUE_MODE_"+strings.ToUpper(args.ValueMode)]
+	if !ok {
+		return errors.Errorf("unsupported value mode %s", args.ValueMode)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), args.Timeout)
+	defer cancel()
+
+	if args.Token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+args.Token)
+	}
+
+	conn, err := grpc.DialContext(ctx, args.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return errors.Wrapf(err, "could not connect to %s", args.Addr)
+	}
+	defer conn.Close()
+
+	client := command.NewReceiverClient(conn)
+	q := command.LqlQuery{
+		Query:     args.Args.Num(1),
+		ValueMode: command.ValueMode(mode),
+		PageSize:  args.PageSize,
+	}
+
+	// all pages are read and printed as they come
+	documents := 0
+	for {
+		result, err := client.Query(ctx, &q)
+		if err != nil {
+			return err
+		}
+
+		if err := printResult(result); err != nil {
+			return err
+		}
+
+		documents += len(result.Documents)
+		if result.NextPageToken == "" {
+			fmt.Fprintf(os.Stderr, "%d documents\n", documents)
+			return nil
+		}
+
+		q.PageToken = result.NextPageToken
+	}
+}
+
+// printResult prints the plan of explained queries and documents as json, one per line
+func printResult(result *command.LqlResult) error {
+	if result.Plan != "" {
+		fmt.Print(result.Plan)
+	}
+
+	for _, d := range result.Documents {
+		b, err := protojson.Marshal(d)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+	}
+
+	for _, e := range result.Errors {
+		fmt.Fprintln(os.Stderr, "error:", e)
+	}
+
+	return nil
+}
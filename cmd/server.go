@@ -1,22 +1,39 @@
 package main
 
 import (
-	"flag"
+	"fmt"
+	"github.com/ardanlabs/conf/v2"
 	"github.com/denismitr/lemon-server/internal/server"
 	"github.com/denismitr/lemon-server/internal/server/serverpb"
+	"github.com/pkg/errors"
 	"log"
 )
 
 var build = "dev"
 
-func main() {
-	var yamlFile = flag.String("yaml-config", "", "Path to config yaml file")
-	var env = flag.String("environment", "dev", "Environment to run server in. Supported values (dev, prod, test)")
-	var dotenvFile = flag.String("dotenv", "", "Path to .env file")
+// cli holds the flags needed before the configuration itself can be loaded,
+// every other flag is treated as a configuration override e.g. --grpc-port=4000
+type cli struct {
+	YamlConfig  string `conf:"help:Path to config yaml file"`
+	Environment string `conf:"default:dev,help:Environment to run server in. Supported values dev|prod|test"`
+	Dotenv      string `conf:"help:Path to .env file"`
+	PrintConfig bool   `conf:"help:Print effective configuration with the source of every value and exit"`
+}
 
-	flag.Parse()
+func main() {
+	var args cli
+	if help, err := conf.Parse("LEMON", &args); err != nil {
+		if errors.Is(err, conf.ErrHelpWanted) {
+			fmt.Println(help)
+			if usage, err := conf.UsageInfo("", &server.Config{}); err == nil {
+				fmt.Println(usage)
+			}
+			return
+		}
+		log.Fatal(err.Error())
+	}
 
-	serverEnv, err := server.CreateEnvironment(*env)
+	serverEnv, err := server.CreateEnvironment(args.Environment)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
@@ -24,12 +41,22 @@ func main() {
 	factory := serverpb.NewFactory()
 	factory.WithBuildVersion(build).WithEnvironment(serverEnv)
 
-	if *yamlFile != "" {
-		factory.WithYamlConfig(*yamlFile)
-	} else if *dotenvFile != "" {
-		factory.WithDotEnv(*dotenvFile)
-	} else {
-		log.Fatal("Configuration must be provided via --yaml-config or --dotenv")
+	if args.YamlConfig != "" {
+		factory.WithYamlConfig(args.YamlConfig)
+	}
+
+	if args.Dotenv != "" {
+		factory.WithDotEnv(args.Dotenv)
+	}
+
+	if args.PrintConfig {
+		cfg, err := factory.BuildConfig()
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+		fmt.Print(cfg.Print())
+		return
 	}
 
 	srv, err := factory.BuildGrpcServer()
@@ -5,11 +5,16 @@ go 1.16
 require (
 	github.com/ardanlabs/conf/v2 v2.2.0
 	github.com/denismitr/lemon v0.10.0
+	github.com/golang/snappy v0.0.4
+	github.com/hashicorp/raft v1.3.11
+	github.com/hashicorp/raft-boltdb/v2 v2.2.2
 	github.com/joho/godotenv v1.4.0
+	github.com/klauspost/compress v1.13.6
 	github.com/pkg/errors v0.9.1
 	github.com/stretchr/testify v1.7.0
 	go.uber.org/zap v1.19.1
 	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013
 	google.golang.org/grpc v1.42.0
 	google.golang.org/protobuf v1.27.1
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,219 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrClosed = errors.New("audit log is closed")
+
+const (
+	currentFile   = "audit.log"
+	rotatedGlob   = "audit-*.log"
+	rotatedLayout = "20060102T150405.000000000"
+)
+
+// Record describes a single destructive operation
+type Record struct {
+	Time      time.Time `json:"time"`
+	Principal string    `json:"principal"`
+	Peer      string    `json:"peer"`
+	Method    string    `json:"method"`
+	Database  string    `json:"database"`
+	Keys      []string  `json:"keys,omitempty"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Log is an append-only audit trail stored as json lines,
+// the current file is rotated once it grows over the max size
+type Log struct {
+	dir     string
+	maxSize int64
+	mu      sync.Mutex
+	f       *os.File
+	size    int64
+}
+
+// Open opens or creates the audit log in the given directory
+func Open(dir string, maxSize int64) (*Log, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, errors.Wrapf(err, "could not create audit log directory %s", dir)
+	}
+
+	l := &Log{dir: dir, maxSize: maxSize}
+	if err := l.openCurrent(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *Log) openCurrent() error {
+	f, err := os.OpenFile(filepath.Join(l.dir, currentFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return errors.Wrap(err, "could not open audit log")
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return errors.Wrap(err, "could not stat audit log")
+	}
+
+	l.f = f
+	l.size = info.Size()
+
+	return nil
+}
+
+// Append writes a record to the log and syncs it to disk
+func (l *Log) Append(r Record) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return errors.Wrap(err, "could not serialize audit record")
+	}
+	b = append(b, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return ErrClosed
+	}
+
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(b)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.f.Write(b)
+	l.size += int64(n)
+	if err != nil {
+		return errors.Wrap(err, "could not write audit record")
+	}
+
+	return l.f.Sync()
+}
+
+func (l *Log) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return errors.Wrap(err, "could not close audit log")
+	}
+
+	rotated := filepath.Join(l.dir, fmt.Sprintf("audit-%s.log", time.Now().UTC().Format(rotatedLayout)))
+	if err := os.Rename(filepath.Join(l.dir, currentFile), rotated); err != nil {
+		return errors.Wrap(err, "could not rotate audit log")
+	}
+
+	return l.openCurrent()
+}
+
+// Query returns records within [from, to), zero times leave the range open,
+// a limit of zero returns all matching records
+func (l *Log) Query(from, to time.Time, limit int) ([]Record, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rotated, err := filepath.Glob(filepath.Join(l.dir, rotatedGlob))
+	if err != nil {
+		return nil, err
+	}
+
+	// rotated file names sort chronologically
+	sort.Strings(rotated)
+	files := append(rotated, filepath.Join(l.dir, currentFile))
+
+	var result []Record
+	for _, path := range files {
+		if !from.IsZero() && rotatedBefore(path, from) {
+			continue
+		}
+
+		records, err := readRecords(path, from, to)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, records...)
+		if limit > 0 && len(result) >= limit {
+			return result[:limit], nil
+		}
+	}
+
+	return result, nil
+}
+
+// rotatedBefore reports whether the file was rotated before the given time,
+// in which case it only holds older records
+func rotatedBefore(path string, t time.Time) bool {
+	name := filepath.Base(path)
+	if !strings.HasPrefix(name, "audit-") {
+		return false
+	}
+
+	rotatedAt, err := time.Parse(rotatedLayout, strings.TrimSuffix(strings.TrimPrefix(name, "audit-"), ".log"))
+	if err != nil {
+		return false
+	}
+
+	return rotatedAt.Before(t)
+}
+
+func readRecords(path string, from, to time.Time) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "could not open audit file %s", path)
+	}
+	defer f.Close()
+
+	var records []Record
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		var r Record
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			return nil, errors.Wrapf(err, "corrupted audit record in %s", path)
+		}
+
+		if !from.IsZero() && r.Time.Before(from) {
+			continue
+		}
+
+		if !to.IsZero() && !r.Time.Before(to) {
+			continue
+		}
+
+		records = append(records, r)
+	}
+
+	return records, sc.Err()
+}
+
+// Close closes the current audit file
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return nil
+	}
+
+	err := l.f.Close()
+	l.f = nil
+
+	return err
+}
@@ -0,0 +1,49 @@
+package audit
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Log_AppendRotateQuery(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, 300)
+	require.NoError(t, err)
+	defer l.Close()
+
+	base := time.Date(2021, 12, 1, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, l.Append(Record{
+			Time:      base.Add(time.Duration(i) * time.Minute),
+			Principal: "alice",
+			Method:    "/command.Receiver/BatchDeleteByKey",
+			Database:  "users",
+			Keys:      []string{"u:1", "u:2"},
+			Status:    "OK",
+		}))
+	}
+
+	rotated, err := filepath.Glob(filepath.Join(dir, rotatedGlob))
+	require.NoError(t, err)
+	assert.NotEmpty(t, rotated, "log should have been rotated")
+
+	all, err := l.Query(time.Time{}, time.Time{}, 0)
+	require.NoError(t, err)
+	require.Len(t, all, 5)
+	for i, r := range all {
+		assert.Equal(t, base.Add(time.Duration(i)*time.Minute), r.Time)
+	}
+
+	ranged, err := l.Query(base.Add(time.Minute), base.Add(3*time.Minute), 0)
+	require.NoError(t, err)
+	require.Len(t, ranged, 2)
+	assert.Equal(t, base.Add(time.Minute), ranged[0].Time)
+
+	limited, err := l.Query(time.Time{}, time.Time{}, 3)
+	require.NoError(t, err)
+	assert.Len(t, limited, 3)
+}
@@ -0,0 +1,410 @@
+// Package cluster runs lemon-server nodes as a raft cluster.
+//
+// Every write to the engine of a node is proposed as an entry of the raft log and applied
+// by all nodes once a majority has logged it, so that a write acknowledged by the leader
+// survives the loss of any minority of nodes. Only the leader accepts writes, the grpc
+// server of other nodes forwards them to it. Reads are served by the node they are sent
+// to and may lag behind the leader on other nodes.
+//
+// Raft snapshots are backups of the store. The store of a node is derived from the raft
+// log, so it is rebuilt from the last snapshot and the entries following it on every start.
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/denismitr/lemon-server/internal/database"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+var ErrNotLeader = errors.New("node is not the cluster leader")
+
+const (
+	// retainedSnapshots is the number of raft snapshots kept on disk
+	retainedSnapshots = 2
+	maxPool           = 3
+	transportTimeout  = 10 * time.Second
+	// DefaultApplyTimeout is the time a write waits to be logged by a majority of nodes
+	DefaultApplyTimeout = 10 * time.Second
+)
+
+type Config struct {
+	NodeID string
+	// RaftAddress is the host:port the raft transport listens on, other nodes connect to it
+	RaftAddress string
+	// Address is the host:port of the grpc server of the node
+	Address string
+	// Dir holds the raft log and snapshots
+	Dir string
+	// Bootstrap starts a new cluster with the node as its only member, unless it has raft state already
+	Bootstrap    bool
+	ApplyTimeout time.Duration
+
+	// tune adjusts the raft configuration, tests use it to speed up elections
+	tune func(*raft.Config)
+}
+
+type Node struct {
+	cfg       Config
+	raft      *raft.Raft
+	fsm       *fsm
+	logs      *raftboltdb.BoltStore
+	transport *raft.NetworkTransport
+	lg        *zap.SugaredLogger
+	done      chan struct{}
+}
+
+// Status describes a node and the members of its cluster
+type Status struct {
+	NodeID       string
+	State        string
+	LeaderID     string
+	Term         uint64
+	LastIndex    uint64
+	AppliedIndex uint64
+	Nodes        []NodeStatus
+}
+
+type NodeStatus struct {
+	ID          string
+	RaftAddress string
+	Address     string
+	Voter       bool
+	Leader      bool
+}
+
+// NewNode starts the raft node of an engine, the databases of the engine are replaced with
+// those of the raft log, which is why a node without raft state must have an empty store
+func NewNode(cfg Config, engine *database.LemonEngine, lg *zap.SugaredLogger) (*Node, error) {
+	if cfg.NodeID == "" {
+		return nil, errors.New("cluster node id is empty")
+	}
+
+	if cfg.ApplyTimeout <= 0 {
+		cfg.ApplyTimeout = DefaultApplyTimeout
+	}
+
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "could not create directory %s", cfg.Dir)
+	}
+
+	// snapshots not persisted before a crash are left behind
+	stale, _ := filepath.Glob(filepath.Join(cfg.Dir, snapshotPattern))
+	for _, path := range stale {
+		if err := os.Remove(path); err != nil {
+			return nil, errors.Wrapf(err, "could not remove snapshot file %s", path)
+		}
+	}
+
+	out := zap.NewStdLog(lg.Desugar()).Writer()
+
+	logs, err := raftboltdb.NewBoltStore(filepath.Join(cfg.Dir, "raft.db"))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open raft log")
+	}
+
+	snaps, err := raft.NewFileSnapshotStore(cfg.Dir, retainedSnapshots, out)
+	if err != nil {
+		_ = logs.Close()
+		return nil, errors.Wrap(err, "could not open raft snapshots")
+	}
+
+	existing, err := raft.HasExistingState(logs, logs, snaps)
+	if err != nil {
+		_ = logs.Close()
+		return nil, err
+	}
+
+	if existing {
+		// raft restores the last snapshot and applies the entries following it again
+		if err := engine.Restore(nil); err != nil {
+			_ = logs.Close()
+			return nil, errors.Wrap(err, "could not clear the store before replaying the raft log")
+		}
+	} else {
+		names, err := engine.Databases()
+		if err != nil {
+			_ = logs.Close()
+			return nil, err
+		}
+
+		if len(names) > 0 {
+			_ = logs.Close()
+			return nil, errors.Errorf("store of new cluster node %s is not empty, it has %d databases", cfg.NodeID, len(names))
+		}
+	}
+
+	transport, err := raft.NewTCPTransport(cfg.RaftAddress, nil, maxPool, transportTimeout, out)
+	if err != nil {
+		_ = logs.Close()
+		return nil, errors.Wrapf(err, "could not listen on raft address %s", cfg.RaftAddress)
+	}
+
+	notify := make(chan bool, 1)
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(cfg.NodeID)
+	conf.LogOutput = out
+	conf.LogLevel = "WARN"
+	conf.NotifyCh = notify
+	if cfg.tune != nil {
+		cfg.tune(conf)
+	}
+
+	n := &Node{
+		cfg:       cfg,
+		fsm:       newFSM(engine, cfg.Dir, lg),
+		logs:      logs,
+		transport: transport,
+		lg:        lg,
+		done:      make(chan struct{}),
+	}
+
+	if n.raft, err = raft.NewRaft(conf, n.fsm, logs, logs, snaps, transport); err != nil {
+		_ = transport.Close()
+		_ = logs.Close()
+		return nil, errors.Wrap(err, "could not start raft")
+	}
+
+	if cfg.Bootstrap && !existing {
+		if err := n.raft.BootstrapCluster(raft.Configuration{
+			Servers: []raft.Server{{ID: conf.LocalID, Address: transport.LocalAddr()}},
+		}).Error(); err != nil {
+			_ = n.Shutdown()
+			return nil, errors.Wrap(err, "could not bootstrap cluster")
+		}
+	}
+
+	go n.announce(notify)
+
+	return n, nil
+}
+
+// announce makes the grpc address of the node known whenever it becomes the leader,
+// so that the other nodes can forward writes to it
+func (n *Node) announce(notify <-chan bool) {
+	for {
+		select {
+		case <-n.done:
+			return
+		case leader := <-notify:
+			if !leader || n.fsm.address(n.cfg.NodeID) == n.cfg.Address {
+				continue
+			}
+
+			if err := n.addMember(context.Background(), n.cfg.NodeID, n.cfg.Address); err != nil {
+				n.lg.Errorf("could not announce address %s of cluster node %s: %v", n.cfg.Address, n.cfg.NodeID, err)
+			}
+		}
+	}
+}
+
+func (n *Node) ID() string {
+	return n.cfg.NodeID
+}
+
+func (n *Node) IsLeader() bool {
+	return n.raft.State() == raft.Leader
+}
+
+// Leader returns the id and the grpc address of the leader, both are empty while there is none
+func (n *Node) Leader() (id, address string) {
+	_, leaderID := n.raft.LeaderWithID()
+	if leaderID == "" {
+		return "", ""
+	}
+
+	return string(leaderID), n.fsm.address(string(leaderID))
+}
+
+// propose logs an entry and waits until it is applied by the leader
+func (n *Node) propose(ctx context.Context, e entry) (*result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if !n.IsLeader() {
+		return nil, n.notLeader()
+	}
+
+	op := e.Op
+	e.Time = time.Now()
+	e.Principal = database.PrincipalFrom(ctx)
+	b, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	f := n.raft.Apply(b, n.cfg.ApplyTimeout)
+	if err := f.Error(); err != nil {
+		if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) {
+			return nil, n.notLeader()
+		}
+		return nil, errors.Wrapf(err, "could not log %s", op)
+	}
+
+	r, ok := f.Response().(*result)
+	if !ok {
+		return nil, errors.Errorf("unexpected response %T to %s", f.Response(), op)
+	}
+
+	return r, r.err
+}
+
+func (n *Node) notLeader() error {
+	id, address := n.Leader()
+	if id == "" {
+		return errors.Wrap(ErrNotLeader, "there is no leader")
+	}
+
+	return errors.Wrapf(ErrNotLeader, "leader is %s at %s", id, address)
+}
+
+func (n *Node) addMember(ctx context.Context, id, address string) error {
+	payload, err := json.Marshal(member{ID: id, Address: address})
+	if err != nil {
+		return err
+	}
+
+	_, err = n.propose(ctx, entry{Op: opAddMember, Payload: payload})
+	return err
+}
+
+// AddNode makes a node a voting member, the node has to be started without bootstrapping
+func (n *Node) AddNode(ctx context.Context, id, raftAddress, address string) error {
+	if id == "" || raftAddress == "" || address == "" {
+		return errors.Wrap(database.ErrInvalidInput, "node id, raft address and address are required")
+	}
+
+	// the address is known before the node can become the leader
+	if err := n.addMember(ctx, id, address); err != nil {
+		return err
+	}
+
+	if err := n.raft.AddVoter(raft.ServerID(id), raft.ServerAddress(raftAddress), 0, n.cfg.ApplyTimeout).Error(); err != nil {
+		if errors.Is(err, raft.ErrNotLeader) {
+			return n.notLeader()
+		}
+		return errors.Wrapf(err, "could not add node %s", id)
+	}
+
+	n.lg.Infof("added cluster node %s at %s", id, raftAddress)
+
+	return nil
+}
+
+// RemoveNode removes a member, removing the leader makes the others elect a new one
+func (n *Node) RemoveNode(ctx context.Context, id string) error {
+	if id == "" {
+		return errors.Wrap(database.ErrInvalidInput, "node id is required")
+	}
+
+	if !n.IsLeader() {
+		return n.notLeader()
+	}
+
+	if err := n.raft.RemoveServer(raft.ServerID(id), 0, n.cfg.ApplyTimeout).Error(); err != nil {
+		if errors.Is(err, raft.ErrNotLeader) {
+			return n.notLeader()
+		}
+		return errors.Wrapf(err, "could not remove node %s", id)
+	}
+
+	n.lg.Infof("removed cluster node %s", id)
+
+	if id == n.cfg.NodeID {
+		// the removed leader steps down, the next one forgets the address
+		return nil
+	}
+
+	payload, err := json.Marshal(id)
+	if err != nil {
+		return err
+	}
+
+	_, err = n.propose(ctx, entry{Op: opRemoveMember, Payload: payload})
+	return err
+}
+
+// Snapshot makes raft take a snapshot now, instead of after a number of entries
+func (n *Node) Snapshot() error {
+	return n.raft.Snapshot().Error()
+}
+
+func (n *Node) Status() (Status, error) {
+	s := Status{
+		NodeID:       n.cfg.NodeID,
+		State:        stateName(n.raft.State()),
+		Term:         n.term(),
+		LastIndex:    n.raft.LastIndex(),
+		AppliedIndex: n.raft.AppliedIndex(),
+	}
+	s.LeaderID, _ = n.Leader()
+
+	f := n.raft.GetConfiguration()
+	if err := f.Error(); err != nil {
+		return s, errors.Wrap(err, "could not read cluster configuration")
+	}
+
+	for _, srv := range f.Configuration().Servers {
+		s.Nodes = append(s.Nodes, NodeStatus{
+			ID:          string(srv.ID),
+			RaftAddress: string(srv.Address),
+			Address:     n.fsm.address(string(srv.ID)),
+			Voter:       srv.Suffrage == raft.Voter,
+			Leader:      string(srv.ID) == s.LeaderID,
+		})
+	}
+
+	sort.Slice(s.Nodes, func(i, j int) bool {
+		return s.Nodes[i].ID < s.Nodes[j].ID
+	})
+
+	return s, nil
+}
+
+func (n *Node) term() uint64 {
+	term, _ := strconv.ParseUint(n.raft.Stats()["term"], 10, 64)
+	return term
+}
+
+func stateName(s raft.RaftState) string {
+	switch s {
+	case raft.Leader:
+		return "leader"
+	case raft.Follower:
+		return "follower"
+	case raft.Candidate:
+		return "candidate"
+	default:
+		return "shutdown"
+	}
+}
+
+// Shutdown stops the node, the store is left to its owner to close
+func (n *Node) Shutdown() error {
+	select {
+	case <-n.done:
+		return nil
+	default:
+		close(n.done)
+	}
+
+	err := n.raft.Shutdown().Error()
+	if tErr := n.transport.Close(); tErr != nil && err == nil {
+		err = tErr
+	}
+	if lErr := n.logs.Close(); lErr != nil && err == nil {
+		err = lErr
+	}
+
+	return err
+}
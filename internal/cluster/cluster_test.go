@@ -0,0 +1,180 @@
+package cluster
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/denismitr/lemon-server/internal/database"
+	"github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type testNode struct {
+	*Node
+	engine *Engine
+	store  *database.Store
+	dir    string
+}
+
+// startNode runs a node on a loopback port, dir keeps its store and raft state across restarts
+func startNode(t *testing.T, id, dir, raftAddress string, bootstrap bool) *testNode {
+	store := database.NewStore(filepath.Join(dir, "data"), time.Minute)
+	le := database.NewEngine(store, nil, zap.NewNop().Sugar())
+
+	n, err := NewNode(Config{
+		NodeID:      id,
+		RaftAddress: raftAddress,
+		Address:     id + ".grpc:3099",
+		Dir:         filepath.Join(dir, "raft"),
+		Bootstrap:   bootstrap,
+		tune: func(c *raft.Config) {
+			c.HeartbeatTimeout = 100 * time.Millisecond
+			c.ElectionTimeout = 100 * time.Millisecond
+			c.LeaderLeaseTimeout = 50 * time.Millisecond
+			c.CommitTimeout = 5 * time.Millisecond
+			// snapshots truncate the log, so that nodes joining later install them
+			c.TrailingLogs = 1
+		},
+	}, le, zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	tn := &testNode{Node: n, engine: NewEngine(le, n), store: store, dir: dir}
+	t.Cleanup(tn.stop)
+
+	return tn
+}
+
+func (tn *testNode) stop() {
+	_ = tn.Shutdown()
+	_ = tn.store.Close()
+}
+
+func (tn *testNode) raftAddress() string {
+	return string(tn.transport.LocalAddr())
+}
+
+func leaderOf(t *testing.T, nodes ...*testNode) *testNode {
+	var leader *testNode
+	require.Eventually(t, func() bool {
+		for _, n := range nodes {
+			if n.IsLeader() {
+				id, address := n.Leader()
+				if id == n.ID() && address == n.cfg.Address {
+					leader = n
+					return true
+				}
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+
+	return leader
+}
+
+func hasValue(t *testing.T, nodes []*testNode, dbName, key, value string) {
+	for _, n := range nodes {
+		require.Eventually(t, func() bool {
+			docs, err := n.engine.MGet(context.Background(), dbName, []string{key}, time.Time{})
+			return err == nil && docs[key] != nil && docs[key].RawString() == value
+		}, 5*time.Second, 10*time.Millisecond, "node %s", n.ID())
+	}
+}
+
+func Test_Cluster(t *testing.T) {
+	ctx := context.Background()
+	// nodes started by subtests run until the end of the test
+	parent := t
+
+	n1 := startNode(t, "n1", t.TempDir(), "127.0.0.1:0", true)
+	n2 := startNode(t, "n2", t.TempDir(), "127.0.0.1:0", false)
+	n3 := startNode(t, "n3", t.TempDir(), "127.0.0.1:0", false)
+
+	leader := leaderOf(t, n1)
+	for _, n := range []*testNode{n2, n3} {
+		require.NoError(t, leader.AddNode(ctx, n.ID(), n.raftAddress(), n.cfg.Address))
+	}
+
+	nodes := []*testNode{n1, n2, n3}
+
+	t.Run("writes are applied by all nodes", func(t *testing.T) {
+		_, err := leader.engine.BatchUpsert(ctx, "users", database.BatchUpsert{{Key: "u:1", Value: "ann"}})
+		require.NoError(t, err)
+		hasValue(t, nodes, "users", "u:1", "ann")
+
+		_, err = leader.engine.BatchUpsert(ctx, "users", database.BatchUpsert{{Key: "u:1", Value: "bob", ExpectedRevision: 7}})
+		assert.True(t, errors.Is(err, database.ErrRevisionMismatch))
+
+		docs, err := n3.engine.MGet(ctx, "users", []string{"u:1"}, time.Time{})
+		require.NoError(t, err)
+		assert.Equal(t, uint64(1), docs["u:1"].Revision())
+	})
+
+	t.Run("followers reject writes", func(t *testing.T) {
+		_, err := n2.engine.BatchUpsert(ctx, "users", database.BatchUpsert{{Key: "u:2", Value: "cid"}})
+		require.True(t, errors.Is(err, ErrNotLeader))
+		assert.Contains(t, err.Error(), n1.cfg.Address)
+	})
+
+	t.Run("nodes joining later install a snapshot", func(t *testing.T) {
+		_, err := leader.engine.BatchUpsert(ctx, "users", database.BatchUpsert{{Key: "u:2", Value: "cid"}})
+		require.NoError(t, err)
+		require.NoError(t, leader.Snapshot())
+
+		// the snapshot was streamed from a file that is removed once persisted
+		stale, err := filepath.Glob(filepath.Join(leader.cfg.Dir, snapshotPattern))
+		require.NoError(t, err)
+		assert.Empty(t, stale)
+
+		n4 := startNode(parent, "n4", t.TempDir(), "127.0.0.1:0", false)
+		require.NoError(t, leader.AddNode(ctx, n4.ID(), n4.raftAddress(), n4.cfg.Address))
+		nodes = append(nodes, n4)
+
+		hasValue(t, nodes, "users", "u:2", "cid")
+
+		s, err := n4.Status()
+		require.NoError(t, err)
+		assert.Equal(t, "follower", s.State)
+		assert.Equal(t, "n1", s.LeaderID)
+		require.Len(t, s.Nodes, 4)
+		assert.Equal(t, n4.cfg.Address, s.Nodes[3].Address)
+	})
+
+	t.Run("a new leader is elected when the leader fails", func(t *testing.T) {
+		n1.stop()
+		nodes = nodes[1:]
+
+		leader = leaderOf(t, nodes...)
+		_, err := leader.engine.BatchUpsert(ctx, "users", database.BatchUpsert{{Key: "u:3", Value: "dan"}})
+		require.NoError(t, err)
+		hasValue(t, nodes, "users", "u:3", "dan")
+
+		require.NoError(t, leader.RemoveNode(ctx, "n1"))
+		s, err := leader.Status()
+		require.NoError(t, err)
+		assert.Len(t, s.Nodes, 3)
+	})
+
+	t.Run("restarted nodes rebuild their store from the log", func(t *testing.T) {
+		follower := nodes[0]
+		if follower == leader {
+			follower = nodes[1]
+		}
+
+		follower.stop()
+		restarted := startNode(parent, follower.ID(), follower.dir, follower.raftAddress(), false)
+
+		_, err := leader.engine.BatchDeleteByKey(ctx, "users", database.BatchDeleteByKey{"u:1"})
+		require.NoError(t, err)
+		hasValue(t, []*testNode{restarted}, "users", "u:3", "dan")
+
+		require.Eventually(t, func() bool {
+			docs, err := restarted.engine.MGet(ctx, "users", []string{"u:1", "u:2"}, time.Time{})
+			return err == nil && len(docs) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+}
@@ -0,0 +1,138 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/denismitr/lemon-server/internal/database"
+)
+
+// Engine proposes the writes of an engine through the raft log of its node,
+// reads are served by the engine of the node itself
+type Engine struct {
+	*database.LemonEngine
+	node *Node
+}
+
+func NewEngine(engine *database.LemonEngine, node *Node) *Engine {
+	return &Engine{
+		LemonEngine: engine,
+		node:        node,
+	}
+}
+
+// writes proposes writes to documents, encoded with the go types of their values, together
+// with the id of the transaction they make when they span databases or shards
+func (e *Engine) writes(ctx context.Context, op, dbName string, writes ...database.TxWrite) (*result, error) {
+	payload, err := database.MarshalTxWrites(writes)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := database.NewTransactionID()
+	if err != nil {
+		return nil, err
+	}
+
+	return e.node.propose(ctx, entry{Op: op, Database: dbName, Transaction: id, Payload: payload})
+}
+
+func (e *Engine) propose(ctx context.Context, op, dbName string, v interface{}) (*result, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.node.propose(ctx, entry{Op: op, Database: dbName, Payload: payload})
+}
+
+func (e *Engine) BatchInsert(ctx context.Context, dbName string, bi database.BatchInsert) (*database.ExecResult, error) {
+	r, err := e.writes(ctx, opInsert, dbName, database.TxWrite{Database: dbName, Inserts: bi})
+	if err != nil {
+		return nil, err
+	}
+	return r.exec, nil
+}
+
+func (e *Engine) BatchUpsert(ctx context.Context, dbName string, bu database.BatchUpsert) (*database.ExecResult, error) {
+	r, err := e.writes(ctx, opUpsert, dbName, database.TxWrite{Database: dbName, Upserts: bu})
+	if err != nil {
+		return nil, err
+	}
+	return r.exec, nil
+}
+
+func (e *Engine) BatchDeleteByKey(
+	ctx context.Context,
+	dbName string,
+	keys database.BatchDeleteByKey,
+) (*database.ExecResult, error) {
+	r, err := e.writes(ctx, opDelete, dbName, database.TxWrite{Database: dbName, Deletes: keys})
+	if err != nil {
+		return nil, err
+	}
+	return r.exec, nil
+}
+
+func (e *Engine) CrossDatabaseTransaction(ctx context.Context, writes []database.TxWrite) (*database.TxResult, error) {
+	r, err := e.writes(ctx, opTransaction, "", writes...)
+	if err != nil {
+		return nil, err
+	}
+	return r.tx, nil
+}
+
+func (e *Engine) BatchPatch(ctx context.Context, dbName string, bp database.BatchPatch) (*database.ExecResult, error) {
+	r, err := e.propose(ctx, opPatch, dbName, bp)
+	if err != nil {
+		return nil, err
+	}
+	return r.exec, nil
+}
+
+func (e *Engine) Undelete(
+	ctx context.Context,
+	dbName string,
+	keys []string,
+	ignoreMissing bool,
+) (*database.ExecResult, error) {
+	r, err := e.propose(ctx, opUndelete, dbName, undeletePayload{Keys: keys, IgnoreMissing: ignoreMissing})
+	if err != nil {
+		return nil, err
+	}
+	return r.exec, nil
+}
+
+func (e *Engine) SetSchema(ctx context.Context, dbName string, s *database.Schema) error {
+	_, err := e.propose(ctx, opSetSchema, dbName, s)
+	return err
+}
+
+func (e *Engine) SetOptions(ctx context.Context, dbName string, o *database.Options) error {
+	// invalid options are rejected before they are logged
+	if err := o.Validate(); err != nil {
+		return err
+	}
+
+	_, err := e.propose(ctx, opSetOptions, dbName, o)
+	return err
+}
+
+func (e *Engine) SetIndexes(ctx context.Context, dbName string, tags []string) ([]database.Index, error) {
+	r, err := e.propose(ctx, opSetIndexes, dbName, tags)
+	if err != nil {
+		return nil, err
+	}
+	return r.indexes, nil
+}
+
+func (e *Engine) RotateKey(ctx context.Context, dbName, keyID string) error {
+	_, err := e.propose(ctx, opRotateKey, dbName, keyID)
+	return err
+}
+
+// Reshard is logged like the other writes, every node moves the documents of its store itself
+func (e *Engine) Reshard(ctx context.Context, dbName string, shards int) error {
+	_, err := e.propose(ctx, opReshard, dbName, shards)
+	return err
+}
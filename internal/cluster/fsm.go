@@ -0,0 +1,294 @@
+package cluster
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/denismitr/lemon-server/internal/database"
+	"github.com/hashicorp/raft"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// operations of log entries
+const (
+	opInsert       = "insert"
+	opUpsert       = "upsert"
+	opDelete       = "delete"
+	opPatch        = "patch"
+	opTransaction  = "transaction"
+	opUndelete     = "undelete"
+	opSetSchema    = "set_schema"
+	opSetOptions   = "set_options"
+	opSetIndexes   = "set_indexes"
+	opRotateKey    = "rotate_key"
+	opReshard      = "reshard"
+	opAddMember    = "add_member"
+	opRemoveMember = "remove_member"
+)
+
+// entry is a write proposed through the raft log, it carries the time and principal
+// of the request and the id of the transaction it makes, so that all nodes apply it the same way
+type entry struct {
+	Op          string          `json:"op"`
+	Database    string          `json:"database,omitempty"`
+	Time        time.Time       `json:"time"`
+	Principal   string          `json:"principal,omitempty"`
+	Transaction string          `json:"transaction,omitempty"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+}
+
+type undeletePayload struct {
+	Keys          []string `json:"keys"`
+	IgnoreMissing bool     `json:"ignore_missing,omitempty"`
+}
+
+type member struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+}
+
+// result is what applying an entry returned, errors included
+type result struct {
+	exec    *database.ExecResult
+	tx      *database.TxResult
+	indexes []database.Index
+	err     error
+}
+
+// snapshotPattern names the files snapshots are written to in the raft dir before they are persisted
+const snapshotPattern = "fsm-snapshot-*.tar"
+
+// fsm applies the entries of the raft log to the engine of a node, and keeps
+// the grpc addresses of the members, so that writes can be forwarded to the leader
+type fsm struct {
+	engine  *database.LemonEngine
+	dir     string
+	lg      *zap.SugaredLogger
+	members map[string]string
+	mu      sync.Mutex
+}
+
+func newFSM(engine *database.LemonEngine, dir string, lg *zap.SugaredLogger) *fsm {
+	return &fsm{
+		engine:  engine,
+		dir:     dir,
+		lg:      lg,
+		members: make(map[string]string),
+	}
+}
+
+func (f *fsm) address(id string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.members[id]
+}
+
+// Apply applies a committed entry, failed writes fail the same way on every node
+func (f *fsm) Apply(l *raft.Log) interface{} {
+	var e entry
+	if err := json.Unmarshal(l.Data, &e); err != nil {
+		f.lg.Errorf("could not decode raft log entry %d: %v", l.Index, err)
+		return &result{err: errors.Wrapf(err, "could not decode raft log entry %d", l.Index)}
+	}
+
+	ctx := database.WithTime(database.WithPrincipal(context.Background(), e.Principal), e.Time)
+	if e.Transaction != "" {
+		ctx = database.WithTransactionID(ctx, e.Transaction)
+	}
+	r := f.apply(ctx, &e)
+	if r.err != nil {
+		f.lg.Debugf("raft log entry %d %s failed: %v", l.Index, e.Op, r.err)
+	}
+
+	return r
+}
+
+func (f *fsm) apply(ctx context.Context, e *entry) *result {
+	var r result
+	switch e.Op {
+	case opInsert, opUpsert, opDelete, opTransaction:
+		writes, err := database.UnmarshalTxWrites(e.Payload)
+		if err != nil {
+			return &result{err: err}
+		}
+
+		switch {
+		case e.Op == opTransaction:
+			r.tx, r.err = f.engine.CrossDatabaseTransaction(ctx, writes)
+		case len(writes) != 1:
+			r.err = errors.Errorf("%s entry must hold the writes of one database", e.Op)
+		case e.Op == opInsert:
+			r.exec, r.err = f.engine.BatchInsert(ctx, e.Database, writes[0].Inserts)
+		case e.Op == opUpsert:
+			r.exec, r.err = f.engine.BatchUpsert(ctx, e.Database, writes[0].Upserts)
+		default:
+			r.exec, r.err = f.engine.BatchDeleteByKey(ctx, e.Database, writes[0].Deletes)
+		}
+	case opPatch:
+		var bp database.BatchPatch
+		if r.err = json.Unmarshal(e.Payload, &bp); r.err == nil {
+			r.exec, r.err = f.engine.BatchPatch(ctx, e.Database, bp)
+		}
+	case opUndelete:
+		var p undeletePayload
+		if r.err = json.Unmarshal(e.Payload, &p); r.err == nil {
+			r.exec, r.err = f.engine.Undelete(ctx, e.Database, p.Keys, p.IgnoreMissing)
+		}
+	case opSetSchema:
+		var p database.Schema
+		if r.err = json.Unmarshal(e.Payload, &p); r.err != nil {
+			break
+		}
+
+		var s *database.Schema
+		if s, r.err = database.NewSchema(p.JSONSchema, p.RequiredTags); r.err == nil {
+			r.err = f.engine.SetSchema(ctx, e.Database, s)
+		}
+	case opSetOptions:
+		var o database.Options
+		if r.err = json.Unmarshal(e.Payload, &o); r.err == nil {
+			r.err = f.engine.SetOptions(ctx, e.Database, &o)
+		}
+	case opSetIndexes:
+		var tags []string
+		if r.err = json.Unmarshal(e.Payload, &tags); r.err == nil {
+			r.indexes, r.err = f.engine.SetIndexes(ctx, e.Database, tags)
+		}
+	case opRotateKey:
+		var keyID string
+		if r.err = json.Unmarshal(e.Payload, &keyID); r.err == nil {
+			r.err = f.engine.RotateKey(ctx, e.Database, keyID)
+		}
+	case opReshard:
+		var shards int
+		if r.err = json.Unmarshal(e.Payload, &shards); r.err == nil {
+			r.err = f.engine.Reshard(ctx, e.Database, shards)
+		}
+	case opAddMember:
+		var m member
+		if r.err = json.Unmarshal(e.Payload, &m); r.err == nil {
+			f.mu.Lock()
+			f.members[m.ID] = m.Address
+			f.mu.Unlock()
+		}
+	case opRemoveMember:
+		var id string
+		if r.err = json.Unmarshal(e.Payload, &id); r.err == nil {
+			f.mu.Lock()
+			delete(f.members, id)
+			f.mu.Unlock()
+		}
+	default:
+		r.err = errors.Errorf("unknown raft log entry operation %s", e.Op)
+	}
+
+	return &r
+}
+
+// Snapshot writes the members and a backup of the store to a file, raft does not apply entries
+// meanwhile, the file is streamed to the snapshot sink once they are applied again
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	f.mu.Lock()
+	members, err := json.Marshal(f.members)
+	f.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.CreateTemp(f.dir, snapshotPattern)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create snapshot file")
+	}
+
+	s := &snapshot{path: file.Name()}
+	err = f.write(file, members)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		s.Release()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (f *fsm) write(w io.Writer, members []byte) error {
+	bw := bufio.NewWriter(w)
+	if err := binary.Write(bw, binary.BigEndian, uint32(len(members))); err != nil {
+		return err
+	}
+
+	if _, err := bw.Write(members); err != nil {
+		return err
+	}
+
+	if err := f.engine.Backup(context.Background(), bw); err != nil {
+		return errors.Wrap(err, "could not back up the store")
+	}
+
+	return bw.Flush()
+}
+
+// Restore replaces the members and all databases with those of a snapshot
+func (f *fsm) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+
+	var n uint32
+	if err := binary.Read(rc, binary.BigEndian, &n); err != nil {
+		return errors.Wrap(err, "could not read snapshot")
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rc, b); err != nil {
+		return errors.Wrap(err, "could not read snapshot members")
+	}
+
+	members := make(map[string]string)
+	if err := json.Unmarshal(b, &members); err != nil {
+		return errors.Wrap(err, "could not decode snapshot members")
+	}
+
+	if err := f.engine.Restore(rc); err != nil {
+		return errors.Wrap(err, "could not restore the store")
+	}
+
+	f.mu.Lock()
+	f.members = members
+	f.mu.Unlock()
+
+	return nil
+}
+
+// snapshot is a file holding the store as it was when the snapshot was taken
+type snapshot struct {
+	path string
+}
+
+func (s *snapshot) Persist(sink raft.SnapshotSink) error {
+	file, err := os.Open(s.path)
+	if err != nil {
+		_ = sink.Cancel()
+		return errors.Wrap(err, "could not open snapshot file")
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(sink, file); err != nil {
+		_ = sink.Cancel()
+		return err
+	}
+
+	return sink.Close()
+}
+
+func (s *snapshot) Release() {
+	_ = os.Remove(s.path)
+}
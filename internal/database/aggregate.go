@@ -0,0 +1,278 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/denismitr/lemon"
+)
+
+// aggregatePartialEvery is the number of matching documents after which a partial result is emitted
+const aggregatePartialEvery = 10000
+
+// AggregateFunc computes a value over the tags of the matching documents
+type AggregateFunc int
+
+const (
+	// AggregateCount counts documents, those having the tag when one is given
+	AggregateCount AggregateFunc = iota
+	AggregateSum
+	AggregateMin
+	AggregateMax
+	AggregateAvg
+	// AggregateDistinctCount counts the distinct values of the tag
+	AggregateDistinctCount
+)
+
+// Aggregation is a function over a tag, sum, min, max and avg only take int and float values
+type Aggregation struct {
+	Func AggregateFunc
+	Tag  string
+}
+
+// AggregateQuery aggregates the documents matched by Filter, in groups by the
+// value of the GroupBy tag when it is given
+type AggregateQuery struct {
+	Filter       TagQuery
+	Aggregations []Aggregation
+	GroupBy      string
+}
+
+// Validate checks the filter and the aggregations of a query
+func (q *AggregateQuery) Validate() error {
+	if err := q.Filter.Validate(); err != nil {
+		return err
+	}
+
+	if len(q.Aggregations) == 0 {
+		return &FieldError{Field: "aggregations", Description: "at least one aggregation must be given", Err: ErrInvalidQuery}
+	}
+
+	for i, a := range q.Aggregations {
+		field := fmt.Sprintf("aggregations[%d]", i)
+		if a.Func < AggregateCount || a.Func > AggregateDistinctCount {
+			return &FieldError{Field: field + ".function", Description: "unknown function", Err: ErrInvalidQuery}
+		}
+
+		if a.Tag == "" && a.Func != AggregateCount {
+			return &FieldError{Field: field + ".tag", Description: "tag must be given", Err: ErrInvalidQuery}
+		}
+
+		if isSystemTag(a.Tag) {
+			return &FieldError{Field: field + ".tag", Description: "tag name may not start with " + SystemTagPrefix, Err: ErrInvalidQuery}
+		}
+	}
+
+	if isSystemTag(q.GroupBy) {
+		return &FieldError{Field: "group_by", Description: "tag name may not start with " + SystemTagPrefix, Err: ErrInvalidQuery}
+	}
+
+	return nil
+}
+
+// AggregateValue is the result of an aggregation, Count is the number of values it was computed
+// from, so that a zero Count tells there was nothing to compute min, max or avg of
+type AggregateValue struct {
+	Aggregation
+	Value float64
+	Count uint64
+}
+
+// AggregateGroup holds the aggregated values of the documents having the same group tag value,
+// Value is nil for documents without the tag or when the query is not grouped
+type AggregateGroup struct {
+	Value  interface{}
+	Values []AggregateValue
+}
+
+// AggregateResult is a partial result while documents are still being scanned
+type AggregateResult struct {
+	Groups    []AggregateGroup
+	Documents uint64
+	Partial   bool
+}
+
+type accumulator struct {
+	count    uint64
+	sum      float64
+	min, max float64
+	distinct map[string]bool
+}
+
+func (a *accumulator) add(f AggregateFunc, v interface{}) {
+	if f == AggregateDistinctCount {
+		encoded, ok := indexValue(v)
+		if !ok {
+			return
+		}
+
+		if a.distinct == nil {
+			a.distinct = make(map[string]bool)
+		}
+		a.distinct[encoded] = true
+		a.count++
+		return
+	}
+
+	if f == AggregateCount {
+		a.count++
+		return
+	}
+
+	var n float64
+	switch typed := v.(type) {
+	case int:
+		n = float64(typed)
+	case float64:
+		n = typed
+	default:
+		return
+	}
+
+	if a.count == 0 || n < a.min {
+		a.min = n
+	}
+
+	if a.count == 0 || n > a.max {
+		a.max = n
+	}
+
+	a.sum += n
+	a.count++
+}
+
+func (a *accumulator) value(f AggregateFunc) float64 {
+	switch f {
+	case AggregateCount:
+		return float64(a.count)
+	case AggregateSum:
+		return a.sum
+	case AggregateMin:
+		return a.min
+	case AggregateMax:
+		return a.max
+	case AggregateAvg:
+		if a.count == 0 {
+			return 0
+		}
+		return a.sum / float64(a.count)
+	case AggregateDistinctCount:
+		return float64(len(a.distinct))
+	default:
+		return 0
+	}
+}
+
+type aggregateGroup struct {
+	value        interface{}
+	accumulators []accumulator
+}
+
+// aggregator accumulates the aggregations of a query per group
+type aggregator struct {
+	q         *AggregateQuery
+	groups    map[string]*aggregateGroup
+	documents uint64
+}
+
+func newAggregator(q *AggregateQuery) *aggregator {
+	return &aggregator{q: q, groups: make(map[string]*aggregateGroup)}
+}
+
+func (ag *aggregator) add(tags lemon.M) {
+	ag.documents++
+
+	var groupKey string
+	var groupValue interface{}
+	if ag.q.GroupBy != "" {
+		if v, ok := tags[ag.q.GroupBy]; ok {
+			groupKey, _ = indexValue(v)
+			groupValue = v
+			if n, ok := v.(int); ok && tags.Bool(timestampTagPrefix+ag.q.GroupBy) {
+				groupValue = time.Unix(0, int64(n)).UTC()
+			}
+		}
+	}
+
+	g, ok := ag.groups[groupKey]
+	if !ok {
+		g = &aggregateGroup{value: groupValue, accumulators: make([]accumulator, len(ag.q.Aggregations))}
+		ag.groups[groupKey] = g
+	}
+
+	for i, a := range ag.q.Aggregations {
+		if a.Tag == "" {
+			g.accumulators[i].add(a.Func, nil)
+			continue
+		}
+
+		if v, ok := tags[a.Tag]; ok {
+			g.accumulators[i].add(a.Func, v)
+		}
+	}
+}
+
+// result returns the aggregated values, groups ordered by value with the documents without it first
+func (ag *aggregator) result(partial bool) *AggregateResult {
+	keys := make([]string, 0, len(ag.groups))
+	for k := range ag.groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	result := AggregateResult{Documents: ag.documents, Partial: partial}
+	for _, k := range keys {
+		g := ag.groups[k]
+		group := AggregateGroup{Value: g.value, Values: make([]AggregateValue, len(ag.q.Aggregations))}
+		for i, a := range ag.q.Aggregations {
+			group.Values[i] = AggregateValue{
+				Aggregation: a,
+				Value:       g.accumulators[i].value(a.Func),
+				Count:       g.accumulators[i].count,
+			}
+		}
+		result.Groups = append(result.Groups, group)
+	}
+
+	return &result
+}
+
+// aggregate scans the matching documents and emits a partial result every aggregatePartialEvery of them,
+// followed by the final result
+func (s *settings) aggregate(
+	ctx context.Context,
+	tx *lemon.Tx,
+	q *AggregateQuery,
+	emit func(*AggregateResult) error,
+) error {
+	ag := newAggregator(q)
+	if err := s.accumulate(ctx, tx, ag, emit); err != nil {
+		return err
+	}
+
+	return emit(ag.result(false))
+}
+
+// accumulate adds the matching documents to ag, emitting a partial result every aggregatePartialEvery
+// documents ag has seen, so that an aggregator can be shared by the shards of a database
+func (s *settings) accumulate(
+	ctx context.Context,
+	tx *lemon.Tx,
+	ag *aggregator,
+	emit func(*AggregateResult) error,
+) error {
+	var failed error
+	if err := s.scanMatching(ctx, tx, &ag.q.Filter, func(_ *lemon.Document, tags lemon.M) bool {
+		ag.add(tags)
+		if ag.documents%aggregatePartialEvery == 0 {
+			failed = emit(ag.result(true))
+		}
+		return failed == nil
+	}); err != nil {
+		return err
+	}
+
+	return failed
+}
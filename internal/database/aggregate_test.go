@@ -0,0 +1,116 @@
+package database
+
+import (
+	"context"
+	"testing"
+
+	"github.com/denismitr/lemon"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_aggregate(t *testing.T) {
+	db, closer, err := lemon.Open(lemon.InMemory)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = closer() })
+
+	s := &settings{options: &Options{}}
+	docs := []struct {
+		key  string
+		tags []Tag
+	}{
+		{key: "job:1", tags: []Tag{{Name: "region", Value: "eu"}, {Name: "bytes", Value: 10}, {Name: "status", Value: "failed"}}},
+		{key: "job:2", tags: []Tag{{Name: "region", Value: "eu"}, {Name: "bytes", Value: 30}, {Name: "status", Value: "ok"}}},
+		{key: "job:3", tags: []Tag{{Name: "region", Value: "us"}, {Name: "bytes", Value: 5}, {Name: "status", Value: "failed"}}},
+		{key: "job:4", tags: []Tag{{Name: "status", Value: "failed"}}},
+		{key: "other", tags: []Tag{{Name: "region", Value: "eu"}, {Name: "bytes", Value: 1000}}},
+	}
+
+	require.NoError(t, db.Update(context.Background(), func(tx *lemon.Tx) error {
+		for _, d := range docs {
+			value, appliers, err := s.encode(d.key, "v", "", d.tags, false)
+			if err != nil {
+				return err
+			}
+
+			if err := tx.Insert(d.key, value, appliers...); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	aggregate := func(q AggregateQuery) []*AggregateResult {
+		t.Helper()
+		require.NoError(t, q.Validate())
+
+		var results []*AggregateResult
+		require.NoError(t, db.View(context.Background(), func(tx *lemon.Tx) error {
+			return s.aggregate(context.Background(), tx, &q, func(r *AggregateResult) error {
+				results = append(results, r)
+				return nil
+			})
+		}))
+
+		return results
+	}
+
+	t.Run("count with filter", func(t *testing.T) {
+		results := aggregate(AggregateQuery{
+			Filter:       TagQuery{Tags: []TagPredicate{{Name: "status", Op: TagEq, Value: "failed"}}},
+			Aggregations: []Aggregation{{Func: AggregateCount}},
+		})
+
+		require.Len(t, results, 1)
+		assert.False(t, results[0].Partial)
+		assert.Equal(t, uint64(3), results[0].Documents)
+		require.Len(t, results[0].Groups, 1)
+		assert.Nil(t, results[0].Groups[0].Value)
+		assert.Equal(t, 3.0, results[0].Groups[0].Values[0].Value)
+	})
+
+	t.Run("grouped by tag with key prefix", func(t *testing.T) {
+		results := aggregate(AggregateQuery{
+			Filter: TagQuery{KeyPrefix: "job:"},
+			Aggregations: []Aggregation{
+				{Func: AggregateSum, Tag: "bytes"},
+				{Func: AggregateMin, Tag: "bytes"},
+				{Func: AggregateMax, Tag: "bytes"},
+				{Func: AggregateAvg, Tag: "bytes"},
+				{Func: AggregateDistinctCount, Tag: "status"},
+			},
+			GroupBy: "region",
+		})
+
+		require.Len(t, results, 1)
+		groups := results[0].Groups
+		require.Len(t, groups, 3)
+
+		// documents without the group tag come first
+		assert.Nil(t, groups[0].Value)
+		assert.Equal(t, uint64(0), groups[0].Values[0].Count)
+		assert.Equal(t, 1.0, groups[0].Values[4].Value)
+
+		assert.Equal(t, "eu", groups[1].Value)
+		values := make([]float64, len(groups[1].Values))
+		for i, v := range groups[1].Values {
+			values[i] = v.Value
+		}
+		assert.Equal(t, []float64{40, 10, 30, 20, 2}, values)
+
+		assert.Equal(t, "us", groups[2].Value)
+		assert.Equal(t, 5.0, groups[2].Values[0].Value)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		tt := []AggregateQuery{
+			{},
+			{Aggregations: []Aggregation{{Func: AggregateSum}}},
+			{Aggregations: []Aggregation{{Func: AggregateCount}}, GroupBy: "@content_type"},
+		}
+
+		for _, q := range tt {
+			assert.Error(t, q.Validate())
+		}
+	})
+}
@@ -0,0 +1,227 @@
+package database
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/denismitr/lemon"
+	"github.com/pkg/errors"
+)
+
+// Backups are tar archives of the files of all databases, their settings and the intent log
+// of cross database transactions, other files in the store dir are left out
+
+// backupExts are the extensions of the files a database consists of
+var backupExts = []string{ext, searchExt, optionsExt, schemaExt, keysExt, indexesExt, shardsExt}
+
+// splitBackupFile returns the database and the extension of a file in the store dir,
+// ok is false for files that are not part of a database
+func splitBackupFile(name string) (dbName, fileExt string, ok bool) {
+	i := strings.IndexByte(name, '.')
+	if i <= 0 || !validDBNameRegEx.MatchString(name[:i]) {
+		return "", "", false
+	}
+
+	for _, e := range backupExts {
+		if name[i:] == e {
+			return name[:i], e, true
+		}
+	}
+
+	return "", "", false
+}
+
+func isIntentFile(name string) bool {
+	return strings.HasSuffix(name, ".json") && !strings.HasPrefix(name, ".")
+}
+
+// Backup writes the files of all databases to w as a tar archive, database files are
+// copied while their database is locked for reading, so that no write is half copied
+func (s *Store) Backup(ctx context.Context, w io.Writer) error {
+	tw := tar.NewWriter(w)
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errors.Wrapf(err, "could not list files in %s", s.dir)
+	}
+
+	for _, e := range entries {
+		dbName, fileExt, ok := splitBackupFile(e.Name())
+		if e.IsDir() || !ok {
+			continue
+		}
+
+		src := filepath.Join(s.dir, e.Name())
+		if !strings.HasSuffix(fileExt, ext) {
+			if err := addBackupFile(tw, src, e.Name()); err != nil {
+				return err
+			}
+			continue
+		}
+
+		db, err := s.getFile(dbName, fileExt)
+		if err != nil {
+			return err
+		}
+
+		if err := db.View(ctx, func(tx *lemon.Tx) error {
+			return addBackupFile(tw, src, e.Name())
+		}); err != nil {
+			return err
+		}
+	}
+
+	intents, err := os.ReadDir(filepath.Join(s.dir, intentsDir))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errors.Wrapf(err, "could not list transaction intents in %s", s.dir)
+	}
+
+	for _, e := range intents {
+		if e.IsDir() || !isIntentFile(e.Name()) {
+			continue
+		}
+
+		src := filepath.Join(s.dir, intentsDir, e.Name())
+		if err := addBackupFile(tw, src, path.Join(intentsDir, e.Name())); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+// addBackupFile copies a file to the archive without reading it into memory as a whole
+func addBackupFile(tw *tar.Writer, src, name string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			// removed since the directory was listed
+			return nil
+		}
+		return errors.Wrapf(err, "could not read file %s", src)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "could not read file %s", src)
+	}
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name: name,
+		Mode: 0644,
+		Size: info.Size(),
+	}); err != nil {
+		return err
+	}
+
+	if _, err := io.CopyN(tw, f, info.Size()); err != nil {
+		return errors.Wrapf(err, "could not copy file %s", src)
+	}
+
+	return nil
+}
+
+// Restore closes all databases and replaces their files with those of a backup,
+// when r is nil all databases are removed
+func (s *Store) Restore(r io.Reader) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+
+	for id, c := range s.databases {
+		c.t.Stop()
+		delete(s.databases, id)
+		if err := c.closer(); err != nil {
+			return errors.Wrapf(err, "could not close database file %s", id)
+		}
+	}
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errors.Wrapf(err, "could not list files in %s", s.dir)
+	}
+
+	for _, e := range entries {
+		if _, _, ok := splitBackupFile(e.Name()); ok && !e.IsDir() {
+			if err := os.Remove(filepath.Join(s.dir, e.Name())); err != nil {
+				return errors.Wrapf(err, "could not remove file %s", e.Name())
+			}
+		}
+	}
+
+	if err := os.RemoveAll(filepath.Join(s.dir, intentsDir)); err != nil {
+		return errors.Wrapf(err, "could not remove transaction intents in %s", s.dir)
+	}
+
+	if r == nil {
+		return nil
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "could not read backup")
+		}
+
+		dir, name := path.Split(hdr.Name)
+		switch dir {
+		case "":
+			if _, _, ok := splitBackupFile(name); !ok {
+				return errors.Errorf("backup file %s is not part of a database", hdr.Name)
+			}
+		case intentsDir + "/":
+			if !isIntentFile(name) {
+				return errors.Errorf("backup file %s is not a transaction intent", hdr.Name)
+			}
+		default:
+			return errors.Errorf("backup file %s is outside of the store", hdr.Name)
+		}
+
+		dst := filepath.Join(s.dir, filepath.FromSlash(hdr.Name))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return errors.Wrapf(err, "could not create directory of %s", dst)
+		}
+
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return errors.Wrapf(err, "could not read backup file %s", hdr.Name)
+		}
+
+		if err := writeSynced(dst, b); err != nil {
+			return err
+		}
+	}
+}
+
+// Backup writes all databases with their settings to w
+func (le *LemonEngine) Backup(ctx context.Context, w io.Writer) error {
+	return le.store.Backup(ctx, w)
+}
+
+// Restore replaces all databases and their settings with those of a backup written
+// by Backup, when r is nil all databases are removed
+func (le *LemonEngine) Restore(r io.Reader) error {
+	err := le.store.Restore(r)
+
+	// settings read before are stale, even when the backup could not be restored completely
+	le.schemas.reset()
+	le.options.reset()
+	le.keys.reset()
+	le.indexes.reset()
+	le.shardMaps.reset()
+	le.counts.reset()
+
+	return err
+}
@@ -0,0 +1,52 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_BackupRestore(t *testing.T) {
+	le := newTestEngine(t)
+	ctx := context.Background()
+
+	_, err := le.BatchUpsert(ctx, "users", BatchUpsert{{Key: "u:1", Value: "ann", Tags: []Tag{{Name: "age", Value: 30}}}})
+	require.NoError(t, err)
+	schema, err := NewSchema(nil, []RequiredTag{{Name: "age"}})
+	require.NoError(t, err)
+	require.NoError(t, le.SetSchema(ctx, "users", schema))
+
+	var backup bytes.Buffer
+	require.NoError(t, le.Backup(ctx, &backup))
+
+	_, err = le.BatchUpsert(ctx, "users", BatchUpsert{{Key: "u:2", Value: "bob", Tags: []Tag{{Name: "age", Value: 25}}}})
+	require.NoError(t, err)
+	_, err = le.BatchUpsert(ctx, "orders", BatchUpsert{{Key: "o:1", Value: 1}})
+	require.NoError(t, err)
+	require.NoError(t, le.SetSchema(ctx, "users", &Schema{}))
+
+	require.NoError(t, le.Restore(bytes.NewReader(backup.Bytes())))
+
+	docs, err := le.MGet(ctx, "users", []string{"u:1", "u:2"}, time.Time{})
+	require.NoError(t, err)
+	assert.Len(t, docs, 1)
+	assert.Equal(t, "ann", docs["u:1"].RawString())
+
+	names, err := le.Databases()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"users"}, names)
+
+	restored, err := le.Schema(ctx, "users")
+	require.NoError(t, err)
+	require.NotNil(t, restored)
+	assert.Equal(t, schema.RequiredTags, restored.RequiredTags)
+
+	require.NoError(t, le.Restore(nil))
+	names, err = le.Databases()
+	require.NoError(t, err)
+	assert.Empty(t, names)
+}
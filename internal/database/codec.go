@@ -0,0 +1,105 @@
+package database
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+var ErrUnknownCodec = errors.New("unknown compression codec")
+
+// system tags recording how a value was compressed, so that compression
+// settings can change without rewriting documents written before
+const (
+	codecTag   = SystemTagPrefix + "codec"
+	rawSizeTag = SystemTagPrefix + "raw_size"
+)
+
+// Codec is the compression algorithm of a document value
+type Codec string
+
+const (
+	NoCodec     Codec = ""
+	GzipCodec   Codec = "gzip"
+	SnappyCodec Codec = "snappy"
+	ZstdCodec   Codec = "zstd"
+)
+
+// zstd encoders and decoders are expensive to create and safe for concurrent EncodeAll/DecodeAll
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+func initZstd() error {
+	zstdOnce.Do(func() {
+		if zstdEncoder, zstdErr = zstd.NewWriter(nil); zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil)
+	})
+
+	return zstdErr
+}
+
+// Valid reports whether the codec is known, NoCodec included
+func (c Codec) Valid() bool {
+	switch c {
+	case NoCodec, GzipCodec, SnappyCodec, ZstdCodec:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c Codec) compress(b []byte) ([]byte, error) {
+	switch c {
+	case GzipCodec:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(b); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case SnappyCodec:
+		return snappy.Encode(nil, b), nil
+	case ZstdCodec:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstdEncoder.EncodeAll(b, nil), nil
+	default:
+		return nil, errors.Wrapf(ErrUnknownCodec, "codec %s", c)
+	}
+}
+
+func (c Codec) decompress(b []byte) ([]byte, error) {
+	switch c {
+	case GzipCodec:
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	case SnappyCodec:
+		return snappy.Decode(nil, b)
+	case ZstdCodec:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstdDecoder.DecodeAll(b, nil)
+	default:
+		return nil, errors.Wrapf(ErrUnknownCodec, "codec %s", c)
+	}
+}
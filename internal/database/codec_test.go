@@ -0,0 +1,60 @@
+package database
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/denismitr/lemon"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_encode_Compression(t *testing.T) {
+	text := string(bytes.Repeat([]byte("lemon "), 100))
+
+	tt := []struct {
+		name        string
+		opts        CompressionOptions
+		value       interface{}
+		raw         []byte
+		contentType lemon.ContentTypeIdentifier
+		compressed  bool
+	}{
+		{name: "gzip string", opts: CompressionOptions{Codec: GzipCodec}, value: text, raw: []byte(text), contentType: lemon.String, compressed: true},
+		{name: "snappy bytes", opts: CompressionOptions{Codec: SnappyCodec}, value: []byte(text), raw: []byte(text), contentType: lemon.Bytes, compressed: true},
+		{name: "zstd string", opts: CompressionOptions{Codec: ZstdCodec, Threshold: 100}, value: text, raw: []byte(text), contentType: lemon.String, compressed: true},
+		{name: "below threshold", opts: CompressionOptions{Codec: ZstdCodec, Threshold: 1000}, value: text, raw: []byte(text), contentType: lemon.String},
+		{name: "no codec", opts: CompressionOptions{}, value: text, raw: []byte(text), contentType: lemon.String},
+		{name: "incompressible", opts: CompressionOptions{Codec: GzipCodec}, value: []byte{1, 2, 3}, raw: []byte{1, 2, 3}, contentType: lemon.Bytes},
+		{name: "ints are never compressed", opts: CompressionOptions{Codec: GzipCodec}, value: 42, raw: []byte("42"), contentType: lemon.Integer},
+	}
+
+	var stats Stats
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			db, closer, err := lemon.Open(lemon.InMemory)
+			require.NoError(t, err)
+			defer func() { _ = closer() }()
+
+			s := &settings{options: &Options{Compression: tc.opts}}
+			value, appliers, err := s.encode("doc", tc.value, "", []Tag{{Name: "foo", Value: "bar"}}, false)
+			require.NoError(t, err)
+			require.NoError(t, db.Insert("doc", value, appliers...))
+
+			stored, err := db.Get("doc")
+			require.NoError(t, err)
+			stats.add(stored)
+			assert.Equal(t, tc.compressed, stored.Tags()[codecTag] != nil)
+
+			d, err := s.decode(stored)
+			require.NoError(t, err)
+			assert.Equal(t, tc.raw, d.Value())
+			assert.Equal(t, tc.contentType, d.ContentType())
+			assert.Equal(t, lemon.M{"foo": "bar"}, d.Tags())
+		})
+	}
+
+	assert.Equal(t, uint64(len(tt)), stats.Documents)
+	assert.Equal(t, uint64(3), stats.CompressedDocuments)
+	assert.Greater(t, stats.CompressionRatio, 2.0)
+}
@@ -1,10 +1,17 @@
 package database
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/denismitr/lemon"
+	"github.com/denismitr/lemon-server/internal/jsondoc"
 	"github.com/denismitr/lemon-server/pkg/command"
 	"github.com/pkg/errors"
+	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/timestamppb"
+	"math"
+	"strconv"
+	"time"
 )
 
 var ErrInvalidInput = errors.New("invalid user input")
@@ -12,6 +19,38 @@ var ErrInvalidDocumentValue = errors.New("invalid document value")
 var ErrInvalidTagValue = errors.New("invalid tag value")
 var ErrEmptyInput = errors.New("empty input")
 var ErrInvalidKey = errors.New("invalid lemon DB key")
+var ErrReservedTagName = errors.New("reserved tag name")
+var ErrInvalidJSONValue = errors.New("invalid json document value")
+
+// timestamps have to fit into int64 unix nanoseconds
+var (
+	minTimestamp = time.Unix(0, math.MinInt64).UTC()
+	maxTimestamp = time.Unix(0, math.MaxInt64).UTC()
+)
+
+// FieldError points at the request field that caused the error
+type FieldError struct {
+	Field       string
+	Description string
+	Err         error
+}
+
+func (e *FieldError) Error() string {
+	return e.Err.Error() + ": " + e.Field + ": " + e.Description
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// ReadOptions control how documents are returned to clients
+type ReadOptions struct {
+	Mode command.ValueMode
+	// JSONProjection lists json pointers to return instead of whole json documents
+	JSONProjection []string
+	// MetadataOnly returns documents without their value
+	MetadataOnly bool
+}
 
 func ConvertGrpcToLemonInsert(request *command.BatchInsertRequest) (BatchInsert, error) {
 	bi := make(BatchInsert, len(request.Stmt))
@@ -26,30 +65,32 @@ func ConvertGrpcToLemonInsert(request *command.BatchInsertRequest) (BatchInsert,
 		case *command.InsertStatement_Bool:
 			bi[i].Value = typedValue.Bool
 		case *command.InsertStatement_Int:
-			bi[i].Value = typedValue.Int
+			// lemon keeps go ints with its own integer content type
+			bi[i].Value = int(typedValue.Int)
 		case *command.InsertStatement_Str:
 			bi[i].Value = typedValue.Str
+		case *command.InsertStatement_Float:
+			bi[i].Value = typedValue.Float
+		case *command.InsertStatement_Timestamp:
+			t, err := convertGrpcTimestamp(typedValue.Timestamp)
+			if err != nil {
+				return nil, errors.Wrap(ErrInvalidDocumentValue, err.Error())
+			}
+			bi[i].Value = t
 		default:
 			return nil, errors.Wrapf(ErrInvalidDocumentValue, "value type %T unsupported", typedValue)
 		}
 
+		if err := validateJSONValue(i, stmt.ContentType, bi[i].Value); err != nil {
+			return nil, err
+		}
+
 		if stmt.Tags != nil {
-			bi[i].Tags = make([]Tag, len(stmt.Tags))
-			for j, tag := range stmt.Tags {
-				bi[i].Tags[j].Name = tag.Name
-				switch typedTagValue := tag.Value.(type) {
-				case *command.Tag_Int:
-					bi[i].Tags[j].Value = typedTagValue.Int
-				case *command.Tag_Float:
-					bi[i].Tags[j].Value = typedTagValue.Float
-				case *command.Tag_Str:
-					bi[i].Tags[j].Value = typedTagValue.Str
-				case *command.Tag_Bool:
-					bi[i].Tags[j].Value = typedTagValue.Bool
-				default:
-					return nil, errors.Wrapf(ErrInvalidTagValue, "value type %T unsupported", typedTagValue)
-				}
+			tags, err := convertGrpcTags(stmt.Tags)
+			if err != nil {
+				return nil, err
 			}
+			bi[i].Tags = tags
 		}
 	}
 
@@ -64,11 +105,8 @@ func ConvertGrpcToLemonBatchDeleteByKey(req *command.BatchDeleteByKeyRequest) (B
 	seen := make(map[string]bool, len(req.Keys))
 	batch := make(BatchDeleteByKey, 0, len(req.Keys))
 
+	// keys are expected to be checked by KeyValidator beforehand
 	for _, k := range req.Keys {
-		if len(k) == 0 || len(k) > 255 {
-			return nil, errors.Wrap(ErrInvalidKey, "key may not be empty and may not be over 255 characters")
-		}
-
 		if _, ok := seen[k]; ok {
 			// just ignore duplicates
 			continue
@@ -81,12 +119,39 @@ func ConvertGrpcToLemonBatchDeleteByKey(req *command.BatchDeleteByKeyRequest) (B
 	return batch, nil
 }
 
+func ConvertGrpcToLemonBatchPatch(req *command.PatchRequest) (BatchPatch, error) {
+	if len(req.Stmt) == 0 {
+		return nil, errors.Wrap(ErrEmptyInput, "at least one patch statement must be given")
+	}
+
+	bp := make(BatchPatch, len(req.Stmt))
+	for i, stmt := range req.Stmt {
+		bp[i].Key = stmt.Key
+		bp[i].ExpectedRevision = stmt.ExpectedRevision
+		switch typedPatch := stmt.Patch.(type) {
+		case *command.PatchStatement_MergePatch:
+			bp[i].MergePatch = []byte(typedPatch.MergePatch)
+		case *command.PatchStatement_JsonPatch:
+			bp[i].JSONPatch = []byte(typedPatch.JsonPatch)
+		default:
+			return nil, &FieldError{
+				Field:       fmt.Sprintf("stmt[%d].patch", i),
+				Description: "either merge_patch or json_patch must be given",
+				Err:         ErrInvalidInput,
+			}
+		}
+	}
+
+	return bp, nil
+}
+
 func ConvertGrpcToLemonUpsert(request *command.BatchUpsertRequest) (BatchUpsert, error) {
 	bi := make(BatchUpsert, len(request.Stmt))
 	for i, stmt := range request.Stmt {
 		bi[i].Key = stmt.Key
 		bi[i].PreserveTimestamps = stmt.PreserveTimestamps
 		bi[i].ContentType = stmt.ContentType
+		bi[i].ExpectedRevision = stmt.ExpectedRevision
 
 		switch typedValue := stmt.Value.(type) {
 		case *command.UpsertStatement_Blob:
@@ -94,65 +159,217 @@ func ConvertGrpcToLemonUpsert(request *command.BatchUpsertRequest) (BatchUpsert,
 		case *command.UpsertStatement_Bool:
 			bi[i].Value = typedValue.Bool
 		case *command.UpsertStatement_Int:
-			bi[i].Value = typedValue.Int
+			// lemon keeps go ints with its own integer content type
+			bi[i].Value = int(typedValue.Int)
 		case *command.UpsertStatement_Str:
 			bi[i].Value = typedValue.Str
+		case *command.UpsertStatement_Float:
+			bi[i].Value = typedValue.Float
+		case *command.UpsertStatement_Timestamp:
+			t, err := convertGrpcTimestamp(typedValue.Timestamp)
+			if err != nil {
+				return nil, errors.Wrap(ErrInvalidDocumentValue, err.Error())
+			}
+			bi[i].Value = t
 		default:
 			return nil, errors.Wrapf(ErrInvalidDocumentValue, "value type %T unsupported", typedValue)
 		}
 
+		if err := validateJSONValue(i, stmt.ContentType, bi[i].Value); err != nil {
+			return nil, err
+		}
+
 		if stmt.Tags != nil {
-			if err := covertTags(bi, i, stmt); err != nil {
+			tags, err := convertGrpcTags(stmt.Tags)
+			if err != nil {
 				return nil, err
 			}
+			bi[i].Tags = tags
 		}
 	}
 
 	return bi, nil
 }
 
-func covertTags(bi BatchUpsert, i int, stmt *command.UpsertStatement) error {
-	bi[i].Tags = make([]Tag, len(stmt.Tags))
-	for j, tag := range stmt.Tags {
-		bi[i].Tags[j].Name = tag.Name
+// ConvertGrpcToLemonTransaction converts the writes of a cross database transaction,
+// deletes keep duplicates out the same way BatchDeleteByKey does
+func ConvertGrpcToLemonTransaction(req *command.CrossDatabaseTransactionRequest) ([]TxWrite, error) {
+	writes := make([]TxWrite, len(req.Writes))
+	for i, w := range req.Writes {
+		writes[i].Database = w.Database
+
+		bi, err := ConvertGrpcToLemonInsert(&command.BatchInsertRequest{Stmt: w.Inserts})
+		if err != nil {
+			return nil, errors.Wrapf(err, "writes[%d].inserts", i)
+		}
+
+		bu, err := ConvertGrpcToLemonUpsert(&command.BatchUpsertRequest{Stmt: w.Upserts})
+		if err != nil {
+			return nil, errors.Wrapf(err, "writes[%d].upserts", i)
+		}
+
+		if len(bi) > 0 {
+			writes[i].Inserts = bi
+		}
+
+		if len(bu) > 0 {
+			writes[i].Upserts = bu
+		}
+
+		if len(w.Deletes) > 0 {
+			if writes[i].Deletes, err = ConvertGrpcToLemonBatchDeleteByKey(&command.BatchDeleteByKeyRequest{Keys: w.Deletes}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return writes, nil
+}
+
+func convertGrpcTags(grpcTags []*command.Tag) ([]Tag, error) {
+	tags := make([]Tag, len(grpcTags))
+	for j, tag := range grpcTags {
+		if isSystemTag(tag.Name) {
+			return nil, errors.Wrapf(ErrReservedTagName, "tag name %s may not start with %s", tag.Name, SystemTagPrefix)
+		}
+
+		tags[j].Name = tag.Name
 		switch typedTagValue := tag.Value.(type) {
 		case *command.Tag_Int:
-			bi[i].Tags[j].Value = typedTagValue.Int
+			// lemon only supports go ints for integer tags
+			tags[j].Value = int(typedTagValue.Int)
 		case *command.Tag_Float:
-			bi[i].Tags[j].Value = typedTagValue.Float
+			tags[j].Value = typedTagValue.Float
 		case *command.Tag_Str:
-			bi[i].Tags[j].Value = typedTagValue.Str
+			tags[j].Value = typedTagValue.Str
 		case *command.Tag_Bool:
-			bi[i].Tags[j].Value = typedTagValue.Bool
+			tags[j].Value = typedTagValue.Bool
+		case *command.Tag_Timestamp:
+			t, err := convertGrpcTimestamp(typedTagValue.Timestamp)
+			if err != nil {
+				return nil, errors.Wrapf(ErrInvalidTagValue, "tag %s: %s", tag.Name, err)
+			}
+			tags[j].Value = t
 		default:
-			return errors.Wrapf(ErrInvalidTagValue, "value type %T unsupported", typedTagValue)
+			return nil, errors.Wrapf(ErrInvalidTagValue, "value type %T unsupported", typedTagValue)
+		}
+	}
+	return tags, nil
+}
+
+// convertGrpcTimestamp accepts timestamps that can be stored as unix nanoseconds
+func convertGrpcTimestamp(ts *timestamppb.Timestamp) (time.Time, error) {
+	if err := ts.CheckValid(); err != nil {
+		return time.Time{}, err
+	}
+
+	t := ts.AsTime()
+	if t.Before(minTimestamp) || t.After(maxTimestamp) {
+		return time.Time{}, errors.Errorf("timestamp %s out of range [%s, %s]", t, minTimestamp, maxTimestamp)
+	}
+
+	return t, nil
+}
+
+// validateJSONValue makes sure a value declared as json is a valid json document
+func validateJSONValue(i int, contentType string, value interface{}) error {
+	if !IsJSONContentType(contentType) {
+		return nil
+	}
+
+	var raw []byte
+	switch typed := value.(type) {
+	case string:
+		raw = []byte(typed)
+	case []byte:
+		raw = typed
+	default:
+		return &FieldError{
+			Field:       fmt.Sprintf("stmt[%d].value", i),
+			Description: "json documents must be given as str or blob",
+			Err:         ErrInvalidJSONValue,
+		}
+	}
+
+	if !jsondoc.Valid(raw) {
+		return &FieldError{
+			Field:       fmt.Sprintf("stmt[%d].value", i),
+			Description: "value is not a valid json document",
+			Err:         ErrInvalidJSONValue,
 		}
 	}
+
+	return nil
+}
+
+// Validate checks that all projection paths are valid json pointers
+func (o ReadOptions) Validate() error {
+	if o.MetadataOnly && len(o.JSONProjection) > 0 {
+		return &FieldError{
+			Field:       "json_projection",
+			Description: "cannot be combined with the metadata projection",
+			Err:         ErrInvalidInput,
+		}
+	}
+
+	for i, p := range o.JSONProjection {
+		if _, err := jsondoc.ParsePointer(p); err != nil {
+			return &FieldError{
+				Field:       fmt.Sprintf("json_projection[%d]", i),
+				Description: err.Error(),
+				Err:         ErrInvalidInput,
+			}
+		}
+	}
+
 	return nil
 }
 
-func ConvertLemonToGrpcDocument(d *lemon.Document) (*command.Document, error) {
+func ConvertLemonToGrpcDocument(d *Document, opts ReadOptions) (*command.Document, error) {
 	var result command.Document
 
 	result.Key = d.Key()
 	result.CreatedAt = timestamppb.New(d.CreatedAt())
 	result.UpdatedAt = timestamppb.New(d.UpdatedAt())
-	result.ContentType = string(d.ContentType())
-	result.Value = d.Value()
+	result.ContentType = contentTypeOf(d)
+	result.Revision = d.Revision()
+	result.ValueSize = uint64(d.ValueSize())
+	result.ContentHash = d.ContentHash()
+
+	switch {
+	case opts.MetadataOnly:
+		// only the value size and hash are returned
+	case len(opts.JSONProjection) > 0 && IsJSONContentType(result.ContentType):
+		projected, err := jsondoc.Project(d.Value(), opts.JSONProjection)
+		if err != nil {
+			return nil, errors.Wrapf(ErrInvalidJSONValue, "could not project document %s: %s", d.Key(), err)
+		}
+
+		if opts.Mode == command.ValueMode_VALUE_MODE_BYTES {
+			result.Value = projected
+		} else {
+			result.TypedValue = &command.Document_Str{Str: string(projected)}
+		}
+	case opts.Mode == command.ValueMode_VALUE_MODE_BYTES:
+		result.Value = d.Value()
+	default:
+		if err := setGrpcTypedValue(&result, d); err != nil {
+			return nil, err
+		}
+	}
 
 	for name, v := range d.Tags() {
-		ct := &command.Tag{Name: name}
-		switch typedTagValue := v.(type) {
-		case int:
-			ct.Value = &command.Tag_Int{Int: int64(typedTagValue)}
-		case float64:
-			ct.Value = &command.Tag_Float{Float: float64(typedTagValue)}
-		case bool:
-			ct.Value = &command.Tag_Bool{Bool: typedTagValue}
-		case string:
-			ct.Value = &command.Tag_Str{Str: typedTagValue}
-		default:
-			return nil, errors.Wrapf(ErrInvalidTagValue, "tag type %T unsupported", typedTagValue)
+		if isSystemTag(name) {
+			continue
+		}
+
+		if n, ok := v.(int); ok && isTimestampTag(d, name) {
+			v = time.Unix(0, int64(n))
+		}
+
+		ct, err := convertTagToGrpc(name, v)
+		if err != nil {
+			return nil, err
 		}
 
 		result.Tags = append(result.Tags, ct)
@@ -160,3 +377,450 @@ func ConvertLemonToGrpcDocument(d *lemon.Document) (*command.Document, error) {
 
 	return &result, nil
 }
+
+func convertTagToGrpc(name string, v interface{}) (*command.Tag, error) {
+	ct := &command.Tag{Name: name}
+	switch typedTagValue := v.(type) {
+	case int:
+		ct.Value = &command.Tag_Int{Int: int64(typedTagValue)}
+	case time.Time:
+		ct.Value = &command.Tag_Timestamp{Timestamp: timestamppb.New(typedTagValue)}
+	case float64:
+		ct.Value = &command.Tag_Float{Float: typedTagValue}
+	case bool:
+		ct.Value = &command.Tag_Bool{Bool: typedTagValue}
+	case string:
+		ct.Value = &command.Tag_Str{Str: typedTagValue}
+	default:
+		return nil, errors.Wrapf(ErrInvalidTagValue, "tag type %T unsupported", typedTagValue)
+	}
+
+	return ct, nil
+}
+
+// setGrpcTypedValue restores the value type it was written with from the lemon
+// content type, int64 and bool values stored by lemon as json are recognized too
+func setGrpcTypedValue(result *command.Document, d *Document) error {
+	switch d.Tags().String(valueTypeTag) {
+	case floatValueType:
+		f, err := strconv.ParseFloat(d.RawString(), 64)
+		if err != nil {
+			return errors.Wrapf(ErrInvalidDocumentValue, "document %s holds invalid float", d.Key())
+		}
+		result.TypedValue = &command.Document_Float{Float: f}
+		return nil
+	case timestampValueType:
+		var t time.Time
+		if err := json.Unmarshal(d.Value(), &t); err != nil {
+			return errors.Wrapf(ErrInvalidDocumentValue, "document %s holds invalid timestamp", d.Key())
+		}
+		result.TypedValue = &command.Document_Timestamp{Timestamp: timestamppb.New(t)}
+		return nil
+	}
+
+	switch d.ContentType() {
+	case lemon.String:
+		result.TypedValue = &command.Document_Str{Str: d.RawString()}
+		return nil
+	case lemon.Bytes:
+		result.TypedValue = &command.Document_Blob{Blob: d.Value()}
+		return nil
+	case lemon.Integer:
+		n, err := strconv.ParseInt(d.RawString(), 10, 64)
+		if err != nil {
+			return errors.Wrapf(ErrInvalidDocumentValue, "document %s holds invalid integer", d.Key())
+		}
+		result.TypedValue = &command.Document_Int{Int: n}
+		return nil
+	case lemon.Bool, lemon.JSON:
+		switch v := d.RawString(); v {
+		case "true", "false":
+			result.TypedValue = &command.Document_Bool{Bool: v == "true"}
+			return nil
+		default:
+			if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+				result.TypedValue = &command.Document_Int{Int: n}
+				return nil
+			}
+		}
+	}
+
+	return errors.Wrapf(ErrInvalidDocumentValue, "document %s has unsupported content type %s", d.Key(), d.ContentType())
+}
+
+var grpcTagTypes = map[command.TagType]TagType{
+	command.TagType_TAG_TYPE_ANY:       AnyTag,
+	command.TagType_TAG_TYPE_STR:       StrTag,
+	command.TagType_TAG_TYPE_INT:       IntTag,
+	command.TagType_TAG_TYPE_FLOAT:     FloatTag,
+	command.TagType_TAG_TYPE_BOOL:      BoolTag,
+	command.TagType_TAG_TYPE_TIMESTAMP: TimestampTag,
+}
+
+func ConvertGrpcToSchema(request *command.DatabaseSchema) (*Schema, error) {
+	requiredTags := make([]RequiredTag, len(request.RequiredTags))
+	for i, rt := range request.RequiredTags {
+		t, ok := grpcTagTypes[rt.Type]
+		if !ok {
+			return nil, &FieldError{
+				Field:       fmt.Sprintf("required_tags[%d].type", i),
+				Description: fmt.Sprintf("unknown tag type %d", rt.Type),
+				Err:         ErrInvalidSchema,
+			}
+		}
+
+		requiredTags[i] = RequiredTag{Name: rt.Name, Type: t}
+	}
+
+	return NewSchema([]byte(request.JsonSchema), requiredTags)
+}
+
+func ConvertSchemaToGrpc(database string, s *Schema) *command.DatabaseSchema {
+	result := command.DatabaseSchema{Database: database}
+	if s == nil {
+		return &result
+	}
+
+	result.JsonSchema = string(s.JSONSchema)
+	for _, rt := range s.RequiredTags {
+		grpcRequiredTag := command.RequiredTag{Name: rt.Name}
+		for gt, t := range grpcTagTypes {
+			if t == rt.Type {
+				grpcRequiredTag.Type = gt
+			}
+		}
+
+		result.RequiredTags = append(result.RequiredTags, &grpcRequiredTag)
+	}
+
+	return &result
+}
+
+// ConvertVersionToGrpc converts a document version the same way documents are converted
+func ConvertVersionToGrpc(v *Version, opts ReadOptions) (*command.DocumentVersion, error) {
+	doc, err := ConvertLemonToGrpcDocument(v.Document, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	result := command.DocumentVersion{
+		Document: doc,
+		Version:  uint64(v.Number),
+		Deleted:  v.Deleted,
+	}
+
+	if !v.WrittenAt.IsZero() {
+		result.WrittenAt = timestamppb.New(v.WrittenAt)
+	}
+
+	if !v.SupersededAt.IsZero() {
+		result.SupersededAt = timestamppb.New(v.SupersededAt)
+	}
+
+	return &result, nil
+}
+
+var grpcCodecs = map[command.Codec]Codec{
+	command.Codec_CODEC_NONE:   NoCodec,
+	command.Codec_CODEC_GZIP:   GzipCodec,
+	command.Codec_CODEC_SNAPPY: SnappyCodec,
+	command.Codec_CODEC_ZSTD:   ZstdCodec,
+}
+
+func ConvertGrpcToOptions(request *command.DatabaseOptions) (*Options, error) {
+	var o Options
+	if request.Compression != nil {
+		codec, ok := grpcCodecs[request.Compression.Codec]
+		if !ok {
+			return nil, &FieldError{
+				Field:       "compression.codec",
+				Description: fmt.Sprintf("unknown codec %d", request.Compression.Codec),
+				Err:         ErrInvalidOptions,
+			}
+		}
+
+		o.Compression = CompressionOptions{Codec: codec, Threshold: int(request.Compression.Threshold)}
+	}
+
+	if request.Encryption != nil {
+		o.Encryption = EncryptionOptions{KeyID: request.Encryption.KeyId, Tags: request.Encryption.Tags}
+	}
+
+	if request.History != nil {
+		o.History = HistoryOptions{
+			MaxVersions: int(request.History.MaxVersions),
+			Retention:   request.History.Retention.AsDuration(),
+		}
+	}
+
+	if request.Trash != nil {
+		o.Trash = TrashOptions{
+			Enabled:   request.Trash.Enabled,
+			Retention: request.Trash.Retention.AsDuration(),
+		}
+	}
+
+	if request.FullText != nil {
+		o.FullText = FullTextOptions{Enabled: request.FullText.Enabled}
+	}
+
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &o, nil
+}
+
+func ConvertOptionsToGrpc(database string, o *Options) *command.DatabaseOptions {
+	result := command.DatabaseOptions{
+		Database:    database,
+		Compression: &command.Compression{Threshold: uint32(o.Compression.Threshold)},
+		Encryption:  &command.Encryption{KeyId: o.Encryption.KeyID, Tags: o.Encryption.Tags},
+		History:     &command.History{MaxVersions: uint32(o.History.MaxVersions)},
+		Trash:       &command.Trash{Enabled: o.Trash.Enabled},
+		FullText:    &command.FullText{Enabled: o.FullText.Enabled},
+	}
+
+	if o.History.Retention > 0 {
+		result.History.Retention = durationpb.New(o.History.Retention)
+	}
+
+	if o.Trash.Retention > 0 {
+		result.Trash.Retention = durationpb.New(o.Trash.Retention)
+	}
+
+	for gc, c := range grpcCodecs {
+		if c == o.Compression.Codec {
+			result.Compression.Codec = gc
+		}
+	}
+
+	return &result
+}
+
+func ConvertDescriptionToGrpc(database string, d *Description) *command.DatabaseDescription {
+	result := command.DatabaseDescription{
+		Database: database,
+		Stats: &command.DatabaseStats{
+			Documents:           d.Stats.Documents,
+			CompressedDocuments: d.Stats.CompressedDocuments,
+			RawBytes:            d.Stats.RawBytes,
+			StoredBytes:         d.Stats.StoredBytes,
+			CompressionRatio:    d.Stats.CompressionRatio,
+			EncryptedDocuments:  d.Stats.EncryptedDocuments,
+			Versions:            d.Stats.Versions,
+			TrashedDocuments:    d.Stats.TrashedDocuments,
+		},
+		Options:        ConvertOptionsToGrpc(database, &d.Options),
+		Shards:         uint32(d.Shards),
+		ReshardingFrom: uint32(d.ReshardingFrom),
+	}
+
+	if d.Encryption != nil {
+		result.Encryption = &command.EncryptionStatus{
+			KeyId:            d.Encryption.KeyID,
+			KeyVersion:       uint32(d.Encryption.KeyVersion),
+			PendingDocuments: d.Encryption.PendingDocuments,
+			Rotating:         d.Encryption.Rotating,
+		}
+	}
+
+	for _, idx := range d.Indexes {
+		result.Indexes = append(result.Indexes, &command.Index{Tag: idx.Tag, Ready: idx.Ready, Entries: idx.Entries})
+	}
+
+	return &result
+}
+
+func ConvertGrpcToIndexTags(request *command.DatabaseIndexes) []string {
+	tags := make([]string, len(request.Indexes))
+	for i, idx := range request.Indexes {
+		tags[i] = idx.Tag
+	}
+
+	return tags
+}
+
+func ConvertIndexesToGrpc(database string, indexes []Index) *command.DatabaseIndexes {
+	result := command.DatabaseIndexes{Database: database}
+	for _, idx := range indexes {
+		result.Indexes = append(result.Indexes, &command.Index{Tag: idx.Tag, Ready: idx.Ready})
+	}
+
+	return &result
+}
+
+var grpcTagOperators = map[command.TagOperator]TagOperator{
+	command.TagOperator_TAG_OPERATOR_EQ:  TagEq,
+	command.TagOperator_TAG_OPERATOR_GT:  TagGt,
+	command.TagOperator_TAG_OPERATOR_GTE: TagGte,
+	command.TagOperator_TAG_OPERATOR_LT:  TagLt,
+	command.TagOperator_TAG_OPERATOR_LTE: TagLte,
+}
+
+func ConvertGrpcToTagQuery(request *command.TagQueryRequest) (TagQuery, error) {
+	q := TagQuery{
+		KeyPrefix: request.KeyPrefix,
+		Tags:      make([]TagPredicate, len(request.Tags)),
+		Limit:     int(request.Limit),
+	}
+
+	for i, p := range request.Tags {
+		op, ok := grpcTagOperators[p.Op]
+		if !ok {
+			return TagQuery{}, &FieldError{
+				Field:       fmt.Sprintf("tags[%d].op", i),
+				Description: "unknown operator " + p.Op.String(),
+				Err:         ErrInvalidQuery,
+			}
+		}
+
+		if p.Tag == nil {
+			return TagQuery{}, &FieldError{
+				Field:       fmt.Sprintf("tags[%d].tag", i),
+				Description: "tag must be given",
+				Err:         ErrInvalidQuery,
+			}
+		}
+
+		tags, err := convertGrpcTags([]*command.Tag{p.Tag})
+		if err != nil {
+			return TagQuery{}, &FieldError{Field: fmt.Sprintf("tags[%d].tag", i), Description: err.Error(), Err: ErrInvalidQuery}
+		}
+
+		q.Tags[i] = TagPredicate{Name: tags[0].Name, Op: op, Value: tags[0].Value}
+	}
+
+	return q, q.Validate()
+}
+
+var grpcAggregateFunctions = map[command.AggregateFunction]AggregateFunc{
+	command.AggregateFunction_AGGREGATE_FUNCTION_COUNT:          AggregateCount,
+	command.AggregateFunction_AGGREGATE_FUNCTION_SUM:            AggregateSum,
+	command.AggregateFunction_AGGREGATE_FUNCTION_MIN:            AggregateMin,
+	command.AggregateFunction_AGGREGATE_FUNCTION_MAX:            AggregateMax,
+	command.AggregateFunction_AGGREGATE_FUNCTION_AVG:            AggregateAvg,
+	command.AggregateFunction_AGGREGATE_FUNCTION_DISTINCT_COUNT: AggregateDistinctCount,
+}
+
+func ConvertGrpcToAggregateQuery(request *command.AggregateRequest) (AggregateQuery, error) {
+	filter, err := ConvertGrpcToTagQuery(&command.TagQueryRequest{KeyPrefix: request.KeyPrefix, Tags: request.Tags})
+	if err != nil {
+		return AggregateQuery{}, err
+	}
+
+	q := AggregateQuery{
+		Filter:       filter,
+		Aggregations: make([]Aggregation, len(request.Aggregations)),
+		GroupBy:      request.GroupBy,
+	}
+
+	for i, a := range request.Aggregations {
+		f, ok := grpcAggregateFunctions[a.Function]
+		if !ok {
+			return AggregateQuery{}, &FieldError{
+				Field:       fmt.Sprintf("aggregations[%d].function", i),
+				Description: "unknown function " + a.Function.String(),
+				Err:         ErrInvalidQuery,
+			}
+		}
+
+		q.Aggregations[i] = Aggregation{Func: f, Tag: a.Tag}
+	}
+
+	return q, q.Validate()
+}
+
+func ConvertAggregateResultToGrpc(groupBy string, r *AggregateResult) (*command.AggregateResult, error) {
+	functions := make(map[AggregateFunc]command.AggregateFunction, len(grpcAggregateFunctions))
+	for gf, f := range grpcAggregateFunctions {
+		functions[f] = gf
+	}
+
+	result := command.AggregateResult{Documents: r.Documents, Partial: r.Partial}
+	for _, g := range r.Groups {
+		group := command.AggregateGroup{}
+		if g.Value != nil {
+			tag, err := convertTagToGrpc(groupBy, g.Value)
+			if err != nil {
+				return nil, err
+			}
+			group.Group = tag
+		}
+
+		for _, v := range g.Values {
+			group.Values = append(group.Values, &command.AggregateValue{
+				Aggregation: &command.Aggregation{Function: functions[v.Func], Tag: v.Tag},
+				Value:       v.Value,
+				Count:       v.Count,
+			})
+		}
+
+		result.Groups = append(result.Groups, &group)
+	}
+
+	return &result, nil
+}
+
+// ConvertChangeToGrpcMutation converts a change to replicate, with system tags and the lemon type of the value
+func ConvertChangeToGrpcMutation(dbName string, c Change) (*command.Mutation, error) {
+	m := &command.Mutation{Database: dbName, Key: c.Key}
+	if c.Document == nil {
+		m.Deleted = true
+		return m, nil
+	}
+
+	m.Value = c.Document.Value()
+	m.ContentType = string(c.Document.ContentType())
+	if c.Document.HasTimestamps() {
+		m.CreatedAt = c.Document.CreatedAt().UnixMilli()
+		m.UpdatedAt = c.Document.UpdatedAt().UnixMilli()
+	}
+
+	for name, v := range c.Document.Tags() {
+		ct, err := convertTagToGrpc(name, v)
+		if err != nil {
+			return nil, err
+		}
+
+		m.Tags = append(m.Tags, ct)
+	}
+
+	return m, nil
+}
+
+// ConvertGrpcMutationToChange converts a replicated mutation back, system tags included
+func ConvertGrpcMutationToChange(m *command.Mutation) (Change, error) {
+	c := Change{Key: m.Key}
+	if m.Deleted {
+		return c, nil
+	}
+
+	tags := make(lemon.M, len(m.Tags))
+	for _, tag := range m.Tags {
+		switch typedTagValue := tag.Value.(type) {
+		case *command.Tag_Int:
+			tags[tag.Name] = int(typedTagValue.Int)
+		case *command.Tag_Float:
+			tags[tag.Name] = typedTagValue.Float
+		case *command.Tag_Str:
+			tags[tag.Name] = typedTagValue.Str
+		case *command.Tag_Bool:
+			tags[tag.Name] = typedTagValue.Bool
+		default:
+			return Change{}, errors.Wrapf(ErrInvalidTagValue, "value type %T unsupported", typedTagValue)
+		}
+	}
+
+	c.Document = &Document{
+		key:           m.Key,
+		value:         m.Value,
+		contentType:   lemon.ContentTypeIdentifier(m.ContentType),
+		tags:          tags,
+		createdAt:     time.UnixMilli(m.CreatedAt),
+		updatedAt:     time.UnixMilli(m.UpdatedAt),
+		hasTimestamps: m.CreatedAt != 0 || m.UpdatedAt != 0,
+	}
+
+	return c, nil
+}
@@ -0,0 +1,317 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/denismitr/lemon"
+	"github.com/denismitr/lemon-server/internal/jsondoc"
+	"github.com/denismitr/lemon-server/pkg/command"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func insertConverted(t *testing.T, request *command.BatchInsertRequest) map[string]*Document {
+	t.Helper()
+
+	bi, err := ConvertGrpcToLemonInsert(request)
+	require.NoError(t, err)
+
+	db, closer, err := lemon.Open(lemon.InMemory)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = closer() })
+
+	s := &settings{options: &Options{}}
+	require.NoError(t, db.Update(context.Background(), func(tx *lemon.Tx) error {
+		for i := range bi {
+			value, appliers, err := s.encode(bi[i].Key, bi[i].Value, bi[i].ContentType, bi[i].Tags, bi[i].WithTimestamps)
+			if err != nil {
+				return err
+			}
+
+			if err := tx.Insert(bi[i].Key, value, appliers...); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	keys := make([]string, len(bi))
+	for i := range bi {
+		keys[i] = bi[i].Key
+	}
+
+	stored, err := db.MGet(keys...)
+	require.NoError(t, err)
+
+	docs := make(map[string]*Document, len(stored))
+	for key, d := range stored {
+		docs[key], err = s.decode(d)
+		require.NoError(t, err)
+	}
+
+	return docs
+}
+
+func Test_ConvertLemonToGrpcDocument_TypedValues(t *testing.T) {
+	ts := timestamppb.New(time.Date(2021, 11, 5, 10, 30, 0, 123456789, time.UTC))
+	docs := insertConverted(t, &command.BatchInsertRequest{
+		Stmt: []*command.InsertStatement{
+			{Key: "str", Value: &command.InsertStatement_Str{Str: "foo"}},
+			{Key: "blob", Value: &command.InsertStatement_Blob{Blob: []byte{0, 1, 2}}},
+			{Key: "int", Value: &command.InsertStatement_Int{Int: -42}},
+			{Key: "bool", Value: &command.InsertStatement_Bool{Bool: true}},
+			{Key: "float", Value: &command.InsertStatement_Float{Float: 1.5}},
+			{Key: "whole float", Value: &command.InsertStatement_Float{Float: 2}},
+			{Key: "timestamp", Value: &command.InsertStatement_Timestamp{Timestamp: ts}},
+		},
+	})
+
+	expected := map[string]interface{}{
+		"str":         &command.Document_Str{Str: "foo"},
+		"blob":        &command.Document_Blob{Blob: []byte{0, 1, 2}},
+		"int":         &command.Document_Int{Int: -42},
+		"bool":        &command.Document_Bool{Bool: true},
+		"float":       &command.Document_Float{Float: 1.5},
+		"whole float": &command.Document_Float{Float: 2},
+		"timestamp":   &command.Document_Timestamp{Timestamp: ts},
+	}
+
+	for key, exp := range expected {
+		t.Run(key, func(t *testing.T) {
+			doc, err := ConvertLemonToGrpcDocument(docs[key], ReadOptions{Mode: command.ValueMode_VALUE_MODE_TYPED})
+			require.NoError(t, err)
+			assert.Equal(t, exp, doc.TypedValue)
+			assert.Nil(t, doc.Value)
+		})
+	}
+
+	t.Run("bytes compatibility mode", func(t *testing.T) {
+		doc, err := ConvertLemonToGrpcDocument(docs["int"], ReadOptions{Mode: command.ValueMode_VALUE_MODE_BYTES})
+		require.NoError(t, err)
+		assert.Equal(t, []byte("-42"), doc.Value)
+		assert.Nil(t, doc.TypedValue)
+	})
+
+	t.Run("requests without value mode get bytes", func(t *testing.T) {
+		request := &command.MultiGetQueryRequest{Database: "db", Keys: []string{"str"}}
+		doc, err := ConvertLemonToGrpcDocument(docs["str"], ReadOptions{Mode: request.ValueMode})
+		require.NoError(t, err)
+		assert.Equal(t, []byte("foo"), doc.Value)
+		assert.Nil(t, doc.TypedValue)
+	})
+}
+
+func Test_ConvertLemonToGrpcDocument_TimestampTags(t *testing.T) {
+	ts := timestamppb.New(time.Date(2021, 11, 5, 10, 30, 0, 123456789, time.UTC))
+	docs := insertConverted(t, &command.BatchInsertRequest{
+		Stmt: []*command.InsertStatement{{
+			Key:   "doc",
+			Value: &command.InsertStatement_Str{Str: "foo"},
+			Tags: []*command.Tag{
+				{Name: "published_at", Value: &command.Tag_Timestamp{Timestamp: ts}},
+				{Name: "views", Value: &command.Tag_Int{Int: 7}},
+			},
+		}},
+	})
+
+	// timestamp tags are int tags for lemon, so they can be range queried
+	assert.Equal(t, int(ts.AsTime().UnixNano()), docs["doc"].Tags().Int("published_at"))
+
+	doc, err := ConvertLemonToGrpcDocument(docs["doc"], ReadOptions{})
+	require.NoError(t, err)
+	require.Len(t, doc.Tags, 2)
+
+	tags := make(map[string]*command.Tag, len(doc.Tags))
+	for _, tag := range doc.Tags {
+		tags[tag.Name] = tag
+	}
+
+	assert.Equal(t, ts.AsTime(), tags["published_at"].GetTimestamp().AsTime())
+	assert.Equal(t, int64(7), tags["views"].GetInt())
+
+	t.Run("invalid timestamp", func(t *testing.T) {
+		_, err := ConvertGrpcToLemonInsert(&command.BatchInsertRequest{
+			Stmt: []*command.InsertStatement{{
+				Key:   "doc",
+				Value: &command.InsertStatement_Timestamp{Timestamp: &timestamppb.Timestamp{Seconds: 1, Nanos: -1}},
+			}},
+		})
+		assert.True(t, errors.Is(err, ErrInvalidDocumentValue))
+	})
+}
+
+func Test_ConvertGrpcToLemonInsert_JSONValues(t *testing.T) {
+	tt := []struct {
+		name  string
+		stmt  *command.InsertStatement
+		valid bool
+	}{
+		{
+			name:  "valid json string",
+			stmt:  &command.InsertStatement{Key: "a", ContentType: "application/json", Value: &command.InsertStatement_Str{Str: `{"a":1}`}},
+			valid: true,
+		},
+		{
+			name:  "valid vendor json blob",
+			stmt:  &command.InsertStatement{Key: "a", ContentType: "application/vnd.foo+json", Value: &command.InsertStatement_Blob{Blob: []byte(`[1,2]`)}},
+			valid: true,
+		},
+		{
+			name: "invalid json",
+			stmt: &command.InsertStatement{Key: "a", ContentType: "application/json", Value: &command.InsertStatement_Str{Str: `{"a":`}},
+		},
+		{
+			name: "json given as int",
+			stmt: &command.InsertStatement{Key: "a", ContentType: "application/json", Value: &command.InsertStatement_Int{Int: 1}},
+		},
+		{
+			name:  "not json content type",
+			stmt:  &command.InsertStatement{Key: "a", ContentType: "text/plain", Value: &command.InsertStatement_Str{Str: `{"a":`}},
+			valid: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ConvertGrpcToLemonInsert(&command.BatchInsertRequest{
+				Stmt: []*command.InsertStatement{tc.stmt},
+			})
+
+			if tc.valid {
+				assert.NoError(t, err)
+				return
+			}
+
+			var fieldErr *FieldError
+			require.True(t, errors.As(err, &fieldErr))
+			assert.Equal(t, "stmt[0].value", fieldErr.Field)
+			assert.True(t, errors.Is(err, ErrInvalidJSONValue))
+		})
+	}
+
+	t.Run("reserved tag name", func(t *testing.T) {
+		_, err := ConvertGrpcToLemonInsert(&command.BatchInsertRequest{
+			Stmt: []*command.InsertStatement{{
+				Key:   "a",
+				Value: &command.InsertStatement_Str{Str: "foo"},
+				Tags:  []*command.Tag{{Name: "@content_type", Value: &command.Tag_Str{Str: "x"}}},
+			}},
+		})
+
+		assert.True(t, errors.Is(err, ErrReservedTagName))
+	})
+}
+
+func Test_ConvertLemonToGrpcDocument_JSONProjection(t *testing.T) {
+	docs := insertConverted(t, &command.BatchInsertRequest{
+		Stmt: []*command.InsertStatement{
+			{
+				Key:         "user",
+				ContentType: "application/json",
+				Value:       &command.InsertStatement_Str{Str: `{"name":"foo","address":{"city":"bar"},"age":3}`},
+				Tags:        []*command.Tag{{Name: "role", Value: &command.Tag_Str{Str: "admin"}}},
+			},
+			{Key: "plain", Value: &command.InsertStatement_Str{Str: "not json"}},
+		},
+	})
+
+	opts := ReadOptions{Mode: command.ValueMode_VALUE_MODE_TYPED, JSONProjection: []string{"/name", "/address/city", "/missing"}}
+	require.NoError(t, opts.Validate())
+
+	doc, err := ConvertLemonToGrpcDocument(docs["user"], opts)
+	require.NoError(t, err)
+	assert.Equal(t, "application/json", doc.ContentType)
+	assert.JSONEq(t, `{"/name":"foo","/address/city":"bar"}`, doc.GetStr())
+	require.Len(t, doc.Tags, 1)
+	assert.Equal(t, "role", doc.Tags[0].Name)
+
+	doc, err = ConvertLemonToGrpcDocument(docs["plain"], opts)
+	require.NoError(t, err)
+	assert.Equal(t, "not json", doc.GetStr())
+
+	assert.Error(t, ReadOptions{JSONProjection: []string{"name"}}.Validate())
+}
+
+func Test_ConvertLemonToGrpcDocument_MetadataOnly(t *testing.T) {
+	docs := insertConverted(t, &command.BatchInsertRequest{
+		Stmt: []*command.InsertStatement{
+			{
+				Key:   "blob",
+				Value: &command.InsertStatement_Blob{Blob: []byte("abc")},
+				Tags:  []*command.Tag{{Name: "role", Value: &command.Tag_Str{Str: "admin"}}},
+			},
+		},
+	})
+
+	opts := ReadOptions{MetadataOnly: true}
+	require.NoError(t, opts.Validate())
+
+	doc, err := ConvertLemonToGrpcDocument(docs["blob"], opts)
+	require.NoError(t, err)
+	assert.Nil(t, doc.TypedValue)
+	assert.Nil(t, doc.Value)
+	assert.Equal(t, uint64(3), doc.ValueSize)
+	assert.Equal(t, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad", doc.ContentHash)
+	require.Len(t, doc.Tags, 1)
+
+	// the full document carries the same size and hash
+	full, err := ConvertLemonToGrpcDocument(docs["blob"], ReadOptions{Mode: command.ValueMode_VALUE_MODE_BYTES})
+	require.NoError(t, err)
+	assert.Equal(t, []byte("abc"), full.Value)
+	assert.Equal(t, doc.ContentHash, full.ContentHash)
+
+	assert.Error(t, ReadOptions{MetadataOnly: true, JSONProjection: []string{"/name"}}.Validate())
+}
+
+func Test_patchDocument(t *testing.T) {
+	db, closer, err := lemon.Open(lemon.InMemory)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = closer() })
+
+	require.NoError(t, db.Update(context.Background(), func(tx *lemon.Tx) error {
+		appliers := createMetaAppliers(nil, "application/json", []Tag{{Name: "n", Value: 1}}, true)
+		if err := tx.Insert("doc", `{"a":1,"b":[1,2]}`, appliers...); err != nil {
+			return err
+		}
+		return tx.Insert("plain", "foo")
+	}))
+
+	tt := []struct {
+		name     string
+		patch    Patch
+		expected string
+		err      error
+	}{
+		{name: "merge patch", patch: Patch{Key: "doc", MergePatch: []byte(`{"a":null,"c":"x"}`)}, expected: `{"b":[1,2],"c":"x"}`},
+		{name: "json patch", patch: Patch{Key: "doc", JSONPatch: []byte(`[{"op":"add","path":"/b/-","value":3}]`)}, expected: `{"a":1,"b":[1,2,3]}`},
+		{name: "failed test", patch: Patch{Key: "doc", JSONPatch: []byte(`[{"op":"test","path":"/a","value":2}]`)}, err: jsondoc.ErrTestFailed},
+		{name: "missing document", patch: Patch{Key: "nope", MergePatch: []byte(`{}`)}, err: ErrDocumentNotFound},
+		{name: "not json", patch: Patch{Key: "plain", MergePatch: []byte(`{}`)}, err: ErrNotJSONDocument},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			tx, err := db.Begin(context.Background(), false)
+			require.NoError(t, err)
+			defer func() { _ = tx.Rollback() }()
+
+			err = patchDocument(tx, 0, tc.patch, &settings{options: &Options{}}, time.Now())
+			if tc.err != nil {
+				assert.True(t, errors.Is(err, tc.err), "got %v", err)
+				return
+			}
+
+			require.NoError(t, err)
+			d, err := tx.Get(tc.patch.Key)
+			require.NoError(t, err)
+			assert.JSONEq(t, tc.expected, d.RawString())
+			assert.Equal(t, "application/json", contentTypeOf(newDocument(d)))
+			assert.Equal(t, 1, d.Tags().Int("n"))
+			assert.True(t, d.HasTimestamps())
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package database
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/denismitr/lemon"
+	"github.com/pkg/errors"
+)
+
+// documentCounts keeps the number of user documents of databases once they were counted, so that
+// the documents quota is checked without scanning them. Counts are loaded in lemon transactions
+// holding their database, which gives them a new version, and writes change the counts they saw
+// in their transactions once they committed, a write seeing a count loaded later was loaded with it
+type documentCounts struct {
+	mu      sync.Mutex
+	counts  map[string]documentCount
+	version uint64
+}
+
+type documentCount struct {
+	n       int
+	version uint64
+}
+
+// countChange is the number of documents a write added to a database, negative when it removed some
+type countChange struct {
+	name    string
+	delta   int
+	version uint64
+}
+
+func newDocumentCounts() *documentCounts {
+	return &documentCounts{counts: make(map[string]documentCount)}
+}
+
+// get returns the count of a database, ok is false when it was not loaded
+func (dc *documentCounts) get(name string) (n int, ok bool) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	c, ok := dc.counts[name]
+	return c.n, ok
+}
+
+// load sets the count of a database, which has to be held by a lemon transaction
+func (dc *documentCounts) load(name string, n int) uint64 {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.version++
+	dc.counts[name] = documentCount{n: n, version: dc.version}
+	return dc.version
+}
+
+// change records a write of a database in a lemon transaction holding it
+func (dc *documentCounts) change(name string, delta int) countChange {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	return countChange{name: name, delta: delta, version: dc.counts[name].version}
+}
+
+// apply changes the count of a database by a committed write, unless it was loaded since
+func (dc *documentCounts) apply(cc countChange) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	c, ok := dc.counts[cc.name]
+	if !ok || c.version != cc.version || cc.delta == 0 {
+		return
+	}
+
+	c.n += cc.delta
+	dc.counts[cc.name] = c
+}
+
+// forget drops the count of a database changed by writes that are not counted
+func (dc *documentCounts) forget(name string) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	delete(dc.counts, name)
+}
+
+func (dc *documentCounts) reset() {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.counts = make(map[string]documentCount)
+}
+
+// SetMaxDocuments sets the maximum number of documents a database may hold, zero means unlimited
+func (le *LemonEngine) SetMaxDocuments(n int) {
+	atomic.StoreInt64(&le.maxDocuments, int64(n))
+}
+
+// countDocuments records the documents a write added to a database in tx, fewer when it removed
+// some, and checks that the database, together with the other shards of a sharded one, does not
+// hold more documents than allowed when it added any. The other shards are not locked, so writes
+// to them made at the same time can exceed it by their own documents. The change has to be
+// applied to the counts once tx is committed
+func (le *LemonEngine) countDocuments(tx *lemon.Tx, dbName string, delta int) (countChange, error) {
+	cc := le.counts.change(dbName, delta)
+
+	max := atomic.LoadInt64(&le.maxDocuments)
+	if max <= 0 || delta <= 0 {
+		return cc, nil
+	}
+
+	n, ok := le.counts.get(dbName)
+	if ok {
+		n += delta
+	} else {
+		// the write is counted along with the documents stored before
+		counted, err := countUser(tx)
+		if err != nil {
+			return cc, errors.Wrap(ErrEngineFailed, err.Error())
+		}
+
+		n = counted
+		cc.version = le.counts.load(dbName, n-delta)
+	}
+
+	logical := LogicalName(dbName)
+	others, err := le.otherShardsCount(logical, dbName)
+	if err != nil {
+		return cc, err
+	}
+
+	if int64(n+others) > max {
+		return cc, errors.Wrapf(ErrQuotaExceeded, "database %s may not hold more than %d documents", logical, max)
+	}
+
+	return cc, nil
+}
+
+// otherShardsCount returns the number of documents of the shards of a database other than shard,
+// they were counted by route before the write, shards forgotten since are left out
+func (le *LemonEngine) otherShardsCount(dbName, shard string) (int, error) {
+	m, err := le.shardMaps.get(dbName)
+	if err != nil || m == nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, name := range m.names(dbName) {
+		if name == shard {
+			continue
+		}
+
+		if n, ok := le.counts.get(name); ok {
+			total += n
+		}
+	}
+
+	return total, nil
+}
+
+// countShards counts the documents of the shards of a database not counted yet, so that
+// writes to one of them can check the documents quota of the whole database
+func (le *LemonEngine) countShards(ctx context.Context, dbName string, m *shardMap) error {
+	if m == nil || atomic.LoadInt64(&le.maxDocuments) <= 0 {
+		return nil
+	}
+
+	for _, name := range m.names(dbName) {
+		if _, ok := le.counts.get(name); ok {
+			continue
+		}
+
+		db, err := le.store.Get(name)
+		if err != nil {
+			return err
+		}
+
+		if err := db.View(ctx, func(tx *lemon.Tx) error {
+			n, err := countUser(tx)
+			if err != nil {
+				return errors.Wrap(ErrEngineFailed, err.Error())
+			}
+
+			le.counts.load(name, n)
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/denismitr/lemon"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_DocumentsQuota(t *testing.T) {
+	le := newTestEngine(t)
+	le.SetMaxDocuments(3)
+	ctx := context.Background()
+
+	// the count kept by writes has to match the documents stored
+	counted := func(t *testing.T, expected int) {
+		n, ok := le.counts.get("quota")
+		require.True(t, ok)
+		assert.Equal(t, expected, n)
+
+		db, err := le.store.Get("quota")
+		require.NoError(t, err)
+		require.NoError(t, db.View(ctx, func(tx *lemon.Tx) error {
+			stored, err := countUser(tx)
+			assert.Equal(t, expected, stored)
+			return err
+		}))
+	}
+
+	_, err := le.BatchInsert(ctx, "quota", BatchInsert{{Key: "a", Value: 1}, {Key: "b", Value: 2}})
+	require.NoError(t, err)
+	counted(t, 2)
+
+	_, err = le.BatchUpsert(ctx, "quota", BatchUpsert{{Key: "a", Value: 3}, {Key: "c", Value: 4}})
+	require.NoError(t, err)
+	counted(t, 3)
+
+	_, err = le.BatchInsert(ctx, "quota", BatchInsert{{Key: "d", Value: 5}})
+	assert.True(t, errors.Is(err, ErrQuotaExceeded))
+	counted(t, 3)
+
+	// replacing documents does not add any
+	_, err = le.BatchUpsert(ctx, "quota", BatchUpsert{{Key: "b", Value: 6}})
+	require.NoError(t, err)
+
+	_, err = le.BatchDeleteByKey(ctx, "quota", BatchDeleteByKey{"a", "missing"})
+	require.NoError(t, err)
+	counted(t, 2)
+
+	_, err = le.CrossDatabaseTransaction(ctx, []TxWrite{
+		{Database: "other", Inserts: BatchInsert{{Key: "x", Value: 1}}},
+		{Database: "quota", Inserts: BatchInsert{{Key: "d", Value: 7}, {Key: "e", Value: 8}}},
+	})
+	assert.True(t, errors.Is(err, ErrQuotaExceeded))
+	counted(t, 2)
+
+	_, err = le.CrossDatabaseTransaction(ctx, []TxWrite{
+		{Database: "other", Inserts: BatchInsert{{Key: "x", Value: 1}}},
+		{Database: "quota", Inserts: BatchInsert{{Key: "d", Value: 7}}, Deletes: BatchDeleteByKey{"b"}},
+	})
+	require.NoError(t, err)
+	counted(t, 2)
+
+	require.NoError(t, le.ApplyChanges(ctx, "quota", []Change{{Key: "c"}, {Key: "f", Document: &Document{tags: lemon.M{}}}}))
+	counted(t, 2)
+}
+
+func Test_DocumentsQuota_sharded(t *testing.T) {
+	le := newTestEngine(t)
+	ctx := context.Background()
+
+	var batch BatchUpsert
+	for i := 0; i < 20; i++ {
+		batch = append(batch, Upsert{Key: fmt.Sprintf("u:%d", i), Value: i})
+	}
+	_, err := le.BatchUpsert(ctx, "users", batch)
+	require.NoError(t, err)
+
+	require.NoError(t, le.Reshard(ctx, "users", 4))
+	require.Eventually(t, func() bool {
+		d, err := le.Describe(ctx, "users")
+		return err == nil && d.Shards == 4 && d.ReshardingFrom == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the quota is checked against the documents of all the shards
+	le.SetMaxDocuments(21)
+	_, err = le.BatchInsert(ctx, "users", BatchInsert{{Key: "u:20", Value: 20}})
+	require.NoError(t, err)
+
+	_, err = le.BatchInsert(ctx, "users", BatchInsert{{Key: "u:21", Value: 21}})
+	require.True(t, errors.Is(err, ErrQuotaExceeded))
+	assert.Contains(t, err.Error(), "database users may not")
+}
@@ -0,0 +1,366 @@
+package database
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var ErrEncryptionKeyMissing = errors.New("encryption key missing")
+var ErrEncryptionUnavailable = errors.New("encryption is not configured")
+var ErrKeyNotFound = errors.New("key not found")
+
+const keysExt = ".keys.json"
+
+// dekSize is the size of data encryption keys, AES-256
+const dekSize = 32
+
+// KeyProvider wraps and unwraps data encryption keys with key encryption keys
+// it holds, the way a KMS does. Key encryption keys never leave the provider.
+type KeyProvider interface {
+	// Wrap encrypts a data encryption key with the key encryption key keyID
+	Wrap(ctx context.Context, keyID string, dek []byte) ([]byte, error)
+	// Unwrap decrypts a data encryption key, ErrKeyNotFound is returned for unknown key ids
+	Unwrap(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// KeyfileProvider is a KeyProvider backed by a local keyfile, a stand-in for a KMS.
+// The keyfile holds one key-id:base64-encoded-32-byte-key pair per line,
+// empty lines and lines starting with # are ignored.
+type KeyfileProvider struct {
+	keys map[string][]byte
+}
+
+// NewKeyfileProvider reads all keys from the keyfile
+func NewKeyfileProvider(path string) (*KeyfileProvider, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not open keyfile %s", path)
+	}
+	defer f.Close()
+
+	p := KeyfileProvider{keys: make(map[string][]byte)}
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.Errorf("keyfile %s line %d must be in key-id:base64-key format", path, n)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil || len(key) != dekSize {
+			return nil, errors.Errorf("keyfile %s line %d must hold a base64 encoded %d byte key", path, n, dekSize)
+		}
+
+		p.keys[parts[0]] = key
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "could not read keyfile %s", path)
+	}
+
+	return &p, nil
+}
+
+func (p *KeyfileProvider) Wrap(_ context.Context, keyID string, dek []byte) ([]byte, error) {
+	kek, ok := p.keys[keyID]
+	if !ok {
+		return nil, errors.Wrapf(ErrKeyNotFound, "key %s", keyID)
+	}
+
+	return seal(kek, dek, []byte(keyID))
+}
+
+func (p *KeyfileProvider) Unwrap(_ context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	kek, ok := p.keys[keyID]
+	if !ok {
+		return nil, errors.Wrapf(ErrKeyNotFound, "key %s", keyID)
+	}
+
+	return open(kek, wrapped, []byte(keyID))
+}
+
+// seal encrypts with AES-GCM, the random nonce is prepended to the ciphertext
+func seal(key, plaintext, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(key, sealed, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+type wrappedKey struct {
+	Version int    `json:"version"`
+	KeyID   string `json:"key_id"`
+	Wrapped []byte `json:"wrapped"`
+}
+
+type keyringFile struct {
+	Active int          `json:"active"`
+	Keys   []wrappedKey `json:"keys"`
+}
+
+// keyring holds the unwrapped data encryption keys of a database by version,
+// new values are always encrypted with the active one
+type keyring struct {
+	active int
+	keyID  string
+	deks   map[int][]byte
+	file   keyringFile
+}
+
+func (k *keyring) activeKey() []byte {
+	return k.deks[k.active]
+}
+
+// keyringRegistry keeps wrapped data encryption keys in files next to the database files
+type keyringRegistry struct {
+	dir      string
+	provider KeyProvider
+	keyrings map[string]*keyring
+	mu       sync.Mutex
+}
+
+func newKeyringRegistry(dir string, provider KeyProvider) *keyringRegistry {
+	return &keyringRegistry{
+		dir:      dir,
+		provider: provider,
+		keyrings: make(map[string]*keyring),
+	}
+}
+
+// reset forgets what has been read, so that it is read again from the sidecar files
+func (r *keyringRegistry) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keyrings = make(map[string]*keyring)
+}
+
+// get returns the keyring of a database, nil when the database has never been encrypted
+func (r *keyringRegistry) get(ctx context.Context, dbName string) (*keyring, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.load(ctx, dbName)
+}
+
+func (r *keyringRegistry) load(ctx context.Context, dbName string) (*keyring, error) {
+	if k, ok := r.keyrings[dbName]; ok {
+		return k, nil
+	}
+
+	path, err := sidecarPath(r.dir, dbName, keysExt)
+	if err != nil {
+		return nil, err
+	}
+
+	var file keyringFile
+	found, err := readSidecar(path, &file)
+	if err != nil {
+		return nil, err
+	}
+
+	if !found {
+		return nil, nil
+	}
+
+	if r.provider == nil {
+		return nil, errors.Wrapf(ErrEncryptionKeyMissing, "database %s is encrypted, but no key provider is configured", dbName)
+	}
+
+	k := keyring{active: file.Active, deks: make(map[int][]byte, len(file.Keys)), file: file}
+	for _, wk := range file.Keys {
+		dek, err := r.provider.Unwrap(ctx, wk.KeyID, wk.Wrapped)
+		if errors.Is(err, ErrKeyNotFound) {
+			return nil, errors.Wrapf(
+				ErrEncryptionKeyMissing,
+				"database %s needs key %s for data key version %d, which the key provider does not have",
+				dbName, wk.KeyID, wk.Version,
+			)
+		}
+
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not unwrap data key version %d of database %s", wk.Version, dbName)
+		}
+
+		k.deks[wk.Version] = dek
+		if wk.Version == file.Active {
+			k.keyID = wk.KeyID
+		}
+	}
+
+	if k.activeKey() == nil {
+		return nil, errors.Errorf("keys file %s has no active data key", path)
+	}
+
+	r.keyrings[dbName] = &k
+
+	return &k, nil
+}
+
+// ensure makes sure the active data key of a database is wrapped with keyID,
+// a new data key is created otherwise
+func (r *keyringRegistry) ensure(ctx context.Context, dbName, keyID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k, err := r.load(ctx, dbName)
+	if err != nil {
+		return err
+	}
+
+	if k != nil && k.keyID == keyID {
+		return nil
+	}
+
+	return r.addKey(ctx, dbName, k, keyID)
+}
+
+// rotate creates a new active data key wrapped with keyID, or the current key id when empty
+func (r *keyringRegistry) rotate(ctx context.Context, dbName, keyID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k, err := r.load(ctx, dbName)
+	if err != nil {
+		return err
+	}
+
+	if k == nil {
+		return errors.Wrapf(ErrEncryptionUnavailable, "database %s is not encrypted", dbName)
+	}
+
+	if keyID == "" {
+		keyID = k.keyID
+	}
+
+	return r.addKey(ctx, dbName, k, keyID)
+}
+
+func (r *keyringRegistry) addKey(ctx context.Context, dbName string, current *keyring, keyID string) error {
+	if r.provider == nil {
+		return ErrEncryptionUnavailable
+	}
+
+	dek := make([]byte, dekSize)
+	if _, err := io.ReadFull(rand.Reader, dek); err != nil {
+		return err
+	}
+
+	wrapped, err := r.provider.Wrap(ctx, keyID, dek)
+	if err != nil {
+		if errors.Is(err, ErrKeyNotFound) {
+			return errors.Wrapf(ErrEncryptionKeyMissing, "key %s is unknown to the key provider", keyID)
+		}
+		return errors.Wrapf(err, "could not wrap data key with key %s", keyID)
+	}
+
+	next := keyring{active: 1, keyID: keyID, deks: map[int][]byte{}}
+	if current != nil {
+		next.active = current.active + 1
+		next.file.Keys = append(next.file.Keys, current.file.Keys...)
+		for v, d := range current.deks {
+			next.deks[v] = d
+		}
+	}
+
+	for _, wk := range next.file.Keys {
+		if wk.Version >= next.active {
+			next.active = wk.Version + 1
+		}
+	}
+
+	next.deks[next.active] = dek
+	next.file.Active = next.active
+	next.file.Keys = append(next.file.Keys, wrappedKey{Version: next.active, KeyID: keyID, Wrapped: wrapped})
+
+	return r.store(dbName, &next)
+}
+
+// prune drops data keys no document is encrypted with anymore
+func (r *keyringRegistry) prune(dbName string, inUse map[int]bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k, ok := r.keyrings[dbName]
+	if !ok || k == nil {
+		return nil
+	}
+
+	next := keyring{active: k.active, keyID: k.keyID, deks: map[int][]byte{}, file: keyringFile{Active: k.active}}
+	for _, wk := range k.file.Keys {
+		if wk.Version == k.active || inUse[wk.Version] {
+			next.file.Keys = append(next.file.Keys, wk)
+			next.deks[wk.Version] = k.deks[wk.Version]
+		}
+	}
+
+	if len(next.file.Keys) == len(k.file.Keys) {
+		return nil
+	}
+
+	return r.store(dbName, &next)
+}
+
+func (r *keyringRegistry) store(dbName string, k *keyring) error {
+	path, err := sidecarPath(r.dir, dbName, keysExt)
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(k.file.Keys, func(i, j int) bool {
+		return k.file.Keys[i].Version < k.file.Keys[j].Version
+	})
+
+	if err := writeSidecar(path, k.file); err != nil {
+		return err
+	}
+
+	r.keyrings[dbName] = k
+
+	return nil
+}
@@ -0,0 +1,174 @@
+package database
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/denismitr/lemon"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeKeyfile(t *testing.T, ids ...string) string {
+	t.Helper()
+
+	lines := []string{"# test keys", ""}
+	for i, id := range ids {
+		key := []byte(strings.Repeat(string(rune('a'+i)), dekSize))
+		lines = append(lines, id+":"+base64.StdEncoding.EncodeToString(key))
+	}
+
+	path := filepath.Join(t.TempDir(), "keys")
+	require.NoError(t, os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600))
+
+	return path
+}
+
+func Test_NewKeyfileProvider(t *testing.T) {
+	kp, err := NewKeyfileProvider(writeKeyfile(t, "k1"))
+	require.NoError(t, err)
+
+	wrapped, err := kp.Wrap(context.Background(), "k1", []byte("secret"))
+	require.NoError(t, err)
+
+	dek, err := kp.Unwrap(context.Background(), "k1", wrapped)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("secret"), dek)
+
+	_, err = kp.Unwrap(context.Background(), "k2", wrapped)
+	assert.True(t, errors.Is(err, ErrKeyNotFound))
+
+	path := filepath.Join(t.TempDir(), "invalid")
+	require.NoError(t, os.WriteFile(path, []byte("k1:dG9vIHNob3J0"), 0600))
+	_, err = NewKeyfileProvider(path)
+	assert.Error(t, err)
+}
+
+func Test_keyringRegistry(t *testing.T) {
+	dir := t.TempDir()
+	kp, err := NewKeyfileProvider(writeKeyfile(t, "k1", "k2"))
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	r := newKeyringRegistry(dir, kp)
+	require.NoError(t, r.ensure(ctx, "users", "k1"))
+	require.NoError(t, r.ensure(ctx, "users", "k1"))
+	require.NoError(t, r.rotate(ctx, "users", "k2"))
+
+	k, err := newKeyringRegistry(dir, kp).get(ctx, "users")
+	require.NoError(t, err)
+	assert.Equal(t, 2, k.active)
+	assert.Equal(t, "k2", k.keyID)
+	assert.Len(t, k.deks, 2)
+
+	require.NoError(t, r.prune("users", map[int]bool{0: true}))
+	k, err = newKeyringRegistry(dir, kp).get(ctx, "users")
+	require.NoError(t, err)
+	assert.Len(t, k.deks, 1)
+
+	// k2 wraps the active data key, but is gone from the keyfile
+	onlyK1, err := NewKeyfileProvider(writeKeyfile(t, "k1"))
+	require.NoError(t, err)
+	_, err = newKeyringRegistry(dir, onlyK1).get(ctx, "users")
+	assert.True(t, errors.Is(err, ErrEncryptionKeyMissing))
+	assert.Contains(t, err.Error(), "needs key k2")
+
+	_, err = newKeyringRegistry(dir, nil).get(ctx, "users")
+	assert.True(t, errors.Is(err, ErrEncryptionKeyMissing))
+
+	missing, err := r.get(ctx, "orders")
+	require.NoError(t, err)
+	assert.Nil(t, missing)
+}
+
+func Test_encode_Encryption(t *testing.T) {
+	kp, err := NewKeyfileProvider(writeKeyfile(t, "k1"))
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	r := newKeyringRegistry(t.TempDir(), kp)
+	require.NoError(t, r.ensure(ctx, "users", "k1"))
+	keys, err := r.get(ctx, "users")
+	require.NoError(t, err)
+
+	db, closer, err := lemon.Open(lemon.InMemory)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = closer() })
+
+	published := time.Date(2021, 11, 5, 10, 30, 0, 0, time.UTC)
+	tags := []Tag{
+		{Name: "email", Value: "foo@example.com"},
+		{Name: "age", Value: 42},
+		{Name: "score", Value: 1.5},
+		{Name: "active", Value: true},
+		{Name: "published_at", Value: published},
+	}
+
+	s := &settings{
+		options: &Options{
+			Compression: CompressionOptions{Codec: GzipCodec},
+			Encryption:  EncryptionOptions{KeyID: "k1", Tags: true},
+		},
+		keys: keys,
+	}
+
+	value, appliers, err := s.encode("doc", `{"name":"foo"}`, "application/json", tags, true)
+	require.NoError(t, err)
+	require.NoError(t, db.Insert("doc", value, appliers...))
+
+	stored, err := db.Get("doc")
+	require.NoError(t, err)
+	assert.NotContains(t, string(stored.Value()), "foo")
+	assert.NotContains(t, stored.Tags().String("email"), "foo")
+	assert.False(t, s.stale(stored))
+
+	assertDecoded := func(s *settings, stored *lemon.Document) {
+		t.Helper()
+
+		d, err := s.decode(stored)
+		require.NoError(t, err)
+		assert.Equal(t, `{"name":"foo"}`, d.RawString())
+		assert.Equal(t, lemon.String, d.ContentType())
+		assert.Equal(t, "foo@example.com", d.Tags()["email"])
+		assert.Equal(t, 42, d.Tags()["age"])
+		assert.Equal(t, 1.5, d.Tags()["score"])
+		assert.Equal(t, true, d.Tags()["active"])
+		assert.Equal(t, int(published.UnixNano()), d.Tags()["published_at"])
+		assert.True(t, isTimestampTag(d, "published_at"))
+		assert.Equal(t, "application/json", contentTypeOf(d))
+	}
+
+	assertDecoded(s, stored)
+
+	_, err = (&settings{options: &Options{}}).decode(stored)
+	assert.True(t, errors.Is(err, ErrEncryptionKeyMissing))
+
+	// after a rotation the document is stale until it gets re-encrypted with the new key
+	require.NoError(t, r.rotate(ctx, "users", ""))
+	rotated, err := r.get(ctx, "users")
+	require.NoError(t, err)
+	s.keys = rotated
+	assert.True(t, s.stale(stored))
+
+	require.NoError(t, db.Update(ctx, func(tx *lemon.Tx) error {
+		return reencryptDocument(tx, "doc", s)
+	}))
+
+	reencrypted, err := db.Get("doc")
+	require.NoError(t, err)
+	assert.False(t, s.stale(reencrypted))
+	assert.Equal(t, 2, reencrypted.Tags().Int(dekTag))
+	assert.Equal(t, stored.UpdatedAt().UnixMilli(), reencrypted.UpdatedAt().UnixMilli())
+	assertDecoded(s, reencrypted)
+
+	var stats Stats
+	stats.add(reencrypted)
+	assert.Equal(t, uint64(1), stats.EncryptedDocuments)
+	assert.Equal(t, uint64(len(`{"name":"foo"}`)), stats.RawBytes)
+}
@@ -2,6 +2,14 @@ package database
 
 import (
 	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/denismitr/lemon-server/internal/jsondoc"
+	"github.com/denismitr/lemon-server/internal/lql"
 
 	"go.uber.org/zap"
 
@@ -10,6 +18,9 @@ import (
 )
 
 var ErrEngineFailed = errors.New("database engine faied")
+var ErrQuotaExceeded = errors.New("quota exceeded")
+var ErrDocumentNotFound = errors.New("document not found")
+var ErrNotJSONDocument = errors.New("document is not json")
 
 type Tag struct {
 	Name  string
@@ -31,11 +42,83 @@ type Upsert struct {
 	ContentType        string
 	PreserveTimestamps bool
 	Tags               []Tag
+	// ExpectedRevision fails the write with ErrRevisionMismatch when the document
+	// is at another revision, zero means any revision or no document at all
+	ExpectedRevision uint64
+}
+
+// Patch is either an RFC 7386 merge patch or an RFC 6902 json patch of a json document
+type Patch struct {
+	Key              string
+	MergePatch       []byte
+	JSONPatch        []byte
+	ExpectedRevision uint64
 }
 
 type BatchInsert []Insert
 type BatchUpsert []Upsert
 type BatchDeleteByKey []string
+type BatchPatch []Patch
+
+func (bi BatchInsert) keys() []string {
+	keys := make([]string, len(bi))
+	for i := range bi {
+		keys[i] = bi[i].Key
+	}
+	return keys
+}
+
+func (bu BatchUpsert) keys() []string {
+	keys := make([]string, len(bu))
+	for i := range bu {
+		keys[i] = bu[i].Key
+	}
+	return keys
+}
+
+// checkSchema fails with a SchemaError listing the statements not conforming to the schema
+func (bi BatchInsert) checkSchema(s *settings) error {
+	if s.schema == nil {
+		return nil
+	}
+
+	var violations []SchemaViolation
+	for i := range bi {
+		violations = append(violations, s.schema.check(i, bi[i].Value, bi[i].ContentType, bi[i].Tags)...)
+	}
+
+	if violations != nil {
+		return &SchemaError{Violations: violations}
+	}
+
+	return nil
+}
+
+// checkSchema fails with a SchemaError listing the statements not conforming to the schema
+func (bu BatchUpsert) checkSchema(s *settings) error {
+	if s.schema == nil {
+		return nil
+	}
+
+	var violations []SchemaViolation
+	for i := range bu {
+		violations = append(violations, s.schema.check(i, bu[i].Value, bu[i].ContentType, bu[i].Tags)...)
+	}
+
+	if violations != nil {
+		return &SchemaError{Violations: violations}
+	}
+
+	return nil
+}
+
+func (bp BatchPatch) keys() []string {
+	keys := make([]string, len(bp))
+	for i := range bp {
+		keys[i] = bp[i].Key
+	}
+	return keys
+}
 
 type ExecResult struct {
 	RowsAffected uint64
@@ -45,155 +128,1366 @@ type Engine interface {
 	BatchInsert(ctx context.Context, dbName string, bi BatchInsert) (*ExecResult, error)
 	BatchUpsert(ctx context.Context, dbName string, bu BatchUpsert) (*ExecResult, error)
 	BatchDeleteByKey(ctx context.Context, dbName string, keys BatchDeleteByKey) (*ExecResult, error)
-	MGet(ctx context.Context, database string, keys []string) (map[string]*lemon.Document, error)
+	BatchPatch(ctx context.Context, dbName string, bp BatchPatch) (*ExecResult, error)
+	CrossDatabaseTransaction(ctx context.Context, writes []TxWrite) (*TxResult, error)
+	MGet(ctx context.Context, database string, keys []string, asOf time.Time) (map[string]*Document, error)
+	Exists(ctx context.Context, dbName string, keys []string) ([]bool, error)
+	History(ctx context.Context, dbName, key string, limit int) ([]*Version, error)
+	Schema(ctx context.Context, dbName string) (*Schema, error)
+	SetSchema(ctx context.Context, dbName string, s *Schema) error
+	Options(ctx context.Context, dbName string) (*Options, error)
+	SetOptions(ctx context.Context, dbName string, o *Options) error
+	Describe(ctx context.Context, dbName string) (*Description, error)
+	RotateKey(ctx context.Context, dbName, keyID string) error
+	Undelete(ctx context.Context, dbName string, keys []string, ignoreMissing bool) (*ExecResult, error)
+	FindByTags(ctx context.Context, dbName string, q TagQuery, page Page) ([]*Document, error)
+	Aggregate(ctx context.Context, dbName string, q AggregateQuery, emit func(*AggregateResult) error) error
+	Query(ctx context.Context, stmt *lql.Statement, page Page) (*QueryResult, error)
+	Search(ctx context.Context, dbName string, q SearchQuery) (*SearchResult, error)
+	Indexes(ctx context.Context, dbName string) ([]Index, error)
+	SetIndexes(ctx context.Context, dbName string, tags []string) ([]Index, error)
+	Reshard(ctx context.Context, dbName string, shards int) error
+}
+
+// Stats describe the documents stored in a database
+type Stats struct {
+	Documents           uint64
+	CompressedDocuments uint64
+	EncryptedDocuments  uint64
+	// Versions are previous versions of documents kept by history
+	Versions uint64
+	// TrashedDocuments are soft deleted documents not yet purged
+	TrashedDocuments uint64
+	// RawBytes is the size of all values before compression and encryption
+	RawBytes    uint64
+	StoredBytes uint64
+	// CompressionRatio is RawBytes divided by StoredBytes
+	CompressionRatio float64
 }
 
+func (s *Stats) add(d *lemon.Document) {
+	s.Documents++
+	s.StoredBytes += uint64(len(d.Value()))
+	if d.Tags().HasInt(rawSizeTag) {
+		s.RawBytes += uint64(d.Tags().Int(rawSizeTag))
+	} else {
+		s.RawBytes += uint64(len(d.Value()))
+	}
+
+	if _, ok := d.Tags()[codecTag]; ok {
+		s.CompressedDocuments++
+	}
+
+	if d.Tags().Int(dekTag) > 0 {
+		s.EncryptedDocuments++
+	}
+
+	s.CompressionRatio = 1
+	if s.StoredBytes > 0 {
+		s.CompressionRatio = float64(s.RawBytes) / float64(s.StoredBytes)
+	}
+}
+
+// merge adds the statistics of a shard
+func (s *Stats) merge(o Stats) {
+	s.Documents += o.Documents
+	s.CompressedDocuments += o.CompressedDocuments
+	s.EncryptedDocuments += o.EncryptedDocuments
+	s.Versions += o.Versions
+	s.TrashedDocuments += o.TrashedDocuments
+	s.RawBytes += o.RawBytes
+	s.StoredBytes += o.StoredBytes
+
+	if s.Documents > 0 {
+		s.CompressionRatio = 1
+		if s.StoredBytes > 0 {
+			s.CompressionRatio = float64(s.RawBytes) / float64(s.StoredBytes)
+		}
+	}
+}
+
+// EncryptionStatus describes the data keys of an encrypted database
+type EncryptionStatus struct {
+	KeyID      string
+	KeyVersion int
+	// PendingDocuments are not yet encrypted with the active data key
+	PendingDocuments uint64
+	Rotating         bool
+}
+
+type Description struct {
+	// Shards is the number of shards of the database, ReshardingFrom the previous one while
+	// documents are being moved to their new shards
+	Shards         int
+	ReshardingFrom int
+	Stats          Stats
+	Options        Options
+	Encryption     *EncryptionStatus
+	Indexes        []IndexStats
+}
+
+// reencryptBatchSize is the number of documents re-encrypted in one transaction
+const reencryptBatchSize = 500
+
 // LemonEngine wraps and manages the database store
 type LemonEngine struct {
-	store *Store
-	lg    *zap.SugaredLogger
+	store        *Store
+	schemas      *schemaRegistry
+	options      *optionsRegistry
+	keys         *keyringRegistry
+	indexes      *indexRegistry
+	lg           *zap.SugaredLogger
+	maxDocuments int64
+	counts       *documentCounts
+	// tombstoneRetention is the time tombstones are kept for, as a time.Duration
+	tombstoneRetention int64
+
+	// rotations holds the databases being re-encrypted, true when another pass was requested
+	rotations map[string]bool
+	// reindexing holds the databases whose indexes are being built, the same way
+	reindexing map[string]bool
+	// searchBuilds holds the databases whose full-text indexes are being built, the same way
+	searchBuilds map[string]bool
+	searchLocks  map[string]*sync.Mutex
+	shardMaps    *shardRegistry
+	shardLocks   map[string]*sync.RWMutex
+	// resharding holds the databases whose documents are being moved to their new shards
+	resharding       map[string]bool
+	shardingDisabled bool
+	// doubts holds the transactions in doubt being completed by their id
+	doubts map[string]*doubt
+	// commit commits the lemon transactions of cross database transactions
+	commit func(tx *lemon.Tx) error
+	hooks  []CommitHook
+	// changeHooks are not called for documents moved between shards
+	changeHooks []CommitHook
+	mu          sync.Mutex
 }
 
-// NewEngine - creates a new LemonEngine
-func NewEngine(store *Store, lg *zap.SugaredLogger) *LemonEngine {
+// CommitHook is called with the keys of the user documents written
+// by every committed write to a database, after the commit
+type CommitHook func(dbName string, keys []string)
+
+// NewEngine - creates a new LemonEngine, the key provider may be nil when encryption is not used
+func NewEngine(store *Store, kp KeyProvider, lg *zap.SugaredLogger) *LemonEngine {
 	return &LemonEngine{
-		store: store,
-		lg:    lg,
+		store:        store,
+		schemas:      newSchemaRegistry(store.dir),
+		options:      newOptionsRegistry(store.dir),
+		keys:         newKeyringRegistry(store.dir, kp),
+		indexes:      newIndexRegistry(store.dir),
+		lg:           lg,
+		counts:       newDocumentCounts(),
+		rotations:    make(map[string]bool),
+		reindexing:   make(map[string]bool),
+		searchBuilds: make(map[string]bool),
+		searchLocks:  make(map[string]*sync.Mutex),
+		shardMaps:    newShardRegistry(store.dir),
+		shardLocks:   make(map[string]*sync.RWMutex),
+		resharding:   make(map[string]bool),
+		doubts:       make(map[string]*doubt),
+		commit:       (*lemon.Tx).Commit,
+	}
+}
+
+// AddCommitHook registers a hook, hooks run in the write path and have to be quick
+func (le *LemonEngine) AddCommitHook(h CommitHook) {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	le.hooks = append(le.hooks, h)
+}
+
+// AddChangeHook registers a hook called like commit hooks, except for writes moving documents
+// between the shards of a database, which do not change them
+func (le *LemonEngine) AddChangeHook(h CommitHook) {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	le.changeHooks = append(le.changeHooks, h)
+}
+
+// committed updates what is derived from documents after a write of keys was committed
+func (le *LemonEngine) committed(dbName string, s *settings, keys []string) {
+	le.updateSearch(dbName, s, keys)
+	le.callHooks(dbName, keys, true)
+}
+
+// callHooks calls the commit hooks, and the change hooks when the documents of keys changed
+func (le *LemonEngine) callHooks(dbName string, keys []string, changed bool) {
+	le.mu.Lock()
+	hooks := le.hooks
+	if changed {
+		hooks = append(hooks[:len(hooks):len(hooks)], le.changeHooks...)
+	}
+	le.mu.Unlock()
+
+	for _, h := range hooks {
+		h(dbName, keys)
 	}
 }
 
-func (le *LemonEngine) MGet(ctx context.Context, database string, keys []string) (map[string]*lemon.Document, error) {
-	db, err := le.store.Get(database)
+// open returns a database together with the settings to write and read its documents,
+// it fails with ErrEncryptionKeyMissing when the database cannot be decrypted
+func (le *LemonEngine) open(ctx context.Context, dbName string) (*lemon.DB, *settings, error) {
+	db, err := le.store.Get(dbName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s, err := le.settings(ctx, dbName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return db, s, nil
+}
+
+func (le *LemonEngine) settings(ctx context.Context, dbName string) (*settings, error) {
+	schema, err := le.schemas.get(dbName)
 	if err != nil {
 		return nil, err
 	}
 
-	// todo: add MGetContext to LemonDB
-	documentMap, err := db.MGetContext(ctx, keys...)
+	opts, err := le.options.get(dbName)
 	if err != nil {
-		return nil, errors.Wrap(ErrEngineFailed, err.Error())
+		return nil, err
+	}
+
+	keys, err := le.keys.get(ctx, dbName)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Encryption.KeyID != "" && keys == nil {
+		return nil, errors.Wrapf(
+			ErrEncryptionKeyMissing,
+			"database %s is encrypted with key %s, but its keys file is missing",
+			dbName, opts.Encryption.KeyID,
+		)
+	}
+
+	indexes, err := le.indexes.get(dbName)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, idx := range indexes {
+		if !idx.Ready {
+			le.resumeReindex(dbName)
+			break
+		}
 	}
 
-	return documentMap, nil
+	return &settings{schema: schema, options: opts, keys: keys, indexes: indexes}, nil
 }
 
-func (le *LemonEngine) BatchInsert(ctx context.Context, dbName string, bi BatchInsert) (*ExecResult, error) {
-	db, err := le.store.Get(dbName)
+// Schema returns the schema of a database, nil when it has none
+func (le *LemonEngine) Schema(_ context.Context, dbName string) (*Schema, error) {
+	return le.schemas.get(dbName)
+}
+
+// setSchema attaches a schema to a database, an empty schema detaches it,
+// documents already in the database are not validated
+func (le *LemonEngine) setSchema(_ context.Context, dbName string, s *Schema) error {
+	return le.schemas.set(dbName, s)
+}
+
+// Options returns the storage options of a database
+func (le *LemonEngine) Options(_ context.Context, dbName string) (*Options, error) {
+	return le.options.get(dbName)
+}
+
+// setOptions changes the storage options of a database, documents already in the database
+// keep their compression, but get re-encrypted in the background when encryption changes,
+// the full-text index is built in the background when full-text search gets enabled
+func (le *LemonEngine) setOptions(ctx context.Context, dbName string, o *Options) error {
+	if err := o.Validate(); err != nil {
+		return err
+	}
+
+	current, err := le.options.get(dbName)
+	if err != nil {
+		return err
+	}
+
+	if o.Encryption.Tags {
+		indexes, err := le.indexes.get(dbName)
+		if err != nil {
+			return err
+		}
+
+		if len(indexes) > 0 {
+			return &FieldError{
+				Field:       "encryption.tags",
+				Description: "tags of a database with indexes cannot be encrypted",
+				Err:         ErrInvalidOptions,
+			}
+		}
+	}
+
+	if o.Encryption.KeyID != "" {
+		if err := le.keys.ensure(ctx, dbName, o.Encryption.KeyID); err != nil {
+			return err
+		}
+	}
+
+	if err := le.options.set(dbName, o); err != nil {
+		return err
+	}
+
+	if current.Encryption != o.Encryption {
+		le.reencrypt(dbName)
+	}
+
+	if current.FullText != o.FullText {
+		le.rebuildSearch(dbName)
+	}
+
+	return nil
+}
+
+// rotateKey creates a new data key for an encrypted database and re-encrypts its documents
+// in the background, the data key gets wrapped with keyID or the current key when empty
+func (le *LemonEngine) rotateKey(ctx context.Context, dbName, keyID string) error {
+	opts, err := le.options.get(dbName)
+	if err != nil {
+		return err
+	}
+
+	if opts.Encryption.KeyID == "" {
+		return errors.Wrapf(ErrEncryptionUnavailable, "database %s is not encrypted", dbName)
+	}
+
+	if err := le.rotateKeyring(ctx, dbName, opts, keyID); err != nil {
+		return err
+	}
+
+	le.reencrypt(dbName)
+
+	return nil
+}
+
+// rotateKeyring creates the new data key of a database and switches its options to keyID
+func (le *LemonEngine) rotateKeyring(ctx context.Context, dbName string, opts *Options, keyID string) error {
+	if err := le.keys.rotate(ctx, dbName, keyID); err != nil {
+		return err
+	}
+
+	if keyID != "" && keyID != opts.Encryption.KeyID {
+		rotated := *opts
+		rotated.Encryption.KeyID = keyID
+		if err := le.options.set(dbName, &rotated); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// describe returns the options of a database and stats gathered by scanning all its documents
+func (le *LemonEngine) describe(ctx context.Context, dbName string) (*Description, error) {
+	db, s, err := le.open(ctx, dbName)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := db.Update(ctx, func(tx *lemon.Tx) error {
-		for i := range bi {
-			metaAppliers := make([]lemon.MetaApplier, 0, 2)
+	var stats Stats
+	var pending uint64
+	entries := make(map[string]uint64)
+	if err := db.View(ctx, func(tx *lemon.Tx) error {
+		return tx.Scan(nil, func(d *lemon.Document) bool {
+			if s.keys != nil && s.stale(d) {
+				pending++
+			}
+
+			if strings.HasPrefix(d.Key(), historyKeyPrefix) {
+				stats.Versions++
+			} else if strings.HasPrefix(d.Key(), trashKeyPrefix) {
+				stats.TrashedDocuments++
+			} else if strings.HasPrefix(d.Key(), indexKeyPrefix) {
+				entries[indexEntryTag(d.Key())]++
+			} else if !isSystemKey(d.Key()) {
+				stats.add(d)
+			}
+			return ctx.Err() == nil
+		})
+	}); err != nil {
+		return nil, errors.Wrap(ErrEngineFailed, err.Error())
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-			ct := lemon.ContentTypeIdentifier(bi[i].ContentType)
-			if ct != "" {
-				metaAppliers = append(metaAppliers, lemon.WithContentType(ct))
+	description := Description{Stats: stats, Options: *s.options, Shards: 1}
+	for _, idx := range s.indexes {
+		description.Indexes = append(description.Indexes, IndexStats{
+			Tag:     idx.Tag,
+			Ready:   idx.Ready,
+			Entries: entries[indexTagSegment(idx.Tag)],
+		})
+	}
+	if s.keys != nil {
+		le.mu.Lock()
+		_, rotating := le.rotations[dbName]
+		le.mu.Unlock()
+
+		description.Encryption = &EncryptionStatus{
+			KeyID:            s.keys.keyID,
+			KeyVersion:       s.keys.active,
+			PendingDocuments: pending,
+			Rotating:         rotating,
+		}
+	}
+
+	return &description, nil
+}
+
+// reencrypt starts rewriting the documents of a database that are not encrypted
+// the way its options say, another pass follows when one is already running
+func (le *LemonEngine) reencrypt(dbName string) {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+
+	if _, ok := le.rotations[dbName]; ok {
+		le.rotations[dbName] = true
+		return
+	}
+
+	le.rotations[dbName] = false
+
+	go func() {
+		for {
+			err := le.reencryptDocuments(context.Background(), dbName)
+			if err != nil {
+				le.lg.Errorf("could not re-encrypt database '%s': %s", dbName, err)
+			}
+
+			le.mu.Lock()
+			if err != nil || !le.rotations[dbName] {
+				delete(le.rotations, dbName)
+				le.mu.Unlock()
+				return
 			}
 
-			if bi[i].Tags != nil {
-				m := make(lemon.M)
-				for _, tag := range bi[i].Tags {
-					m[tag.Name] = tag.Value
+			le.rotations[dbName] = false
+			le.mu.Unlock()
+		}
+	}()
+}
+
+// reencryptDocuments rewrites stale documents in batches until there are none left,
+// then drops the data keys no document uses anymore
+func (le *LemonEngine) reencryptDocuments(ctx context.Context, dbName string) error {
+	for {
+		db, s, err := le.open(ctx, dbName)
+		if err != nil {
+			return err
+		}
+
+		var stale []string
+		inUse := make(map[int]bool)
+		if err := db.View(ctx, func(tx *lemon.Tx) error {
+			return tx.Scan(nil, func(d *lemon.Document) bool {
+				if s.stale(d) {
+					stale = append(stale, d.Key())
 				}
-				metaAppliers = append(metaAppliers, lemon.WithTags().Map(m))
+				inUse[d.Tags().Int(dekTag)] = true
+				inUse[d.Tags().Int(tagsDEKTag)] = true
+				return true
+			})
+		}); err != nil {
+			return errors.Wrap(ErrEngineFailed, err.Error())
+		}
+
+		if len(stale) == 0 {
+			return le.keys.prune(dbName, inUse)
+		}
+
+		for len(stale) > 0 {
+			n := reencryptBatchSize
+			if n > len(stale) {
+				n = len(stale)
 			}
 
-			if err := tx.Insert(
-				bi[i].Key,
-				bi[i].Value,
-				metaAppliers...,
-			); err != nil {
+			if err := db.Update(ctx, func(tx *lemon.Tx) error {
+				for _, key := range stale[:n] {
+					if err := reencryptDocument(tx, key, s); err != nil {
+						return err
+					}
+				}
+				return nil
+			}); err != nil {
 				return err
 			}
+
+			le.lg.Infof("re-encrypted %d documents of database '%s'", n, dbName)
+			stale = stale[n:]
 		}
+	}
+}
+
+func reencryptDocument(tx *lemon.Tx, key string, s *settings) error {
+	stored, err := tx.Get(key)
+	if err != nil {
+		if errors.Is(err, lemon.ErrKeyDoesNotExist) {
+			return nil
+		}
+
+		return errors.Wrap(ErrEngineFailed, err.Error())
+	}
+
+	if !s.stale(stored) {
 		return nil
-	}); err != nil {
-		return nil, err
 	}
 
-	return &ExecResult{
-		RowsAffected: uint64(len(bi)),
-	}, nil
+	d, err := s.decode(stored)
+	if err != nil {
+		return err
+	}
+
+	m := make(lemon.M, len(d.Tags()))
+	for name, v := range d.Tags() {
+		m[name] = v
+	}
+
+	// versions are encrypted for the document they belong to
+	value, err := s.encodeRaw(d.Key(), d.Value(), d.ContentType(), m)
+	if err != nil {
+		return err
+	}
+
+	appliers := []lemon.MetaApplier{m}
+	if d.HasTimestamps() {
+		appliers = append(appliers, preservedTimestamps(d))
+	}
+
+	return tx.InsertOrReplace(key, value, appliers...)
 }
 
-func (le *LemonEngine) BatchDeleteByKey(
+// mget returns documents by keys, as they were at asOf when it is not zero
+func (le *LemonEngine) mget(
 	ctx context.Context,
-	dbName string,
-	keys BatchDeleteByKey,
-) (*ExecResult, error) {
-	db, err := le.store.Get(dbName)
+	database string,
+	keys []string,
+	asOf time.Time,
+) (map[string]*Document, error) {
+	db, s, err := le.open(ctx, database)
 	if err != nil {
 		return nil, err
 	}
 
-	deleted := 0
-	if err := db.Update(ctx, func(tx *lemon.Tx) error {
-		for _, k := range keys {
+	if !asOf.IsZero() {
+		return mgetAsOf(ctx, db, s, keys, asOf)
+	}
+
+	// keys are read in the transaction rather than with MGetContext, whose reads lock the
+	// database again and deadlock with a write waiting for the transaction
+	result := make(map[string]*Document, len(keys))
+	if err := db.View(ctx, func(tx *lemon.Tx) error {
+		for _, key := range keys {
 			if err := ctx.Err(); err != nil {
 				return err
 			}
 
-			if err := tx.Remove(k); err != nil {
-				le.lg.Infof("could not find key '%s' to remove from database '%s'", k, dbName)
+			d, err := tx.Get(key)
+			if errors.Is(err, lemon.ErrKeyDoesNotExist) {
 				continue
-			} else {
-				deleted++
 			}
-		}
 
+			if err != nil {
+				return errors.Wrap(ErrEngineFailed, err.Error())
+			}
+
+			if result[key], err = s.decode(d); err != nil {
+				return err
+			}
+		}
 		return nil
 	}); err != nil {
 		return nil, err
 	}
 
-	return &ExecResult{
-		RowsAffected: uint64(deleted),
-	}, nil
+	return result, nil
 }
 
-func (le *LemonEngine) BatchUpsert(ctx context.Context, dbName string, bi BatchUpsert) (*ExecResult, error) {
+// exists reports whether each of the keys exists without reading the documents,
+// so neither decompression nor an encryption key is needed
+func (le *LemonEngine) exists(ctx context.Context, dbName string, keys []string) ([]bool, error) {
 	db, err := le.store.Get(dbName)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := db.Update(ctx, func(tx *lemon.Tx) error {
-		for i := range bi {
-			metaAppliers := make([]lemon.MetaApplier, 0, 3)
-
-			ct := lemon.ContentTypeIdentifier(bi[i].ContentType)
-			if ct != "" {
-				metaAppliers = append(metaAppliers, lemon.WithContentType(ct))
+	result := make([]bool, len(keys))
+	if err := db.View(ctx, func(tx *lemon.Tx) error {
+		for i, key := range keys {
+			if err := ctx.Err(); err != nil {
+				return err
 			}
 
-			if bi[i].PreserveTimestamps {
-				metaAppliers = append(metaAppliers, lemon.WithTimestamps())
-			}
+			result[i] = tx.Has(key)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
 
-			if bi[i].Tags != nil {
-				m := make(lemon.M)
-				for _, tag := range bi[i].Tags {
-					m[tag.Name] = tag.Value
-				}
-				metaAppliers = append(metaAppliers, lemon.WithTags().Map(m))
+	return result, nil
+}
+
+func mgetAsOf(ctx context.Context, db *lemon.DB, s *settings, keys []string, asOf time.Time) (map[string]*Document, error) {
+	result := make(map[string]*Document, len(keys))
+	if err := db.View(ctx, func(tx *lemon.Tx) error {
+		for _, key := range keys {
+			if err := ctx.Err(); err != nil {
+				return err
 			}
 
-			if err := tx.InsertOrReplace(
-				bi[i].Key,
-				bi[i].Value,
-				metaAppliers...,
-			); err != nil {
+			d, err := s.versionAt(tx, key, asOf)
+			if err != nil {
 				return err
 			}
+
+			if d != nil {
+				result[key] = d
+			}
 		}
 		return nil
 	}); err != nil {
 		return nil, err
 	}
 
-	return &ExecResult{
-		RowsAffected: uint64(len(bi)),
-	}, nil
+	return result, nil
+}
+
+// history returns the current version of a document followed by its previous versions,
+// newest first and at most limit of them when limit is positive
+func (le *LemonEngine) history(ctx context.Context, dbName, key string, limit int) ([]*Version, error) {
+	db, s, err := le.open(ctx, dbName)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []*Version
+	if err := db.View(ctx, func(tx *lemon.Tx) error {
+		versions, err = s.history(tx, key, limit)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	return versions, nil
+}
+
+// FindByTags returns a page of the documents matching a tag query in key order,
+// using an index when one serves the query
+func (le *LemonEngine) FindByTags(ctx context.Context, dbName string, q TagQuery, page Page) ([]*Document, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+
+	result, err := le.Query(ctx, q.statement(dbName), page)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Documents, nil
+}
+
+// aggregate computes aggregations over the documents matching a query in a read transaction,
+// emitting partial results while scanning large databases and the final result last
+func (le *LemonEngine) aggregate(ctx context.Context, dbName string, q AggregateQuery, emit func(*AggregateResult) error) error {
+	if err := q.Validate(); err != nil {
+		return err
+	}
+
+	db, s, err := le.open(ctx, dbName)
+	if err != nil {
+		return err
+	}
+
+	return db.View(ctx, func(tx *lemon.Tx) error {
+		return s.aggregate(ctx, tx, &q, emit)
+	})
+}
+
+// query plans an LQL statement and reads a page of its documents in a read transaction,
+// explained statements only return their plan
+func (le *LemonEngine) query(ctx context.Context, stmt *lql.Statement, page Page) (*QueryResult, error) {
+	db, s, err := le.open(ctx, stmt.Database)
+	if err != nil {
+		return nil, err
+	}
+
+	plan, err := s.planQuery(stmt)
+	if err != nil {
+		return nil, err
+	}
+
+	result := QueryResult{Plan: plan}
+	if stmt.Explain {
+		return &result, nil
+	}
+
+	if err := db.View(ctx, func(tx *lemon.Tx) error {
+		result.Documents, err = s.query(ctx, tx, plan, page)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// setIndexes declares the tags a database is indexed on, new indexes are built in the
+// background and used by queries once they are ready, entries of dropped ones get removed
+func (le *LemonEngine) setIndexes(_ context.Context, dbName string, tags []string) ([]Index, error) {
+	if err := validateIndexes(tags); err != nil {
+		return nil, err
+	}
+
+	opts, err := le.options.get(dbName)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tags) > 0 && opts.Encryption.Tags {
+		return nil, &FieldError{
+			Field:       "indexes",
+			Description: "tags of database " + dbName + " are encrypted and cannot be indexed",
+			Err:         ErrInvalidIndexes,
+		}
+	}
+
+	indexes, err := le.indexes.set(dbName, tags)
+	if err != nil {
+		return nil, err
+	}
+
+	le.reindex(dbName)
+
+	return indexes, nil
+}
+
+// reindex starts building the indexes of a database that are not ready and removing
+// entries of dropped ones, another pass follows when one is already running
+func (le *LemonEngine) reindex(dbName string) {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+
+	if _, ok := le.reindexing[dbName]; ok {
+		le.reindexing[dbName] = true
+		return
+	}
+
+	le.reindexing[dbName] = false
+
+	go func() {
+		for {
+			err := le.buildIndexes(context.Background(), dbName)
+			if err != nil {
+				le.lg.Errorf("could not build indexes of database '%s': %s", dbName, err)
+			}
+
+			le.mu.Lock()
+			if err != nil || !le.reindexing[dbName] {
+				delete(le.reindexing, dbName)
+				le.mu.Unlock()
+				return
+			}
+
+			le.reindexing[dbName] = false
+			le.mu.Unlock()
+		}
+	}()
+}
+
+// resumeReindex builds indexes left unfinished e.g. by a restart, unless they are being built
+func (le *LemonEngine) resumeReindex(dbName string) {
+	le.mu.Lock()
+	_, ok := le.reindexing[dbName]
+	le.mu.Unlock()
+
+	if !ok {
+		le.reindex(dbName)
+	}
+}
+
+// buildIndexes removes the entries of dropped indexes, then indexes all documents
+// for the indexes that are not ready yet in batches, and marks them ready
+func (le *LemonEngine) buildIndexes(ctx context.Context, dbName string) error {
+	db, s, err := le.open(ctx, dbName)
+	if err != nil {
+		return err
+	}
+
+	declared := make(map[string]bool, len(s.indexes))
+	var building []Index
+	for _, idx := range s.indexes {
+		declared[indexTagSegment(idx.Tag)] = true
+		if !idx.Ready {
+			building = append(building, idx)
+		}
+	}
+
+	var dropped, keys []string
+	if err := db.View(ctx, func(tx *lemon.Tx) error {
+		if err := scanPrefix(tx, indexKeyPrefix, func(d *lemon.Document) bool {
+			if !declared[indexEntryTag(d.Key())] {
+				dropped = append(dropped, d.Key())
+			}
+			return true
+		}); err != nil {
+			return err
+		}
+
+		if len(building) == 0 {
+			return nil
+		}
+
+		return scanUser(tx, func(d *lemon.Document) bool {
+			keys = append(keys, d.Key())
+			return true
+		})
+	}); err != nil {
+		return errors.Wrap(ErrEngineFailed, err.Error())
+	}
+
+	for len(dropped) > 0 {
+		n := indexBatchSize
+		if n > len(dropped) {
+			n = len(dropped)
+		}
+
+		if err := db.Update(ctx, func(tx *lemon.Tx) error {
+			return tx.Remove(dropped[:n]...)
+		}); err != nil {
+			return err
+		}
+
+		dropped = dropped[n:]
+	}
+
+	for len(keys) > 0 {
+		n := indexBatchSize
+		if n > len(keys) {
+			n = len(keys)
+		}
+
+		if err := db.Update(ctx, func(tx *lemon.Tx) error {
+			for _, key := range keys[:n] {
+				d, err := getStored(tx, key)
+				if err != nil {
+					return err
+				}
+
+				if d == nil {
+					continue
+				}
+
+				if err := indexDocument(tx, d, building); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		keys = keys[n:]
+	}
+
+	if len(building) == 0 {
+		return nil
+	}
+
+	le.lg.Infof("built %d indexes of database '%s'", len(building), dbName)
+
+	return le.indexes.markReady(dbName, building)
+}
+
+func (le *LemonEngine) batchInsert(ctx context.Context, dbName string, bi BatchInsert) (*ExecResult, error) {
+	db, s, err := le.open(ctx, dbName)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := bi.checkSchema(s); err != nil {
+		return nil, err
+	}
+
+	var cc countChange
+	now := nowFrom(ctx)
+	if err := db.Update(ctx, func(tx *lemon.Tx) error {
+		if err := insertDocuments(tx, s, bi, now); err != nil {
+			return err
+		}
+		cc, err = le.countDocuments(tx, dbName, len(bi))
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	le.counts.apply(cc)
+	le.committed(dbName, s, bi.keys())
+
+	return &ExecResult{
+		RowsAffected: uint64(len(bi)),
+	}, nil
+}
+
+func (le *LemonEngine) batchDeleteByKey(
+	ctx context.Context,
+	dbName string,
+	keys BatchDeleteByKey,
+) (*ExecResult, error) {
+	db, s, err := le.open(ctx, dbName)
+	if err != nil {
+		return nil, err
+	}
+
+	deleted := 0
+	var cc countChange
+	now := nowFrom(ctx)
+	principal := PrincipalFrom(ctx)
+	if err := db.Update(ctx, func(tx *lemon.Tx) error {
+		deleted, err = le.deleteDocuments(ctx, tx, dbName, s, keys, now, principal)
+		cc = le.counts.change(dbName, -deleted)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	le.counts.apply(cc)
+	le.committed(dbName, s, keys)
+
+	return &ExecResult{
+		RowsAffected: uint64(deleted),
+	}, nil
+}
+
+// undelete restores soft deleted documents from the trash, all of them or none, keys
+// missing from the trash fail the batch with ErrDocumentNotFound unless ignoreMissing is set
+func (le *LemonEngine) undelete(ctx context.Context, dbName string, keys []string, ignoreMissing bool) (*ExecResult, error) {
+	db, s, err := le.open(ctx, dbName)
+	if err != nil {
+		return nil, err
+	}
+
+	restored := 0
+	var cc countChange
+	now := nowFrom(ctx)
+	if err := db.Update(ctx, func(tx *lemon.Tx) error {
+		restored, cc, err = le.undeleteDocuments(ctx, tx, dbName, s, keys, ignoreMissing, now)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	le.counts.apply(cc)
+	le.committed(dbName, s, keys)
+
+	return &ExecResult{
+		RowsAffected: uint64(restored),
+	}, nil
+}
+
+// undeleteDocuments restores documents from the trash in tx, returning how many were restored
+// and the change of the count of documents
+func (le *LemonEngine) undeleteDocuments(
+	ctx context.Context,
+	tx *lemon.Tx,
+	dbName string,
+	s *settings,
+	keys []string,
+	ignoreMissing bool,
+	now time.Time,
+) (int, countChange, error) {
+	restored := 0
+	for _, k := range keys {
+		if err := ctx.Err(); err != nil {
+			return 0, countChange{}, err
+		}
+
+		ok, err := s.restore(tx, k, now)
+		if err != nil {
+			return 0, countChange{}, err
+		}
+
+		if ok {
+			if err := s.updateIndexes(tx, k, nil); err != nil {
+				return 0, countChange{}, err
+			}
+			restored++
+		} else if !ignoreMissing {
+			return 0, countChange{}, errors.Wrapf(ErrDocumentNotFound, "key %s is not in the trash", k)
+		}
+	}
+
+	cc, err := le.countDocuments(tx, dbName, restored)
+	return restored, cc, err
+}
+
+// PurgeTrash removes the documents deleted longer ago than the trash retention
+// of their database and calls purged with their keys, it is meant to be run
+// periodically by the store janitor
+func (le *LemonEngine) PurgeTrash(purged func(dbName string, keys []string)) {
+	names, err := le.store.Names()
+	if err != nil {
+		le.lg.Errorf("could not list databases to purge trash: %v", err)
+		return
+	}
+
+	for _, name := range names {
+		o, err := le.options.get(name)
+		if err != nil {
+			le.lg.Errorf("could not read options of database %s to purge trash: %v", name, err)
+			continue
+		}
+
+		if o.Trash.Retention <= 0 {
+			continue
+		}
+
+		db, err := le.store.Get(name)
+		if err != nil {
+			if !errors.Is(err, ErrStoreClosed) {
+				le.lg.Errorf("could not open database %s to purge trash: %v", name, err)
+			}
+			continue
+		}
+
+		var keys []string
+		now := time.Now()
+		if err := db.Update(context.Background(), func(tx *lemon.Tx) error {
+			keys, err = purgeTrash(tx, o.Trash.Retention, now)
+			return err
+		}); err != nil {
+			le.lg.Errorf("could not purge trash of database %s: %v", name, err)
+			continue
+		}
+
+		if len(keys) > 0 {
+			le.lg.Infof("purged %d documents from the trash of database %s", len(keys), name)
+			if purged != nil {
+				purged(LogicalName(name), keys)
+			}
+		}
+	}
+}
+
+// SetTombstoneRetention sets the time the revisions of deleted documents are kept for, documents
+// created again under their key later start over from revision 1, zero keeps them forever
+func (le *LemonEngine) SetTombstoneRetention(d time.Duration) {
+	atomic.StoreInt64(&le.tombstoneRetention, int64(d))
+}
+
+// PurgeTombstones removes the tombstones older than the tombstone retention,
+// it is meant to be run periodically by the store janitor
+func (le *LemonEngine) PurgeTombstones() {
+	retention := time.Duration(atomic.LoadInt64(&le.tombstoneRetention))
+	if retention <= 0 {
+		return
+	}
+
+	names, err := le.store.Names()
+	if err != nil {
+		le.lg.Errorf("could not list databases to purge tombstones: %v", err)
+		return
+	}
+
+	for _, name := range names {
+		db, err := le.store.Get(name)
+		if err != nil {
+			if !errors.Is(err, ErrStoreClosed) {
+				le.lg.Errorf("could not open database %s to purge tombstones: %v", name, err)
+			}
+			continue
+		}
+
+		var n int
+		now := time.Now()
+		if err := db.Update(context.Background(), func(tx *lemon.Tx) error {
+			n, err = purgeTombstones(tx, retention, now)
+			return err
+		}); err != nil {
+			le.lg.Errorf("could not purge tombstones of database %s: %v", name, err)
+			continue
+		}
+
+		if n > 0 {
+			le.lg.Infof("purged %d tombstones from database %s", n, name)
+		}
+	}
+}
+
+func (le *LemonEngine) batchUpsert(ctx context.Context, dbName string, bi BatchUpsert) (*ExecResult, error) {
+	db, s, err := le.open(ctx, dbName)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := bi.checkSchema(s); err != nil {
+		return nil, err
+	}
+
+	var cc countChange
+	now := nowFrom(ctx)
+	if err := db.Update(ctx, func(tx *lemon.Tx) error {
+		added, err := upsertDocuments(tx, s, bi, now)
+		if err != nil {
+			return err
+		}
+		cc, err = le.countDocuments(tx, dbName, added)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	le.counts.apply(cc)
+	le.committed(dbName, s, bi.keys())
+
+	return &ExecResult{
+		RowsAffected: uint64(len(bi)),
+	}, nil
+}
+
+// insertDocuments writes new documents in tx, keys already taken fail the whole batch
+func insertDocuments(tx *lemon.Tx, s *settings, bi BatchInsert, now time.Time) error {
+	for i := range bi {
+		value, metaAppliers, err := s.encode(bi[i].Key, bi[i].Value, bi[i].ContentType, bi[i].Tags, bi[i].WithTimestamps)
+		if err != nil {
+			return err
+		}
+
+		revision, err := nextRevision(tx, nil, bi[i].Key, 0)
+		if err != nil {
+			return err
+		}
+
+		metaAppliers = append(metaAppliers, s.writeStamp(now), revision)
+
+		if err := tx.Insert(
+			bi[i].Key,
+			value,
+			metaAppliers...,
+		); err != nil {
+			return err
+		}
+
+		if err := s.updateIndexes(tx, bi[i].Key, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// upsertDocuments writes documents in tx, replacing the ones stored under the same keys,
+// returning how many were added
+func upsertDocuments(tx *lemon.Tx, s *settings, bu BatchUpsert, now time.Time) (int, error) {
+	added := 0
+	for i := range bu {
+		value, metaAppliers, err := s.encode(bu[i].Key, bu[i].Value, bu[i].ContentType, bu[i].Tags, bu[i].PreserveTimestamps)
+		if err != nil {
+			return 0, err
+		}
+
+		stored, err := getStored(tx, bu[i].Key)
+		if err != nil {
+			return 0, err
+		}
+
+		revision, err := nextRevision(tx, stored, bu[i].Key, bu[i].ExpectedRevision)
+		if err != nil {
+			return 0, err
+		}
+
+		metaAppliers = append(metaAppliers, s.writeStamp(now), revision)
+		if stored != nil && s.options.History.enabled() {
+			if err := s.saveVersion(tx, stored, now, false); err != nil {
+				return 0, err
+			}
+		}
+
+		if err := tx.InsertOrReplace(
+			bu[i].Key,
+			value,
+			metaAppliers...,
+		); err != nil {
+			return 0, err
+		}
+
+		if err := s.updateIndexes(tx, bu[i].Key, stored); err != nil {
+			return 0, err
+		}
+
+		if stored == nil {
+			added++
+		}
+	}
+
+	return added, nil
+}
+
+// deleteDocuments removes or trashes documents in tx, returning how many were found
+func (le *LemonEngine) deleteDocuments(
+	ctx context.Context,
+	tx *lemon.Tx,
+	dbName string,
+	s *settings,
+	keys BatchDeleteByKey,
+	now time.Time,
+	principal string,
+) (int, error) {
+	deleted := 0
+	for _, k := range keys {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+
+		stored, err := getStored(tx, k)
+		if err != nil {
+			return 0, err
+		}
+
+		if stored == nil {
+			le.lg.Infof("could not find key '%s' to remove from database '%s'", k, dbName)
+			continue
+		}
+
+		if s.options.History.enabled() {
+			if err := s.saveVersion(tx, stored, now, true); err != nil {
+				return 0, err
+			}
+		}
+
+		if s.options.Trash.Enabled {
+			err = trash(tx, stored, now, principal)
+		} else {
+			err = tx.Remove(k)
+		}
+
+		if err != nil {
+			return 0, err
+		}
+
+		if err := bury(tx, k, revisionOf(stored.Tags()), now); err != nil {
+			return 0, err
+		}
+
+		if err := s.updateIndexes(tx, k, stored); err != nil {
+			return 0, err
+		}
+
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+// batchPatch applies patches to json documents, all of them or none
+func (le *LemonEngine) batchPatch(ctx context.Context, dbName string, bp BatchPatch) (*ExecResult, error) {
+	db, s, err := le.open(ctx, dbName)
+	if err != nil {
+		return nil, err
+	}
+
+	now := nowFrom(ctx)
+	if err := db.Update(ctx, func(tx *lemon.Tx) error {
+		for i := range bp {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			if err := patchDocument(tx, i, bp[i], s, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	le.committed(dbName, s, bp.keys())
+
+	return &ExecResult{
+		RowsAffected: uint64(len(bp)),
+	}, nil
+}
+
+func patchDocument(tx *lemon.Tx, i int, p Patch, s *settings, now time.Time) error {
+	stored, err := tx.Get(p.Key)
+	if err != nil {
+		if errors.Is(err, lemon.ErrKeyDoesNotExist) {
+			return errors.Wrapf(ErrDocumentNotFound, "key %s", p.Key)
+		}
+
+		return errors.Wrap(ErrEngineFailed, err.Error())
+	}
+
+	revision, err := nextRevision(tx, stored, p.Key, p.ExpectedRevision)
+	if err != nil {
+		return err
+	}
+
+	d, err := s.decode(stored)
+	if err != nil {
+		return err
+	}
+
+	contentType := contentTypeOf(d)
+	if !IsJSONContentType(contentType) {
+		return errors.Wrapf(ErrNotJSONDocument, "key %s has content type %s", p.Key, contentType)
+	}
+
+	var patched []byte
+	if p.MergePatch != nil {
+		patched, err = jsondoc.MergePatch(d.Value(), p.MergePatch)
+	} else {
+		patched, err = jsondoc.ApplyPatch(d.Value(), p.JSONPatch)
+	}
+
+	if err != nil {
+		return &FieldError{
+			Field:       fmt.Sprintf("stmt[%d].patch", i),
+			Description: err.Error(),
+			Err:         err,
+		}
+	}
+
+	if s.schema != nil {
+		if violations := s.schema.checkValue(i, patched, contentType); violations != nil {
+			return &SchemaError{Violations: violations}
+		}
+	}
+
+	// tags include the content type system tag and are kept as they are
+	m := make(lemon.M, len(d.Tags()))
+	for name, v := range d.Tags() {
+		m[name] = v
+	}
+
+	ct := lemon.String
+	if d.IsBytes() {
+		ct = lemon.Bytes
+	}
+
+	value, err := s.encodeRaw(p.Key, patched, ct, m)
+	if err != nil {
+		return err
+	}
+
+	appliers := []lemon.MetaApplier{m, s.writeStamp(now), revision}
+	if d.HasTimestamps() {
+		appliers = append(appliers, lemon.WithTimestamps())
+	}
+
+	if s.options.History.enabled() {
+		if err := s.saveVersion(tx, stored, now, false); err != nil {
+			return err
+		}
+	}
+
+	return tx.InsertOrReplace(p.Key, value, appliers...)
 }
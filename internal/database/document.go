@@ -0,0 +1,93 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/denismitr/lemon"
+)
+
+// Document is a lemon document as it was written by the client,
+// with storage details like compression already undone
+type Document struct {
+	key           string
+	value         []byte
+	contentType   lemon.ContentTypeIdentifier
+	tags          lemon.M
+	createdAt     time.Time
+	updatedAt     time.Time
+	hasTimestamps bool
+}
+
+func newDocument(d *lemon.Document) *Document {
+	tags := make(lemon.M, len(d.Tags()))
+	for name, v := range d.Tags() {
+		tags[name] = v
+	}
+
+	// system documents like versions are read as the user document they belong to
+	key := d.Key()
+	if k, ok := tags[keyTag].(string); ok {
+		key = k
+	}
+
+	return &Document{
+		key:           key,
+		value:         d.Value(),
+		contentType:   d.ContentType(),
+		tags:          tags,
+		createdAt:     d.CreatedAt(),
+		updatedAt:     d.UpdatedAt(),
+		hasTimestamps: d.HasTimestamps(),
+	}
+}
+
+func (d *Document) Key() string {
+	return d.key
+}
+
+func (d *Document) Value() []byte {
+	return d.value
+}
+
+// ValueSize is the size of the value as written by the client
+func (d *Document) ValueSize() int {
+	return len(d.value)
+}
+
+// ContentHash is the hex encoded sha256 of the value as written by the client
+func (d *Document) ContentHash() string {
+	sum := sha256.Sum256(d.value)
+	return hex.EncodeToString(sum[:])
+}
+
+func (d *Document) RawString() string {
+	return string(d.value)
+}
+
+// ContentType is the lemon value type, see contentTypeOf for the one given by the client
+func (d *Document) ContentType() lemon.ContentTypeIdentifier {
+	return d.contentType
+}
+
+func (d *Document) IsBytes() bool {
+	return d.contentType == lemon.Bytes
+}
+
+// Tags returns user tags together with system tags
+func (d *Document) Tags() lemon.M {
+	return d.tags
+}
+
+func (d *Document) CreatedAt() time.Time {
+	return d.createdAt
+}
+
+func (d *Document) UpdatedAt() time.Time {
+	return d.updatedAt
+}
+
+func (d *Document) HasTimestamps() bool {
+	return d.hasTimestamps
+}
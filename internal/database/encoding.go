@@ -0,0 +1,308 @@
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+
+	"github.com/denismitr/lemon"
+	"github.com/pkg/errors"
+)
+
+// system tags recording how a value and its tags were transformed for storage
+const (
+	// plainTypeTag is the lemon type of a value before it was compressed or encrypted
+	plainTypeTag = SystemTagPrefix + "plain_type"
+	// dekTag is the version of the data key a value is encrypted with
+	dekTag = SystemTagPrefix + "dek"
+	// tagsDEKTag is the version of the data key user tag values are encrypted with
+	tagsDEKTag = SystemTagPrefix + "tags_dek"
+)
+
+// settings are everything the engine needs to know about a database to write and read its documents
+type settings struct {
+	schema  *Schema
+	options *Options
+	keys    *keyring
+	indexes []Index
+}
+
+func (s *settings) encryptsValues() bool {
+	return s.options.Encryption.KeyID != ""
+}
+
+func (s *settings) encryptsTags() bool {
+	return s.encryptsValues() && s.options.Encryption.Tags
+}
+
+// encode returns the value to store together with its lemon meta
+func (s *settings) encode(
+	key string,
+	value interface{},
+	contentType string,
+	tags []Tag,
+	timestamps bool,
+) (interface{}, []lemon.MetaApplier, error) {
+	m := createMeta(value, contentType, tags)
+
+	raw, ct, err := serializeValue(value)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stored, err := s.encodeRaw(key, raw, ct, m)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	appliers := []lemon.MetaApplier{m}
+	if timestamps {
+		appliers = append(appliers, lemon.WithTimestamps())
+	}
+
+	return stored, appliers, nil
+}
+
+// encodeRaw compresses and encrypts a serialized value as the database options say,
+// m holds the user and system tags of the document and gets the storage system tags
+func (s *settings) encodeRaw(key string, raw []byte, ct lemon.ContentTypeIdentifier, m lemon.M) (interface{}, error) {
+	stored := raw
+	transformed := false
+
+	c := s.options.Compression
+	if c.Codec != NoCodec && (ct == lemon.String || ct == lemon.Bytes) && len(raw) >= c.Threshold {
+		compressed, err := c.Codec.compress(raw)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not compress value with %s", c.Codec)
+		}
+
+		if len(compressed) < len(raw) {
+			stored = compressed
+			m[codecTag] = string(c.Codec)
+			transformed = true
+		}
+	}
+
+	if s.encryptsValues() {
+		sealed, err := seal(s.keys.activeKey(), stored, []byte(key))
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not encrypt value of %s", key)
+		}
+
+		stored = sealed
+		m[dekTag] = s.keys.active
+		transformed = true
+	}
+
+	if s.encryptsTags() {
+		if err := s.encryptTags(key, m); err != nil {
+			return nil, err
+		}
+	}
+
+	if !transformed {
+		return lemonValue(raw, ct)
+	}
+
+	m[plainTypeTag] = string(ct)
+	m[rawSizeTag] = len(raw)
+
+	return stored, nil
+}
+
+// encryptTags replaces user tag values with sealed strings carrying their type
+func (s *settings) encryptTags(key string, m lemon.M) error {
+	for name, v := range m {
+		if isSystemTag(name) {
+			continue
+		}
+
+		var plain string
+		switch typed := v.(type) {
+		case int:
+			plain = "i:" + strconv.Itoa(typed)
+		case float64:
+			plain = "f:" + strconv.FormatFloat(typed, 'g', -1, 64)
+		case bool:
+			plain = "b:" + strconv.FormatBool(typed)
+		case string:
+			plain = "s:" + typed
+		default:
+			return errors.Wrapf(ErrInvalidTagValue, "tag %s has unsupported type %T", name, v)
+		}
+
+		sealed, err := seal(s.keys.activeKey(), []byte(plain), tagAdditionalData(key, name))
+		if err != nil {
+			return errors.Wrapf(err, "could not encrypt tag %s of %s", name, key)
+		}
+
+		m[name] = base64.StdEncoding.EncodeToString(sealed)
+	}
+
+	m[tagsDEKTag] = s.keys.active
+
+	return nil
+}
+
+// decode undoes compression and encryption of a stored document
+func (s *settings) decode(d *lemon.Document) (*Document, error) {
+	doc := newDocument(d)
+
+	if version := doc.tags.Int(tagsDEKTag); version > 0 {
+		dek, err := s.dataKey(doc.key, version)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := decryptTags(dek, doc); err != nil {
+			return nil, err
+		}
+	}
+
+	if version := doc.tags.Int(dekTag); version > 0 {
+		dek, err := s.dataKey(doc.key, version)
+		if err != nil {
+			return nil, err
+		}
+
+		if doc.value, err = open(dek, doc.value, []byte(doc.key)); err != nil {
+			return nil, errors.Wrapf(ErrInvalidDocumentValue, "could not decrypt document %s: %s", doc.key, err)
+		}
+	}
+
+	if codec, ok := doc.tags[codecTag].(string); ok {
+		raw, err := Codec(codec).decompress(doc.value)
+		if err != nil {
+			return nil, errors.Wrapf(ErrInvalidDocumentValue, "could not decompress document %s: %s", doc.key, err)
+		}
+
+		doc.value = raw
+	}
+
+	if ct, ok := doc.tags[plainTypeTag].(string); ok {
+		doc.contentType = lemon.ContentTypeIdentifier(ct)
+	}
+
+	for _, name := range []string{codecTag, rawSizeTag, plainTypeTag, dekTag, tagsDEKTag} {
+		delete(doc.tags, name)
+	}
+
+	return doc, nil
+}
+
+// stale reports whether a stored document is not encrypted the way the options say
+func (s *settings) stale(d *lemon.Document) bool {
+	var valueVersion, tagsVersion int
+	if s.encryptsValues() {
+		valueVersion = s.keys.active
+	}
+
+	if s.encryptsTags() {
+		tagsVersion = s.keys.active
+	}
+
+	return d.Tags().Int(dekTag) != valueVersion || d.Tags().Int(tagsDEKTag) != tagsVersion
+}
+
+func (s *settings) dataKey(key string, version int) ([]byte, error) {
+	if s.keys != nil {
+		if dek, ok := s.keys.deks[version]; ok {
+			return dek, nil
+		}
+	}
+
+	return nil, errors.Wrapf(
+		ErrEncryptionKeyMissing,
+		"document %s is encrypted with data key version %d, which is not in the keys file",
+		key, version,
+	)
+}
+
+func decryptTags(dek []byte, doc *Document) error {
+	for name, v := range doc.tags {
+		if isSystemTag(name) {
+			continue
+		}
+
+		sealed, err := base64.StdEncoding.DecodeString(doc.tags.String(name))
+		if err != nil {
+			return errors.Wrapf(ErrInvalidTagValue, "encrypted tag %s of %s is not base64: %v", name, doc.key, v)
+		}
+
+		plain, err := open(dek, sealed, tagAdditionalData(doc.key, name))
+		if err != nil || len(plain) < 2 {
+			return errors.Wrapf(ErrInvalidTagValue, "could not decrypt tag %s of %s", name, doc.key)
+		}
+
+		text := string(plain[2:])
+		switch string(plain[:2]) {
+		case "i:":
+			doc.tags[name], err = strconv.Atoi(text)
+		case "f:":
+			doc.tags[name], err = strconv.ParseFloat(text, 64)
+		case "b:":
+			doc.tags[name], err = strconv.ParseBool(text)
+		case "s:":
+			doc.tags[name] = text
+		default:
+			err = errors.Errorf("unknown type prefix %q", plain[:2])
+		}
+
+		if err != nil {
+			return errors.Wrapf(ErrInvalidTagValue, "encrypted tag %s of %s: %s", name, doc.key, err)
+		}
+	}
+
+	return nil
+}
+
+// tagAdditionalData binds a sealed tag value to its document and name,
+// so that it cannot be moved to another tag unnoticed
+func tagAdditionalData(key, name string) []byte {
+	return []byte(key + "\x00" + name)
+}
+
+// serializeValue serializes a value the way lemon does
+func serializeValue(value interface{}) ([]byte, lemon.ContentTypeIdentifier, error) {
+	switch typed := value.(type) {
+	case []byte:
+		return typed, lemon.Bytes, nil
+	case int:
+		return []byte(strconv.Itoa(typed)), lemon.Integer, nil
+	case string:
+		return []byte(typed), lemon.String, nil
+	}
+
+	b, err := json.Marshal(value)
+	if err != nil {
+		return nil, "", errors.Wrapf(ErrInvalidDocumentValue, "could not marshal value: %s", err)
+	}
+
+	return b, lemon.JSON, nil
+}
+
+// lemonValue turns a serialized value back into one lemon stores with the given type
+func lemonValue(raw []byte, ct lemon.ContentTypeIdentifier) (interface{}, error) {
+	switch ct {
+	case lemon.String:
+		return string(raw), nil
+	case lemon.Integer:
+		n, err := strconv.Atoi(string(raw))
+		if err != nil {
+			return nil, errors.Wrapf(ErrInvalidDocumentValue, "%s is not an int", raw)
+		}
+		return n, nil
+	case lemon.JSON:
+		return json.RawMessage(raw), nil
+	default:
+		return raw, nil
+	}
+}
+
+// preservedTimestamps keeps the timestamps of a document that is rewritten without being changed
+func preservedTimestamps(d *Document) lemon.MetaApplier {
+	return lemon.M{
+		lemon.CreatedAt: int(d.CreatedAt().UnixMilli()),
+		lemon.UpdatedAt: int(d.UpdatedAt().UnixMilli()),
+	}
+}
@@ -0,0 +1,251 @@
+package database
+
+import (
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/denismitr/lemon"
+	"github.com/pkg/errors"
+)
+
+// Previous versions of a document are system documents keyed by the document key and
+// an increasing sequence number, their value and tags are copied from the replaced
+// document as they were stored, so they stay compressed and encrypted
+const historyKeyPrefix = SystemKeyPrefix + "history:"
+
+// system tags of versions
+const (
+	// keyTag is the key of the user document a system document belongs to
+	keyTag = SystemTagPrefix + "key"
+	// writtenAtTag is the time in unix nanoseconds a document was written at
+	writtenAtTag    = SystemTagPrefix + "written_at"
+	supersededAtTag = SystemTagPrefix + "superseded_at"
+	deletedTag      = SystemTagPrefix + "deleted"
+)
+
+// Version is a version of a document, the current one has a zero SupersededAt
+type Version struct {
+	*Document
+	Number       int
+	WrittenAt    time.Time
+	SupersededAt time.Time
+	// Deleted marks the last version of a document that was deleted
+	Deleted bool
+}
+
+// historyPrefix returns the key prefix of all versions of a document, keys are
+// encoded, since they may contain the : lemon uses to split keys into segments
+func historyPrefix(key string) string {
+	return historyKeyPrefix + base64.RawURLEncoding.EncodeToString([]byte(key)) + ":"
+}
+
+// writeStamp records the write time of a document when the database keeps history
+func (s *settings) writeStamp(now time.Time) lemon.M {
+	if !s.options.History.enabled() {
+		return lemon.M{}
+	}
+
+	return lemon.M{writtenAtTag: int(now.UnixNano())}
+}
+
+type storedVersion struct {
+	key    string
+	number int
+	d      *lemon.Document
+}
+
+// storedVersions returns the versions of a document, oldest first
+func storedVersions(tx *lemon.Tx, key string) ([]storedVersion, error) {
+	prefix := historyPrefix(key)
+
+	var versions []storedVersion
+	if err := scanPrefix(tx, prefix, func(d *lemon.Document) bool {
+		n, err := strconv.Atoi(strings.TrimPrefix(d.Key(), prefix))
+		if err == nil {
+			versions = append(versions, storedVersion{key: d.Key(), number: n, d: d})
+		}
+		return true
+	}); err != nil {
+		return nil, errors.Wrap(ErrEngineFailed, err.Error())
+	}
+
+	return versions, nil
+}
+
+// saveVersion keeps the stored document as its previous version, before it gets replaced
+// or deleted, and drops the versions the history options do not keep anymore
+func (s *settings) saveVersion(tx *lemon.Tx, stored *lemon.Document, now time.Time, deleted bool) error {
+	versions, err := storedVersions(tx, stored.Key())
+	if err != nil {
+		return err
+	}
+
+	number := 1
+	if len(versions) > 0 {
+		number = versions[len(versions)-1].number + 1
+	}
+
+	m := make(lemon.M, len(stored.Tags())+4)
+	for name, v := range stored.Tags() {
+		m[name] = v
+	}
+
+	m[keyTag] = stored.Key()
+	m[supersededAtTag] = int(now.UnixNano())
+	if deleted {
+		m[deletedTag] = true
+	}
+
+	// the value is copied as bytes, so its lemon type has to be kept aside
+	if _, ok := m[plainTypeTag]; !ok {
+		m[plainTypeTag] = string(stored.ContentType())
+	}
+
+	appliers := []lemon.MetaApplier{m}
+	if stored.HasTimestamps() {
+		appliers = append(appliers, lemon.M{
+			lemon.CreatedAt: int(stored.CreatedAt().UnixMilli()),
+			lemon.UpdatedAt: int(stored.UpdatedAt().UnixMilli()),
+		})
+	}
+
+	versionKey := historyPrefix(stored.Key()) + strconv.Itoa(number)
+	if err := tx.Insert(versionKey, stored.Value(), appliers...); err != nil {
+		return err
+	}
+
+	versions = append(versions, storedVersion{key: versionKey, number: number})
+
+	return s.pruneVersions(tx, versions, now)
+}
+
+func (s *settings) pruneVersions(tx *lemon.Tx, versions []storedVersion, now time.Time) error {
+	h := s.options.History
+	for i, v := range versions {
+		expired := h.MaxVersions > 0 && len(versions)-i > h.MaxVersions
+		if !expired && h.Retention > 0 && v.d != nil {
+			expired = now.Sub(time.Unix(0, int64(v.d.Tags().Int(supersededAtTag)))) > h.Retention
+		}
+
+		if !expired {
+			continue
+		}
+
+		if err := tx.Remove(v.key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// history returns the current version of a document followed by the kept versions, newest first
+func (s *settings) history(tx *lemon.Tx, key string, limit int) ([]*Version, error) {
+	versions, err := storedVersions(tx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*Version
+
+	current, err := tx.Get(key)
+	if err != nil && !errors.Is(err, lemon.ErrKeyDoesNotExist) {
+		return nil, errors.Wrap(ErrEngineFailed, err.Error())
+	}
+
+	if current != nil {
+		number := 1
+		if len(versions) > 0 {
+			number = versions[len(versions)-1].number + 1
+		}
+
+		v, err := s.version(current, number)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, v)
+	}
+
+	now := time.Now()
+	for i := len(versions) - 1; i >= 0; i-- {
+		if limit > 0 && len(result) >= limit {
+			break
+		}
+
+		supersededAt := time.Unix(0, int64(versions[i].d.Tags().Int(supersededAtTag)))
+		if r := s.options.History.Retention; r > 0 && now.Sub(supersededAt) > r {
+			break
+		}
+
+		v, err := s.version(versions[i].d, versions[i].number)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, v)
+	}
+
+	return result, nil
+}
+
+// versionAt returns the version of a document that was current at the given time, nil when there was none
+func (s *settings) versionAt(tx *lemon.Tx, key string, at time.Time) (*Document, error) {
+	versions, err := storedVersions(tx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidate *lemon.Document
+	for _, v := range versions {
+		if time.Unix(0, int64(v.d.Tags().Int(supersededAtTag))).After(at) {
+			candidate = v.d
+			break
+		}
+	}
+
+	if candidate == nil {
+		current, err := tx.Get(key)
+		if errors.Is(err, lemon.ErrKeyDoesNotExist) {
+			return nil, nil
+		}
+
+		if err != nil {
+			return nil, errors.Wrap(ErrEngineFailed, err.Error())
+		}
+
+		candidate = current
+	}
+
+	// versions written without history enabled are taken to be as old as it gets
+	if writtenAt := candidate.Tags().Int(writtenAtTag); writtenAt > 0 && time.Unix(0, int64(writtenAt)).After(at) {
+		return nil, nil
+	}
+
+	return s.decode(candidate)
+}
+
+func (s *settings) version(d *lemon.Document, number int) (*Version, error) {
+	doc, err := s.decode(d)
+	if err != nil {
+		return nil, err
+	}
+
+	v := Version{
+		Document: doc,
+		Number:   number,
+		Deleted:  doc.tags.Bool(deletedTag),
+	}
+
+	if n := doc.tags.Int(writtenAtTag); n > 0 {
+		v.WrittenAt = time.Unix(0, int64(n))
+	}
+
+	if n := doc.tags.Int(supersededAtTag); n > 0 {
+		v.SupersededAt = time.Unix(0, int64(n))
+	}
+
+	return &v, nil
+}
@@ -0,0 +1,117 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/denismitr/lemon"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_history(t *testing.T) {
+	db, closer, err := lemon.Open(lemon.InMemory)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = closer() })
+
+	s := &settings{options: &Options{History: HistoryOptions{MaxVersions: 2}}}
+	start := time.Date(2021, 11, 5, 10, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time { return start.Add(time.Duration(minutes) * time.Minute) }
+
+	upsert := func(key string, value interface{}, now time.Time) {
+		t.Helper()
+		require.NoError(t, db.Update(context.Background(), func(tx *lemon.Tx) error {
+			stored, appliers, err := s.encode(key, value, "", []Tag{{Name: "n", Value: 1}}, false)
+			if err != nil {
+				return err
+			}
+
+			if err := saveVersionOf(tx, s, key, now, false); err != nil {
+				return err
+			}
+
+			return tx.InsertOrReplace(key, stored, append(appliers, s.writeStamp(now))...)
+		}))
+	}
+
+	// the key holds the : lemon splits keys by, versions of foo must not mix with it
+	upsert("foo:1", "other", at(0))
+	upsert("foo", "v1", at(0))
+	upsert("foo", 2, at(10))
+	upsert("foo", "v3", at(20))
+	upsert("foo", []byte("v4"), at(30))
+
+	require.NoError(t, db.Update(context.Background(), func(tx *lemon.Tx) error {
+		if err := saveVersionOf(tx, s, "foo", at(40), true); err != nil {
+			return err
+		}
+		return tx.Remove("foo")
+	}))
+
+	require.NoError(t, db.View(context.Background(), func(tx *lemon.Tx) error {
+		versions, err := s.history(tx, "foo", 0)
+		require.NoError(t, err)
+
+		// only two versions are kept and the document itself is gone
+		require.Len(t, versions, 2)
+		assert.Equal(t, 4, versions[0].Number)
+		assert.Equal(t, []byte("v4"), versions[0].Value())
+		assert.Equal(t, lemon.Bytes, versions[0].ContentType())
+		assert.True(t, versions[0].Deleted)
+		assert.Equal(t, at(30), versions[0].WrittenAt.UTC())
+		assert.Equal(t, at(40), versions[0].SupersededAt.UTC())
+		assert.Equal(t, "v3", versions[1].RawString())
+		assert.Equal(t, lemon.String, versions[1].ContentType())
+		assert.Equal(t, "foo", versions[1].Key())
+		assert.Equal(t, 1, versions[1].Tags()["n"])
+
+		limited, err := s.history(tx, "foo", 1)
+		require.NoError(t, err)
+		assert.Len(t, limited, 1)
+
+		tt := []struct {
+			at       time.Time
+			expected string
+		}{
+			{at: at(25), expected: "v3"},
+			{at: at(35), expected: "v4"},
+			{at: at(45)},
+			// the version current then is not kept anymore
+			{at: at(15)},
+		}
+
+		for _, tc := range tt {
+			d, err := s.versionAt(tx, "foo", tc.at)
+			require.NoError(t, err)
+			if tc.expected == "" {
+				assert.Nil(t, d, "at %s", tc.at)
+			} else {
+				require.NotNil(t, d, "at %s", tc.at)
+				assert.Equal(t, tc.expected, d.RawString())
+			}
+		}
+
+		other, err := s.history(tx, "foo:1", 0)
+		require.NoError(t, err)
+		require.Len(t, other, 1)
+		assert.Equal(t, "other", other[0].RawString())
+		assert.True(t, other[0].SupersededAt.IsZero())
+
+		n, err := countUser(tx)
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+
+		return nil
+	}))
+}
+
+// saveVersionOf keeps the current version of a document when there is one
+func saveVersionOf(tx *lemon.Tx, s *settings, key string, now time.Time, deleted bool) error {
+	stored, err := getStored(tx, key)
+	if err != nil || stored == nil {
+		return err
+	}
+
+	return s.saveVersion(tx, stored, now, deleted)
+}
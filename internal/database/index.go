@@ -0,0 +1,335 @@
+package database
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/denismitr/lemon"
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidIndexes = errors.New("invalid database indexes")
+
+const indexesExt = ".indexes.json"
+
+// indexBatchSize is the number of documents indexed in one transaction while building indexes
+const indexBatchSize = 500
+
+// Index entries are system documents keyed by the indexed tag, the tag value encoded so
+// that keys sort in value order, and the document key, e.g. @index:t<tag>:i<value>:k<key>.
+// Segments carry a type letter, so that lemon never compares them as integers.
+const indexKeyPrefix = SystemKeyPrefix + "index:"
+
+// Index is a secondary index on the values of a tag, it is used by queries once it is Ready
+type Index struct {
+	Tag   string `json:"tag"`
+	Ready bool   `json:"ready"`
+}
+
+// IndexStats describe an index of a database
+type IndexStats struct {
+	Tag     string
+	Ready   bool
+	Entries uint64
+}
+
+// validateIndexes checks the tags indexes are declared on
+func validateIndexes(tags []string) error {
+	seen := make(map[string]bool, len(tags))
+	for i, tag := range tags {
+		field := fmt.Sprintf("indexes[%d].tag", i)
+		switch {
+		case tag == "":
+			return &FieldError{Field: field, Description: "tag name may not be empty", Err: ErrInvalidIndexes}
+		case isSystemTag(tag):
+			return &FieldError{Field: field, Description: "tag name may not start with " + SystemTagPrefix, Err: ErrInvalidIndexes}
+		case seen[tag]:
+			return &FieldError{Field: field, Description: "tag " + tag + " is indexed twice", Err: ErrInvalidIndexes}
+		}
+		seen[tag] = true
+	}
+
+	return nil
+}
+
+func indexTagSegment(tag string) string {
+	return "t" + base64.RawURLEncoding.EncodeToString([]byte(tag))
+}
+
+// indexPrefix returns the key prefix of all entries of the index on tag
+func indexPrefix(tag string) string {
+	return indexKeyPrefix + indexTagSegment(tag) + ":"
+}
+
+func indexKey(tag, value, key string) string {
+	return indexPrefix(tag) + value + ":k" + base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+// indexValue encodes a tag value so that encoded values of the same type
+// sort like the values, and values of different types never mix
+func indexValue(v interface{}) (string, bool) {
+	var b [8]byte
+	switch typed := v.(type) {
+	case int:
+		binary.BigEndian.PutUint64(b[:], uint64(typed)^(1<<63))
+		return "i" + hex.EncodeToString(b[:]), true
+	case float64:
+		bits := math.Float64bits(typed)
+		if bits&(1<<63) != 0 {
+			bits = ^bits
+		} else {
+			bits |= 1 << 63
+		}
+		binary.BigEndian.PutUint64(b[:], bits)
+		return "f" + hex.EncodeToString(b[:]), true
+	case string:
+		return "s" + hex.EncodeToString([]byte(typed)), true
+	case bool:
+		return "b" + strconv.FormatBool(typed), true
+	default:
+		return "", false
+	}
+}
+
+// indexedValue returns the encoded value of a tag of a stored document
+func indexedValue(d *lemon.Document, tag string) (string, bool) {
+	if d == nil {
+		return "", false
+	}
+
+	v, ok := d.Tags()[tag]
+	if !ok {
+		return "", false
+	}
+
+	return indexValue(v)
+}
+
+// updateIndexes replaces the index entries of a document after it was written or removed,
+// before is the document as it was stored before, nil when there was none
+func (s *settings) updateIndexes(tx *lemon.Tx, key string, before *lemon.Document) error {
+	if len(s.indexes) == 0 {
+		return nil
+	}
+
+	after, err := getStored(tx, key)
+	if err != nil {
+		return err
+	}
+
+	for _, idx := range s.indexes {
+		prev, hadPrev := indexedValue(before, idx.Tag)
+		next, hasNext := indexedValue(after, idx.Tag)
+		if hadPrev && hasNext && prev == next {
+			continue
+		}
+
+		// entries may be missing while an index is still being built
+		if hadPrev && tx.Has(indexKey(idx.Tag, prev, key)) {
+			if err := tx.Remove(indexKey(idx.Tag, prev, key)); err != nil {
+				return err
+			}
+		}
+
+		if hasNext {
+			if err := tx.InsertOrReplace(indexKey(idx.Tag, next, key), key); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// indexDocument adds the entries of a stored document to the given indexes
+func indexDocument(tx *lemon.Tx, d *lemon.Document, indexes []Index) error {
+	for _, idx := range indexes {
+		if v, ok := indexedValue(d, idx.Tag); ok {
+			if err := tx.InsertOrReplace(indexKey(idx.Tag, v, d.Key()), d.Key()); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// indexEntryTag returns the tag segment of an index entry key
+func indexEntryTag(key string) string {
+	segment := strings.TrimPrefix(key, indexKeyPrefix)
+	if i := strings.Index(segment, ":"); i >= 0 {
+		return segment[:i]
+	}
+
+	return segment
+}
+
+// indexBounds limit the encoded values an index scan visits, empty bounds are open
+type indexBounds struct {
+	tag          string
+	typ          byte
+	lower, upper string
+	lowerExcl    bool
+	upperExcl    bool
+}
+
+// scanIndex returns the keys of documents whose indexed tag value is within bounds, in value order
+func scanIndex(tx *lemon.Tx, b indexBounds) ([]string, error) {
+	prefix := indexPrefix(b.tag)
+	from := prefix + string(b.typ)
+	if b.lower != "" {
+		from = prefix + b.lower
+	}
+
+	var keys []string
+	if err := tx.Scan(lemon.Q().Prefix(from), func(d *lemon.Document) bool {
+		if !strings.HasPrefix(d.Key(), prefix) {
+			return false
+		}
+
+		value := strings.TrimPrefix(d.Key(), prefix)
+		if i := strings.LastIndex(value, ":"); i >= 0 {
+			value = value[:i]
+		}
+
+		// the scan starts within the values of the type, so another type means it is past them
+		if value == "" || value[0] != b.typ {
+			return false
+		}
+
+		if b.lower != "" && (value < b.lower || (b.lowerExcl && value == b.lower)) {
+			return true
+		}
+
+		if b.upper != "" && (value > b.upper || (b.upperExcl && value == b.upper)) {
+			return false
+		}
+
+		keys = append(keys, d.RawString())
+		return true
+	}); err != nil {
+		return nil, errors.Wrap(ErrEngineFailed, err.Error())
+	}
+
+	return keys, nil
+}
+
+// indexRegistry keeps the indexes declared on databases in files next to the database files
+type indexRegistry struct {
+	dir     string
+	indexes map[string][]Index
+	mu      sync.RWMutex
+}
+
+func newIndexRegistry(dir string) *indexRegistry {
+	return &indexRegistry{
+		dir:     dir,
+		indexes: make(map[string][]Index),
+	}
+}
+
+// reset forgets what has been read, so that it is read again from the sidecar files
+func (r *indexRegistry) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.indexes = make(map[string][]Index)
+}
+
+// get returns the indexes of a database
+func (r *indexRegistry) get(dbName string) ([]Index, error) {
+	r.mu.RLock()
+	indexes, ok := r.indexes[dbName]
+	r.mu.RUnlock()
+	if ok {
+		return indexes, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if indexes, ok := r.indexes[dbName]; ok {
+		return indexes, nil
+	}
+
+	path, err := sidecarPath(r.dir, dbName, indexesExt)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := readSidecar(path, &indexes); err != nil {
+		return nil, err
+	}
+
+	r.indexes[dbName] = indexes
+
+	return indexes, nil
+}
+
+// set declares the indexes of a database, indexes that were declared before stay ready
+func (r *indexRegistry) set(dbName string, tags []string) ([]Index, error) {
+	current, err := r.get(dbName)
+	if err != nil {
+		return nil, err
+	}
+
+	ready := make(map[string]bool, len(current))
+	for _, idx := range current {
+		ready[idx.Tag] = idx.Ready
+	}
+
+	indexes := make([]Index, len(tags))
+	for i, tag := range tags {
+		indexes[i] = Index{Tag: tag, Ready: ready[tag]}
+	}
+
+	return indexes, r.store(dbName, indexes)
+}
+
+// markReady marks indexes as ready unless they were dropped in the meantime
+func (r *indexRegistry) markReady(dbName string, built []Index) error {
+	current, err := r.get(dbName)
+	if err != nil {
+		return err
+	}
+
+	indexes := make([]Index, len(current))
+	copy(indexes, current)
+	for i := range indexes {
+		for _, b := range built {
+			if indexes[i].Tag == b.Tag {
+				indexes[i].Ready = true
+			}
+		}
+	}
+
+	return r.store(dbName, indexes)
+}
+
+func (r *indexRegistry) store(dbName string, indexes []Index) error {
+	path, err := sidecarPath(r.dir, dbName, indexesExt)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(indexes) == 0 {
+		err = removeSidecar(path)
+	} else {
+		err = writeSidecar(path, indexes)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	r.indexes[dbName] = indexes
+
+	return nil
+}
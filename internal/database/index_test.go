@@ -0,0 +1,144 @@
+package database
+
+import (
+	"context"
+	"math"
+	"sort"
+	"testing"
+
+	"github.com/denismitr/lemon"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_indexValue_Order(t *testing.T) {
+	tt := []struct {
+		name   string
+		values []interface{}
+	}{
+		{name: "ints", values: []interface{}{math.MinInt64, -100, -1, 0, 1, 9, 10, math.MaxInt64}},
+		{name: "floats", values: []interface{}{math.Inf(-1), -2.5, -0.5, 0.0, 0.25, 1.0, 1e10, math.Inf(1)}},
+		{name: "strings", values: []interface{}{"", "a", "ab", "b", "ba", "z"}},
+		{name: "bools", values: []interface{}{false, true}},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			encoded := make([]string, len(tc.values))
+			for i, v := range tc.values {
+				var ok bool
+				encoded[i], ok = indexValue(v)
+				require.True(t, ok)
+			}
+
+			assert.True(t, sort.StringsAreSorted(encoded), "%v", encoded)
+		})
+	}
+}
+
+func Test_find(t *testing.T) {
+	db, closer, err := lemon.Open(lemon.InMemory)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = closer() })
+
+	s := &settings{options: &Options{}, indexes: []Index{{Tag: "age", Ready: true}, {Tag: "city", Ready: true}}}
+	write := func(key string, tags []Tag) {
+		t.Helper()
+		require.NoError(t, db.Update(context.Background(), func(tx *lemon.Tx) error {
+			stored, err := getStored(tx, key)
+			if err != nil {
+				return err
+			}
+
+			value, appliers, err := s.encode(key, key, "", tags, false)
+			if err != nil {
+				return err
+			}
+
+			if err := tx.InsertOrReplace(key, value, appliers...); err != nil {
+				return err
+			}
+
+			return s.updateIndexes(tx, key, stored)
+		}))
+	}
+
+	write("u:1", []Tag{{Name: "age", Value: 17}, {Name: "city", Value: "Oslo"}})
+	write("u:2", []Tag{{Name: "age", Value: 30}, {Name: "city", Value: "Rome"}})
+	write("u:3", []Tag{{Name: "age", Value: 18}, {Name: "city", Value: "Oslo"}})
+	write("u:4", []Tag{{Name: "score", Value: 45.5}})
+	write("v:1", []Tag{{Name: "age", Value: 40}})
+	// moving u:2 out of Rome has to remove its entry from the city index
+	write("u:2", []Tag{{Name: "age", Value: 30}, {Name: "city", Value: "Oslo"}})
+
+	tt := []struct {
+		name     string
+		q        TagQuery
+		expected []string
+	}{
+		{
+			name:     "equality",
+			q:        TagQuery{Tags: []TagPredicate{{Name: "city", Op: TagEq, Value: "Oslo"}}},
+			expected: []string{"u:1", "u:2", "u:3"},
+		},
+		{
+			name:     "replaced value",
+			q:        TagQuery{Tags: []TagPredicate{{Name: "city", Op: TagEq, Value: "Rome"}}},
+			expected: nil,
+		},
+		{
+			name: "range in value order",
+			q: TagQuery{Tags: []TagPredicate{
+				{Name: "age", Op: TagGte, Value: 18},
+				{Name: "age", Op: TagLt, Value: 40},
+			}},
+			expected: []string{"u:2", "u:3"},
+		},
+		{
+			name: "open range with key prefix",
+			q: TagQuery{KeyPrefix: "u:", Tags: []TagPredicate{
+				{Name: "age", Op: TagGt, Value: 17},
+			}},
+			expected: []string{"u:2", "u:3"},
+		},
+		{
+			name:     "not indexed",
+			q:        TagQuery{Tags: []TagPredicate{{Name: "score", Op: TagLte, Value: 45.5}}},
+			expected: []string{"u:4"},
+		},
+		{
+			name: "equality preferred and other predicates filtered",
+			q: TagQuery{Limit: 1, Tags: []TagPredicate{
+				{Name: "age", Op: TagGt, Value: 17},
+				{Name: "city", Op: TagEq, Value: "Oslo"},
+			}},
+			expected: []string{"u:2"},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			require.NoError(t, tc.q.Validate())
+
+			// documents come in key order whether an index serves the query or not
+			for _, ready := range []bool{true, false} {
+				indexed := *s
+				indexed.indexes = []Index{{Tag: "age", Ready: ready}, {Tag: "city", Ready: ready}}
+
+				plan, err := indexed.planQuery(tc.q.statement("test"))
+				require.NoError(t, err)
+
+				var keys []string
+				require.NoError(t, db.View(context.Background(), func(tx *lemon.Tx) error {
+					documents, err := indexed.query(context.Background(), tx, plan, Page{})
+					for _, d := range documents {
+						keys = append(keys, d.Key())
+					}
+					return err
+				}))
+
+				assert.Equal(t, tc.expected, keys)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package database
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+const DefaultMaxKeyLength = 255
+
+// DuplicatePolicy tells what to do with a key repeated within one upsert batch
+type DuplicatePolicy string
+
+const (
+	RejectDuplicates DuplicatePolicy = "reject"
+	LastWins         DuplicatePolicy = "last-wins"
+)
+
+// KeyViolation describes an invalid key and its location in the request
+type KeyViolation struct {
+	Field       string
+	Description string
+}
+
+// KeyError holds all key violations found in a request
+type KeyError struct {
+	Violations []KeyViolation
+}
+
+func (e *KeyError) Error() string {
+	descriptions := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		descriptions[i] = v.Field + ": " + v.Description
+	}
+
+	return ErrInvalidKey.Error() + ": " + strings.Join(descriptions, "; ")
+}
+
+func (e *KeyError) Unwrap() error {
+	return ErrInvalidKey
+}
+
+// KeyValidator is the single place where keys of every read and write request are checked
+type KeyValidator struct {
+	maxLength       int
+	allowed         *regexp.Regexp
+	allowedChars    string
+	upsertDuplicate DuplicatePolicy
+}
+
+// NewKeyValidator creates a validator, allowedChars is the contents of a regex
+// character class e.g. a-zA-Z0-9:_- and when empty any printable character is allowed
+func NewKeyValidator(maxLength int, allowedChars string, upsertDuplicate DuplicatePolicy) (*KeyValidator, error) {
+	if maxLength <= 0 {
+		maxLength = DefaultMaxKeyLength
+	}
+
+	v := KeyValidator{
+		maxLength:       maxLength,
+		allowedChars:    allowedChars,
+		upsertDuplicate: upsertDuplicate,
+	}
+
+	if allowedChars != "" {
+		re, err := regexp.Compile("^[" + allowedChars + "]+$")
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid allowed key characters %s", allowedChars)
+		}
+		v.allowed = re
+	}
+
+	switch upsertDuplicate {
+	case RejectDuplicates, LastWins:
+	case "":
+		v.upsertDuplicate = RejectDuplicates
+	default:
+		return nil, errors.Errorf("unknown duplicate key policy %s", upsertDuplicate)
+	}
+
+	return &v, nil
+}
+
+func (v *KeyValidator) check(key string) string {
+	switch {
+	case len(key) == 0:
+		return "key may not be empty"
+	case len(key) > v.maxLength:
+		return fmt.Sprintf("key may not be over %d bytes", v.maxLength)
+	case !utf8.ValidString(key):
+		return "key must be valid UTF-8"
+	case isSystemKey(key):
+		return fmt.Sprintf("key may not start with %s, it is reserved", SystemKeyPrefix)
+	case v.allowed != nil && !v.allowed.MatchString(key):
+		return fmt.Sprintf("key may only contain characters [%s]", v.allowedChars)
+	case v.allowed == nil && strings.IndexFunc(key, func(r rune) bool { return !unicode.IsPrint(r) }) >= 0:
+		return "key may not contain non printable characters"
+	default:
+		return ""
+	}
+}
+
+func (v *KeyValidator) checkAll(field string, keys []string, rejectDuplicates bool) error {
+	var violations []KeyViolation
+
+	seen := make(map[string]int, len(keys))
+	for i, k := range keys {
+		if desc := v.check(k); desc != "" {
+			violations = append(violations, KeyViolation{Field: fmt.Sprintf(field, i), Description: desc})
+			continue
+		}
+
+		if first, ok := seen[k]; ok && rejectDuplicates {
+			violations = append(violations, KeyViolation{
+				Field:       fmt.Sprintf(field, i),
+				Description: fmt.Sprintf("duplicate key, already used at index %d", first),
+			})
+			continue
+		}
+
+		seen[k] = i
+	}
+
+	if violations != nil {
+		return &KeyError{Violations: violations}
+	}
+
+	return nil
+}
+
+// Patch validates patch statements, a key may only be patched once per request
+func (v *KeyValidator) Patch(bp BatchPatch) error {
+	keys := make([]string, len(bp))
+	for i := range bp {
+		keys[i] = bp[i].Key
+	}
+
+	return v.checkAll("stmt[%d].key", keys, true)
+}
+
+// Insert validates insert statements, duplicate keys are always rejected
+func (v *KeyValidator) Insert(bi BatchInsert) error {
+	keys := make([]string, len(bi))
+	for i := range bi {
+		keys[i] = bi[i].Key
+	}
+
+	return v.checkAll("stmt[%d].key", keys, true)
+}
+
+// Upsert validates upsert statements, with the last-wins policy only the last
+// statement for every repeated key is kept
+func (v *KeyValidator) Upsert(bu BatchUpsert) (BatchUpsert, error) {
+	keys := make([]string, len(bu))
+	for i := range bu {
+		keys[i] = bu[i].Key
+	}
+
+	if err := v.checkAll("stmt[%d].key", keys, v.upsertDuplicate == RejectDuplicates); err != nil {
+		return nil, err
+	}
+
+	if v.upsertDuplicate != LastWins {
+		return bu, nil
+	}
+
+	last := make(map[string]int, len(bu))
+	for i := range bu {
+		last[bu[i].Key] = i
+	}
+
+	if len(last) == len(bu) {
+		return bu, nil
+	}
+
+	deduped := make(BatchUpsert, 0, len(last))
+	for i := range bu {
+		if last[bu[i].Key] == i {
+			deduped = append(deduped, bu[i])
+		}
+	}
+
+	return deduped, nil
+}
+
+// Keys validates keys of reads and deletes, where duplicates are harmless
+func (v *KeyValidator) Keys(keys []string) error {
+	return v.checkAll("keys[%d]", keys, false)
+}
+
+// Key validates the single key of a request
+func (v *KeyValidator) Key(key string) error {
+	if desc := v.check(key); desc != "" {
+		return &KeyError{Violations: []KeyViolation{{Field: "key", Description: desc}}}
+	}
+
+	return nil
+}
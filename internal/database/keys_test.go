@@ -0,0 +1,105 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_KeyValidator_Keys(t *testing.T) {
+	v, err := NewKeyValidator(10, "a-z0-9:", RejectDuplicates)
+	require.NoError(t, err)
+
+	valid := [][]string{
+		{"foo"},
+		{"foo:1", "foo:2"},
+		{"foo", "foo"},
+	}
+
+	for i, keys := range valid {
+		t.Run(fmt.Sprintf("Valid keys test case: %d", i), func(t *testing.T) {
+			assert.NoError(t, v.Keys(keys))
+		})
+	}
+
+	invalid := []struct {
+		keys  []string
+		field string
+	}{
+		{keys: []string{""}, field: "keys[0]"},
+		{keys: []string{"foo", strings.Repeat("a", 11)}, field: "keys[1]"},
+		{keys: []string{"foo", "bar", "Foo"}, field: "keys[2]"},
+		{keys: []string{"foo bar"}, field: "keys[0]"},
+		{keys: []string{"@history"}, field: "keys[0]"},
+	}
+
+	for i, tc := range invalid {
+		t.Run(fmt.Sprintf("Invalid keys test case: %d", i), func(t *testing.T) {
+			err := v.Keys(tc.keys)
+			require.Error(t, err)
+			assert.True(t, errors.Is(err, ErrInvalidKey))
+
+			var keyErr *KeyError
+			require.True(t, errors.As(err, &keyErr))
+			require.Len(t, keyErr.Violations, 1)
+			assert.Equal(t, tc.field, keyErr.Violations[0].Field)
+		})
+	}
+}
+
+func Test_KeyValidator_MaxLength(t *testing.T) {
+	v, err := NewKeyValidator(4, "", RejectDuplicates)
+	require.NoError(t, err)
+
+	assert.NoError(t, v.Key("ää"))
+
+	err = v.Key("äää")
+	var keyErr *KeyError
+	require.True(t, errors.As(err, &keyErr))
+	require.Len(t, keyErr.Violations, 1)
+	assert.Equal(t, "key may not be over 4 bytes", keyErr.Violations[0].Description)
+}
+
+func Test_KeyValidator_Duplicates(t *testing.T) {
+	bu := BatchUpsert{
+		{Key: "a", Value: "1"},
+		{Key: "b", Value: "2"},
+		{Key: "a", Value: "3"},
+	}
+
+	t.Run("insert rejects duplicates", func(t *testing.T) {
+		v, err := NewKeyValidator(0, "", LastWins)
+		require.NoError(t, err)
+
+		err = v.Insert(BatchInsert{{Key: "a"}, {Key: "a"}})
+		var keyErr *KeyError
+		require.True(t, errors.As(err, &keyErr))
+		assert.Equal(t, "stmt[1].key", keyErr.Violations[0].Field)
+	})
+
+	t.Run("upsert rejects duplicates", func(t *testing.T) {
+		v, err := NewKeyValidator(0, "", RejectDuplicates)
+		require.NoError(t, err)
+
+		_, err = v.Upsert(bu)
+		var keyErr *KeyError
+		require.True(t, errors.As(err, &keyErr))
+		assert.Equal(t, "stmt[2].key", keyErr.Violations[0].Field)
+	})
+
+	t.Run("upsert keeps last statement", func(t *testing.T) {
+		v, err := NewKeyValidator(0, "", LastWins)
+		require.NoError(t, err)
+
+		deduped, err := v.Upsert(bu)
+		require.NoError(t, err)
+		require.Len(t, deduped, 2)
+		assert.Equal(t, "b", deduped[0].Key)
+		assert.Equal(t, "a", deduped[1].Key)
+		assert.Equal(t, "3", deduped[1].Value)
+	})
+}
@@ -0,0 +1,414 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/denismitr/lemon"
+	"github.com/denismitr/lemon-server/internal/lql"
+	"github.com/pkg/errors"
+)
+
+// ScanKind is the way a query plan reads documents
+type ScanKind int
+
+const (
+	// FullScan reads every document of the database
+	FullScan ScanKind = iota
+	// KeyRangeScan reads the documents between two keys or sharing a key prefix
+	KeyRangeScan
+	// IndexScan reads the documents found by a secondary index on a tag
+	IndexScan
+)
+
+func (k ScanKind) String() string {
+	switch k {
+	case KeyRangeScan:
+		return "key range scan"
+	case IndexScan:
+		return "index scan"
+	default:
+		return "full scan"
+	}
+}
+
+// keyRange limits the keys a key range scan visits, in key order, empty bounds are open
+type keyRange struct {
+	prefix       string
+	lower, upper string
+	lowerExcl    bool
+	upperExcl    bool
+}
+
+// start returns the key an ascending scan starts from
+func (r keyRange) start() string {
+	if compareKeys(r.prefix, r.lower) > 0 {
+		return r.prefix
+	}
+
+	return r.lower
+}
+
+// below reports whether a key comes before the range
+func (r keyRange) below(key string) bool {
+	if r.lower != "" {
+		if c := compareKeys(key, r.lower); c < 0 || (c == 0 && r.lowerExcl) {
+			return true
+		}
+	}
+
+	return r.prefix != "" && !strings.HasPrefix(key, r.prefix) && compareKeys(key, r.prefix) < 0
+}
+
+// above reports whether a key comes after the range
+func (r keyRange) above(key string) bool {
+	if r.upper != "" {
+		if c := compareKeys(key, r.upper); c > 0 || (c == 0 && r.upperExcl) {
+			return true
+		}
+	}
+
+	return r.prefix != "" && !strings.HasPrefix(key, r.prefix) && compareKeys(key, r.prefix) > 0
+}
+
+// after narrows the range to the keys following a key in scan order
+func (r keyRange) after(key string, desc bool) keyRange {
+	switch {
+	case key == "":
+	case desc && (r.upper == "" || compareKeys(key, r.upper) <= 0):
+		r.upper, r.upperExcl = key, true
+	case !desc && (r.lower == "" || compareKeys(key, r.lower) >= 0):
+		r.lower, r.lowerExcl = key, true
+	}
+
+	return r
+}
+
+// QueryPlan describes how a statement reads, filters, orders and limits documents
+type QueryPlan struct {
+	Statement *lql.Statement
+	Scan      ScanKind
+	// Bounds are the conditions limiting the documents the scan reads
+	Bounds []lql.Condition
+	// Filter are the conditions checked on every document the scan reads
+	Filter []lql.Condition
+	// Sort is set when the keys found by an index are ordered before documents are read
+	Sort bool
+
+	keys  keyRange
+	index indexBounds
+	tags  TagQuery
+}
+
+// String returns the EXPLAIN output of the plan, one step per line
+func (p *QueryPlan) String() string {
+	var sb strings.Builder
+	sb.WriteString(p.Statement.String())
+	sb.WriteString("\n")
+
+	fmt.Fprintf(&sb, "  scan: %s", p.Scan)
+	if len(p.Bounds) > 0 {
+		fmt.Fprintf(&sb, " on %s", joinConditions(p.Bounds))
+	}
+
+	if p.desc() && !p.Sort {
+		sb.WriteString(" descending")
+	}
+	sb.WriteString("\n")
+
+	if len(p.Filter) > 0 {
+		fmt.Fprintf(&sb, "  filter: %s\n", joinConditions(p.Filter))
+	}
+
+	if p.Sort {
+		order := "ASC"
+		if p.desc() {
+			order = "DESC"
+		}
+		fmt.Fprintf(&sb, "  sort: key %s\n", order)
+	}
+
+	if p.Statement.Limit > 0 {
+		fmt.Fprintf(&sb, "  limit: %d\n", p.Statement.Limit)
+	}
+
+	return sb.String()
+}
+
+func joinConditions(conditions []lql.Condition) string {
+	parts := make([]string, len(conditions))
+	for i, c := range conditions {
+		parts[i] = c.String()
+	}
+
+	return strings.Join(parts, " AND ")
+}
+
+// Page selects the documents of an ordered read following the last document of the previous page
+type Page struct {
+	// After is the key of the last document of the previous page, empty for the first page
+	After string
+	// Size is the maximum number of documents of the page, zero means all of them
+	Size int
+}
+
+// QueryResult holds the documents of a query in order, or only its plan when it was explained
+type QueryResult struct {
+	Plan      *QueryPlan
+	Documents []*Document
+}
+
+// tagQuery converts the tag conditions of a statement to a tag query
+func tagQuery(stmt *lql.Statement) (TagQuery, error) {
+	var q TagQuery
+	ops := map[lql.Operator]TagOperator{lql.Eq: TagEq, lql.Gt: TagGt, lql.Gte: TagGte, lql.Lt: TagLt, lql.Lte: TagLte}
+	for i, c := range stmt.Where {
+		if c.Field.IsKey() {
+			continue
+		}
+
+		if isSystemTag(c.Field.Tag) {
+			return q, &FieldError{
+				Field:       fmt.Sprintf("where[%d]", i),
+				Description: "tag name may not start with " + SystemTagPrefix,
+				Err:         ErrInvalidQuery,
+			}
+		}
+
+		op, ok := ops[c.Op]
+		if !ok {
+			return q, &FieldError{Field: fmt.Sprintf("where[%d]", i), Description: c.Op.String() + " only applies to key", Err: ErrInvalidQuery}
+		}
+
+		q.Tags = append(q.Tags, TagPredicate{Name: c.Field.Tag, Op: op, Value: c.Value})
+	}
+
+	return q, q.Validate()
+}
+
+// keyBounds narrows the key range by the key conditions of a statement, reporting false when there are none
+func keyBounds(stmt *lql.Statement) (keyRange, bool) {
+	var r keyRange
+	bounded := false
+	for _, c := range stmt.Where {
+		v, ok := c.Value.(string)
+		if !c.Field.IsKey() || !ok {
+			continue
+		}
+
+		if c.Op == lql.Eq || c.Op == lql.Gt || c.Op == lql.Gte {
+			if r.lower == "" || compareKeys(v, r.lower) > 0 || (v == r.lower && c.Op == lql.Gt) {
+				r.lower, r.lowerExcl = v, c.Op == lql.Gt
+			}
+			bounded = true
+		}
+
+		if c.Op == lql.Eq || c.Op == lql.Lt || c.Op == lql.Lte {
+			if r.upper == "" || compareKeys(v, r.upper) < 0 || (v == r.upper && c.Op == lql.Lt) {
+				r.upper, r.upperExcl = v, c.Op == lql.Lt
+			}
+			bounded = true
+		}
+
+		if c.Op == lql.Prefix && v != "" && !isSystemKey(v) && isContiguousPrefix(v) && len(v) > len(r.prefix) {
+			r.prefix = v
+			bounded = true
+		}
+	}
+
+	return r, bounded
+}
+
+// planQuery chooses how to execute a statement: a key equality and an equality on an indexed tag
+// select the fewest documents, followed by key ranges and prefixes, then ranges on indexed tags,
+// and without any of them all documents are scanned
+func (s *settings) planQuery(stmt *lql.Statement) (*QueryPlan, error) {
+	tags, err := tagQuery(stmt)
+	if err != nil {
+		return nil, err
+	}
+
+	p := QueryPlan{Statement: stmt, Scan: FullScan, tags: tags}
+	keys, bounded := keyBounds(stmt)
+	index, indexed := s.plan(&tags)
+	keyEq := bounded && keys.lower != "" && keys.lower == keys.upper && !keys.lowerExcl && !keys.upperExcl
+	indexEq := indexed && index.lower == index.upper && !index.lowerExcl && !index.upperExcl
+
+	switch {
+	case keyEq || (bounded && !indexEq):
+		p.Scan, p.keys = KeyRangeScan, keys
+	case indexed:
+		p.Scan, p.index = IndexScan, index
+	}
+
+	predicates := tags.Tags
+	for _, c := range stmt.Where {
+		served := false
+		switch {
+		case c.Field.IsKey():
+			served = p.Scan == KeyRangeScan && (c.Op != lql.Prefix || c.Value == keys.prefix)
+		default:
+			pred := predicates[0]
+			predicates = predicates[1:]
+			if p.Scan == IndexScan && pred.Name == index.tag {
+				v, _ := indexValue(pred.Value)
+				served = v[0] == index.typ && (pred.Op != TagEq || v == index.lower)
+			}
+		}
+
+		if served {
+			p.Bounds = append(p.Bounds, c)
+		} else {
+			p.Filter = append(p.Filter, c)
+		}
+	}
+
+	p.Sort = p.Scan == IndexScan
+
+	return &p, nil
+}
+
+// matches reports whether the key and tags of a document satisfy all conditions of the plan
+func (p *QueryPlan) matches(key string, tags lemon.M) bool {
+	for _, c := range p.Statement.Where {
+		v, ok := c.Value.(string)
+		if !c.Field.IsKey() || !ok {
+			continue
+		}
+
+		cmp := compareKeys(key, v)
+		switch {
+		case c.Op == lql.Prefix && !strings.HasPrefix(key, v),
+			c.Op == lql.Eq && key != v,
+			c.Op == lql.Gt && cmp <= 0,
+			c.Op == lql.Gte && cmp < 0,
+			c.Op == lql.Lt && cmp >= 0,
+			c.Op == lql.Lte && cmp > 0:
+			return false
+		}
+	}
+
+	return p.tags.matches(key, tags)
+}
+
+func (p *QueryPlan) desc() bool {
+	return p.Statement.OrderBy != nil && p.Statement.OrderBy.Desc
+}
+
+// scan calls cb with every stored user document the plan reads following the after key, in key order
+func (p *QueryPlan) scan(tx *lemon.Tx, after string, cb func(d *lemon.Document) bool) error {
+	desc := p.desc()
+	r := p.keys.after(after, desc)
+
+	if p.Scan == IndexScan {
+		keys, err := scanIndex(tx, p.index)
+		if err != nil {
+			return err
+		}
+
+		sort.Slice(keys, func(i, j int) bool {
+			c := compareKeys(keys[i], keys[j])
+			return (c < 0 && !desc) || (c > 0 && desc)
+		})
+
+		for _, key := range keys {
+			if r.below(key) || r.above(key) {
+				continue
+			}
+
+			d, err := getStored(tx, key)
+			if err != nil {
+				return err
+			}
+
+			if d != nil && !cb(d) {
+				break
+			}
+		}
+
+		return nil
+	}
+
+	opts := lemon.Q()
+	if start := r.start(); start != "" {
+		opts = opts.Prefix(start)
+	}
+
+	var err error
+	if desc {
+		// lemon stops descending at the start key, keys above the range are skipped
+		err = tx.Scan(opts.KeyOrder(lemon.DescOrder), func(d *lemon.Document) bool {
+			if isSystemKey(d.Key()) || r.above(d.Key()) {
+				return true
+			}
+
+			return !r.below(d.Key()) && cb(d)
+		})
+	} else {
+		err = tx.Scan(opts, func(d *lemon.Document) bool {
+			if isSystemKey(d.Key()) || r.below(d.Key()) {
+				return true
+			}
+
+			return !r.above(d.Key()) && cb(d)
+		})
+	}
+
+	if err != nil {
+		return errors.Wrap(ErrEngineFailed, err.Error())
+	}
+
+	return nil
+}
+
+// limit returns the number of documents a page of the plan holds at most, 0 when unlimited
+func (p *QueryPlan) limit(page Page) int {
+	limit := p.Statement.Limit
+	if page.Size > 0 && (limit <= 0 || page.Size < limit) {
+		limit = page.Size
+	}
+
+	return limit
+}
+
+// query executes a plan, returning the documents of a page in key order
+func (s *settings) query(ctx context.Context, tx *lemon.Tx, p *QueryPlan, page Page) ([]*Document, error) {
+	limit := p.limit(page)
+
+	var result []*Document
+	var failed error
+	if err := p.scan(tx, page.After, func(d *lemon.Document) bool {
+		if failed = ctx.Err(); failed != nil {
+			return false
+		}
+
+		tags, err := s.plainTags(d)
+		if err != nil {
+			failed = err
+			return false
+		}
+
+		if !p.matches(d.Key(), tags) {
+			return true
+		}
+
+		decoded, err := s.decode(d)
+		if err != nil {
+			failed = err
+			return false
+		}
+
+		result = append(result, decoded)
+		return limit <= 0 || len(result) < limit
+	}); err != nil {
+		return nil, err
+	}
+
+	if failed != nil {
+		return nil, failed
+	}
+
+	return result, nil
+}
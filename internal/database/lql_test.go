@@ -0,0 +1,156 @@
+package database
+
+import (
+	"context"
+	"testing"
+
+	"github.com/denismitr/lemon"
+	"github.com/denismitr/lemon-server/internal/lql"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_compareKeys(t *testing.T) {
+	tt := []struct {
+		a, b     string
+		expected int
+	}{
+		{a: "u:2", b: "u:10", expected: -1},
+		// leading zeros compare as strings
+		{a: "u:09", b: "u:1", expected: -1},
+		{a: "u", b: "u:1", expected: -1},
+		{a: "u:a", b: "u:b", expected: -1},
+		{a: "u:1:x", b: "u:1:x", expected: 0},
+		{a: "v", b: "u:1", expected: 1},
+	}
+
+	for _, tc := range tt {
+		assert.Equal(t, tc.expected, compareKeys(tc.a, tc.b), "%s %s", tc.a, tc.b)
+	}
+}
+
+func Test_query(t *testing.T) {
+	db, closer, err := lemon.Open(lemon.InMemory)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = closer() })
+
+	s := &settings{options: &Options{}, indexes: []Index{{Tag: "age", Ready: true}, {Tag: "city", Ready: true}}}
+	docs := []struct {
+		key  string
+		tags []Tag
+	}{
+		{key: "u:1", tags: []Tag{{Name: "age", Value: 17}, {Name: "city", Value: "Oslo"}}},
+		{key: "u:2", tags: []Tag{{Name: "age", Value: 30}, {Name: "city", Value: "Rome"}}},
+		{key: "u:10", tags: []Tag{{Name: "age", Value: 18}, {Name: "city", Value: "Oslo"}}},
+		{key: "u:11", tags: []Tag{{Name: "age", Value: 52}, {Name: "city", Value: "Oslo"}}},
+		{key: "v:1", tags: []Tag{{Name: "age", Value: 40}}},
+	}
+
+	require.NoError(t, db.Update(context.Background(), func(tx *lemon.Tx) error {
+		for _, d := range docs {
+			value, appliers, err := s.encode(d.key, d.key, "", d.tags, false)
+			if err != nil {
+				return err
+			}
+
+			if err := tx.Insert(d.key, value, appliers...); err != nil {
+				return err
+			}
+
+			if err := s.updateIndexes(tx, d.key, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	tt := []struct {
+		query    string
+		plan     string
+		expected []string
+	}{
+		{
+			query:    `FIND IN users`,
+			plan:     "  scan: full scan\n",
+			expected: []string{"u:1", "u:2", "u:10", "u:11", "v:1"},
+		},
+		{
+			query:    `FIND IN users WHERE key PREFIX "u:" AND tag.age >= 18 ORDER BY key DESC LIMIT 2`,
+			plan:     "  scan: key range scan on key PREFIX \"u:\" descending\n  filter: tag.age >= 18\n  limit: 2\n",
+			expected: []string{"u:11", "u:10"},
+		},
+		{
+			query:    `FIND IN users WHERE key > "u:2" AND key <= "v:1"`,
+			plan:     "  scan: key range scan on key > \"u:2\" AND key <= \"v:1\"\n",
+			expected: []string{"u:10", "u:11", "v:1"},
+		},
+		{
+			query:    `FIND IN users WHERE key PREFIX "u:1"`,
+			plan:     "  scan: full scan\n  filter: key PREFIX \"u:1\"\n",
+			expected: []string{"u:1", "u:10", "u:11"},
+		},
+		{
+			query:    `FIND IN users WHERE key PREFIX "u:" AND tag.city = "Oslo" AND tag.age < 50 ORDER BY key DESC`,
+			plan:     "  scan: index scan on tag.city = \"Oslo\"\n  filter: key PREFIX \"u:\" AND tag.age < 50\n  sort: key DESC\n",
+			expected: []string{"u:10", "u:1"},
+		},
+		{
+			query:    `FIND IN users WHERE tag.age > 17 AND tag.age < 50 LIMIT 2`,
+			plan:     "  scan: index scan on tag.age > 17 AND tag.age < 50\n  sort: key ASC\n  limit: 2\n",
+			expected: []string{"u:2", "u:10"},
+		},
+		{
+			query:    `FIND IN users WHERE key = "u:2" AND tag.city = "Rome"`,
+			plan:     "  scan: key range scan on key = \"u:2\"\n  filter: tag.city = \"Rome\"\n",
+			expected: []string{"u:2"},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.query, func(t *testing.T) {
+			stmt, err := lql.Parse(tc.query)
+			require.NoError(t, err)
+
+			plan, err := s.planQuery(stmt)
+			require.NoError(t, err)
+			assert.Equal(t, stmt.String()+"\n"+tc.plan, plan.String())
+
+			var keys []string
+			require.NoError(t, db.View(context.Background(), func(tx *lemon.Tx) error {
+				documents, err := s.query(context.Background(), tx, plan, Page{})
+				for _, d := range documents {
+					keys = append(keys, d.Key())
+				}
+				return err
+			}))
+			assert.Equal(t, tc.expected, keys)
+
+			// reading the documents in pages of one yields the same documents
+			var paged []string
+			page := Page{Size: 1}
+			require.NoError(t, db.View(context.Background(), func(tx *lemon.Tx) error {
+				for {
+					documents, err := s.query(context.Background(), tx, plan, page)
+					if err != nil || len(documents) == 0 {
+						return err
+					}
+
+					paged = append(paged, documents[0].Key())
+					page.After = documents[0].Key()
+				}
+			}))
+
+			if stmt.Limit == 0 {
+				assert.Equal(t, tc.expected, paged)
+			}
+		})
+	}
+
+	t.Run("system tags", func(t *testing.T) {
+		stmt, err := lql.Parse(`FIND IN users WHERE tag."@deleted" = true`)
+		require.NoError(t, err)
+
+		_, err = s.planQuery(stmt)
+		assert.ErrorIs(t, err, ErrInvalidQuery)
+	})
+}
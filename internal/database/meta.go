@@ -0,0 +1,88 @@
+package database
+
+import (
+	"strings"
+	"time"
+
+	"github.com/denismitr/lemon"
+)
+
+// System tags are kept by the server next to user tags, since lemon only
+// exposes user tags on read. Their names start with a prefix user tags may
+// not use and they are never returned to clients as tags.
+const (
+	SystemTagPrefix = "@"
+	contentTypeTag  = SystemTagPrefix + "content_type"
+	// valueTypeTag marks values lemon stores as json, but which were not written as json
+	valueTypeTag = SystemTagPrefix + "value_type"
+	// timestampTagPrefix marks int tags holding unix nanoseconds
+	timestampTagPrefix = SystemTagPrefix + "timestamp:"
+)
+
+const (
+	floatValueType     = "float"
+	timestampValueType = "timestamp"
+)
+
+func isSystemTag(name string) bool {
+	return strings.HasPrefix(name, SystemTagPrefix)
+}
+
+// IsJSONContentType reports whether the user given content type denotes a json document
+func IsJSONContentType(ct string) bool {
+	ct = strings.ToLower(strings.TrimSpace(strings.Split(ct, ";")[0]))
+	return ct == "application/json" || (strings.HasPrefix(ct, "application/") && strings.HasSuffix(ct, "+json"))
+}
+
+// contentTypeOf returns the content type given by the user on write,
+// falling back to the lemon value type for documents written without one
+func contentTypeOf(d *Document) string {
+	if ct, ok := d.Tags()[contentTypeTag].(string); ok {
+		return ct
+	}
+
+	return string(d.ContentType())
+}
+
+// isTimestampTag reports whether the int tag with the given name was written as a timestamp
+func isTimestampTag(d *Document, name string) bool {
+	return d.Tags().Bool(timestampTagPrefix + name)
+}
+
+// createMetaAppliers builds lemon meta for a document, tags have to come
+// first, because lemon tag appliers replace all the tags set before them
+func createMetaAppliers(value interface{}, contentType string, tags []Tag, timestamps bool) []lemon.MetaApplier {
+	appliers := []lemon.MetaApplier{createMeta(value, contentType, tags)}
+	if timestamps {
+		appliers = append(appliers, lemon.WithTimestamps())
+	}
+
+	return appliers
+}
+
+// createMeta builds the user tags of a document together with the system tags describing it
+func createMeta(value interface{}, contentType string, tags []Tag) lemon.M {
+	m := make(lemon.M, len(tags)+2)
+	for _, tag := range tags {
+		if t, ok := tag.Value.(time.Time); ok {
+			m[tag.Name] = int(t.UnixNano())
+			m[timestampTagPrefix+tag.Name] = true
+			continue
+		}
+
+		m[tag.Name] = tag.Value
+	}
+
+	if contentType != "" {
+		m[contentTypeTag] = contentType
+	}
+
+	switch value.(type) {
+	case float64:
+		m[valueTypeTag] = floatValueType
+	case time.Time:
+		m[valueTypeTag] = timestampValueType
+	}
+
+	return m
+}
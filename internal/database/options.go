@@ -0,0 +1,210 @@
+package database
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidOptions = errors.New("invalid database options")
+
+const optionsExt = ".options.json"
+
+// CompressionOptions enable compression of string and bytes values
+// of at least Threshold bytes
+type CompressionOptions struct {
+	Codec     Codec `json:"codec,omitempty"`
+	Threshold int   `json:"threshold,omitempty"`
+}
+
+// EncryptionOptions enable envelope encryption of values, and of tag values when Tags is set,
+// with a data key wrapped by the key provider key KeyID
+type EncryptionOptions struct {
+	KeyID string `json:"key_id,omitempty"`
+	Tags  bool   `json:"tags,omitempty"`
+}
+
+// HistoryOptions keep previous versions of replaced and deleted documents, the last
+// MaxVersions of them and the ones superseded within Retention, whichever is fewer
+type HistoryOptions struct {
+	MaxVersions int           `json:"max_versions,omitempty"`
+	Retention   time.Duration `json:"retention,omitempty"`
+}
+
+func (h HistoryOptions) enabled() bool {
+	return h.MaxVersions > 0 || h.Retention > 0
+}
+
+// TrashOptions make deletes move documents to the trash, from where they can be restored
+// until they are purged Retention after being deleted, zero Retention keeps them forever
+type TrashOptions struct {
+	Enabled   bool          `json:"enabled,omitempty"`
+	Retention time.Duration `json:"retention,omitempty"`
+}
+
+// FullTextOptions keep a full-text index of string values for searches
+type FullTextOptions struct {
+	Enabled bool `json:"enabled,omitempty"`
+}
+
+// Options are per-database storage settings, changing compression only affects
+// documents written afterwards, while documents get re-encrypted in the background
+// when encryption changes
+type Options struct {
+	Compression CompressionOptions `json:"compression"`
+	Encryption  EncryptionOptions  `json:"encryption"`
+	History     HistoryOptions     `json:"history"`
+	Trash       TrashOptions       `json:"trash"`
+	FullText    FullTextOptions    `json:"full_text"`
+}
+
+// Validate checks the options before they are stored
+func (o *Options) Validate() error {
+	if !o.Compression.Codec.Valid() {
+		return &FieldError{
+			Field:       "compression.codec",
+			Description: "unknown codec " + string(o.Compression.Codec),
+			Err:         ErrInvalidOptions,
+		}
+	}
+
+	if o.Compression.Threshold < 0 {
+		return &FieldError{
+			Field:       "compression.threshold",
+			Description: "threshold may not be negative",
+			Err:         ErrInvalidOptions,
+		}
+	}
+
+	if o.History.MaxVersions < 0 {
+		return &FieldError{
+			Field:       "history.max_versions",
+			Description: "max versions may not be negative",
+			Err:         ErrInvalidOptions,
+		}
+	}
+
+	if o.History.Retention < 0 {
+		return &FieldError{
+			Field:       "history.retention",
+			Description: "retention may not be negative",
+			Err:         ErrInvalidOptions,
+		}
+	}
+
+	if o.Trash.Retention < 0 {
+		return &FieldError{
+			Field:       "trash.retention",
+			Description: "retention may not be negative",
+			Err:         ErrInvalidOptions,
+		}
+	}
+
+	if o.Encryption.Tags && o.Encryption.KeyID == "" {
+		return &FieldError{
+			Field:       "encryption.tags",
+			Description: "tag encryption needs a key id",
+			Err:         ErrInvalidOptions,
+		}
+	}
+
+	if o.FullText.Enabled && o.Encryption.KeyID != "" {
+		return &FieldError{
+			Field:       "full_text.enabled",
+			Description: "values of encrypted databases cannot be indexed",
+			Err:         ErrInvalidOptions,
+		}
+	}
+
+	return nil
+}
+
+func (o *Options) isDefault() bool {
+	return o == nil || *o == Options{}
+}
+
+// optionsRegistry keeps database options in files next to the database files
+type optionsRegistry struct {
+	dir     string
+	options map[string]*Options
+	mu      sync.RWMutex
+}
+
+func newOptionsRegistry(dir string) *optionsRegistry {
+	return &optionsRegistry{
+		dir:     dir,
+		options: make(map[string]*Options),
+	}
+}
+
+// reset forgets what has been read, so that it is read again from the sidecar files
+func (r *optionsRegistry) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.options = make(map[string]*Options)
+}
+
+// get returns the options of a database, the defaults when none were set
+func (r *optionsRegistry) get(dbName string) (*Options, error) {
+	r.mu.RLock()
+	o, ok := r.options[dbName]
+	r.mu.RUnlock()
+	if ok {
+		return o, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if o, ok := r.options[dbName]; ok {
+		return o, nil
+	}
+
+	path, err := sidecarPath(r.dir, dbName, optionsExt)
+	if err != nil {
+		return nil, err
+	}
+
+	o = &Options{}
+	if _, err := readSidecar(path, o); err != nil {
+		return nil, err
+	}
+
+	if err := o.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "options file %s", path)
+	}
+
+	r.options[dbName] = o
+
+	return o, nil
+}
+
+// set stores the options of a database, default options remove the file
+func (r *optionsRegistry) set(dbName string, o *Options) error {
+	if err := o.Validate(); err != nil {
+		return err
+	}
+
+	path, err := sidecarPath(r.dir, dbName, optionsExt)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if o.isDefault() {
+		err = removeSidecar(path)
+	} else {
+		err = writeSidecar(path, o)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	copied := *o
+	r.options[dbName] = &copied
+
+	return nil
+}
@@ -0,0 +1,269 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/denismitr/lemon"
+	"github.com/denismitr/lemon-server/internal/lql"
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidQuery = errors.New("invalid query")
+
+// TagOperator compares a tag value with the value of a predicate
+type TagOperator int
+
+const (
+	TagEq TagOperator = iota
+	TagGt
+	TagGte
+	TagLt
+	TagLte
+)
+
+// TagPredicate matches documents having a tag of the type of Value that compares to it with Op,
+// timestamp values compare to timestamp tags
+type TagPredicate struct {
+	Name  string
+	Op    TagOperator
+	Value interface{}
+}
+
+// TagQuery selects documents by key prefix and tag predicates, which all have to match
+type TagQuery struct {
+	KeyPrefix string
+	Tags      []TagPredicate
+	// Limit is the maximum number of documents to return, zero means all of them
+	Limit int
+}
+
+// Validate checks the predicates of a query
+func (q *TagQuery) Validate() error {
+	for i := range q.Tags {
+		p := &q.Tags[i]
+		field := fmt.Sprintf("tags[%d]", i)
+		if isSystemTag(p.Name) {
+			return &FieldError{Field: field + ".name", Description: "tag name may not start with " + SystemTagPrefix, Err: ErrInvalidQuery}
+		}
+
+		if t, ok := p.Value.(time.Time); ok {
+			p.Value = int(t.UnixNano())
+		}
+
+		if _, ok := indexValue(p.Value); !ok {
+			return &FieldError{Field: field + ".value", Description: fmt.Sprintf("unsupported type %T", p.Value), Err: ErrInvalidQuery}
+		}
+
+		if p.Op < TagEq || p.Op > TagLte {
+			return &FieldError{Field: field + ".op", Description: "unknown operator", Err: ErrInvalidQuery}
+		}
+	}
+
+	return nil
+}
+
+// match reports whether tags satisfy the predicate
+func (p TagPredicate) match(tags lemon.M) bool {
+	v, ok := tags[p.Name]
+	if !ok {
+		return false
+	}
+
+	c, ok := compareTagValues(v, p.Value)
+	if !ok {
+		return false
+	}
+
+	switch p.Op {
+	case TagEq:
+		return c == 0
+	case TagGt:
+		return c > 0
+	case TagGte:
+		return c >= 0
+	case TagLt:
+		return c < 0
+	case TagLte:
+		return c <= 0
+	default:
+		return false
+	}
+}
+
+// compareTagValues compares values of the same type, reporting false for values of different types
+func compareTagValues(a, b interface{}) (int, bool) {
+	switch x := a.(type) {
+	case int:
+		y, ok := b.(int)
+		return compareOrdered(x < y, x > y), ok
+	case float64:
+		y, ok := b.(float64)
+		return compareOrdered(x < y, x > y), ok
+	case string:
+		y, ok := b.(string)
+		return strings.Compare(x, y), ok
+	case bool:
+		y, ok := b.(bool)
+		return compareOrdered(!x && y, x && !y), ok
+	default:
+		return 0, false
+	}
+}
+
+func compareOrdered(less, greater bool) int {
+	switch {
+	case less:
+		return -1
+	case greater:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// matches reports whether the key and tags of a document satisfy the query
+func (q *TagQuery) matches(key string, tags lemon.M) bool {
+	if !strings.HasPrefix(key, q.KeyPrefix) {
+		return false
+	}
+
+	for _, p := range q.Tags {
+		if !p.match(tags) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// plan returns the bounds of the index scan serving a query, false when no ready index
+// covers any of its predicates, equality predicates are preferred over ranges
+func (s *settings) plan(q *TagQuery) (indexBounds, bool) {
+	ready := make(map[string]bool, len(s.indexes))
+	for _, idx := range s.indexes {
+		ready[idx.Tag] = idx.Ready
+	}
+
+	for _, p := range q.Tags {
+		if p.Op == TagEq && ready[p.Name] {
+			v, _ := indexValue(p.Value)
+			return indexBounds{tag: p.Name, typ: v[0], lower: v, upper: v}, true
+		}
+	}
+
+	for _, p := range q.Tags {
+		if !ready[p.Name] {
+			continue
+		}
+
+		v, _ := indexValue(p.Value)
+		b := indexBounds{tag: p.Name, typ: v[0]}
+		for _, other := range q.Tags {
+			ov, _ := indexValue(other.Value)
+			if other.Name != p.Name || ov[0] != b.typ {
+				continue
+			}
+
+			switch other.Op {
+			case TagGt, TagGte:
+				if b.lower == "" || ov > b.lower || (ov == b.lower && other.Op == TagGt) {
+					b.lower, b.lowerExcl = ov, other.Op == TagGt
+				}
+			case TagLt, TagLte:
+				if b.upper == "" || ov < b.upper || (ov == b.upper && other.Op == TagLt) {
+					b.upper, b.upperExcl = ov, other.Op == TagLt
+				}
+			}
+		}
+
+		return b, true
+	}
+
+	return indexBounds{}, false
+}
+
+// plainTags returns the tags of a stored document, decrypting them when they are encrypted
+func (s *settings) plainTags(d *lemon.Document) (lemon.M, error) {
+	if d.Tags().Int(tagsDEKTag) == 0 {
+		return d.Tags(), nil
+	}
+
+	decoded, err := s.decode(d)
+	if err != nil {
+		return nil, err
+	}
+
+	return decoded.Tags(), nil
+}
+
+// scanMatching calls cb with every stored document matching a query and its plain tags,
+// scanning an index when one serves the query and the documents otherwise
+func (s *settings) scanMatching(ctx context.Context, tx *lemon.Tx, q *TagQuery, cb func(d *lemon.Document, tags lemon.M) bool) error {
+	var failed error
+	visit := func(d *lemon.Document) bool {
+		if failed = ctx.Err(); failed != nil {
+			return false
+		}
+
+		tags, err := s.plainTags(d)
+		if err != nil {
+			failed = err
+			return false
+		}
+
+		if !q.matches(d.Key(), tags) {
+			return true
+		}
+
+		return cb(d, tags)
+	}
+
+	if b, ok := s.plan(q); ok {
+		keys, err := scanIndex(tx, b)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			d, err := getStored(tx, key)
+			if err != nil {
+				return err
+			}
+
+			if d != nil && !visit(d) {
+				break
+			}
+		}
+	} else {
+		var err error
+		if q.KeyPrefix != "" {
+			err = scanKeyPrefix(tx, q.KeyPrefix, visit)
+		} else {
+			err = scanUser(tx, visit)
+		}
+
+		if err != nil {
+			return errors.Wrap(ErrEngineFailed, err.Error())
+		}
+	}
+
+	return failed
+}
+
+// statement converts a validated query to the LQL statement it is executed as, in key order
+func (q *TagQuery) statement(dbName string) *lql.Statement {
+	ops := map[TagOperator]lql.Operator{TagEq: lql.Eq, TagGt: lql.Gt, TagGte: lql.Gte, TagLt: lql.Lt, TagLte: lql.Lte}
+	stmt := lql.Statement{Database: dbName, Limit: q.Limit}
+	if q.KeyPrefix != "" {
+		stmt.Where = append(stmt.Where, lql.Condition{Op: lql.Prefix, Value: q.KeyPrefix})
+	}
+
+	for _, p := range q.Tags {
+		stmt.Where = append(stmt.Where, lql.Condition{Field: lql.Field{Tag: p.Name}, Op: ops[p.Op], Value: p.Value})
+	}
+
+	return &stmt
+}
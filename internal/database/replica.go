@@ -0,0 +1,262 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/denismitr/lemon"
+	"github.com/pkg/errors"
+)
+
+// Replicas copy documents as they were written on another server, with their tags,
+// timestamps and revisions, and store them with the options of their own databases.
+// Only user documents are copied, so followers keep no history and no trash, their deletes
+// leave tombstones like those of the primary.
+
+// snapshotBatchSize is the number of documents of a snapshot read in one transaction
+const snapshotBatchSize = 500
+
+// Change is the state of a document after a committed write, Document is nil once it is deleted
+type Change struct {
+	Key      string
+	Document *Document
+}
+
+// Databases returns the names of all databases
+func (le *LemonEngine) Databases() ([]string, error) {
+	return le.store.Names()
+}
+
+// Changes reads the documents of keys as they are stored now, duplicate keys are read once
+func (le *LemonEngine) Changes(ctx context.Context, dbName string, keys []string) ([]Change, error) {
+	db, s, err := le.open(ctx, dbName)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool, len(keys))
+	changes := make([]Change, 0, len(keys))
+	if err := db.View(ctx, func(tx *lemon.Tx) error {
+		for _, key := range keys {
+			if seen[key] || isSystemKey(key) {
+				continue
+			}
+			seen[key] = true
+
+			stored, err := getStored(tx, key)
+			if err != nil {
+				return err
+			}
+
+			c := Change{Key: key}
+			if stored != nil {
+				if c.Document, err = s.decode(stored); err != nil {
+					return err
+				}
+			}
+
+			changes = append(changes, c)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+// Snapshot calls emit with batches of all user documents of a database in key order,
+// documents written while the snapshot is taken may be emitted as they were before or after
+func (le *LemonEngine) Snapshot(ctx context.Context, dbName string, emit func([]Change) error) error {
+	keys, err := le.userKeys(ctx, dbName)
+	if err != nil {
+		return err
+	}
+
+	for len(keys) > 0 {
+		n := snapshotBatchSize
+		if n > len(keys) {
+			n = len(keys)
+		}
+
+		changes, err := le.Changes(ctx, dbName, keys[:n])
+		if err != nil {
+			return err
+		}
+
+		if err := emit(changes); err != nil {
+			return err
+		}
+
+		keys = keys[n:]
+	}
+
+	return nil
+}
+
+func (le *LemonEngine) userKeys(ctx context.Context, dbName string) ([]string, error) {
+	db, err := le.store.Get(dbName)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	if err := db.View(ctx, func(tx *lemon.Tx) error {
+		return scanUser(tx, func(d *lemon.Document) bool {
+			keys = append(keys, d.Key())
+			return true
+		})
+	}); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func (le *LemonEngine) buriedKeys(ctx context.Context, dbName string) ([]string, error) {
+	db, err := le.store.Get(dbName)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	if err := db.View(ctx, func(tx *lemon.Tx) error {
+		keys, err = tombstoneKeys(tx)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// ApplyChanges writes documents read from another server by Changes or Snapshot, all of them or none
+func (le *LemonEngine) ApplyChanges(ctx context.Context, dbName string, changes []Change) error {
+	return le.applyChanges(ctx, dbName, changes, false)
+}
+
+// applyChanges writes changes, moved tells that they only move documents between shards
+func (le *LemonEngine) applyChanges(ctx context.Context, dbName string, changes []Change, moved bool) error {
+	db, s, err := le.open(ctx, dbName)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, len(changes))
+	var cc countChange
+	now := nowFrom(ctx)
+	if err := db.Update(ctx, func(tx *lemon.Tx) error {
+		added := 0
+		for i, c := range changes {
+			if isSystemKey(c.Key) {
+				return errors.Wrapf(ErrInvalidInput, "key %s of a change is reserved", c.Key)
+			}
+
+			n, err := applyChange(tx, s, c, !moved, now)
+			if err != nil {
+				return err
+			}
+
+			added += n
+			keys[i] = c.Key
+		}
+
+		// copies and moves are not limited by the documents quota, their documents were admitted before
+		cc = le.counts.change(dbName, added)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	le.counts.apply(cc)
+
+	if moved {
+		le.updateSearch(dbName, s, keys)
+		le.callHooks(dbName, keys, false)
+	} else {
+		le.committed(dbName, s, keys)
+	}
+
+	return nil
+}
+
+// applyChange writes a change, deleted documents leave a tombstone when buried is set,
+// it returns 1 when it added a document and -1 when it removed one
+func applyChange(tx *lemon.Tx, s *settings, c Change, buried bool, now time.Time) (int, error) {
+	stored, err := getStored(tx, c.Key)
+	if err != nil {
+		return 0, err
+	}
+
+	if c.Document == nil {
+		if stored == nil {
+			return 0, nil
+		}
+
+		if err := tx.Remove(c.Key); err != nil {
+			return 0, err
+		}
+
+		if buried {
+			if err := bury(tx, c.Key, revisionOf(stored.Tags()), now); err != nil {
+				return 0, err
+			}
+		}
+
+		return -1, s.updateIndexes(tx, c.Key, stored)
+	}
+
+	// the document brings its revision along
+	if stored == nil && tx.Has(tombstoneKey(c.Key)) {
+		if err := tx.Remove(tombstoneKey(c.Key)); err != nil {
+			return 0, err
+		}
+	}
+
+	m := make(lemon.M, len(c.Document.Tags()))
+	for name, v := range c.Document.Tags() {
+		m[name] = v
+	}
+
+	value, err := s.encodeRaw(c.Key, c.Document.Value(), c.Document.ContentType(), m)
+	if err != nil {
+		return 0, err
+	}
+
+	appliers := []lemon.MetaApplier{m}
+	if c.Document.HasTimestamps() {
+		appliers = append(appliers, preservedTimestamps(c.Document))
+	}
+
+	if err := tx.InsertOrReplace(c.Key, value, appliers...); err != nil {
+		return 0, err
+	}
+
+	added := 0
+	if stored == nil {
+		added = 1
+	}
+
+	return added, s.updateIndexes(tx, c.Key, stored)
+}
+
+// Prune removes the user documents of a database that keep does not report, returning their number
+func (le *LemonEngine) Prune(ctx context.Context, dbName string, keep func(key string) bool) (int, error) {
+	keys, err := le.userKeys(ctx, dbName)
+	if err != nil {
+		return 0, err
+	}
+
+	var changes []Change
+	for _, key := range keys {
+		if !keep(key) {
+			changes = append(changes, Change{Key: key})
+		}
+	}
+
+	if len(changes) == 0 {
+		return 0, nil
+	}
+
+	return len(changes), le.ApplyChanges(ctx, dbName, changes)
+}
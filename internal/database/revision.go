@@ -0,0 +1,162 @@
+package database
+
+import (
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/denismitr/lemon"
+	"github.com/pkg/errors"
+)
+
+var ErrRevisionMismatch = errors.New("revision mismatch")
+
+// revisionTag is the number of times a document was written, starting with 1 and kept across deletes,
+// documents written before revisions were introduced are at revision 1
+const revisionTag = SystemTagPrefix + "revision"
+
+func revisionOf(tags lemon.M) uint64 {
+	if r := tags.Int(revisionTag); r > 0 {
+		return uint64(r)
+	}
+
+	return 1
+}
+
+// Revision is incremented by every write of a document, so that clients can detect concurrent writes
+func (d *Document) Revision() uint64 {
+	return revisionOf(d.tags)
+}
+
+// Deleted documents leave a tombstone keeping their revision, so that a document created again
+// under the same key continues from it instead of starting over, and clients expecting a revision
+// do not mistake the new document for the deleted one. Tombstones are removed once their key is
+// written again, or by the janitor once they are older than the tombstone retention.
+const tombstoneKeyPrefix = SystemKeyPrefix + "tombstone:"
+
+func tombstoneKey(key string) string {
+	return tombstoneKeyPrefix + base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+// buriedRevision returns the revision a deleted document was at, zero when there is no tombstone
+func buriedRevision(tx *lemon.Tx, key string) (uint64, error) {
+	revision, _, err := buried(tx, key)
+	return revision, err
+}
+
+// buried returns the revision a deleted document was at and when it was deleted,
+// tombstones left before their time was kept are as old as can be
+func buried(tx *lemon.Tx, key string) (uint64, time.Time, error) {
+	tombstone, err := getStored(tx, tombstoneKey(key))
+	if err != nil || tombstone == nil {
+		return 0, time.Time{}, err
+	}
+
+	return uint64(tombstone.Tags().Int(revisionTag)), time.Unix(0, int64(tombstone.Tags().Int(deletedAtTag))), nil
+}
+
+// bury leaves a tombstone for a document deleted at, keeping the higher revision of an existing one
+func bury(tx *lemon.Tx, key string, revision uint64, at time.Time) error {
+	buried, err := buriedRevision(tx, key)
+	if err != nil {
+		return err
+	}
+
+	if buried > revision {
+		revision = buried
+	}
+
+	return tx.InsertOrReplace(tombstoneKey(key), "", lemon.M{
+		revisionTag:  int(revision),
+		deletedAtTag: int(at.UnixNano()),
+	})
+}
+
+// purgeTombstones removes tombstones left more than retention ago, returning how many
+func purgeTombstones(tx *lemon.Tx, retention time.Duration, now time.Time) (int, error) {
+	var expired []string
+	if err := scanPrefix(tx, tombstoneKeyPrefix, func(d *lemon.Document) bool {
+		if now.Sub(time.Unix(0, int64(d.Tags().Int(deletedAtTag)))) > retention {
+			expired = append(expired, d.Key())
+		}
+		return true
+	}); err != nil {
+		return 0, errors.Wrap(ErrEngineFailed, err.Error())
+	}
+
+	if len(expired) == 0 {
+		return 0, nil
+	}
+
+	return len(expired), tx.Remove(expired...)
+}
+
+// nextRevision returns the revision a write of a document makes, after checking it is at
+// the expected revision when expected is not zero, the stored document may be nil, then
+// the tombstone of the key is removed and its revision continued from
+func nextRevision(tx *lemon.Tx, stored *lemon.Document, key string, expected uint64) (lemon.M, error) {
+	var current uint64
+	if stored != nil {
+		current = revisionOf(stored.Tags())
+	}
+
+	if expected > 0 && expected != current {
+		if stored == nil {
+			return nil, errors.Wrapf(ErrRevisionMismatch, "key %s does not exist, expected revision %d", key, expected)
+		}
+
+		return nil, errors.Wrapf(ErrRevisionMismatch, "key %s is at revision %d, expected %d", key, current, expected)
+	}
+
+	if stored == nil {
+		buried, err := buriedRevision(tx, key)
+		if err != nil {
+			return nil, err
+		}
+
+		if buried > 0 {
+			if err := tx.Remove(tombstoneKey(key)); err != nil {
+				return nil, err
+			}
+			current = buried
+		}
+	}
+
+	return lemon.M{revisionTag: int(current + 1)}, nil
+}
+
+// tombstoneKeys returns the keys of the deleted documents that left a tombstone
+func tombstoneKeys(tx *lemon.Tx) ([]string, error) {
+	var encoded []string
+	if err := scanPrefix(tx, tombstoneKeyPrefix, func(d *lemon.Document) bool {
+		encoded = append(encoded, strings.TrimPrefix(d.Key(), tombstoneKeyPrefix))
+		return true
+	}); err != nil {
+		return nil, errors.Wrap(ErrEngineFailed, err.Error())
+	}
+
+	keys := make([]string, len(encoded))
+	for i := range encoded {
+		key, err := base64.RawURLEncoding.DecodeString(encoded[i])
+		if err != nil {
+			return nil, errors.Wrapf(ErrEngineFailed, "tombstone %s has a malformed key", encoded[i])
+		}
+		keys[i] = string(key)
+	}
+
+	return keys, nil
+}
+
+// getStored returns the stored document by key, nil when there is none
+func getStored(tx *lemon.Tx, key string) (*lemon.Document, error) {
+	stored, err := tx.Get(key)
+	if errors.Is(err, lemon.ErrKeyDoesNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(ErrEngineFailed, err.Error())
+	}
+
+	return stored, nil
+}
@@ -0,0 +1,127 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/denismitr/lemon"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_nextRevision(t *testing.T) {
+	db, closer, err := lemon.Open(lemon.InMemory)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = closer() })
+
+	require.NoError(t, db.Update(context.Background(), func(tx *lemon.Tx) error {
+		if err := tx.Insert("legacy", "v"); err != nil {
+			return err
+		}
+		if err := bury(tx, "gone", 5, time.Now()); err != nil {
+			return err
+		}
+		return tx.Insert("foo", "v", lemon.M{revisionTag: 3})
+	}))
+
+	tt := []struct {
+		key      string
+		expected uint64
+		next     int
+		err      error
+	}{
+		{key: "foo", next: 4},
+		{key: "foo", expected: 3, next: 4},
+		{key: "foo", expected: 2, err: ErrRevisionMismatch},
+		{key: "legacy", expected: 1, next: 2},
+		{key: "missing", next: 1},
+		{key: "missing", expected: 1, err: ErrRevisionMismatch},
+		{key: "gone", expected: 5, err: ErrRevisionMismatch},
+		// the tombstone is removed by the write
+		{key: "gone", next: 6},
+		{key: "gone", next: 1},
+	}
+
+	require.NoError(t, db.Update(context.Background(), func(tx *lemon.Tx) error {
+		for _, tc := range tt {
+			stored, err := getStored(tx, tc.key)
+			require.NoError(t, err)
+
+			m, err := nextRevision(tx, stored, tc.key, tc.expected)
+			if tc.err != nil {
+				assert.True(t, errors.Is(err, tc.err), "%s at %d: %v", tc.key, tc.expected, err)
+				continue
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tc.next, m.Int(revisionTag), "%s at %d", tc.key, tc.expected)
+		}
+		return nil
+	}))
+}
+
+func Test_purgeTombstones(t *testing.T) {
+	db, closer, err := lemon.Open(lemon.InMemory)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = closer() })
+
+	now := time.Now()
+	require.NoError(t, db.Update(context.Background(), func(tx *lemon.Tx) error {
+		if err := bury(tx, "old", 3, now.Add(-2*time.Hour)); err != nil {
+			return err
+		}
+		if err := bury(tx, "recent", 4, now.Add(-time.Minute)); err != nil {
+			return err
+		}
+		// left before tombstones recorded their time
+		return tx.Insert(tombstoneKey("legacy"), "", lemon.M{revisionTag: 2})
+	}))
+
+	require.NoError(t, db.Update(context.Background(), func(tx *lemon.Tx) error {
+		n, err := purgeTombstones(tx, time.Hour, now)
+		require.NoError(t, err)
+		assert.Equal(t, 2, n)
+
+		keys, err := tombstoneKeys(tx)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"recent"}, keys)
+		return nil
+	}))
+}
+
+func Test_patchDocument_Revision(t *testing.T) {
+	db, closer, err := lemon.Open(lemon.InMemory)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = closer() })
+
+	s := &settings{options: &Options{}}
+	require.NoError(t, db.Update(context.Background(), func(tx *lemon.Tx) error {
+		value, appliers, err := s.encode("foo", `{"a":1}`, "application/json", nil, false)
+		if err != nil {
+			return err
+		}
+		return tx.Insert("foo", value, append(appliers, lemon.M{revisionTag: 1})...)
+	}))
+
+	patch := func(expected uint64) error {
+		return db.Update(context.Background(), func(tx *lemon.Tx) error {
+			return patchDocument(tx, 0, Patch{Key: "foo", MergePatch: []byte(`{"b":2}`), ExpectedRevision: expected}, s, time.Now())
+		})
+	}
+
+	require.NoError(t, patch(1))
+	assert.True(t, errors.Is(patch(1), ErrRevisionMismatch))
+	require.NoError(t, patch(0))
+
+	require.NoError(t, db.View(context.Background(), func(tx *lemon.Tx) error {
+		stored, err := tx.Get("foo")
+		require.NoError(t, err)
+
+		d, err := s.decode(stored)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(3), d.Revision())
+		return nil
+	}))
+}
@@ -0,0 +1,721 @@
+package database
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/denismitr/lemon"
+	"github.com/denismitr/lemon-server/internal/lql"
+	"github.com/pkg/errors"
+)
+
+// routed is a database locked for a read or a write, shards is nil when it is not sharded
+type routed struct {
+	shards *shardMap
+	unlock func()
+}
+
+// route locks a database for a read, or for a write of keys. Writes spanning shards lock it
+// exclusively, as their shards are written in parallel, and so do writes while resharding,
+// which move their keys to their new shards first. Writes wait for transactions in doubt first,
+// and count the documents of the shards for the documents quota
+func (le *LemonEngine) route(ctx context.Context, dbName string, write bool, keys []string) (*routed, error) {
+	if err := checkLogicalName(dbName); err != nil {
+		return nil, err
+	}
+
+	if write {
+		if err := le.settled(ctx, dbName); err != nil {
+			return nil, err
+		}
+	}
+
+	l := le.shardLock(dbName)
+	l.RLock()
+	m, err := le.shardMaps.get(dbName)
+	if err != nil {
+		l.RUnlock()
+		return nil, err
+	}
+
+	if m != nil && m.resharding() {
+		le.reshard(dbName)
+	}
+
+	if !write || m == nil || (!m.resharding() && !m.spans(dbName, keys)) {
+		if write {
+			if err := le.countShards(ctx, dbName, m); err != nil {
+				l.RUnlock()
+				return nil, err
+			}
+		}
+		return &routed{shards: m, unlock: l.RUnlock}, nil
+	}
+
+	l.RUnlock()
+	l.Lock()
+	if m, err = le.shardMaps.get(dbName); err != nil {
+		l.Unlock()
+		return nil, err
+	}
+
+	if m != nil && m.resharding() {
+		if err := le.moveKeys(ctx, dbName, m, keys); err != nil {
+			l.Unlock()
+			return nil, err
+		}
+	}
+
+	if err := le.countShards(ctx, dbName, m); err != nil {
+		l.Unlock()
+		return nil, err
+	}
+
+	return &routed{shards: m, unlock: l.Unlock}, nil
+}
+
+// write applies a write to the shards of a database, a transaction makes writes spanning
+// shards atomic, one is the write of the database itself when it is not sharded
+func (le *LemonEngine) write(
+	ctx context.Context,
+	w TxWrite,
+	single func(dbName string) (*ExecResult, error),
+) (*ExecResult, error) {
+	r, err := le.route(ctx, w.Database, true, w.keys())
+	if err != nil {
+		return nil, err
+	}
+	defer r.unlock()
+
+	if r.shards == nil {
+		return single(w.Database)
+	}
+
+	writes := r.shards.splitWrite(w)
+	switch len(writes) {
+	case 0:
+		return single(shardName(w.Database, 0, r.shards.Shards))
+	case 1:
+		return single(writes[0].Database)
+	}
+
+	result, err := le.transact(ctx, writes, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ExecResult{RowsAffected: result.RowsAffected}, nil
+}
+
+// BatchInsert inserts documents, all of them or none
+func (le *LemonEngine) BatchInsert(ctx context.Context, dbName string, bi BatchInsert) (*ExecResult, error) {
+	return le.write(ctx, TxWrite{Database: dbName, Inserts: bi}, func(name string) (*ExecResult, error) {
+		return le.batchInsert(ctx, name, bi)
+	})
+}
+
+// BatchUpsert inserts or replaces documents, all of them or none
+func (le *LemonEngine) BatchUpsert(ctx context.Context, dbName string, bu BatchUpsert) (*ExecResult, error) {
+	return le.write(ctx, TxWrite{Database: dbName, Upserts: bu}, func(name string) (*ExecResult, error) {
+		return le.batchUpsert(ctx, name, bu)
+	})
+}
+
+// BatchDeleteByKey deletes documents by keys, all of them or none
+func (le *LemonEngine) BatchDeleteByKey(ctx context.Context, dbName string, keys BatchDeleteByKey) (*ExecResult, error) {
+	return le.write(ctx, TxWrite{Database: dbName, Deletes: keys}, func(name string) (*ExecResult, error) {
+		return le.batchDeleteByKey(ctx, name, keys)
+	})
+}
+
+// CrossDatabaseTransaction writes to several databases, all of them or none, the writes
+// to sharded databases are divided among their shards
+func (le *LemonEngine) CrossDatabaseTransaction(ctx context.Context, writes []TxWrite) (*TxResult, error) {
+	if err := validateTxWrites(writes); err != nil {
+		return nil, err
+	}
+
+	// databases are locked in name order, like their shards are by the transaction
+	writes = append([]TxWrite(nil), writes...)
+	sort.Slice(writes, func(i, j int) bool {
+		return writes[i].Database < writes[j].Database
+	})
+
+	var physical []TxWrite
+	for _, w := range writes {
+		r, err := le.route(ctx, w.Database, true, w.keys())
+		if err != nil {
+			return nil, err
+		}
+		defer r.unlock()
+
+		if r.shards == nil {
+			physical = append(physical, w)
+		} else {
+			physical = append(physical, r.shards.splitWrite(w)...)
+		}
+	}
+
+	return le.transact(ctx, physical, false)
+}
+
+// BatchPatch applies patches to json documents, all of them or none
+func (le *LemonEngine) BatchPatch(ctx context.Context, dbName string, bp BatchPatch) (*ExecResult, error) {
+	keys := bp.keys()
+	r, err := le.route(ctx, dbName, true, keys)
+	if err != nil {
+		return nil, err
+	}
+	defer r.unlock()
+
+	if r.shards == nil || !r.shards.spans(dbName, keys) {
+		return le.batchPatch(ctx, r.single(dbName, keys), bp)
+	}
+
+	now := nowFrom(ctx)
+	return le.writeShards(ctx, r.shards.split(dbName, keys), keys, func(tx *lemon.Tx, s *settings, p shardPart) (int, countChange, error) {
+		for _, pos := range p.positions {
+			if err := ctx.Err(); err != nil {
+				return 0, countChange{}, err
+			}
+
+			if err := patchDocument(tx, pos, bp[pos], s, now); err != nil {
+				return 0, countChange{}, err
+			}
+		}
+		return len(p.positions), countChange{}, nil
+	})
+}
+
+// Undelete restores soft deleted documents from the trash, all of them or none
+func (le *LemonEngine) Undelete(ctx context.Context, dbName string, keys []string, ignoreMissing bool) (*ExecResult, error) {
+	r, err := le.route(ctx, dbName, true, keys)
+	if err != nil {
+		return nil, err
+	}
+	defer r.unlock()
+
+	if r.shards == nil || !r.shards.spans(dbName, keys) {
+		return le.undelete(ctx, r.single(dbName, keys), keys, ignoreMissing)
+	}
+
+	now := nowFrom(ctx)
+	return le.writeShards(ctx, r.shards.split(dbName, keys), keys, func(tx *lemon.Tx, s *settings, p shardPart) (int, countChange, error) {
+		return le.undeleteDocuments(ctx, tx, p.name, s, keysAt(keys, p.positions), ignoreMissing, now)
+	})
+}
+
+// single returns the database the keys of a write all belong to
+func (r *routed) single(dbName string, keys []string) string {
+	if r.shards == nil {
+		return dbName
+	}
+
+	if len(keys) == 0 {
+		return shardName(dbName, 0, r.shards.Shards)
+	}
+
+	return r.shards.owner(dbName, keys[0])
+}
+
+// writeShards applies the parts of a write to their shards in parallel and commits them once
+// all of them succeeded. Unlike transactions they are not logged, so a crash while the shards
+// commit can leave the write applied to some of them only
+func (le *LemonEngine) writeShards(
+	ctx context.Context,
+	parts []shardPart,
+	keys []string,
+	apply func(tx *lemon.Tx, s *settings, p shardPart) (int, countChange, error),
+) (*ExecResult, error) {
+	txs := make([]*lemon.Tx, len(parts))
+	ss := make([]*settings, len(parts))
+	counts := make([]int, len(parts))
+	changes := make([]countChange, len(parts))
+	rollback := func(from int) {
+		for i := from; i < len(txs); i++ {
+			if txs[i] == nil {
+				continue
+			}
+
+			if err := txs[i].Rollback(); err != nil {
+				le.lg.Errorf("could not roll back write to shard %s: %v", parts[i].name, err)
+			}
+		}
+	}
+
+	if err := fanOut(len(parts), func(i int) error {
+		db, s, err := le.open(ctx, parts[i].name)
+		if err != nil {
+			return err
+		}
+
+		tx, err := db.Begin(ctx, false)
+		if err != nil {
+			return err
+		}
+
+		txs[i], ss[i] = tx, s
+		counts[i], changes[i], err = apply(tx, s, parts[i])
+		return err
+	}); err != nil {
+		rollback(0)
+		return nil, err
+	}
+
+	affected := 0
+	for i, tx := range txs {
+		if err := tx.Commit(); err != nil {
+			rollback(i + 1)
+			return nil, errors.Wrapf(err, "could not commit write to shard %s", parts[i].name)
+		}
+
+		le.counts.apply(changes[i])
+		le.committed(parts[i].name, ss[i], keysAt(keys, parts[i].positions))
+		affected += counts[i]
+	}
+
+	return &ExecResult{RowsAffected: uint64(affected)}, nil
+}
+
+func keysAt(keys []string, positions []int) []string {
+	result := make([]string, len(positions))
+	for i, pos := range positions {
+		result[i] = keys[pos]
+	}
+
+	return result
+}
+
+// MGet returns documents by keys, as they were at asOf when it is not zero
+func (le *LemonEngine) MGet(ctx context.Context, database string, keys []string, asOf time.Time) (map[string]*Document, error) {
+	r, err := le.route(ctx, database, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer r.unlock()
+
+	if r.shards == nil {
+		return le.mget(ctx, database, keys, asOf)
+	}
+
+	parts := r.shards.lookup(database, keys)
+	found := make([]map[string]*Document, len(parts))
+	if err := fanOut(len(parts), func(i int) error {
+		var err error
+		found[i], err = le.mget(ctx, parts[i].name, keysAt(keys, parts[i].positions), asOf)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]*Document, len(keys))
+	for _, docs := range found {
+		for key, d := range docs {
+			result[key] = d
+		}
+	}
+
+	return result, nil
+}
+
+// Exists reports whether each of the keys exists without reading the documents
+func (le *LemonEngine) Exists(ctx context.Context, dbName string, keys []string) ([]bool, error) {
+	r, err := le.route(ctx, dbName, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer r.unlock()
+
+	if r.shards == nil {
+		return le.exists(ctx, dbName, keys)
+	}
+
+	parts := r.shards.lookup(dbName, keys)
+	found := make([][]bool, len(parts))
+	if err := fanOut(len(parts), func(i int) error {
+		var err error
+		found[i], err = le.exists(ctx, parts[i].name, keysAt(keys, parts[i].positions))
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	result := make([]bool, len(keys))
+	for i, p := range parts {
+		for j, pos := range p.positions {
+			result[pos] = result[pos] || found[i][j]
+		}
+	}
+
+	return result, nil
+}
+
+// History returns the current version of a document followed by its previous versions
+func (le *LemonEngine) History(ctx context.Context, dbName, key string, limit int) ([]*Version, error) {
+	r, err := le.route(ctx, dbName, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer r.unlock()
+
+	if r.shards == nil {
+		return le.history(ctx, dbName, key, limit)
+	}
+
+	versions, err := le.history(ctx, r.shards.owner(dbName, key), key, limit)
+	if err != nil || len(versions) > 0 {
+		return versions, err
+	}
+
+	if prev := r.shards.previous(dbName, key); prev != "" {
+		return le.history(ctx, prev, key, limit)
+	}
+
+	return versions, nil
+}
+
+// Query plans an LQL statement and reads a page of its documents, the documents of
+// the shards of a database are merged in key order
+func (le *LemonEngine) Query(ctx context.Context, stmt *lql.Statement, page Page) (*QueryResult, error) {
+	r, err := le.route(ctx, stmt.Database, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer r.unlock()
+
+	if r.shards == nil {
+		return le.query(ctx, stmt, page)
+	}
+
+	names := r.shards.names(stmt.Database)
+	if stmt.Explain {
+		// shards have the same settings, so their plans only differ while indexes are built
+		names = names[:1]
+	}
+
+	results := make([]*QueryResult, len(names))
+	if err := fanOut(len(names), func(i int) error {
+		shardStmt := *stmt
+		shardStmt.Database = names[i]
+
+		var err error
+		results[i], err = le.query(ctx, &shardStmt, page)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	plan := results[0].Plan
+	plan.Statement = stmt
+	result := QueryResult{Plan: plan}
+	for _, sr := range results {
+		result.Documents = append(result.Documents, sr.Documents...)
+	}
+
+	sort.SliceStable(result.Documents, func(i, j int) bool {
+		c := compareKeys(result.Documents[i].Key(), result.Documents[j].Key())
+		if plan.desc() {
+			return c > 0
+		}
+		return c < 0
+	})
+
+	if limit := plan.limit(page); limit > 0 && len(result.Documents) > limit {
+		result.Documents = result.Documents[:limit]
+	}
+
+	return &result, nil
+}
+
+// Search returns a page of the documents matching a full-text query ranked by BM25 score,
+// the shards of a database are ranked separately and their hits merged by score
+func (le *LemonEngine) Search(ctx context.Context, dbName string, q SearchQuery) (*SearchResult, error) {
+	r, err := le.route(ctx, dbName, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer r.unlock()
+
+	if r.shards == nil {
+		return le.search(ctx, dbName, q)
+	}
+
+	shardQuery := q
+	shardQuery.Offset = 0
+	if q.Size > 0 {
+		shardQuery.Size = q.Offset + q.Size
+	}
+
+	names := r.shards.names(dbName)
+	results := make([]*SearchResult, len(names))
+	if err := fanOut(len(names), func(i int) error {
+		var err error
+		results[i], err = le.search(ctx, names[i], shardQuery)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	var result SearchResult
+	for _, sr := range results {
+		result.Total += sr.Total
+		result.Hits = append(result.Hits, sr.Hits...)
+	}
+
+	sort.SliceStable(result.Hits, func(i, j int) bool {
+		if result.Hits[i].Score != result.Hits[j].Score {
+			return result.Hits[i].Score > result.Hits[j].Score
+		}
+		return compareKeys(result.Hits[i].Document.Key(), result.Hits[j].Document.Key()) < 0
+	})
+
+	if q.Offset >= len(result.Hits) {
+		result.Hits = nil
+		return &result, nil
+	}
+
+	result.Hits = result.Hits[q.Offset:]
+	if q.Size > 0 && len(result.Hits) > q.Size {
+		result.Hits = result.Hits[:q.Size]
+	}
+
+	return &result, nil
+}
+
+// Aggregate computes aggregations over the documents matching a query, the shards of
+// a database are scanned one after another into the same aggregations
+func (le *LemonEngine) Aggregate(ctx context.Context, dbName string, q AggregateQuery, emit func(*AggregateResult) error) error {
+	r, err := le.route(ctx, dbName, false, nil)
+	if err != nil {
+		return err
+	}
+	defer r.unlock()
+
+	if r.shards == nil {
+		return le.aggregate(ctx, dbName, q, emit)
+	}
+
+	if err := q.Validate(); err != nil {
+		return err
+	}
+
+	ag := newAggregator(&q)
+	for _, name := range r.shards.names(dbName) {
+		db, s, err := le.open(ctx, name)
+		if err != nil {
+			return err
+		}
+
+		if err := db.View(ctx, func(tx *lemon.Tx) error {
+			return s.accumulate(ctx, tx, ag, emit)
+		}); err != nil {
+			return err
+		}
+	}
+
+	return emit(ag.result(false))
+}
+
+// Describe returns statistics and settings of a database, those of a sharded database
+// add up the statistics of its shards
+func (le *LemonEngine) Describe(ctx context.Context, dbName string) (*Description, error) {
+	r, err := le.route(ctx, dbName, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer r.unlock()
+
+	if r.shards == nil {
+		return le.describe(ctx, dbName)
+	}
+
+	names := r.shards.names(dbName)
+	descriptions := make([]*Description, len(names))
+	if err := fanOut(len(names), func(i int) error {
+		var err error
+		descriptions[i], err = le.describe(ctx, names[i])
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	opts, err := le.options.get(dbName)
+	if err != nil {
+		return nil, err
+	}
+
+	description := Description{
+		Shards:         r.shards.Shards,
+		ReshardingFrom: r.shards.From,
+		Options:        *opts,
+	}
+
+	for _, d := range descriptions {
+		description.Stats.merge(d.Stats)
+
+		if d.Encryption != nil {
+			if description.Encryption == nil {
+				encryption := *d.Encryption
+				description.Encryption = &encryption
+			} else {
+				description.Encryption.PendingDocuments += d.Encryption.PendingDocuments
+				description.Encryption.Rotating = description.Encryption.Rotating || d.Encryption.Rotating
+			}
+		}
+
+		for _, ix := range d.Indexes {
+			found := false
+			for i := range description.Indexes {
+				if description.Indexes[i].Tag == ix.Tag {
+					description.Indexes[i].Ready = description.Indexes[i].Ready && ix.Ready
+					description.Indexes[i].Entries += ix.Entries
+					found = true
+				}
+			}
+
+			if !found {
+				description.Indexes = append(description.Indexes, ix)
+			}
+		}
+	}
+
+	return &description, nil
+}
+
+// configure changes a setting of every shard of a sharded database, then of the database
+// itself unless it is one of them, as it only keeps the setting for the shards created later
+func (le *LemonEngine) configure(
+	ctx context.Context,
+	dbName string,
+	shard func(name string) error,
+	own func() error,
+) error {
+	r, err := le.route(ctx, dbName, false, nil)
+	if err != nil {
+		return err
+	}
+	defer r.unlock()
+
+	if r.shards == nil {
+		return shard(dbName)
+	}
+
+	names := r.shards.names(dbName)
+	for _, name := range names {
+		if err := shard(name); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range names {
+		if name == dbName {
+			return nil
+		}
+	}
+
+	return own()
+}
+
+// SetSchema sets the schema documents are validated against, an empty schema removes it
+func (le *LemonEngine) SetSchema(ctx context.Context, dbName string, s *Schema) error {
+	return le.configure(ctx, dbName, func(name string) error {
+		return le.setSchema(ctx, name, s)
+	}, func() error {
+		return le.schemas.set(dbName, s)
+	})
+}
+
+// SetOptions changes the storage options of a database
+func (le *LemonEngine) SetOptions(ctx context.Context, dbName string, o *Options) error {
+	if err := o.Validate(); err != nil {
+		return err
+	}
+
+	return le.configure(ctx, dbName, func(name string) error {
+		return le.setOptions(ctx, name, o)
+	}, func() error {
+		if o.Encryption.KeyID != "" {
+			if err := le.keys.ensure(ctx, dbName, o.Encryption.KeyID); err != nil {
+				return err
+			}
+		}
+		return le.options.set(dbName, o)
+	})
+}
+
+// RotateKey creates a new data key for a database, wrapped by keyID when it is set,
+// documents are re-encrypted with it in the background
+func (le *LemonEngine) RotateKey(ctx context.Context, dbName, keyID string) error {
+	return le.configure(ctx, dbName, func(name string) error {
+		return le.rotateKey(ctx, name, keyID)
+	}, func() error {
+		opts, err := le.options.get(dbName)
+		if err != nil {
+			return err
+		}
+		return le.rotateKeyring(ctx, dbName, opts, keyID)
+	})
+}
+
+// Indexes returns the secondary indexes declared on a database, an index of a sharded
+// database is ready once it is ready in all shards
+func (le *LemonEngine) Indexes(ctx context.Context, dbName string) ([]Index, error) {
+	r, err := le.route(ctx, dbName, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer r.unlock()
+
+	indexes, err := le.indexes.get(dbName)
+	if err != nil || r.shards == nil {
+		return indexes, err
+	}
+
+	// the database itself does not build its indexes, its shards do
+	indexes = append([]Index(nil), indexes...)
+	for i := range indexes {
+		indexes[i].Ready = true
+	}
+
+	for _, name := range r.shards.names(dbName) {
+		shardIndexes, err := le.indexes.get(name)
+		if err != nil {
+			return nil, err
+		}
+
+		ready := make(map[string]bool, len(shardIndexes))
+		for _, ix := range shardIndexes {
+			ready[ix.Tag] = ix.Ready
+		}
+
+		for i := range indexes {
+			indexes[i].Ready = indexes[i].Ready && ready[indexes[i].Tag]
+		}
+	}
+
+	return indexes, nil
+}
+
+// SetIndexes declares the tags a database is indexed on, new indexes are built in the background
+func (le *LemonEngine) SetIndexes(ctx context.Context, dbName string, tags []string) ([]Index, error) {
+	if err := validateIndexes(tags); err != nil {
+		return nil, err
+	}
+
+	var indexes []Index
+	if err := le.configure(ctx, dbName, func(name string) error {
+		declared, err := le.setIndexes(ctx, name, tags)
+		if indexes == nil {
+			indexes = declared
+		}
+		return err
+	}, func() error {
+		_, err := le.indexes.set(dbName, tags)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	return indexes, nil
+}
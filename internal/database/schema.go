@@ -0,0 +1,291 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/denismitr/lemon-server/internal/jsondoc"
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidSchema = errors.New("invalid database schema")
+var ErrSchemaViolation = errors.New("schema violation")
+
+const schemaExt = ".schema.json"
+
+type TagType string
+
+const (
+	AnyTag       TagType = ""
+	StrTag       TagType = "str"
+	IntTag       TagType = "int"
+	FloatTag     TagType = "float"
+	BoolTag      TagType = "bool"
+	TimestampTag TagType = "timestamp"
+)
+
+// RequiredTag is a tag every document of a database must have,
+// of the given type unless the type is AnyTag
+type RequiredTag struct {
+	Name string  `json:"name"`
+	Type TagType `json:"type,omitempty"`
+}
+
+// Schema holds the rules documents of a database have to conform to
+type Schema struct {
+	JSONSchema   json.RawMessage `json:"json_schema,omitempty"`
+	RequiredTags []RequiredTag   `json:"required_tags,omitempty"`
+
+	compiled *jsondoc.Schema
+}
+
+// SchemaViolation points at the statement field that does not conform to the schema
+type SchemaViolation struct {
+	Field       string
+	Description string
+}
+
+type SchemaError struct {
+	Violations []SchemaViolation
+}
+
+func (e *SchemaError) Error() string {
+	descriptions := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		descriptions[i] = v.Field + " " + v.Description
+	}
+
+	return ErrSchemaViolation.Error() + ": " + strings.Join(descriptions, "; ")
+}
+
+func (e *SchemaError) Unwrap() error {
+	return ErrSchemaViolation
+}
+
+// NewSchema compiles the json schema and checks the required tag rules,
+// an empty json schema means values are not validated
+func NewSchema(jsonSchema []byte, requiredTags []RequiredTag) (*Schema, error) {
+	s := Schema{RequiredTags: requiredTags}
+
+	if len(jsonSchema) > 0 {
+		compiled, err := jsondoc.CompileSchema(jsonSchema)
+		if err != nil {
+			return nil, &FieldError{Field: "json_schema", Description: err.Error(), Err: ErrInvalidSchema}
+		}
+
+		s.JSONSchema = compiled.Raw()
+		s.compiled = compiled
+	}
+
+	seen := make(map[string]bool, len(requiredTags))
+	for i, rt := range requiredTags {
+		field := fmt.Sprintf("required_tags[%d]", i)
+		switch {
+		case rt.Name == "":
+			return nil, &FieldError{Field: field, Description: "tag name may not be empty", Err: ErrInvalidSchema}
+		case isSystemTag(rt.Name):
+			return nil, &FieldError{Field: field, Description: "tag name may not start with " + SystemTagPrefix, Err: ErrInvalidSchema}
+		case seen[rt.Name]:
+			return nil, &FieldError{Field: field, Description: "duplicate tag " + rt.Name, Err: ErrInvalidSchema}
+		}
+
+		switch rt.Type {
+		case AnyTag, StrTag, IntTag, FloatTag, BoolTag, TimestampTag:
+		default:
+			return nil, &FieldError{Field: field, Description: "unknown tag type " + string(rt.Type), Err: ErrInvalidSchema}
+		}
+
+		seen[rt.Name] = true
+	}
+
+	return &s, nil
+}
+
+// IsEmpty reports whether the schema has no rules at all
+func (s *Schema) IsEmpty() bool {
+	return s == nil || (s.compiled == nil && len(s.RequiredTags) == 0)
+}
+
+// check validates the value and tags of statement i
+func (s *Schema) check(i int, value interface{}, contentType string, tags []Tag) []SchemaViolation {
+	return append(s.checkValue(i, value, contentType), s.checkTags(i, tags)...)
+}
+
+func (s *Schema) checkValue(i int, value interface{}, contentType string) []SchemaViolation {
+	if s.compiled == nil {
+		return nil
+	}
+
+	field := fmt.Sprintf("stmt[%d].value", i)
+	doc, desc := jsonOf(value, contentType)
+	if desc != "" {
+		return []SchemaViolation{{Field: field, Description: desc}}
+	}
+
+	found, err := s.compiled.Validate(doc)
+	if err != nil {
+		return []SchemaViolation{{Field: field, Description: err.Error()}}
+	}
+
+	var violations []SchemaViolation
+	for _, v := range found {
+		violations = append(violations, SchemaViolation{Field: field + v.Path, Description: v.Description})
+	}
+
+	return violations
+}
+
+func (s *Schema) checkTags(i int, tags []Tag) []SchemaViolation {
+	var violations []SchemaViolation
+	for _, rt := range s.RequiredTags {
+		field := fmt.Sprintf("stmt[%d].tags[%s]", i, rt.Name)
+
+		var tag *Tag
+		for j := range tags {
+			if tags[j].Name == rt.Name {
+				tag = &tags[j]
+				break
+			}
+		}
+
+		if tag == nil {
+			violations = append(violations, SchemaViolation{Field: field, Description: "required tag is missing"})
+			continue
+		}
+
+		if rt.Type != AnyTag && tagTypeOf(tag.Value) != rt.Type {
+			violations = append(violations, SchemaViolation{
+				Field:       field,
+				Description: fmt.Sprintf("must be of type %s, got %s", rt.Type, tagTypeOf(tag.Value)),
+			})
+		}
+	}
+
+	return violations
+}
+
+// jsonOf returns the json representation of a typed value, or the reason there is none
+func jsonOf(value interface{}, contentType string) ([]byte, string) {
+	switch typed := value.(type) {
+	case []byte:
+		if IsJSONContentType(contentType) {
+			return typed, ""
+		}
+		return nil, "binary values cannot be validated against the json schema"
+	case string:
+		if IsJSONContentType(contentType) {
+			return []byte(typed), ""
+		}
+	}
+
+	b, err := json.Marshal(value)
+	if err != nil {
+		return nil, err.Error()
+	}
+
+	return b, ""
+}
+
+func tagTypeOf(v interface{}) TagType {
+	switch v.(type) {
+	case string:
+		return StrTag
+	case int:
+		return IntTag
+	case float64:
+		return FloatTag
+	case bool:
+		return BoolTag
+	case time.Time:
+		return TimestampTag
+	default:
+		return AnyTag
+	}
+}
+
+// schemaRegistry keeps database schemas in files next to the database files
+type schemaRegistry struct {
+	dir     string
+	schemas map[string]*Schema
+	mu      sync.RWMutex
+}
+
+func newSchemaRegistry(dir string) *schemaRegistry {
+	return &schemaRegistry{
+		dir:     dir,
+		schemas: make(map[string]*Schema),
+	}
+}
+
+// reset forgets what has been read, so that it is read again from the sidecar files
+func (r *schemaRegistry) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.schemas = make(map[string]*Schema)
+}
+
+// get returns the schema of a database, nil when it has none
+func (r *schemaRegistry) get(dbName string) (*Schema, error) {
+	r.mu.RLock()
+	s, ok := r.schemas[dbName]
+	r.mu.RUnlock()
+	if ok {
+		return s, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s, ok := r.schemas[dbName]; ok {
+		return s, nil
+	}
+
+	path, err := sidecarPath(r.dir, dbName, schemaExt)
+	if err != nil {
+		return nil, err
+	}
+
+	var stored Schema
+	found, err := readSidecar(path, &stored)
+	if err != nil {
+		return nil, err
+	}
+
+	if found {
+		if s, err = NewSchema(stored.JSONSchema, stored.RequiredTags); err != nil {
+			return nil, errors.Wrapf(err, "schema file %s", path)
+		}
+	}
+
+	r.schemas[dbName] = s
+
+	return s, nil
+}
+
+// set stores the schema of a database, an empty schema removes it
+func (r *schemaRegistry) set(dbName string, s *Schema) error {
+	path, err := sidecarPath(r.dir, dbName, schemaExt)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if s.IsEmpty() {
+		s = nil
+		err = removeSidecar(path)
+	} else {
+		err = writeSidecar(path, s)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	r.schemas[dbName] = s
+
+	return nil
+}
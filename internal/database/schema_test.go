@@ -0,0 +1,125 @@
+package database
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Schema_check(t *testing.T) {
+	s, err := NewSchema(
+		[]byte(`{"type":"object","required":["name"],"properties":{"name":{"type":"string"},"age":{"minimum":0}}}`),
+		[]RequiredTag{{Name: "owner", Type: StrTag}, {Name: "published_at", Type: TimestampTag}},
+	)
+	require.NoError(t, err)
+
+	validTags := []Tag{{Name: "owner", Value: "foo"}, {Name: "published_at", Value: time.Now()}}
+
+	tt := []struct {
+		name        string
+		value       interface{}
+		contentType string
+		tags        []Tag
+		exp         []SchemaViolation
+	}{
+		{name: "valid", value: `{"name":"foo","age":1}`, contentType: "application/json", tags: validTags},
+		{
+			name:        "json path violations",
+			value:       []byte(`{"age":-1}`),
+			contentType: "application/json",
+			tags:        validTags,
+			exp: []SchemaViolation{
+				{Field: "stmt[2].value/name", Description: "is required"},
+				{Field: "stmt[2].value/age", Description: "must be >= 0"},
+			},
+		},
+		{
+			name:  "plain string is validated as json string",
+			value: "foo",
+			tags:  validTags,
+			exp:   []SchemaViolation{{Field: "stmt[2].value", Description: "must be of type object, got string"}},
+		},
+		{
+			name:  "binary values",
+			value: []byte{1, 2},
+			tags:  validTags,
+			exp:   []SchemaViolation{{Field: "stmt[2].value", Description: "binary values cannot be validated against the json schema"}},
+		},
+		{
+			name:        "tag violations",
+			value:       `{"name":"foo"}`,
+			contentType: "application/json",
+			tags:        []Tag{{Name: "published_at", Value: 1}},
+			exp: []SchemaViolation{
+				{Field: "stmt[2].tags[owner]", Description: "required tag is missing"},
+				{Field: "stmt[2].tags[published_at]", Description: "must be of type timestamp, got int"},
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.exp, s.check(2, tc.value, tc.contentType, tc.tags))
+		})
+	}
+}
+
+func Test_NewSchema_Invalid(t *testing.T) {
+	tt := []struct {
+		name         string
+		jsonSchema   string
+		requiredTags []RequiredTag
+		field        string
+	}{
+		{name: "invalid json schema", jsonSchema: `{"type":"date"}`, field: "json_schema"},
+		{name: "system tag", requiredTags: []RequiredTag{{Name: "@content_type"}}, field: "required_tags[0]"},
+		{name: "duplicate tag", requiredTags: []RequiredTag{{Name: "a"}, {Name: "a"}}, field: "required_tags[1]"},
+		{name: "unknown tag type", requiredTags: []RequiredTag{{Name: "a", Type: "date"}}, field: "required_tags[0]"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewSchema([]byte(tc.jsonSchema), tc.requiredTags)
+
+			var fieldErr *FieldError
+			require.True(t, errors.As(err, &fieldErr))
+			assert.Equal(t, tc.field, fieldErr.Field)
+			assert.True(t, errors.Is(err, ErrInvalidSchema))
+		})
+	}
+}
+
+func Test_schemaRegistry(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := NewSchema([]byte(`{"type":"string"}`), []RequiredTag{{Name: "owner"}})
+	require.NoError(t, err)
+
+	r := newSchemaRegistry(dir)
+	require.NoError(t, r.set("users", s))
+	assert.FileExists(t, filepath.Join(dir, "users.schema.json"))
+
+	// a fresh registry reads the schema back from disk
+	loaded, err := newSchemaRegistry(dir).get("users")
+	require.NoError(t, err)
+	require.NotNil(t, loaded)
+	assert.JSONEq(t, `{"type":"string"}`, string(loaded.JSONSchema))
+	assert.Equal(t, []RequiredTag{{Name: "owner"}}, loaded.RequiredTags)
+	assert.Len(t, loaded.check(0, 1, "", []Tag{{Name: "owner", Value: "x"}}), 1)
+
+	require.NoError(t, r.set("users", &Schema{}))
+	_, err = os.Stat(filepath.Join(dir, "users.schema.json"))
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	missing, err := newSchemaRegistry(dir).get("users")
+	require.NoError(t, err)
+	assert.Nil(t, missing)
+
+	_, err = r.get("../users")
+	assert.True(t, errors.Is(err, ErrInvalidDatabaseName))
+}
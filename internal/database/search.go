@@ -0,0 +1,584 @@
+package database
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/denismitr/lemon"
+	"github.com/denismitr/lemon-server/internal/fulltext"
+	"github.com/pkg/errors"
+)
+
+var ErrSearchDisabled = errors.New("full-text search is disabled")
+var ErrSearchNotReady = errors.New("full-text index is not ready")
+
+// The full-text index of a database is a lemon file next to it, e.g. data/products.search.ldb,
+// written after the documents of a write were. Postings keep the positions of a term in a document
+// keyed by p:t<term>:k<key>, indexed documents keep their length and terms keyed by d:k<key>.
+// Segments carry a type letter, so that lemon never compares them as integers.
+const searchExt = ".search" + ext
+
+const (
+	searchPostingPrefix  = "p:"
+	searchDocumentPrefix = "d:"
+	searchStatsKey       = "stats"
+	// searchReadyKey is written once all documents of a database were indexed
+	searchReadyKey = "ready"
+)
+
+// searchBatchSize is the number of documents indexed in one transaction while building a full-text index
+const searchBatchSize = 500
+
+// SearchQuery is a full-text query together with the page of hits to return
+type SearchQuery struct {
+	Query  fulltext.Query
+	Offset int
+	Size   int
+	// HighlightPre and HighlightPost wrap matched words in snippets
+	HighlightPre  string
+	HighlightPost string
+}
+
+// SearchHit is a document matching a full-text query
+type SearchHit struct {
+	Document *Document
+	Score    float64
+	// Snippet is the part of the value with the most matched words, highlighted
+	Snippet string
+}
+
+// SearchResult is a page of hits ranked by score, Total is the number of all matching documents
+type SearchResult struct {
+	Hits  []SearchHit
+	Total int
+}
+
+// searchDocument is what a full-text index keeps of an indexed document
+type searchDocument struct {
+	Length int      `json:"n"`
+	Terms  []string `json:"t"`
+}
+
+func searchTermPrefix(term string) string {
+	return searchPostingPrefix + "t" + base64.RawURLEncoding.EncodeToString([]byte(term)) + ":"
+}
+
+func searchKeySegment(key string) string {
+	return "k" + base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+func postingKey(term, key string) string {
+	return searchTermPrefix(term) + searchKeySegment(key)
+}
+
+func searchDocumentKey(key string) string {
+	return searchDocumentPrefix + searchKeySegment(key)
+}
+
+func decodeSearchKeySegment(segment string) (string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(segment, "k"))
+	if err != nil {
+		return "", errors.Wrapf(ErrEngineFailed, "invalid full-text index entry %s", segment)
+	}
+
+	return string(b), nil
+}
+
+// searchText returns the text a document is indexed with, only plain string values are
+func searchText(d *Document) (string, bool) {
+	if d.ContentType() != lemon.String || d.Tags().String(valueTypeTag) != "" || IsJSONContentType(contentTypeOf(d)) {
+		return "", false
+	}
+
+	return d.RawString(), true
+}
+
+func readSearchStats(tx *lemon.Tx) (fulltext.Stats, error) {
+	var stats fulltext.Stats
+	d, err := getStored(tx, searchStatsKey)
+	if err != nil || d == nil {
+		return stats, err
+	}
+
+	if err := json.Unmarshal(d.Value(), &stats); err != nil {
+		return stats, errors.Wrapf(ErrEngineFailed, "invalid full-text index stats: %s", err)
+	}
+
+	return stats, nil
+}
+
+func writeSearchStats(tx *lemon.Tx, stats fulltext.Stats) error {
+	b, err := json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+
+	return tx.InsertOrReplace(searchStatsKey, string(b))
+}
+
+func readSearchDocument(tx *lemon.Tx, key string) (*searchDocument, error) {
+	d, err := getStored(tx, searchDocumentKey(key))
+	if err != nil || d == nil {
+		return nil, err
+	}
+
+	var sd searchDocument
+	if err := json.Unmarshal(d.Value(), &sd); err != nil {
+		return nil, errors.Wrapf(ErrEngineFailed, "invalid full-text index entry of %s: %s", key, err)
+	}
+
+	return &sd, nil
+}
+
+// indexText replaces the postings of a document with the ones of its tokens, without tokens it is removed
+func indexText(tx *lemon.Tx, stats *fulltext.Stats, key string, tokens []fulltext.Token) error {
+	prev, err := readSearchDocument(tx, key)
+	if err != nil {
+		return err
+	}
+
+	if prev != nil {
+		for _, term := range prev.Terms {
+			if err := tx.Remove(postingKey(term, key)); err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Remove(searchDocumentKey(key)); err != nil {
+			return err
+		}
+
+		stats.Documents--
+		stats.Tokens -= prev.Length
+	}
+
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	var terms []string
+	positions := make(map[string][]string)
+	for _, t := range tokens {
+		if _, ok := positions[t.Term]; !ok {
+			terms = append(terms, t.Term)
+		}
+		positions[t.Term] = append(positions[t.Term], strconv.Itoa(t.Position))
+	}
+
+	for _, term := range terms {
+		if err := tx.InsertOrReplace(postingKey(term, key), strings.Join(positions[term], ",")); err != nil {
+			return err
+		}
+	}
+
+	b, err := json.Marshal(searchDocument{Length: len(tokens), Terms: terms})
+	if err != nil {
+		return err
+	}
+
+	if err := tx.InsertOrReplace(searchDocumentKey(key), string(b)); err != nil {
+		return err
+	}
+
+	stats.Documents++
+	stats.Tokens += len(tokens)
+
+	return nil
+}
+
+// searchIndex reads the full-text index of a database within a transaction
+type searchIndex struct {
+	tx       *lemon.Tx
+	postings map[string]map[string][]int
+}
+
+func (ix *searchIndex) Postings(term string) (map[string][]int, error) {
+	if p, ok := ix.postings[term]; ok {
+		return p, nil
+	}
+
+	prefix := searchTermPrefix(term)
+	postings := make(map[string][]int)
+	var entryErr error
+	if err := scanPrefix(ix.tx, prefix, func(d *lemon.Document) bool {
+		key, err := decodeSearchKeySegment(strings.TrimPrefix(d.Key(), prefix))
+		if err != nil {
+			entryErr = err
+			return false
+		}
+
+		for _, p := range strings.Split(d.RawString(), ",") {
+			pos, err := strconv.Atoi(p)
+			if err != nil {
+				entryErr = errors.Wrapf(ErrEngineFailed, "invalid positions in full-text index entry %s", d.Key())
+				return false
+			}
+			postings[key] = append(postings[key], pos)
+		}
+		return true
+	}); err != nil {
+		return nil, errors.Wrap(ErrEngineFailed, err.Error())
+	}
+
+	if entryErr != nil {
+		return nil, entryErr
+	}
+
+	ix.postings[term] = postings
+	return postings, nil
+}
+
+func (ix *searchIndex) Keys() ([]string, error) {
+	var keys []string
+	var entryErr error
+	if err := scanPrefix(ix.tx, searchDocumentPrefix, func(d *lemon.Document) bool {
+		key, err := decodeSearchKeySegment(strings.TrimPrefix(d.Key(), searchDocumentPrefix))
+		if err != nil {
+			entryErr = err
+			return false
+		}
+
+		keys = append(keys, key)
+		return true
+	}); err != nil {
+		return nil, errors.Wrap(ErrEngineFailed, err.Error())
+	}
+
+	return keys, entryErr
+}
+
+type rankedKey struct {
+	key   string
+	score float64
+}
+
+// rank returns the keys of the documents matching a query, the best scoring ones first
+// and ones scoring the same in key order
+func rank(tx *lemon.Tx, q fulltext.Query) ([]rankedKey, error) {
+	ix := &searchIndex{tx: tx, postings: make(map[string]map[string][]int)}
+	matched, err := fulltext.Match(q, ix)
+	if err != nil {
+		return nil, err
+	}
+
+	stats, err := readSearchStats(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	terms := fulltext.Terms(q)
+	ranked := make([]rankedKey, 0, len(matched))
+	for key := range matched {
+		sd, err := readSearchDocument(tx, key)
+		if err != nil {
+			return nil, err
+		}
+
+		if sd == nil {
+			continue
+		}
+
+		var score float64
+		for _, term := range terms {
+			postings, err := ix.Postings(term)
+			if err != nil {
+				return nil, err
+			}
+			score += fulltext.BM25(len(postings[key]), sd.Length, len(postings), stats)
+		}
+
+		ranked = append(ranked, rankedKey{key: key, score: score})
+	}
+
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].score != ranked[j].score {
+			return ranked[i].score > ranked[j].score
+		}
+		return compareKeys(ranked[i].key, ranked[j].key) < 0
+	})
+
+	return ranked, nil
+}
+
+// search returns a page of the documents matching a full-text query ranked by BM25 score,
+// it fails with ErrSearchNotReady while the index of the database is being built
+func (le *LemonEngine) search(ctx context.Context, dbName string, q SearchQuery) (*SearchResult, error) {
+	db, s, err := le.open(ctx, dbName)
+	if err != nil {
+		return nil, err
+	}
+
+	if !s.options.FullText.Enabled {
+		return nil, errors.Wrapf(ErrSearchDisabled, "database %s", dbName)
+	}
+
+	sdb, err := le.store.getFile(dbName, searchExt)
+	if err != nil {
+		return nil, err
+	}
+
+	var ranked []rankedKey
+	if err := sdb.View(ctx, func(tx *lemon.Tx) error {
+		if !tx.Has(searchReadyKey) {
+			return errors.Wrapf(ErrSearchNotReady, "full-text index of database %s is being built", dbName)
+		}
+
+		ranked, err = rank(tx, q.Query)
+		return err
+	}); err != nil {
+		if errors.Is(err, ErrSearchNotReady) {
+			le.resumeSearch(dbName)
+		}
+		return nil, err
+	}
+
+	result := SearchResult{Total: len(ranked)}
+	if q.Offset >= len(ranked) {
+		return &result, nil
+	}
+
+	page := ranked[q.Offset:]
+	if q.Size > 0 && len(page) > q.Size {
+		page = page[:q.Size]
+	}
+
+	terms := fulltext.Terms(q.Query)
+	if err := db.View(ctx, func(tx *lemon.Tx) error {
+		for _, r := range page {
+			stored, err := getStored(tx, r.key)
+			if err != nil {
+				return err
+			}
+
+			// deleted after the index was read
+			if stored == nil {
+				continue
+			}
+
+			d, err := s.decode(stored)
+			if err != nil {
+				return err
+			}
+
+			text, _ := searchText(d)
+			result.Hits = append(result.Hits, SearchHit{
+				Document: d,
+				Score:    r.score,
+				Snippet:  fulltext.Snippet(text, terms, fulltext.SnippetSize, q.HighlightPre, q.HighlightPost),
+			})
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// searchLock serializes updates of the full-text index of a database
+func (le *LemonEngine) searchLock(dbName string) *sync.Mutex {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+
+	l, ok := le.searchLocks[dbName]
+	if !ok {
+		l = &sync.Mutex{}
+		le.searchLocks[dbName] = l
+	}
+
+	return l
+}
+
+// updateSearch indexes the documents of keys after a write, the index gets rebuilt
+// when it cannot be updated, so that it never misses writes
+func (le *LemonEngine) updateSearch(dbName string, s *settings, keys []string) {
+	if !s.options.FullText.Enabled || len(keys) == 0 {
+		return
+	}
+
+	// the write is done, so the index gets updated even when its request is canceled
+	if err := le.indexSearch(context.Background(), dbName, s, keys); err != nil {
+		le.lg.Errorf("could not update full-text index of database '%s', rebuilding it: %s", dbName, err)
+		le.rebuildSearch(dbName)
+	}
+}
+
+// indexSearch indexes the documents of keys as they are stored, removing
+// the ones that do not exist anymore from the full-text index
+func (le *LemonEngine) indexSearch(ctx context.Context, dbName string, s *settings, keys []string) error {
+	l := le.searchLock(dbName)
+	l.Lock()
+	defer l.Unlock()
+
+	// full-text search may have been disabled since the options were read
+	o, err := le.options.get(dbName)
+	if err != nil || !o.FullText.Enabled {
+		return err
+	}
+
+	db, err := le.store.Get(dbName)
+	if err != nil {
+		return err
+	}
+
+	tokens := make(map[string][]fulltext.Token, len(keys))
+	if err := db.View(ctx, func(tx *lemon.Tx) error {
+		for _, key := range keys {
+			stored, err := getStored(tx, key)
+			if err != nil {
+				return err
+			}
+
+			if stored == nil {
+				continue
+			}
+
+			d, err := s.decode(stored)
+			if err != nil {
+				return err
+			}
+
+			if text, ok := searchText(d); ok {
+				tokens[key] = fulltext.Analyze(text)
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	sdb, err := le.store.getFile(dbName, searchExt)
+	if err != nil {
+		return err
+	}
+
+	return sdb.Update(ctx, func(tx *lemon.Tx) error {
+		stats, err := readSearchStats(tx)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			if err := indexText(tx, &stats, key, tokens[key]); err != nil {
+				return err
+			}
+		}
+
+		return writeSearchStats(tx, stats)
+	})
+}
+
+// rebuildSearch starts building the full-text index of a database from scratch, or removing it
+// when full-text search got disabled, another pass follows when one is already running
+func (le *LemonEngine) rebuildSearch(dbName string) {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+
+	if _, ok := le.searchBuilds[dbName]; ok {
+		le.searchBuilds[dbName] = true
+		return
+	}
+
+	le.searchBuilds[dbName] = false
+
+	go func() {
+		for {
+			err := le.buildSearch(context.Background(), dbName)
+			if err != nil {
+				le.lg.Errorf("could not build full-text index of database '%s': %s", dbName, err)
+			}
+
+			le.mu.Lock()
+			if err != nil || !le.searchBuilds[dbName] {
+				delete(le.searchBuilds, dbName)
+				le.mu.Unlock()
+				return
+			}
+
+			le.searchBuilds[dbName] = false
+			le.mu.Unlock()
+		}
+	}()
+}
+
+// resumeSearch builds a full-text index left unfinished e.g. by a restart, unless it is being built
+func (le *LemonEngine) resumeSearch(dbName string) {
+	le.mu.Lock()
+	_, ok := le.searchBuilds[dbName]
+	le.mu.Unlock()
+
+	if !ok {
+		le.rebuildSearch(dbName)
+	}
+}
+
+// buildSearch removes the full-text index of a database, then indexes all documents
+// in batches when full-text search is enabled, and marks the index ready
+func (le *LemonEngine) buildSearch(ctx context.Context, dbName string) error {
+	db, s, err := le.open(ctx, dbName)
+	if err != nil {
+		return err
+	}
+
+	l := le.searchLock(dbName)
+	l.Lock()
+	err = le.store.removeFile(dbName, searchExt)
+	l.Unlock()
+
+	if err != nil || !s.options.FullText.Enabled {
+		return err
+	}
+
+	var keys []string
+	if err := db.View(ctx, func(tx *lemon.Tx) error {
+		return scanUser(tx, func(d *lemon.Document) bool {
+			keys = append(keys, d.Key())
+			return true
+		})
+	}); err != nil {
+		return errors.Wrap(ErrEngineFailed, err.Error())
+	}
+
+	indexed := len(keys)
+	for len(keys) > 0 {
+		n := searchBatchSize
+		if n > len(keys) {
+			n = len(keys)
+		}
+
+		if err := le.indexSearch(ctx, dbName, s, keys[:n]); err != nil {
+			return err
+		}
+
+		keys = keys[n:]
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	// a pass removing the index follows when full-text search was disabled in the meantime
+	o, err := le.options.get(dbName)
+	if err != nil || !o.FullText.Enabled {
+		return err
+	}
+
+	sdb, err := le.store.getFile(dbName, searchExt)
+	if err != nil {
+		return err
+	}
+
+	if err := sdb.Update(ctx, func(tx *lemon.Tx) error {
+		return tx.InsertOrReplace(searchReadyKey, "true")
+	}); err != nil {
+		return err
+	}
+
+	le.lg.Infof("built full-text index of database '%s' with %d documents", dbName, indexed)
+
+	return nil
+}
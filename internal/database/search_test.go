@@ -0,0 +1,98 @@
+package database
+
+import (
+	"context"
+	"testing"
+
+	"github.com/denismitr/lemon"
+	"github.com/denismitr/lemon-server/internal/fulltext"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_search(t *testing.T) {
+	db, closer, err := lemon.Open(lemon.InMemory)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = closer() })
+
+	texts := map[string]string{
+		"p:1":  "Wireless keyboard with quiet keys",
+		"p:2":  "Wireless mouse, refurbished",
+		"p:10": "Wired keyboard and mouse, a keyboard for every desk",
+		"p:11": "Noise cancelling headphones",
+	}
+
+	index := func(texts map[string]string) {
+		require.NoError(t, db.Update(context.Background(), func(tx *lemon.Tx) error {
+			stats, err := readSearchStats(tx)
+			if err != nil {
+				return err
+			}
+
+			for key, text := range texts {
+				if err := indexText(tx, &stats, key, fulltext.Analyze(text)); err != nil {
+					return err
+				}
+			}
+
+			return writeSearchStats(tx, stats)
+		}))
+	}
+
+	search := func(query string) []string {
+		q, err := fulltext.Parse(query)
+		require.NoError(t, err)
+
+		var keys []string
+		require.NoError(t, db.View(context.Background(), func(tx *lemon.Tx) error {
+			ranked, err := rank(tx, q)
+			for _, r := range ranked {
+				keys = append(keys, r.key)
+			}
+			return err
+		}))
+
+		return keys
+	}
+
+	index(texts)
+
+	tt := []struct {
+		query    string
+		expected []string
+	}{
+		// the document mentioning keyboards twice ranks first
+		{query: "keyboards", expected: []string{"p:10", "p:1"}},
+		// shorter documents rank first
+		{query: "wireless", expected: []string{"p:2", "p:1"}},
+		{query: "wireless (mouse OR keyboard) -refurbished", expected: []string{"p:1"}},
+		{query: `"noise cancelling"`, expected: []string{"p:11"}},
+		{query: `"cancelling noise"`, expected: nil},
+		// negations do not score, so hits rank in key order
+		{query: "NOT keyboard", expected: []string{"p:2", "p:11"}},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.query, func(t *testing.T) {
+			assert.Equal(t, tc.expected, search(tc.query))
+		})
+	}
+
+	t.Run("updates and removals", func(t *testing.T) {
+		index(map[string]string{"p:1": "Wireless trackpad"})
+		index(map[string]string{"p:2": ""})
+
+		assert.Equal(t, []string{"p:10"}, search("keyboard"))
+		assert.Equal(t, []string{"p:1"}, search("wireless"))
+
+		require.NoError(t, db.View(context.Background(), func(tx *lemon.Tx) error {
+			stats, err := readSearchStats(tx)
+			require.NoError(t, err)
+			assert.Equal(t, fulltext.Stats{Documents: 3, Tokens: 2 + 9 + 3}, stats)
+
+			assert.False(t, tx.Has(postingKey("keyboard", "p:1")))
+			assert.False(t, tx.Has(searchDocumentKey("p:2")))
+			return nil
+		}))
+	})
+}
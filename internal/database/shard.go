@@ -0,0 +1,844 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/denismitr/lemon"
+	"github.com/pkg/errors"
+)
+
+// A sharded database spreads its documents over databases of the store, its shards, named after
+// the database and the number of the shard, e.g. users~0 to users~3. The shard of a key is found
+// on a consistent hash ring, so that changing the number of shards only moves the keys of the
+// shards added or removed. Shards have the settings of their database, which are changed on all
+// of them and kept by the database itself for the shards created later.
+//
+// Resharding moves the keys to their new shards in the background while the database is used.
+// Keys are moved in batches with the database locked, and writes of keys not moved yet move
+// them first, so that every key is found in one shard whenever the database is not locked.
+// Previous versions and trashed copies of moved documents are not moved, they are dropped
+// together with the shards removed, the tombstones of deleted documents are moved. Moves are announced to commit hooks, which see shards,
+// but not to change hooks, the documents of the database do not change.
+//
+// Replication streams the documents of shards, but not the layout of databases, so sharding
+// is disabled on replicating servers.
+
+var ErrReshardInProgress = errors.New("database is being resharded")
+var ErrShardingDisabled = errors.New("sharding is disabled")
+
+// MaxShards is the largest number of shards of a database
+const MaxShards = 256
+
+const (
+	shardsExt      = ".shards.json"
+	shardSeparator = "~"
+	// shardPoints is the number of points of every shard on the hash ring
+	shardPoints = 64
+)
+
+// hashRing places shards on a ring of hashes, a key belongs to the shard of the first point
+// at or after the hash of the key
+type hashRing struct {
+	points []uint64
+	shards []int
+}
+
+func newHashRing(n int) *hashRing {
+	type point struct {
+		hash  uint64
+		shard int
+	}
+
+	points := make([]point, 0, n*shardPoints)
+	for i := 0; i < n; i++ {
+		for p := 0; p < shardPoints; p++ {
+			points = append(points, point{hash: hashOf(fmt.Sprintf("%d:%d", i, p)), shard: i})
+		}
+	}
+
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+		return points[i].shard < points[j].shard
+	})
+
+	r := &hashRing{points: make([]uint64, len(points)), shards: make([]int, len(points))}
+	for i, p := range points {
+		r.points[i], r.shards[i] = p.hash, p.shard
+	}
+
+	return r
+}
+
+func (r *hashRing) shard(key string) int {
+	h := hashOf(key)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i] >= h
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+
+	return r.shards[i]
+}
+
+// hashOf is FNV-1a followed by the splitmix64 finalizer, which spreads similar keys over the ring
+func hashOf(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+
+	return x ^ (x >> 31)
+}
+
+// shardName names shard i of n, a database with a single shard is its own shard
+func shardName(dbName string, i, n int) string {
+	if n == 1 {
+		return dbName
+	}
+
+	return dbName + shardSeparator + strconv.Itoa(i)
+}
+
+// shardNames names the n shards of a database
+func shardNames(dbName string, n int) []string {
+	names := make([]string, n)
+	for i := range names {
+		names[i] = shardName(dbName, i, n)
+	}
+
+	return names
+}
+
+// shardMap is the number of shards of a database, From is the previous number
+// while documents are moved to their new shards
+type shardMap struct {
+	Shards int `json:"shards"`
+	From   int `json:"from,omitempty"`
+
+	ring     *hashRing
+	fromRing *hashRing
+}
+
+func (m *shardMap) resharding() bool {
+	return m.From > 0
+}
+
+// owner returns the shard a key belongs to
+func (m *shardMap) owner(dbName, key string) string {
+	return shardName(dbName, m.ring.shard(key), m.Shards)
+}
+
+// previous returns the shard a key belonged to before resharding, empty when it was not moved
+func (m *shardMap) previous(dbName, key string) string {
+	if !m.resharding() {
+		return ""
+	}
+
+	if prev := shardName(dbName, m.fromRing.shard(key), m.From); prev != m.owner(dbName, key) {
+		return prev
+	}
+
+	return ""
+}
+
+// names returns the shards of a database in name order, those of both layouts while resharding
+func (m *shardMap) names(dbName string) []string {
+	names := shardNames(dbName, m.Shards)
+	if m.resharding() {
+		current := make(map[string]bool, len(names))
+		for _, name := range names {
+			current[name] = true
+		}
+
+		for _, name := range shardNames(dbName, m.From) {
+			if !current[name] {
+				names = append(names, name)
+			}
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// shardPart holds the positions of the keys of a batch found in one shard
+type shardPart struct {
+	name      string
+	positions []int
+}
+
+// split groups the positions of keys by the shards they belong to, in shard name order
+func (m *shardMap) split(dbName string, keys []string) []shardPart {
+	return groupKeys(keys, func(key string) []string {
+		return []string{m.owner(dbName, key)}
+	})
+}
+
+// lookup groups the positions of keys by the shards they may be found in, which while resharding
+// are the shards they belong to before and after
+func (m *shardMap) lookup(dbName string, keys []string) []shardPart {
+	return groupKeys(keys, func(key string) []string {
+		if prev := m.previous(dbName, key); prev != "" {
+			return []string{m.owner(dbName, key), prev}
+		}
+		return []string{m.owner(dbName, key)}
+	})
+}
+
+// spans reports whether keys belong to more than one shard
+func (m *shardMap) spans(dbName string, keys []string) bool {
+	for _, key := range keys {
+		if m.owner(dbName, key) != m.owner(dbName, keys[0]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func groupKeys(keys []string, shards func(key string) []string) []shardPart {
+	byName := make(map[string]*shardPart)
+	for pos, key := range keys {
+		for _, name := range shards(key) {
+			p, ok := byName[name]
+			if !ok {
+				p = &shardPart{name: name}
+				byName[name] = p
+			}
+			p.positions = append(p.positions, pos)
+		}
+	}
+
+	parts := make([]shardPart, 0, len(byName))
+	for _, p := range byName {
+		parts = append(parts, *p)
+	}
+
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].name < parts[j].name
+	})
+
+	return parts
+}
+
+// splitWrite divides a write to a sharded database among its shards, in shard name order
+func (m *shardMap) splitWrite(w TxWrite) []TxWrite {
+	byName := make(map[string]*TxWrite)
+	shard := func(key string) *TxWrite {
+		name := m.owner(w.Database, key)
+		sw, ok := byName[name]
+		if !ok {
+			sw = &TxWrite{Database: name}
+			byName[name] = sw
+		}
+		return sw
+	}
+
+	for _, d := range w.Inserts {
+		sw := shard(d.Key)
+		sw.Inserts = append(sw.Inserts, d)
+	}
+
+	for _, d := range w.Upserts {
+		sw := shard(d.Key)
+		sw.Upserts = append(sw.Upserts, d)
+	}
+
+	for _, key := range w.Deletes {
+		sw := shard(key)
+		sw.Deletes = append(sw.Deletes, key)
+	}
+
+	writes := make([]TxWrite, 0, len(byName))
+	for _, sw := range byName {
+		writes = append(writes, *sw)
+	}
+
+	sort.Slice(writes, func(i, j int) bool {
+		return writes[i].Database < writes[j].Database
+	})
+
+	return writes
+}
+
+// shardRegistry keeps the shard maps of sharded databases in files next to the database files
+type shardRegistry struct {
+	dir  string
+	maps map[string]*shardMap
+	mu   sync.RWMutex
+}
+
+func newShardRegistry(dir string) *shardRegistry {
+	return &shardRegistry{
+		dir:  dir,
+		maps: make(map[string]*shardMap),
+	}
+}
+
+// reset forgets what has been read, so that it is read again from the sidecar files
+func (r *shardRegistry) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.maps = make(map[string]*shardMap)
+}
+
+// get returns the shard map of a database, nil when it is not sharded
+func (r *shardRegistry) get(dbName string) (*shardMap, error) {
+	r.mu.RLock()
+	m, ok := r.maps[dbName]
+	r.mu.RUnlock()
+	if ok {
+		return m, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if m, ok := r.maps[dbName]; ok {
+		return m, nil
+	}
+
+	path, err := sidecarPath(r.dir, dbName, shardsExt)
+	if err != nil {
+		return nil, err
+	}
+
+	var stored shardMap
+	found, err := readSidecar(path, &stored)
+	if err != nil {
+		return nil, err
+	}
+
+	if found {
+		if stored.Shards < 1 || stored.Shards > MaxShards || stored.From < 0 || stored.From > MaxShards {
+			return nil, errors.Errorf("shard file %s: invalid number of shards", path)
+		}
+		m = newShardMap(stored.Shards, stored.From)
+	}
+
+	r.maps[dbName] = m
+
+	return m, nil
+}
+
+// set stores the shard map of a database, nil removes it
+func (r *shardRegistry) set(dbName string, m *shardMap) error {
+	path, err := sidecarPath(r.dir, dbName, shardsExt)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if m == nil {
+		err = removeSidecar(path)
+	} else {
+		err = writeSidecar(path, m)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	r.maps[dbName] = m
+
+	return nil
+}
+
+func newShardMap(shards, from int) *shardMap {
+	m := &shardMap{Shards: shards, From: from, ring: newHashRing(shards)}
+	if from > 0 {
+		m.fromRing = newHashRing(from)
+	}
+
+	return m
+}
+
+// shardLock serializes resharding a database with its reads and writes
+func (le *LemonEngine) shardLock(dbName string) *sync.RWMutex {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+
+	l, ok := le.shardLocks[dbName]
+	if !ok {
+		l = new(sync.RWMutex)
+		le.shardLocks[dbName] = l
+	}
+
+	return l
+}
+
+// DisableSharding makes resharding fail, it fails itself when a database is sharded already
+func (le *LemonEngine) DisableSharding() error {
+	le.mu.Lock()
+	le.shardingDisabled = true
+	le.mu.Unlock()
+
+	names, err := le.store.Names()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if strings.Contains(name, shardSeparator) {
+			return errors.Wrapf(ErrShardingDisabled, "database %s is sharded", LogicalName(name))
+		}
+	}
+
+	return nil
+}
+
+// LogicalName returns the database a shard belongs to, the name of other databases is their own
+func LogicalName(name string) string {
+	if i := strings.Index(name, shardSeparator); i >= 0 {
+		return name[:i]
+	}
+
+	return name
+}
+
+// checkLogicalName rejects names of shards, which are only addressed through their database
+func checkLogicalName(dbName string) error {
+	if strings.Contains(dbName, shardSeparator) {
+		return errors.Wrapf(ErrInvalidDatabaseName, "%s is a shard of a database", dbName)
+	}
+
+	return nil
+}
+
+// Reshard spreads the documents of a database over n shards, a single shard being the database
+// itself. Documents are moved in the background while the database is read and written,
+// it cannot be resharded again before they all were moved
+func (le *LemonEngine) Reshard(ctx context.Context, dbName string, n int) error {
+	if err := checkLogicalName(dbName); err != nil {
+		return err
+	}
+
+	if !validDBNameRegEx.MatchString(dbName) {
+		return ErrInvalidDatabaseName
+	}
+
+	if n < 1 || n > MaxShards {
+		return &FieldError{
+			Field:       "shards",
+			Description: fmt.Sprintf("must be between 1 and %d", MaxShards),
+			Err:         ErrInvalidInput,
+		}
+	}
+
+	le.mu.Lock()
+	disabled := le.shardingDisabled
+	le.mu.Unlock()
+	if disabled {
+		return errors.Wrapf(ErrShardingDisabled, "database %s cannot be resharded while replicating", dbName)
+	}
+
+	l := le.shardLock(dbName)
+	l.Lock()
+	defer l.Unlock()
+
+	m, err := le.shardMaps.get(dbName)
+	if err != nil {
+		return err
+	}
+
+	from := 1
+	if m != nil {
+		if m.resharding() {
+			le.reshard(dbName)
+			return errors.Wrapf(
+				ErrReshardInProgress,
+				"database %s is being resharded from %d to %d shards", dbName, m.From, m.Shards,
+			)
+		}
+		from = m.Shards
+	}
+
+	if from == n {
+		return nil
+	}
+
+	existing := make(map[string]bool)
+	for _, name := range shardNames(dbName, from) {
+		existing[name] = true
+	}
+
+	for _, name := range shardNames(dbName, n) {
+		if !existing[name] && name != dbName {
+			if err := le.copySettings(ctx, dbName, name); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := le.shardMaps.set(dbName, newShardMap(n, from)); err != nil {
+		return err
+	}
+
+	le.lg.Infof("resharding database '%s' from %d to %d shards", dbName, from, n)
+	le.reshard(dbName)
+
+	return nil
+}
+
+// copySettings gives a new shard the settings of its database
+func (le *LemonEngine) copySettings(ctx context.Context, dbName, shard string) error {
+	schema, err := le.schemas.get(dbName)
+	if err != nil {
+		return err
+	}
+
+	if schema != nil {
+		if err := le.schemas.set(shard, schema); err != nil {
+			return err
+		}
+	}
+
+	opts, err := le.options.get(dbName)
+	if err != nil {
+		return err
+	}
+
+	if *opts != (Options{}) {
+		if err := le.setOptions(ctx, shard, opts); err != nil {
+			return err
+		}
+	}
+
+	indexes, err := le.indexes.get(dbName)
+	if err != nil {
+		return err
+	}
+
+	if len(indexes) > 0 {
+		tags := make([]string, len(indexes))
+		for i, ix := range indexes {
+			tags[i] = ix.Tag
+		}
+
+		if _, err := le.setIndexes(ctx, shard, tags); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reshard starts moving the documents of a database to their new shards unless they are being moved
+func (le *LemonEngine) reshard(dbName string) {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+
+	if le.resharding[dbName] {
+		return
+	}
+
+	le.resharding[dbName] = true
+
+	go func() {
+		if err := le.moveShards(context.Background(), dbName); err != nil {
+			le.lg.Errorf("could not reshard database '%s': %s", dbName, err)
+		}
+
+		le.mu.Lock()
+		delete(le.resharding, dbName)
+		le.mu.Unlock()
+	}()
+}
+
+// moveShards moves the keys of the shards of the previous layout that belong to other shards now,
+// then stores the new layout and drops the shards not part of it
+func (le *LemonEngine) moveShards(ctx context.Context, dbName string) error {
+	m, err := le.shardMaps.get(dbName)
+	if err != nil || m == nil || !m.resharding() {
+		return err
+	}
+
+	l := le.shardLock(dbName)
+	moved := 0
+	for _, from := range shardNames(dbName, m.From) {
+		keys, err := le.userKeys(ctx, from)
+		if err != nil {
+			return err
+		}
+
+		buried, err := le.buriedKeys(ctx, from)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, buried...)
+
+		var moving []string
+		for _, key := range keys {
+			if m.owner(dbName, key) != from {
+				moving = append(moving, key)
+			}
+		}
+
+		for len(moving) > 0 {
+			n := snapshotBatchSize
+			if n > len(moving) {
+				n = len(moving)
+			}
+
+			l.Lock()
+			err := le.moveFrom(ctx, dbName, m, from, moving[:n])
+			l.Unlock()
+			if err != nil {
+				return err
+			}
+
+			moved += n
+			moving = moving[n:]
+		}
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	if err := le.finishReshard(dbName, m); err != nil {
+		return err
+	}
+
+	le.lg.Infof("resharded database '%s' from %d to %d shards, %d documents moved", dbName, m.From, m.Shards, moved)
+
+	return nil
+}
+
+// moveKeys moves keys not moved yet to their new shards, the database has to be locked
+func (le *LemonEngine) moveKeys(ctx context.Context, dbName string, m *shardMap, keys []string) error {
+	byShard := make(map[string][]string)
+	for _, key := range keys {
+		if prev := m.previous(dbName, key); prev != "" {
+			byShard[prev] = append(byShard[prev], key)
+		}
+	}
+
+	for _, from := range shardNames(dbName, m.From) {
+		if len(byShard[from]) == 0 {
+			continue
+		}
+
+		if err := le.moveFrom(ctx, dbName, m, from, byShard[from]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// moveFrom copies the documents of keys from a shard to the shards they belong to with their
+// revisions and timestamps, then deletes them from the shard, the database has to be locked
+func (le *LemonEngine) moveFrom(ctx context.Context, dbName string, m *shardMap, from string, keys []string) error {
+	if err := le.moveTombstones(ctx, dbName, m, from, keys); err != nil {
+		return err
+	}
+
+	changes, err := le.Changes(ctx, from, keys)
+	if err != nil {
+		return err
+	}
+
+	byShard := make(map[string][]Change)
+	var removed []Change
+	for _, c := range changes {
+		if c.Document == nil {
+			continue
+		}
+
+		owner := m.owner(dbName, c.Key)
+		byShard[owner] = append(byShard[owner], c)
+		removed = append(removed, Change{Key: c.Key})
+	}
+
+	for _, owner := range shardNames(dbName, m.Shards) {
+		if len(byShard[owner]) == 0 {
+			continue
+		}
+
+		if err := le.applyChanges(ctx, owner, byShard[owner], true); err != nil {
+			return errors.Wrapf(err, "could not move documents from shard %s to %s", from, owner)
+		}
+	}
+
+	if len(removed) == 0 {
+		return nil
+	}
+
+	return le.applyChanges(ctx, from, removed, true)
+}
+
+// moveTombstones moves the tombstones of deleted keys from a shard to the shards the keys belong to,
+// the database has to be locked
+func (le *LemonEngine) moveTombstones(ctx context.Context, dbName string, m *shardMap, from string, keys []string) error {
+	src, err := le.store.Get(from)
+	if err != nil {
+		return err
+	}
+
+	type tombstone struct {
+		revision uint64
+		at       time.Time
+	}
+
+	byShard := make(map[string]map[string]tombstone)
+	var moved []string
+	if err := src.View(ctx, func(tx *lemon.Tx) error {
+		for _, key := range keys {
+			revision, at, err := buried(tx, key)
+			if err != nil {
+				return err
+			}
+
+			owner := m.owner(dbName, key)
+			if revision == 0 || owner == from {
+				continue
+			}
+
+			if byShard[owner] == nil {
+				byShard[owner] = make(map[string]tombstone)
+			}
+			byShard[owner][key] = tombstone{revision: revision, at: at}
+			moved = append(moved, key)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if len(moved) == 0 {
+		return nil
+	}
+
+	for _, owner := range shardNames(dbName, m.Shards) {
+		if len(byShard[owner]) == 0 {
+			continue
+		}
+
+		dst, err := le.store.Get(owner)
+		if err != nil {
+			return err
+		}
+
+		if err := dst.Update(ctx, func(tx *lemon.Tx) error {
+			for key, t := range byShard[owner] {
+				if err := bury(tx, key, t.revision, t.at); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return errors.Wrapf(err, "could not move tombstones from shard %s to %s", from, owner)
+		}
+	}
+
+	return src.Update(ctx, func(tx *lemon.Tx) error {
+		for _, key := range moved {
+			if err := tx.Remove(tombstoneKey(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// finishReshard stores the new layout of a database once all keys were moved and drops
+// the shards not part of it
+func (le *LemonEngine) finishReshard(dbName string, m *shardMap) error {
+	var next *shardMap
+	if m.Shards > 1 {
+		next = newShardMap(m.Shards, 0)
+	}
+
+	if err := le.shardMaps.set(dbName, next); err != nil {
+		return err
+	}
+
+	kept := make(map[string]bool)
+	for _, name := range shardNames(dbName, m.Shards) {
+		kept[name] = true
+	}
+
+	for _, name := range shardNames(dbName, m.From) {
+		if kept[name] {
+			continue
+		}
+
+		if err := le.dropShard(dbName, name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// dropShard removes a shard with its files, the database itself only loses its documents,
+// as it keeps the settings for the shards
+func (le *LemonEngine) dropShard(dbName, name string) error {
+	for _, fileExt := range []string{ext, searchExt} {
+		if err := le.store.removeFile(name, fileExt); err != nil {
+			return err
+		}
+	}
+
+	le.counts.forget(name)
+
+	if name == dbName {
+		return nil
+	}
+
+	for _, fileExt := range []string{schemaExt, optionsExt, keysExt, indexesExt} {
+		path, err := sidecarPath(le.store.dir, name, fileExt)
+		if err != nil {
+			return err
+		}
+
+		if err := removeSidecar(path); err != nil {
+			return err
+		}
+	}
+
+	le.schemas.reset()
+	le.options.reset()
+	le.keys.reset()
+	le.indexes.reset()
+
+	return nil
+}
+
+// fanOut calls f with 0 to n-1 in parallel, returning the first error in that order
+func fanOut(n int, f func(i int) error) error {
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = f(i)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
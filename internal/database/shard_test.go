@@ -0,0 +1,177 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/denismitr/lemon-server/internal/lql"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_hashRing(t *testing.T) {
+	four, five := newHashRing(4), newHashRing(5)
+
+	counts := make([]int, 5)
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("u:%d", i)
+		before, after := four.shard(key), five.shard(key)
+		counts[after]++
+
+		// keys only move to the shard added
+		if before != after {
+			assert.Equal(t, 4, after, key)
+		}
+	}
+
+	for shard, n := range counts {
+		assert.InDelta(t, 2000, n, 600, "shard %d", shard)
+	}
+}
+
+func Test_Reshard(t *testing.T) {
+	le := newTestEngine(t)
+	ctx := context.Background()
+
+	var keys []string
+	var batch BatchUpsert
+	for i := 0; i < 120; i++ {
+		key := fmt.Sprintf("u:%d", i)
+		keys = append(keys, key)
+		batch = append(batch, Upsert{Key: key, Value: fmt.Sprintf("user %d", i)})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return compareKeys(keys[i], keys[j]) < 0
+	})
+
+	_, err := le.BatchUpsert(ctx, "users", batch)
+	require.NoError(t, err)
+
+	resharded := func(t *testing.T, shards int) {
+		require.Eventually(t, func() bool {
+			d, err := le.Describe(ctx, "users")
+			return err == nil && d.Shards == shards && d.ReshardingFrom == 0
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	readable := func(t *testing.T) {
+		docs, err := le.MGet(ctx, "users", keys, time.Time{})
+		require.NoError(t, err)
+		assert.Len(t, docs, len(keys))
+		assert.Equal(t, "user 7", docs["u:7"].RawString())
+
+		stmt, err := lql.Parse(`FIND IN users WHERE key > "u:0" LIMIT 5`)
+		require.NoError(t, err)
+		var found []string
+		page := Page{}
+		for {
+			result, err := le.Query(ctx, stmt, page)
+			require.NoError(t, err)
+			if len(result.Documents) == 0 {
+				break
+			}
+			for _, d := range result.Documents {
+				found = append(found, d.Key())
+			}
+			stmt.Limit = 0
+			page = Page{After: found[len(found)-1], Size: 5}
+		}
+		assert.Equal(t, keys[1:], found)
+
+		d, err := le.Describe(ctx, "users")
+		require.NoError(t, err)
+		assert.Equal(t, uint64(len(keys)), d.Stats.Documents)
+	}
+
+	t.Run("documents are moved to new shards", func(t *testing.T) {
+		require.NoError(t, le.Reshard(ctx, "users", 4))
+		resharded(t, 4)
+		readable(t)
+
+		names, err := le.store.Names()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"users~0", "users~1", "users~2", "users~3"}, names)
+	})
+
+	t.Run("writes spanning shards are atomic", func(t *testing.T) {
+		_, err := le.BatchUpsert(ctx, "users", BatchUpsert{
+			{Key: "u:1", Value: "changed"},
+			{Key: "u:2", Value: "changed"},
+			{Key: "u:3", Value: "changed", ExpectedRevision: 7},
+		})
+		require.True(t, errors.Is(err, ErrRevisionMismatch))
+
+		docs, err := le.MGet(ctx, "users", []string{"u:1", "u:2", "u:3"}, time.Time{})
+		require.NoError(t, err)
+		for _, d := range docs {
+			assert.NotEqual(t, "changed", d.RawString())
+		}
+
+		r, err := le.BatchDeleteByKey(ctx, "users", BatchDeleteByKey{"u:1", "u:2", "u:3"})
+		require.NoError(t, err)
+		assert.Equal(t, uint64(3), r.RowsAffected)
+
+		r, err = le.BatchInsert(ctx, "users", BatchInsert{
+			{Key: "u:1", Value: "user 1"},
+			{Key: "u:2", Value: "user 2"},
+			{Key: "u:3", Value: "user 3"},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, uint64(3), r.RowsAffected)
+
+		docs, err = le.MGet(ctx, "users", []string{"u:1", "u:2", "u:3"}, time.Time{})
+		require.NoError(t, err)
+		for _, d := range docs {
+			assert.Equal(t, uint64(2), d.Revision())
+		}
+	})
+
+	t.Run("shards are addressed through their database", func(t *testing.T) {
+		_, err := le.MGet(ctx, "users~0", keys, time.Time{})
+		assert.True(t, errors.Is(err, ErrInvalidDatabaseName))
+
+		err = le.Reshard(ctx, "users", 0)
+		var fieldErr *FieldError
+		require.True(t, errors.As(err, &fieldErr))
+		assert.Equal(t, "shards", fieldErr.Field)
+	})
+
+	t.Run("a database resharded to one shard is its own shard again", func(t *testing.T) {
+		require.NoError(t, le.Reshard(ctx, "users", 1))
+		resharded(t, 1)
+		readable(t)
+
+		names, err := le.store.Names()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"users"}, names)
+	})
+
+	t.Run("tombstones of deleted keys are moved", func(t *testing.T) {
+		deleted := BatchDeleteByKey{"u:1", "u:2", "u:3", "u:4", "u:5"}
+		before, err := le.MGet(ctx, "users", deleted, time.Time{})
+		require.NoError(t, err)
+		_, err = le.BatchDeleteByKey(ctx, "users", deleted)
+		require.NoError(t, err)
+
+		require.NoError(t, le.Reshard(ctx, "users", 3))
+		resharded(t, 3)
+
+		var inserts BatchInsert
+		for _, key := range deleted {
+			inserts = append(inserts, Insert{Key: key, Value: "back"})
+		}
+		_, err = le.BatchInsert(ctx, "users", inserts)
+		require.NoError(t, err)
+
+		docs, err := le.MGet(ctx, "users", deleted, time.Time{})
+		require.NoError(t, err)
+		require.Len(t, docs, len(deleted))
+		for _, d := range docs {
+			assert.Equal(t, before[d.Key()].Revision()+1, d.Revision(), d.Key())
+		}
+	})
+}
@@ -0,0 +1,70 @@
+package database
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// Sidecar files hold per-database settings next to the database file,
+// e.g. data/users.ldb and data/users.schema.json
+
+func sidecarPath(dir, dbName, ext string) (string, error) {
+	if !validDBNameRegEx.MatchString(dbName) {
+		return "", ErrInvalidDatabaseName
+	}
+
+	return filepath.Join(dir, dbName+ext), nil
+}
+
+// readSidecar decodes the json file into v, reporting false when there is no such file
+func readSidecar(path string, v interface{}) (bool, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, errors.Wrapf(err, "could not read file %s", path)
+	}
+
+	if err := json.Unmarshal(b, v); err != nil {
+		return false, errors.Wrapf(err, "could not parse file %s", path)
+	}
+
+	return true, nil
+}
+
+// writeSidecar writes and renames, so that a crash never leaves a partial file behind
+func writeSidecar(path string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrapf(err, "could not create directory %s", dir)
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return errors.Wrapf(err, "could not write file %s", tmp)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return errors.Wrapf(err, "could not replace file %s", path)
+	}
+
+	return nil
+}
+
+func removeSidecar(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errors.Wrapf(err, "could not remove file %s", path)
+	}
+
+	return nil
+}
@@ -1,22 +1,32 @@
 package database
 
 import (
+	"encoding/json"
 	"github.com/denismitr/lemon"
 	"github.com/pkg/errors"
+	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 )
 
 var ErrInvalidDatabaseName = errors.New("invalid database name")
+var ErrStoreClosed = errors.New("store is closed")
 
 const (
-	baseDir = "data" // move to config
+	// baseDir is the data directory used when none is configured
+	baseDir = "data"
 	ext     = ".ldb"
+	// intentsDir holds the intent log of cross database transactions, one file per transaction
+	intentsDir = "transactions"
 )
 
+const DefaultIdleTimeout = 10 * time.Minute
+const DefaultJanitorInterval = time.Minute
+
 type connection struct {
 	db     *lemon.DB
 	t      *time.Timer
@@ -24,53 +34,317 @@ type connection struct {
 }
 
 type Store struct {
-	databases map[string]*connection
-	mu        sync.Mutex
+	dir             string
+	databases       map[string]*connection
+	idleTimeout     time.Duration
+	janitorInterval time.Duration
+	done            chan struct{}
+	closed          bool
+	mu              sync.Mutex
 }
 
-func NewStore() *Store {
+// NewStore keeps the databases in dir, the data directory of the working directory when empty
+func NewStore(dir string, idleTimeout time.Duration) *Store {
+	if dir == "" {
+		dir = baseDir
+	}
+
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultIdleTimeout
+	}
+
 	return &Store{
-		databases: make(map[string]*connection),
+		dir:             dir,
+		databases:       make(map[string]*connection),
+		idleTimeout:     idleTimeout,
+		janitorInterval: DefaultJanitorInterval,
+		done:            make(chan struct{}),
+	}
+}
+
+// SetJanitorInterval changes the time between janitor runs, starting with the next one
+func (s *Store) SetJanitorInterval(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d > 0 {
+		s.janitorInterval = d
+	}
+}
+
+// StartJanitor runs job in the background once every janitor interval, until the store is closed
+func (s *Store) StartJanitor(job func()) {
+	go func() {
+		for {
+			s.mu.Lock()
+			interval := s.janitorInterval
+			s.mu.Unlock()
+
+			select {
+			case <-s.done:
+				return
+			case <-time.After(interval):
+				job()
+			}
+		}
+	}()
+}
+
+// Names returns the names of all databases in the data directory, open or not
+func (s *Store) Names() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "could not list databases in %s", s.dir)
+	}
+
+	var names []string
+	for _, e := range entries {
+		name := strings.TrimSuffix(e.Name(), ext)
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ext) && validDBNameRegEx.MatchString(name) {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
+
+// Close stops the janitor and closes all open databases
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+
+	s.closed = true
+	close(s.done)
+
+	var firstErr error
+	for name, c := range s.databases {
+		c.t.Stop()
+		delete(s.databases, name)
+		if err := c.closer(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// SetIdleTimeout changes the time after which unused databases get closed,
+// open databases pick it up on their next use
+func (s *Store) SetIdleTimeout(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d > 0 {
+		s.idleTimeout = d
 	}
 }
 
 func (s *Store) Get(name string) (*lemon.DB, error) {
+	return s.getFile(name, ext)
+}
+
+// getFile opens the lemon file of a database with the given extension, files other
+// than the database itself hold data kept next to it, like full-text indexes
+func (s *Store) getFile(name, fileExt string) (*lemon.DB, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if c, ok := s.databases[name]; ok {
-		c.t.Reset(10 * time.Minute)
-		return c.db, nil
+	if s.closed {
+		return nil, ErrStoreClosed
+	}
+
+	id := name + fileExt
+	if c, ok := s.databases[id]; ok {
+		if c.t.Stop() {
+			c.t.Reset(s.idleTimeout)
+			return c.db, nil
+		}
+
+		// the idle timer has already fired, and eviction is waiting for the lock
+		delete(s.databases, id)
+		_ = c.closer()
 	}
 
-	fullDBPath, err := createFullDBPath(name)
+	fullDBPath, err := createFilePath(s.dir, name, fileExt)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "could not create directory %s", s.dir)
+	}
+
 	db, closer, err := lemon.Open(fullDBPath)
 	if err != nil {
 		return nil, err
 	}
 
-	c := connection{
+	c := &connection{
 		closer: closer,
 		db:     db,
-		t:      time.NewTimer(10 * time.Minute),
 	}
 
-	s.databases[name] = &c
+	c.t = time.AfterFunc(s.idleTimeout, func() {
+		s.evict(id, c)
+	})
+
+	s.databases[id] = c
 
 	return db, nil
 }
 
-var validDBNameRegEx = regexp.MustCompile(`^[0-9a-zA-Z_-]{1,120}$`)
+// removeFile closes and deletes the lemon file of a database with the given extension
+func (s *Store) removeFile(name, fileExt string) error {
+	path, err := createFilePath(s.dir, name, fileExt)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := name + fileExt
+	if c, ok := s.databases[id]; ok {
+		c.t.Stop()
+		delete(s.databases, id)
+		if err := c.closer(); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errors.Wrapf(err, "could not remove file %s", path)
+	}
 
-func createFullDBPath(name string) (string, error) {
+	return nil
+}
+
+// evict closes an idle database file unless it has been reopened in the meantime
+func (s *Store) evict(id string, c *connection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.databases[id] != c {
+		return
+	}
+
+	delete(s.databases, id)
+	_ = c.closer()
+}
+
+// validDBNameRegEx matches the names of the databases in the store, shards of sharded databases included
+var validDBNameRegEx = regexp.MustCompile(`^[0-9a-zA-Z_-]{1,120}(~[0-9]{1,3})?$`)
+
+func createFilePath(dir, name, fileExt string) (string, error) {
 	if !validDBNameRegEx.MatchString(name) {
 		return "", ErrInvalidDatabaseName
 	}
 
 	name = filepath.Base(name)
 	name = strings.TrimSuffix(name, ext)
-	return "./" + filepath.Join(baseDir, name+ext), nil
+	path := filepath.Join(dir, name+fileExt)
+	if !filepath.IsAbs(path) {
+		path = "./" + path
+	}
+
+	return path, nil
+}
+
+func (s *Store) intentPath(id string) string {
+	return filepath.Join(s.dir, intentsDir, id+".json")
+}
+
+// logIntent durably writes the intent of a cross database transaction,
+// once it returns the transaction is committed
+func (s *Store) logIntent(in *intent) error {
+	b, err := json.Marshal(in)
+	if err != nil {
+		return errors.Wrapf(err, "could not encode intent of transaction %s", in.ID)
+	}
+
+	dir := filepath.Join(s.dir, intentsDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrapf(err, "could not create directory %s", dir)
+	}
+
+	path := s.intentPath(in.ID)
+	tmp := path + ".tmp"
+	if err := writeSynced(tmp, b); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return errors.Wrapf(err, "could not rename file %s", tmp)
+	}
+
+	// the rename itself is only durable once the directory is synced
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrapf(err, "could not open directory %s", dir)
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return errors.Wrapf(err, "could not sync directory %s", dir)
+	}
+
+	return nil
+}
+
+func writeSynced(path string, b []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "could not create file %s", path)
+	}
+
+	if _, err := f.Write(b); err != nil {
+		_ = f.Close()
+		return errors.Wrapf(err, "could not write file %s", path)
+	}
+
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return errors.Wrapf(err, "could not sync file %s", path)
+	}
+
+	return f.Close()
+}
+
+// intents returns the logged intents of cross database transactions in the order they were committed
+func (s *Store) intents() ([]*intent, error) {
+	dir := filepath.Join(s.dir, intentsDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "could not list intents in %s", dir)
+	}
+
+	var intents []*intent
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+
+		in := new(intent)
+		if _, err := readSidecar(filepath.Join(dir, e.Name()), in); err != nil {
+			return nil, err
+		}
+
+		intents = append(intents, in)
+	}
+
+	sort.Slice(intents, func(i, j int) bool {
+		return intents[i].CreatedAt.Before(intents[j].CreatedAt)
+	})
+
+	return intents, nil
+}
+
+// removeIntent forgets a cross database transaction all databases have the writes of
+func (s *Store) removeIntent(id string) error {
+	return removeSidecar(s.intentPath(id))
 }
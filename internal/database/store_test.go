@@ -16,11 +16,12 @@ func Test_createPath(t *testing.T) {
 		{in: "foo", exp: "./data/foo.ldb"},
 		{in: "foo-ldb", exp: "./data/foo-ldb.ldb"},
 		{in: "foo_ldb", exp: "./data/foo_ldb.ldb"},
+		{in: "foo~2", exp: "./data/foo~2.ldb"},
 	}
 
 	for i, tc := range validNames {
 		t.Run(fmt.Sprintf("Valid DB names test case: %d", i), func(t *testing.T) {
-			exp, err := createFullDBPath(tc.in)
+			exp, err := createFilePath(baseDir, tc.in, ext)
 			require.NoErrorf(t, err, "should be no error")
 			assert.Equal(t, tc.exp, exp)
 		})
@@ -37,7 +38,7 @@ func Test_createPath(t *testing.T) {
 
 	for i, tc := range invalidNames {
 		t.Run(fmt.Sprintf("Invalid DB names test case: %d", i), func(t *testing.T) {
-			exp, err := createFullDBPath(tc.in)
+			exp, err := createFilePath(baseDir, tc.in, ext)
 			assert.Error(t, err)
 			assert.Truef(t, errors.Is(err, ErrInvalidDatabaseName), "should be ErrInvalidDatabaseName")
 			assert.Equal(t, "", exp)
@@ -0,0 +1,96 @@
+package database
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/denismitr/lemon"
+)
+
+// System documents are kept by the server next to user documents in the same
+// lemon database, so that they change in the same transactions. Their keys start
+// with a prefix user keys may not use, and they are never returned to clients.
+const SystemKeyPrefix = "@"
+
+func isSystemKey(key string) bool {
+	return strings.HasPrefix(key, SystemKeyPrefix)
+}
+
+// scanUser calls cb for every user document
+func scanUser(tx *lemon.Tx, cb func(d *lemon.Document) bool) error {
+	return tx.Scan(nil, func(d *lemon.Document) bool {
+		if isSystemKey(d.Key()) {
+			return true
+		}
+
+		return cb(d)
+	})
+}
+
+// scanPrefix calls cb for every document whose key starts with prefix, in key order
+func scanPrefix(tx *lemon.Tx, prefix string, cb func(d *lemon.Document) bool) error {
+	return tx.Scan(lemon.Q().Prefix(prefix), func(d *lemon.Document) bool {
+		if !strings.HasPrefix(d.Key(), prefix) {
+			return false
+		}
+
+		return cb(d)
+	})
+}
+
+// scanKeyPrefix calls cb for every user document whose key starts with prefix, lemon compares
+// key segments that look like integers numerically, so keys sharing a last segment fragment that
+// could start an integer are not next to each other and all documents have to be scanned
+func scanKeyPrefix(tx *lemon.Tx, prefix string, cb func(d *lemon.Document) bool) error {
+	if prefix != "" && !isSystemKey(prefix) && isContiguousPrefix(prefix) {
+		return scanPrefix(tx, prefix, cb)
+	}
+
+	return scanUser(tx, func(d *lemon.Document) bool {
+		return !strings.HasPrefix(d.Key(), prefix) || cb(d)
+	})
+}
+
+// isContiguousPrefix reports whether the keys starting with prefix are next to each other in key order
+func isContiguousPrefix(prefix string) bool {
+	fragment := prefix[strings.LastIndex(prefix, ":")+1:]
+	return fragment == "" || strings.Trim(fragment, "+-0123456789") != ""
+}
+
+// compareKeys compares keys in the order lemon keeps them, segment by segment,
+// with segments that are both integers without leading zeros compared numerically
+func compareKeys(a, b string) int {
+	as, bs := strings.Split(a, ":"), strings.Split(b, ":")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if c := compareKeySegments(as[i], bs[i]); c != 0 {
+			return c
+		}
+	}
+
+	return compareOrdered(len(as) < len(bs), len(as) > len(bs))
+}
+
+func compareKeySegments(a, b string) int {
+	if a != "" && b != "" && a[0] != '0' && b[0] != '0' {
+		x, errX := strconv.Atoi(a)
+		y, errY := strconv.Atoi(b)
+		if errX == nil && errY == nil {
+			return compareOrdered(x < y, x > y)
+		}
+	}
+
+	return strings.Compare(a, b)
+}
+
+// countUser returns the number of user documents
+func countUser(tx *lemon.Tx) (int, error) {
+	system := 0
+	if err := scanPrefix(tx, SystemKeyPrefix, func(d *lemon.Document) bool {
+		system++
+		return true
+	}); err != nil {
+		return 0, err
+	}
+
+	return tx.Count() - system, nil
+}
@@ -0,0 +1,717 @@
+package database
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/denismitr/lemon"
+	"github.com/pkg/errors"
+)
+
+var ErrTransactionInDoubt = errors.New("transaction in doubt")
+
+// Cross database transactions use a two-phase commit. In the first phase every database
+// applies its writes in a lemon transaction that is kept open, together with a marker
+// document. Once all of them succeeded, the intent of the transaction with all of its
+// writes is logged by the store, which is the commit point, and the lemon transactions
+// are committed in the second phase. Transactions without a logged intent are rolled back,
+// a crash before the commit point loses the open lemon transactions. A crash after it
+// leaves the transaction in doubt, it is completed at startup by applying the logged
+// writes again to every database without the marker. A database failing to commit is
+// completed the same way in the background, writes to it wait until it is. Markers and
+// the intent are removed once all databases have the writes.
+const transactionKeyPrefix = SystemKeyPrefix + "txn:"
+
+const (
+	// settleRetryMin and settleRetryMax bound the time between attempts to complete a transaction in doubt
+	settleRetryMin = 100 * time.Millisecond
+	settleRetryMax = 10 * time.Second
+)
+
+func transactionKey(id string) string {
+	return transactionKeyPrefix + id
+}
+
+// TxWrite holds the writes of a cross database transaction to one database,
+// applied in the order inserts, upserts, deletes
+type TxWrite struct {
+	Database string
+	Inserts  BatchInsert
+	Upserts  BatchUpsert
+	Deletes  BatchDeleteByKey
+}
+
+func (w TxWrite) keys() []string {
+	keys := append(w.Inserts.keys(), w.Upserts.keys()...)
+	return append(keys, w.Deletes...)
+}
+
+type TxResult struct {
+	ID           string
+	RowsAffected uint64
+}
+
+// participant is a database taking part in a transaction, with its lemon transaction kept open
+type participant struct {
+	write TxWrite
+	s     *settings
+	tx    *lemon.Tx
+	count countChange
+}
+
+func validateTxWrites(writes []TxWrite) error {
+	if len(writes) == 0 {
+		return errors.Wrap(ErrEmptyInput, "at least one database must be written to")
+	}
+
+	seen := make(map[string]int, len(writes))
+	for i, w := range writes {
+		if first, ok := seen[w.Database]; ok {
+			return &FieldError{
+				Field:       fmt.Sprintf("writes[%d].database", i),
+				Description: fmt.Sprintf("database %s is already written to by writes[%d]", w.Database, first),
+				Err:         ErrInvalidInput,
+			}
+		}
+		seen[w.Database] = i
+
+		if len(w.Inserts)+len(w.Upserts)+len(w.Deletes) == 0 {
+			return &FieldError{
+				Field:       fmt.Sprintf("writes[%d]", i),
+				Description: "at least one insert, upsert or delete must be given",
+				Err:         ErrInvalidInput,
+			}
+		}
+	}
+
+	return nil
+}
+
+// NewTransactionID returns a random transaction id
+func NewTransactionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "could not generate transaction id")
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+type transactionIDCtxKey struct{}
+
+// WithTransactionID attaches the id of the transaction a write makes to ctx, so that every node
+// applying the same write logs the same transaction, otherwise transaction ids are random
+func WithTransactionID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, transactionIDCtxKey{}, id)
+}
+
+func transactionIDFrom(ctx context.Context) (string, error) {
+	if id, ok := ctx.Value(transactionIDCtxKey{}).(string); ok && id != "" {
+		return id, nil
+	}
+
+	return NewTransactionID()
+}
+
+// transact writes to several databases, all of them or none. The databases are prepared in parallel
+// when parallel is set, which the caller has to serialize with other parallel transactions
+// of the same databases, as they do not lock them in name order
+func (le *LemonEngine) transact(ctx context.Context, writes []TxWrite, parallel bool) (*TxResult, error) {
+	if err := validateTxWrites(writes); err != nil {
+		return nil, err
+	}
+
+	id, err := transactionIDFrom(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// databases are locked in name order, so that concurrent transactions cannot deadlock
+	writes = append([]TxWrite(nil), writes...)
+	sort.Slice(writes, func(i, j int) bool {
+		return writes[i].Database < writes[j].Database
+	})
+
+	in, err := newIntent(id, nowFrom(ctx), PrincipalFrom(ctx), writes)
+	if err != nil {
+		return nil, err
+	}
+
+	participants := make([]*participant, len(writes))
+	rollback := func() {
+		for _, p := range participants {
+			if p == nil {
+				continue
+			}
+
+			if err := p.tx.Rollback(); err != nil {
+				le.lg.Errorf("could not roll back transaction %s in database %s: %v", id, p.write.Database, err)
+			}
+		}
+	}
+
+	prepared := make([]int, len(writes))
+	if parallel {
+		if err := fanOut(len(writes), func(i int) error {
+			var err error
+			participants[i], prepared[i], err = le.join(ctx, writes[i], in)
+			return err
+		}); err != nil {
+			rollback()
+			return nil, err
+		}
+	} else {
+		for i := range writes {
+			if participants[i], prepared[i], err = le.join(ctx, writes[i], in); err != nil {
+				rollback()
+				return nil, err
+			}
+		}
+	}
+
+	affected := 0
+	for _, n := range prepared {
+		affected += n
+	}
+
+	if err := le.store.logIntent(in); err != nil {
+		rollback()
+		return nil, err
+	}
+
+	var failed []string
+	for _, p := range participants {
+		if err := le.commit(p.tx); err != nil {
+			le.lg.Errorf("could not commit transaction %s to database %s: %v", id, p.write.Database, err)
+			failed = append(failed, p.write.Database)
+			continue
+		}
+
+		le.counts.apply(p.count)
+		le.committed(p.write.Database, p.s, p.write.keys())
+	}
+
+	if failed != nil {
+		le.settle(in, failed)
+		return nil, errors.Wrapf(
+			ErrTransactionInDoubt,
+			"transaction %s is committed, but could not be written to databases %s yet, it is completed in the background",
+			id, strings.Join(failed, ", "),
+		)
+	}
+
+	// the client does not have to wait for the clean up, nor may it cancel it
+	if err := le.forget(context.Background(), in); err != nil {
+		le.lg.Errorf("could not clean up transaction %s: %v", id, err)
+	}
+
+	return &TxResult{ID: id, RowsAffected: uint64(affected)}, nil
+}
+
+// join opens the lemon transaction of a database taking part in a transaction and prepares
+// its writes in it, returning the number of documents written
+func (le *LemonEngine) join(ctx context.Context, w TxWrite, in *intent) (*participant, int, error) {
+	db, s, err := le.open(ctx, w.Database)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if err := w.Inserts.checkSchema(s); err != nil {
+		return nil, 0, errors.Wrapf(err, "database %s", w.Database)
+	}
+
+	if err := w.Upserts.checkSchema(s); err != nil {
+		return nil, 0, errors.Wrapf(err, "database %s", w.Database)
+	}
+
+	tx, err := db.Begin(ctx, false)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	n, cc, err := le.prepare(ctx, tx, s, w, in)
+	if err != nil {
+		if rErr := tx.Rollback(); rErr != nil {
+			le.lg.Errorf("could not roll back transaction %s in database %s: %v", in.ID, w.Database, rErr)
+		}
+		return nil, 0, errors.Wrapf(err, "database %s", w.Database)
+	}
+
+	return &participant{write: w, s: s, tx: tx, count: cc}, n, nil
+}
+
+// prepare applies the writes of a transaction to one database in tx together with the marker,
+// returning the number of documents written and the change of the count of documents
+func (le *LemonEngine) prepare(ctx context.Context, tx *lemon.Tx, s *settings, w TxWrite, in *intent) (int, countChange, error) {
+	if err := insertDocuments(tx, s, w.Inserts, in.CreatedAt); err != nil {
+		return 0, countChange{}, err
+	}
+
+	added, err := upsertDocuments(tx, s, w.Upserts, in.CreatedAt)
+	if err != nil {
+		return 0, countChange{}, err
+	}
+
+	deleted, err := le.deleteDocuments(ctx, tx, w.Database, s, w.Deletes, in.CreatedAt, in.Principal)
+	if err != nil {
+		return 0, countChange{}, err
+	}
+
+	cc, err := le.countDocuments(tx, w.Database, len(w.Inserts)+added-deleted)
+	if err != nil {
+		return 0, countChange{}, err
+	}
+
+	if err := mark(tx, in); err != nil {
+		return 0, countChange{}, err
+	}
+
+	return len(w.Inserts) + len(w.Upserts) + deleted, cc, nil
+}
+
+// replay applies the writes of a committed transaction to one database in tx together with the marker,
+// as they were logged: inserts replace documents and upserts do not check revisions, nor is the quota
+// checked, as the transaction was committed whatever was written since it was prepared
+func (le *LemonEngine) replay(ctx context.Context, tx *lemon.Tx, s *settings, w TxWrite, in *intent) error {
+	upserts := make(BatchUpsert, 0, len(w.Inserts)+len(w.Upserts))
+	for _, ins := range w.Inserts {
+		upserts = append(upserts, Upsert{
+			Key:                ins.Key,
+			Value:              ins.Value,
+			ContentType:        ins.ContentType,
+			Tags:               ins.Tags,
+			PreserveTimestamps: ins.WithTimestamps,
+		})
+	}
+
+	for _, ups := range w.Upserts {
+		ups.ExpectedRevision = 0
+		upserts = append(upserts, ups)
+	}
+
+	if _, err := upsertDocuments(tx, s, upserts, in.CreatedAt); err != nil {
+		return err
+	}
+
+	if _, err := le.deleteDocuments(ctx, tx, w.Database, s, w.Deletes, in.CreatedAt, in.Principal); err != nil {
+		return err
+	}
+
+	return mark(tx, in)
+}
+
+// mark stores the marker of a transaction telling that a database has its writes
+func mark(tx *lemon.Tx, in *intent) error {
+	return tx.InsertOrReplace(transactionKey(in.ID), in.CreatedAt.UTC().Format(time.RFC3339Nano))
+}
+
+// doubt is a committed transaction the databases of which have not all got its writes yet
+type doubt struct {
+	databases []string
+	// done is closed once they have
+	done chan struct{}
+}
+
+// settle applies the writes of a transaction to the databases in doubt until it succeeds,
+// or until the store is closed, which leaves the transaction to be recovered on the next start.
+// Writes to the databases wait for it
+func (le *LemonEngine) settle(in *intent, dbNames []string) {
+	d := &doubt{databases: dbNames, done: make(chan struct{})}
+	le.mu.Lock()
+	le.doubts[in.ID] = d
+	le.mu.Unlock()
+
+	go func() {
+		defer func() {
+			le.mu.Lock()
+			delete(le.doubts, in.ID)
+			le.mu.Unlock()
+			close(d.done)
+		}()
+
+		failed := make(map[string]bool, len(dbNames))
+		for _, name := range dbNames {
+			failed[name] = true
+		}
+
+		ctx := context.Background()
+		delay := settleRetryMin
+		for {
+			redone, err := le.redo(ctx, in, failed)
+			if err == nil {
+				le.lg.Infof("completed transaction %s, written again to %d of %d databases", in.ID, redone, len(in.Writes))
+				break
+			}
+
+			le.lg.Errorf("could not complete transaction %s, retrying in %s: %v", in.ID, delay, err)
+			select {
+			case <-le.store.done:
+				return
+			case <-time.After(delay):
+			}
+
+			if delay *= 2; delay > settleRetryMax {
+				delay = settleRetryMax
+			}
+		}
+
+		if err := le.forget(ctx, in); err != nil {
+			le.lg.Errorf("could not clean up transaction %s: %v", in.ID, err)
+		}
+	}()
+}
+
+// settled waits until the transactions in doubt of a database or its shards are completed
+func (le *LemonEngine) settled(ctx context.Context, dbName string) error {
+	for {
+		var pending *doubt
+		le.mu.Lock()
+		for _, d := range le.doubts {
+			for _, name := range d.databases {
+				if LogicalName(name) == dbName {
+					pending = d
+				}
+			}
+		}
+		le.mu.Unlock()
+
+		if pending == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-pending.done:
+		}
+	}
+}
+
+// forget removes the markers of a transaction all databases have the writes of, and then its intent,
+// which is marked as done first, so that databases without their marker are not written to again
+func (le *LemonEngine) forget(ctx context.Context, in *intent) error {
+	if !in.Done {
+		in.Done = true
+		if err := le.store.logIntent(in); err != nil {
+			return err
+		}
+	}
+
+	key := transactionKey(in.ID)
+	for _, w := range in.Writes {
+		db, err := le.store.Get(w.Database)
+		if err != nil {
+			return err
+		}
+
+		if err := db.Update(ctx, func(tx *lemon.Tx) error {
+			if !tx.Has(key) {
+				return nil
+			}
+			return tx.Remove(key)
+		}); err != nil {
+			return errors.Wrapf(err, "could not remove marker from database %s", w.Database)
+		}
+	}
+
+	return le.store.removeIntent(in.ID)
+}
+
+// RecoverTransactions completes the cross database transactions left in doubt by a crash,
+// it is meant to be run at startup before any requests are served
+func (le *LemonEngine) RecoverTransactions(ctx context.Context) error {
+	intents, err := le.store.intents()
+	if err != nil {
+		return err
+	}
+
+	for _, in := range intents {
+		redone := 0
+		if !in.Done {
+			if redone, err = le.redo(ctx, in, nil); err != nil {
+				return errors.Wrapf(err, "could not recover transaction %s", in.ID)
+			}
+		}
+
+		if err := le.forget(ctx, in); err != nil {
+			return errors.Wrapf(err, "could not clean up transaction %s", in.ID)
+		}
+
+		le.lg.Infof("recovered transaction %s, written again to %d of %d databases", in.ID, redone, len(in.Writes))
+	}
+
+	return nil
+}
+
+// redo applies the logged writes of a committed transaction to the databases without its marker,
+// and to the failed ones, which are removed once they have them, returning the number of databases.
+// A failed lemon commit keeps its writes in memory without storing them, the marker included
+func (le *LemonEngine) redo(ctx context.Context, in *intent, failed map[string]bool) (int, error) {
+	redone := 0
+	for _, iw := range in.Writes {
+		w := iw.txWrite()
+		db, s, err := le.open(ctx, w.Database)
+		if err != nil {
+			return redone, err
+		}
+
+		applied := false
+		if err := db.Update(ctx, func(tx *lemon.Tx) error {
+			if tx.Has(transactionKey(in.ID)) && !failed[w.Database] {
+				return nil
+			}
+
+			applied = true
+			return le.replay(ctx, tx, s, w, in)
+		}); err != nil {
+			return redone, errors.Wrapf(err, "database %s", w.Database)
+		}
+
+		if applied {
+			// replays are not counted
+			le.counts.forget(w.Database)
+			delete(failed, w.Database)
+			le.committed(w.Database, s, w.keys())
+			redone++
+		}
+	}
+
+	return redone, nil
+}
+
+// intent is the log entry of a committed transaction, holding its writes to apply them again
+type intent struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	// Principal is recorded by documents moved to the trash
+	Principal string        `json:"principal,omitempty"`
+	Writes    []intentWrite `json:"writes"`
+	// Done is set once all databases have the writes, while their markers are removed
+	Done bool `json:"done,omitempty"`
+}
+
+type intentWrite struct {
+	Database string           `json:"database"`
+	Inserts  []intentDocument `json:"inserts,omitempty"`
+	Upserts  []intentDocument `json:"upserts,omitempty"`
+	Deletes  []string         `json:"deletes,omitempty"`
+}
+
+type intentDocument struct {
+	Key         string      `json:"key"`
+	Value       typedValue  `json:"value"`
+	ContentType string      `json:"content_type,omitempty"`
+	Tags        []intentTag `json:"tags,omitempty"`
+	// Timestamps is WithTimestamps of inserts and PreserveTimestamps of upserts
+	Timestamps       bool   `json:"timestamps,omitempty"`
+	ExpectedRevision uint64 `json:"expected_revision,omitempty"`
+}
+
+type intentTag struct {
+	Name  string     `json:"name"`
+	Value typedValue `json:"value"`
+}
+
+func newIntent(id string, now time.Time, principal string, writes []TxWrite) (*intent, error) {
+	in := &intent{ID: id, CreatedAt: now, Principal: principal, Writes: make([]intentWrite, len(writes))}
+	for i, w := range writes {
+		in.Writes[i] = newIntentWrite(w)
+	}
+
+	// values that cannot be logged are rejected before any database is locked
+	if _, err := json.Marshal(in); err != nil {
+		return nil, errors.Wrap(ErrInvalidDocumentValue, err.Error())
+	}
+
+	return in, nil
+}
+
+func newIntentWrite(w TxWrite) intentWrite {
+	iw := intentWrite{Database: w.Database, Deletes: w.Deletes}
+	for _, ins := range w.Inserts {
+		iw.Inserts = append(iw.Inserts, intentDocument{
+			Key:         ins.Key,
+			Value:       typedValue{ins.Value},
+			ContentType: ins.ContentType,
+			Tags:        newIntentTags(ins.Tags),
+			Timestamps:  ins.WithTimestamps,
+		})
+	}
+
+	for _, ups := range w.Upserts {
+		iw.Upserts = append(iw.Upserts, intentDocument{
+			Key:              ups.Key,
+			Value:            typedValue{ups.Value},
+			ContentType:      ups.ContentType,
+			Tags:             newIntentTags(ups.Tags),
+			Timestamps:       ups.PreserveTimestamps,
+			ExpectedRevision: ups.ExpectedRevision,
+		})
+	}
+
+	return iw
+}
+
+// MarshalTxWrites encodes writes as json keeping the go types of values and tags,
+// so that they can be logged and applied somewhere else
+func MarshalTxWrites(writes []TxWrite) ([]byte, error) {
+	iws := make([]intentWrite, len(writes))
+	for i, w := range writes {
+		iws[i] = newIntentWrite(w)
+	}
+
+	b, err := json.Marshal(iws)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidDocumentValue, err.Error())
+	}
+
+	return b, nil
+}
+
+func UnmarshalTxWrites(b []byte) ([]TxWrite, error) {
+	var iws []intentWrite
+	if err := json.Unmarshal(b, &iws); err != nil {
+		return nil, err
+	}
+
+	writes := make([]TxWrite, len(iws))
+	for i, iw := range iws {
+		writes[i] = iw.txWrite()
+	}
+
+	return writes, nil
+}
+
+func newIntentTags(tags []Tag) []intentTag {
+	if tags == nil {
+		return nil
+	}
+
+	its := make([]intentTag, len(tags))
+	for i, t := range tags {
+		its[i] = intentTag{Name: t.Name, Value: typedValue{t.Value}}
+	}
+
+	return its
+}
+
+func (iw intentWrite) txWrite() TxWrite {
+	w := TxWrite{Database: iw.Database, Deletes: iw.Deletes}
+	for _, d := range iw.Inserts {
+		w.Inserts = append(w.Inserts, Insert{
+			Key:            d.Key,
+			Value:          d.Value.v,
+			ContentType:    d.ContentType,
+			WithTimestamps: d.Timestamps,
+			Tags:           intentTagsToTags(d.Tags),
+		})
+	}
+
+	for _, d := range iw.Upserts {
+		w.Upserts = append(w.Upserts, Upsert{
+			Key:                d.Key,
+			Value:              d.Value.v,
+			ContentType:        d.ContentType,
+			PreserveTimestamps: d.Timestamps,
+			Tags:               intentTagsToTags(d.Tags),
+			ExpectedRevision:   d.ExpectedRevision,
+		})
+	}
+
+	return w
+}
+
+func intentTagsToTags(its []intentTag) []Tag {
+	if its == nil {
+		return nil
+	}
+
+	tags := make([]Tag, len(its))
+	for i, t := range its {
+		tags[i] = Tag{Name: t.Name, Value: t.Value.v}
+	}
+
+	return tags
+}
+
+// typedValue keeps the go type of a document or tag value through json
+type typedValue struct {
+	v interface{}
+}
+
+type typedJSON struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+func (tv typedValue) MarshalJSON() ([]byte, error) {
+	var typ string
+	switch tv.v.(type) {
+	case []byte:
+		typ = "bytes"
+	case string:
+		typ = "string"
+	case int:
+		typ = "int"
+	case float64:
+		typ = "float"
+	case bool:
+		typ = "bool"
+	case time.Time:
+		typ = "time"
+	default:
+		return nil, errors.Errorf("value type %T unsupported", tv.v)
+	}
+
+	b, err := json.Marshal(tv.v)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(typedJSON{Type: typ, Value: b})
+}
+
+func (tv *typedValue) UnmarshalJSON(b []byte) error {
+	var tj typedJSON
+	if err := json.Unmarshal(b, &tj); err != nil {
+		return err
+	}
+
+	var err error
+	switch tj.Type {
+	case "bytes":
+		var v []byte
+		err = json.Unmarshal(tj.Value, &v)
+		tv.v = v
+	case "string":
+		var v string
+		err = json.Unmarshal(tj.Value, &v)
+		tv.v = v
+	case "int":
+		var v int
+		err = json.Unmarshal(tj.Value, &v)
+		tv.v = v
+	case "float":
+		var v float64
+		err = json.Unmarshal(tj.Value, &v)
+		tv.v = v
+	case "bool":
+		var v bool
+		err = json.Unmarshal(tj.Value, &v)
+		tv.v = v
+	case "time":
+		var v time.Time
+		err = json.Unmarshal(tj.Value, &v)
+		tv.v = v
+	default:
+		return errors.Errorf("value type %s unsupported", tj.Type)
+	}
+
+	return err
+}
@@ -0,0 +1,202 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/denismitr/lemon"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// newTestEngine runs an engine on a temporary data directory
+func newTestEngine(t *testing.T) *LemonEngine {
+	store := NewStore(t.TempDir(), time.Minute)
+	t.Cleanup(func() {
+		_ = store.Close()
+	})
+
+	return NewEngine(store, nil, zap.NewNop().Sugar())
+}
+
+func Test_typedValue(t *testing.T) {
+	values := []interface{}{
+		[]byte("blob"),
+		"str",
+		42,
+		1.5,
+		true,
+		time.Date(2021, 11, 3, 10, 30, 0, 123, time.UTC),
+	}
+
+	for _, v := range values {
+		b, err := json.Marshal(typedValue{v})
+		require.NoError(t, err)
+
+		var tv typedValue
+		require.NoError(t, json.Unmarshal(b, &tv))
+		assert.Equal(t, v, tv.v)
+	}
+
+	_, err := json.Marshal(typedValue{int64(1)})
+	assert.Error(t, err)
+}
+
+func Test_CrossDatabaseTransaction(t *testing.T) {
+	le := newTestEngine(t)
+	ctx := context.Background()
+
+	has := func(t *testing.T, dbName, key string) bool {
+		db, err := le.store.Get(dbName)
+		require.NoError(t, err)
+
+		found := false
+		require.NoError(t, db.View(ctx, func(tx *lemon.Tx) error {
+			found = tx.Has(key)
+			return nil
+		}))
+		return found
+	}
+
+	noIntents := func(t *testing.T) {
+		intents, err := le.store.intents()
+		require.NoError(t, err)
+		assert.Empty(t, intents)
+	}
+
+	t.Run("commits all databases", func(t *testing.T) {
+		tr, err := le.CrossDatabaseTransaction(ctx, []TxWrite{
+			{Database: "orders", Inserts: BatchInsert{{Key: "o:1", Value: `{"item":"i:1"}`, ContentType: "json"}}},
+			{Database: "inventory", Upserts: BatchUpsert{{Key: "i:1", Value: 9, Tags: []Tag{{Name: "sku", Value: "k1"}}}}},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, uint64(2), tr.RowsAffected)
+
+		assert.True(t, has(t, "orders", "o:1"))
+		assert.True(t, has(t, "inventory", "i:1"))
+		assert.False(t, has(t, "orders", transactionKey(tr.ID)))
+		assert.False(t, has(t, "inventory", transactionKey(tr.ID)))
+		noIntents(t)
+	})
+
+	t.Run("uses the transaction id of the context", func(t *testing.T) {
+		tr, err := le.CrossDatabaseTransaction(WithTransactionID(ctx, "logged"), []TxWrite{
+			{Database: "orders", Upserts: BatchUpsert{{Key: "o:9", Value: "x"}}},
+			{Database: "inventory", Upserts: BatchUpsert{{Key: "i:9", Value: 1}}},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, "logged", tr.ID)
+	})
+
+	t.Run("rolls back all databases", func(t *testing.T) {
+		_, err := le.CrossDatabaseTransaction(ctx, []TxWrite{
+			{Database: "inventory", Upserts: BatchUpsert{{Key: "i:2", Value: 5}}},
+			{Database: "orders", Deletes: BatchDeleteByKey{"o:1"}, Upserts: BatchUpsert{{Key: "o:2", Value: "x", ExpectedRevision: 3}}},
+		})
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, ErrRevisionMismatch))
+
+		assert.False(t, has(t, "inventory", "i:2"))
+		assert.True(t, has(t, "orders", "o:1"))
+		noIntents(t)
+	})
+
+	t.Run("rejects databases written twice", func(t *testing.T) {
+		_, err := le.CrossDatabaseTransaction(ctx, []TxWrite{
+			{Database: "orders", Deletes: BatchDeleteByKey{"o:1"}},
+			{Database: "orders", Deletes: BatchDeleteByKey{"o:2"}},
+		})
+
+		var fieldErr *FieldError
+		require.True(t, errors.As(err, &fieldErr))
+		assert.Equal(t, "writes[1].database", fieldErr.Field)
+	})
+
+	t.Run("recovers transactions in doubt", func(t *testing.T) {
+		writes := []TxWrite{
+			{Database: "inventory", Upserts: BatchUpsert{{Key: "i:1", Value: 8}}},
+			{Database: "orders", Inserts: BatchInsert{{Key: "o:3", Value: []byte("order")}}},
+		}
+
+		in, err := newIntent("crashed", time.Now(), "", writes)
+		require.NoError(t, err)
+		require.NoError(t, le.store.logIntent(in))
+
+		// only inventory committed before the crash
+		db, s, err := le.open(ctx, "inventory")
+		require.NoError(t, err)
+		require.NoError(t, db.Update(ctx, func(tx *lemon.Tx) error {
+			_, _, err := le.prepare(ctx, tx, s, writes[0], in)
+			return err
+		}))
+
+		require.NoError(t, le.RecoverTransactions(ctx))
+
+		assert.True(t, has(t, "orders", "o:3"))
+		assert.False(t, has(t, "orders", transactionKey("crashed")))
+		assert.False(t, has(t, "inventory", transactionKey("crashed")))
+		noIntents(t)
+
+		docs, err := le.MGet(ctx, "inventory", []string{"i:1"}, time.Time{})
+		require.NoError(t, err)
+		// the upsert was not applied a second time
+		assert.Equal(t, uint64(2), docs["i:1"].Revision())
+	})
+
+	t.Run("completes databases failing to commit before writing to them again", func(t *testing.T) {
+		le.commit = func(tx *lemon.Tx) error {
+			if tx.Has("o:5") {
+				if err := tx.Rollback(); err != nil {
+					return err
+				}
+				return errors.New("disk full")
+			}
+			return tx.Commit()
+		}
+		defer func() { le.commit = (*lemon.Tx).Commit }()
+
+		_, err := le.CrossDatabaseTransaction(ctx, []TxWrite{
+			{Database: "inventory", Upserts: BatchUpsert{{Key: "i:5", Value: 1}}},
+			{Database: "orders", Inserts: BatchInsert{{Key: "o:5", Value: "order"}}},
+		})
+		require.True(t, errors.Is(err, ErrTransactionInDoubt))
+
+		// the write waits for the transaction, so that it is not overwritten by it
+		_, err = le.BatchUpsert(ctx, "orders", BatchUpsert{{Key: "o:5", Value: "changed", ExpectedRevision: 1}})
+		require.NoError(t, err)
+
+		docs, err := le.MGet(ctx, "orders", []string{"o:5"}, time.Time{})
+		require.NoError(t, err)
+		assert.Equal(t, "changed", docs["o:5"].RawString())
+		noIntents(t)
+	})
+
+	t.Run("recovers transactions whose writes conflict with later ones", func(t *testing.T) {
+		writes := []TxWrite{
+			{Database: "inventory", Upserts: BatchUpsert{{Key: "i:6", Value: 6, ExpectedRevision: 1}}},
+			{Database: "orders", Inserts: BatchInsert{{Key: "o:6", Value: "logged"}}},
+		}
+
+		in, err := newIntent("conflicting", time.Now(), "", writes)
+		require.NoError(t, err)
+		require.NoError(t, le.store.logIntent(in))
+
+		_, err = le.BatchInsert(ctx, "orders", BatchInsert{{Key: "o:6", Value: "later"}})
+		require.NoError(t, err)
+		for i := 1; i <= 2; i++ {
+			_, err = le.BatchUpsert(ctx, "inventory", BatchUpsert{{Key: "i:6", Value: i}})
+			require.NoError(t, err)
+		}
+
+		require.NoError(t, le.RecoverTransactions(ctx))
+		noIntents(t)
+
+		docs, err := le.MGet(ctx, "orders", []string{"o:6"}, time.Time{})
+		require.NoError(t, err)
+		assert.Equal(t, "logged", docs["o:6"].RawString())
+	})
+}
@@ -0,0 +1,173 @@
+package database
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/denismitr/lemon"
+	"github.com/pkg/errors"
+)
+
+var ErrDocumentExists = errors.New("document already exists")
+
+// Soft deleted documents are moved to system documents keyed by the document key,
+// a document deleted again after it was recreated replaces the one in the trash
+const trashKeyPrefix = SystemKeyPrefix + "trash:"
+
+// system tags of trashed documents
+const (
+	deletedAtTag = SystemTagPrefix + "deleted_at"
+	deletedByTag = SystemTagPrefix + "deleted_by"
+)
+
+type principalCtxKey struct{}
+
+// WithPrincipal attaches the principal a request is made by to ctx, so that soft deletes can record it
+func WithPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, principalCtxKey{}, principal)
+}
+
+// PrincipalFrom returns the principal attached to ctx by WithPrincipal
+func PrincipalFrom(ctx context.Context) string {
+	p, _ := ctx.Value(principalCtxKey{}).(string)
+	return p
+}
+
+type nowCtxKey struct{}
+
+// WithTime attaches the time a write is made at to ctx, so that every node applying
+// the same write records it at the same time, otherwise writes are made now
+func WithTime(ctx context.Context, t time.Time) context.Context {
+	return context.WithValue(ctx, nowCtxKey{}, t)
+}
+
+func nowFrom(ctx context.Context) time.Time {
+	if t, ok := ctx.Value(nowCtxKey{}).(time.Time); ok {
+		return t
+	}
+	return time.Now()
+}
+
+func trashKey(key string) string {
+	return trashKeyPrefix + base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+// trash moves a stored document to the trash, as it was stored
+func trash(tx *lemon.Tx, stored *lemon.Document, now time.Time, principal string) error {
+	m := make(lemon.M, len(stored.Tags())+4)
+	for name, v := range stored.Tags() {
+		m[name] = v
+	}
+
+	m[keyTag] = stored.Key()
+	m[deletedAtTag] = int(now.UnixNano())
+	m[deletedByTag] = principal
+
+	// the value is copied as bytes, so its lemon type has to be kept aside
+	if _, ok := m[plainTypeTag]; !ok {
+		m[plainTypeTag] = string(stored.ContentType())
+	}
+
+	appliers := []lemon.MetaApplier{m}
+	if stored.HasTimestamps() {
+		appliers = append(appliers, lemon.M{
+			lemon.CreatedAt: int(stored.CreatedAt().UnixMilli()),
+			lemon.UpdatedAt: int(stored.UpdatedAt().UnixMilli()),
+		})
+	}
+
+	if err := tx.InsertOrReplace(trashKey(stored.Key()), stored.Value(), appliers...); err != nil {
+		return err
+	}
+
+	return tx.Remove(stored.Key())
+}
+
+// restore moves a document back from the trash, reporting whether it was there
+func (s *settings) restore(tx *lemon.Tx, key string, now time.Time) (bool, error) {
+	trashed, err := tx.Get(trashKey(key))
+	if errors.Is(err, lemon.ErrKeyDoesNotExist) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, errors.Wrap(ErrEngineFailed, err.Error())
+	}
+
+	if tx.Has(key) {
+		return false, errors.Wrapf(ErrDocumentExists, "key %s has been recreated since it was deleted", key)
+	}
+
+	d, err := s.decode(trashed)
+	if err != nil {
+		return false, err
+	}
+
+	m := make(lemon.M, len(d.Tags()))
+	for name, v := range d.Tags() {
+		switch name {
+		case keyTag, deletedAtTag, deletedByTag:
+		default:
+			m[name] = v
+		}
+	}
+
+	// restoring is a write, revisions keep increasing across deletes
+	next, err := nextRevision(tx, nil, key, 0)
+	if err != nil {
+		return false, err
+	}
+
+	// documents trashed before tombstones were kept have none
+	if r := next.Int(revisionTag); r > int(revisionOf(m)) {
+		m[revisionTag] = r
+	} else {
+		m[revisionTag] = int(revisionOf(m) + 1)
+	}
+
+	value, err := s.encodeRaw(key, d.Value(), d.ContentType(), m)
+	if err != nil {
+		return false, err
+	}
+
+	appliers := []lemon.MetaApplier{m, s.writeStamp(now)}
+	if d.HasTimestamps() {
+		appliers = append(appliers, preservedTimestamps(d))
+	}
+
+	if err := tx.Insert(key, value, appliers...); err != nil {
+		return false, err
+	}
+
+	return true, tx.Remove(trashKey(key))
+}
+
+// purgeTrash removes documents deleted more than retention ago, returning their keys
+func purgeTrash(tx *lemon.Tx, retention time.Duration, now time.Time) ([]string, error) {
+	var expired, keys []string
+	if err := scanPrefix(tx, trashKeyPrefix, func(d *lemon.Document) bool {
+		deletedAt := time.Unix(0, int64(d.Tags().Int(deletedAtTag)))
+		if now.Sub(deletedAt) > retention {
+			expired = append(expired, d.Key())
+		}
+		return true
+	}); err != nil {
+		return nil, errors.Wrap(ErrEngineFailed, err.Error())
+	}
+
+	if len(expired) == 0 {
+		return nil, nil
+	}
+
+	for _, k := range expired {
+		key, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(k, trashKeyPrefix))
+		if err != nil {
+			return nil, errors.Wrapf(ErrEngineFailed, "trashed document %s has a malformed key", k)
+		}
+		keys = append(keys, string(key))
+	}
+
+	return keys, tx.Remove(expired...)
+}
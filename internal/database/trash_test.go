@@ -0,0 +1,106 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/denismitr/lemon"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_trash(t *testing.T) {
+	db, closer, err := lemon.Open(lemon.InMemory)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = closer() })
+
+	s := &settings{options: &Options{
+		Compression: CompressionOptions{Codec: GzipCodec, Threshold: 1},
+		Trash:       TrashOptions{Enabled: true, Retention: time.Hour},
+	}}
+	start := time.Date(2021, 11, 5, 10, 0, 0, 0, time.UTC)
+
+	insert := func(key string, value interface{}) {
+		t.Helper()
+		require.NoError(t, db.Update(context.Background(), func(tx *lemon.Tx) error {
+			stored, appliers, err := s.encode(key, value, "", []Tag{{Name: "n", Value: 1}}, true)
+			if err != nil {
+				return err
+			}
+			return tx.Insert(key, stored, appliers...)
+		}))
+	}
+
+	remove := func(key string, now time.Time) {
+		t.Helper()
+		require.NoError(t, db.Update(context.Background(), func(tx *lemon.Tx) error {
+			stored, err := tx.Get(key)
+			if err != nil {
+				return err
+			}
+			return trash(tx, stored, now, "alice")
+		}))
+	}
+
+	insert("foo", "some long enough value")
+	insert("bar", 2)
+	insert("baz", []byte("baz"))
+	remove("foo", start)
+	remove("bar", start.Add(30*time.Minute))
+	remove("baz", start.Add(30*time.Minute))
+	insert("baz", []byte("recreated"))
+
+	require.NoError(t, db.View(context.Background(), func(tx *lemon.Tx) error {
+		assert.False(t, tx.Has("foo"))
+
+		trashed, err := tx.Get(trashKey("foo"))
+		require.NoError(t, err)
+		assert.Equal(t, "alice", trashed.Tags().String(deletedByTag))
+		assert.Equal(t, int(start.UnixNano()), trashed.Tags().Int(deletedAtTag))
+
+		n, err := countUser(tx)
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+		return nil
+	}))
+
+	require.NoError(t, db.Update(context.Background(), func(tx *lemon.Tx) error {
+		ok, err := s.restore(tx, "foo", start.Add(time.Minute))
+		require.NoError(t, err)
+		assert.True(t, ok)
+
+		ok, err = s.restore(tx, "missing", start)
+		require.NoError(t, err)
+		assert.False(t, ok)
+
+		_, err = s.restore(tx, "baz", start)
+		assert.True(t, errors.Is(err, ErrDocumentExists))
+
+		stored, err := tx.Get("foo")
+		require.NoError(t, err)
+		assert.False(t, tx.Has(trashKey("foo")))
+
+		d, err := s.decode(stored)
+		require.NoError(t, err)
+		assert.Equal(t, "foo", d.Key())
+		assert.Equal(t, "some long enough value", d.RawString())
+		assert.Equal(t, 1, d.Tags()["n"])
+		assert.NotContains(t, d.Tags(), deletedByTag)
+		assert.True(t, d.HasTimestamps())
+		return nil
+	}))
+
+	require.NoError(t, db.Update(context.Background(), func(tx *lemon.Tx) error {
+		purged, err := purgeTrash(tx, time.Hour, start.Add(80*time.Minute))
+		require.NoError(t, err)
+		assert.Empty(t, purged)
+
+		purged, err = purgeTrash(tx, time.Hour, start.Add(100*time.Minute))
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"bar", "baz"}, purged)
+		assert.False(t, tx.Has(trashKey("bar")))
+		return nil
+	}))
+}
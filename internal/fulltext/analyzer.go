@@ -0,0 +1,51 @@
+package fulltext
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxTermLength is the length in bytes above which words are not indexed, e.g. base64 blobs in text
+const maxTermLength = 64
+
+// Token is a word of a text the way it is indexed and searched for
+type Token struct {
+	Term string
+	// Position is the index of the token among the tokens of the text
+	Position int
+	// Start and End are the byte offsets of the word in the text
+	Start, End int
+}
+
+// Analyze splits a text into words of letters and digits, lower cases and stems them
+func Analyze(text string) []Token {
+	var tokens []Token
+	start := -1
+	for i := 0; i <= len(text); {
+		r, size := utf8.RuneError, 1
+		if i < len(text) {
+			r, size = utf8.DecodeRuneInString(text[i:])
+		}
+
+		if i < len(text) && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			if start < 0 {
+				start = i
+			}
+		} else if start >= 0 {
+			if i-start <= maxTermLength {
+				tokens = append(tokens, Token{
+					Term:     Stem(strings.ToLower(text[start:i])),
+					Position: len(tokens),
+					Start:    start,
+					End:      i,
+				})
+			}
+			start = -1
+		}
+
+		i += size
+	}
+
+	return tokens
+}
@@ -0,0 +1,87 @@
+package fulltext
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStem(t *testing.T) {
+	tt := []struct {
+		word     string
+		expected string
+	}{
+		{word: "caresses", expected: "caress"},
+		{word: "ponies", expected: "poni"},
+		{word: "cats", expected: "cat"},
+		{word: "agreed", expected: "agre"},
+		{word: "hopping", expected: "hop"},
+		{word: "filing", expected: "file"},
+		{word: "happy", expected: "happi"},
+		{word: "relational", expected: "relat"},
+		{word: "connections", expected: "connect"},
+		{word: "connecting", expected: "connect"},
+		{word: "generalizations", expected: "gener"},
+		{word: "controllable", expected: "control"},
+		{word: "wireless", expected: "wireless"},
+		{word: "is", expected: "is"},
+		{word: "café", expected: "café"},
+		{word: "x11", expected: "x11"},
+	}
+
+	for _, tc := range tt {
+		assert.Equal(t, tc.expected, Stem(tc.word), tc.word)
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	tokens := Analyze("Wireless mice, 2 Batteries; e-mail Café!")
+
+	expected := []Token{
+		{Term: "wireless", Position: 0, Start: 0, End: 8},
+		{Term: "mice", Position: 1, Start: 9, End: 13},
+		{Term: "2", Position: 2, Start: 15, End: 16},
+		{Term: "batteri", Position: 3, Start: 17, End: 26},
+		{Term: "e", Position: 4, Start: 28, End: 29},
+		{Term: "mail", Position: 5, Start: 30, End: 34},
+		{Term: "café", Position: 6, Start: 35, End: 40},
+	}
+
+	assert.Equal(t, expected, tokens)
+}
+
+func TestSnippet(t *testing.T) {
+	text := "A quiet keyboard. Wireless keyboards connect to the receiver, wireless mice as well. Batteries included."
+
+	tt := []struct {
+		name     string
+		terms    []string
+		size     int
+		expected string
+	}{
+		{
+			name:     "whole text",
+			terms:    []string{"keyboard"},
+			size:     SnippetSize,
+			expected: "A quiet <em>keyboard</em>. Wireless <em>keyboards</em> connect to the receiver, wireless mice as well. Batteries included.",
+		},
+		{
+			name:     "best window",
+			terms:    []string{"wireless", "mice"},
+			size:     4,
+			expected: "…the receiver, <em>wireless</em> <em>mice</em>…",
+		},
+		{
+			name:     "no match",
+			terms:    []string{"mouse"},
+			size:     3,
+			expected: "A quiet keyboard…",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, Snippet(text, tc.terms, tc.size, DefaultHighlightPre, DefaultHighlightPost))
+		})
+	}
+}
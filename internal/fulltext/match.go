@@ -0,0 +1,207 @@
+package fulltext
+
+// Index gives queries access to indexed documents
+type Index interface {
+	// Postings returns the positions of a term in the documents containing it, by document key
+	Postings(term string) (map[string][]int, error)
+	// Keys returns the keys of all indexed documents
+	Keys() ([]string, error)
+}
+
+// matcher reads postings and keys of an index once per query
+type matcher struct {
+	ix       Index
+	postings map[string]map[string][]int
+	all      map[string]bool
+}
+
+// Match returns the keys of the documents matching a query
+func Match(q Query, ix Index) (map[string]bool, error) {
+	return q.match(&matcher{ix: ix, postings: make(map[string]map[string][]int)})
+}
+
+func (m *matcher) term(term string) (map[string][]int, error) {
+	if p, ok := m.postings[term]; ok {
+		return p, nil
+	}
+
+	p, err := m.ix.Postings(term)
+	if err != nil {
+		return nil, err
+	}
+
+	m.postings[term] = p
+	return p, nil
+}
+
+func (m *matcher) keys() (map[string]bool, error) {
+	if m.all != nil {
+		return m.all, nil
+	}
+
+	keys, err := m.ix.Keys()
+	if err != nil {
+		return nil, err
+	}
+
+	m.all = make(map[string]bool, len(keys))
+	for _, k := range keys {
+		m.all[k] = true
+	}
+
+	return m.all, nil
+}
+
+func (t *Term) match(m *matcher) (map[string]bool, error) {
+	postings, err := m.term(t.Term)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]bool, len(postings))
+	for key := range postings {
+		result[key] = true
+	}
+
+	return result, nil
+}
+
+func (p *Phrase) match(m *matcher) (map[string]bool, error) {
+	postings := make([]map[string][]int, len(p.Terms))
+	for i, t := range p.Terms {
+		var err error
+		if postings[i], err = m.term(t); err != nil {
+			return nil, err
+		}
+	}
+
+	result := make(map[string]bool)
+	for key, first := range postings[0] {
+		if containsPhrase(key, first, postings[1:]) {
+			result[key] = true
+		}
+	}
+
+	return result, nil
+}
+
+// containsPhrase reports whether the terms following the first one of a phrase
+// are at the positions following one of the first term in a document
+func containsPhrase(key string, first []int, rest []map[string][]int) bool {
+	positions := make([]map[int]bool, len(rest))
+	for i, p := range rest {
+		if len(p[key]) == 0 {
+			return false
+		}
+
+		positions[i] = make(map[int]bool, len(p[key]))
+		for _, pos := range p[key] {
+			positions[i][pos] = true
+		}
+	}
+
+	for _, start := range first {
+		found := true
+		for i := range positions {
+			if !positions[i][start+i+1] {
+				found = false
+				break
+			}
+		}
+
+		if found {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a *And) match(m *matcher) (map[string]bool, error) {
+	var result map[string]bool
+	var excluded []map[string]bool
+	for _, q := range a.Queries {
+		// negated queries are subtracted instead of intersecting with all other documents
+		if n, ok := q.(*Not); ok {
+			keys, err := n.Query.match(m)
+			if err != nil {
+				return nil, err
+			}
+			excluded = append(excluded, keys)
+			continue
+		}
+
+		keys, err := q.match(m)
+		if err != nil {
+			return nil, err
+		}
+
+		if result == nil {
+			result = keys
+			continue
+		}
+
+		for key := range result {
+			if !keys[key] {
+				delete(result, key)
+			}
+		}
+	}
+
+	if result == nil {
+		all, err := m.keys()
+		if err != nil {
+			return nil, err
+		}
+
+		result = make(map[string]bool, len(all))
+		for key := range all {
+			result[key] = true
+		}
+	}
+
+	for _, keys := range excluded {
+		for key := range keys {
+			delete(result, key)
+		}
+	}
+
+	return result, nil
+}
+
+func (o *Or) match(m *matcher) (map[string]bool, error) {
+	result := make(map[string]bool)
+	for _, q := range o.Queries {
+		keys, err := q.match(m)
+		if err != nil {
+			return nil, err
+		}
+
+		for key := range keys {
+			result[key] = true
+		}
+	}
+
+	return result, nil
+}
+
+func (n *Not) match(m *matcher) (map[string]bool, error) {
+	excluded, err := n.Query.match(m)
+	if err != nil {
+		return nil, err
+	}
+
+	all, err := m.keys()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]bool, len(all))
+	for key := range all {
+		if !excluded[key] {
+			result[key] = true
+		}
+	}
+
+	return result, nil
+}
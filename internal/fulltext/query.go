@@ -0,0 +1,352 @@
+package fulltext
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+var ErrSyntax = errors.New("search syntax error")
+
+// Query is a parsed search query, words match documents containing them, e.g.
+// wireless (mouse OR keyboard) -refurbished "noise cancelling",
+// words next to each other have to match all, AND, OR and NOT or - combine them
+type Query interface {
+	String() string
+	match(m *matcher) (map[string]bool, error)
+	// terms calls cb for the terms documents are searched for, ignoring negated ones
+	terms(cb func(term string))
+}
+
+// Term matches documents containing an analyzed word
+type Term struct {
+	Term string
+}
+
+// Phrase matches documents containing analyzed words next to each other in order
+type Phrase struct {
+	Terms []string
+}
+
+// And matches documents matching all of its queries
+type And struct {
+	Queries []Query
+}
+
+// Or matches documents matching any of its queries
+type Or struct {
+	Queries []Query
+}
+
+// Not matches documents not matching its query
+type Not struct {
+	Query Query
+}
+
+func (t *Term) String() string {
+	return t.Term
+}
+
+func (p *Phrase) String() string {
+	return strconv.Quote(strings.Join(p.Terms, " "))
+}
+
+func (a *And) String() string {
+	return joinQueries(a.Queries, " AND ")
+}
+
+func (o *Or) String() string {
+	return joinQueries(o.Queries, " OR ")
+}
+
+func (n *Not) String() string {
+	return "NOT " + n.Query.String()
+}
+
+func joinQueries(queries []Query, sep string) string {
+	parts := make([]string, len(queries))
+	for i, q := range queries {
+		parts[i] = q.String()
+	}
+
+	return "(" + strings.Join(parts, sep) + ")"
+}
+
+func (t *Term) terms(cb func(string)) {
+	cb(t.Term)
+}
+
+func (p *Phrase) terms(cb func(string)) {
+	for _, t := range p.Terms {
+		cb(t)
+	}
+}
+
+func (a *And) terms(cb func(string)) {
+	for _, q := range a.Queries {
+		q.terms(cb)
+	}
+}
+
+func (o *Or) terms(cb func(string)) {
+	for _, q := range o.Queries {
+		q.terms(cb)
+	}
+}
+
+func (n *Not) terms(func(string)) {}
+
+// Terms returns the distinct terms a query searches for, in query order and without negated ones
+func Terms(q Query) []string {
+	seen := make(map[string]bool)
+	var terms []string
+	q.terms(func(t string) {
+		if !seen[t] {
+			seen[t] = true
+			terms = append(terms, t)
+		}
+	})
+
+	return terms
+}
+
+type queryToken struct {
+	text string
+	// phrase is set for quoted text, which may contain keywords
+	phrase bool
+	// pos is the byte offset of the token in the query
+	pos int
+}
+
+func (t queryToken) is(s string) bool {
+	return !t.phrase && t.text == s
+}
+
+func (t queryToken) String() string {
+	if t.phrase {
+		return strconv.Quote(t.text)
+	}
+
+	return "'" + t.text + "'"
+}
+
+func isSeparator(r rune) bool {
+	return unicode.IsSpace(r) || r == '(' || r == ')' || r == '"'
+}
+
+// lexQuery splits a query into words, quoted phrases, parentheses and the - prefix
+func lexQuery(query string) ([]queryToken, error) {
+	var tokens []queryToken
+	for i := 0; i < len(query); {
+		r, size := utf8.DecodeRuneInString(query[i:])
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+		case r == '(' || r == ')':
+			tokens = append(tokens, queryToken{text: string(r), pos: i})
+			i += size
+		case r == '"':
+			end := strings.IndexByte(query[i+1:], '"')
+			if end < 0 {
+				return nil, errors.Wrapf(ErrSyntax, "at %d: unterminated phrase", i)
+			}
+			tokens = append(tokens, queryToken{text: query[i+1 : i+1+end], phrase: true, pos: i})
+			i += end + 2
+		case r == '-' && i+1 < len(query):
+			// a minus in front of a word or phrase negates it
+			if next, _ := utf8.DecodeRuneInString(query[i+1:]); !unicode.IsSpace(next) {
+				tokens = append(tokens, queryToken{text: "-", pos: i})
+				i += size
+				continue
+			}
+			fallthrough
+		default:
+			start := i
+			for i < len(query) {
+				r, size := utf8.DecodeRuneInString(query[i:])
+				if isSeparator(r) {
+					break
+				}
+				i += size
+			}
+			tokens = append(tokens, queryToken{text: query[start:i], pos: start})
+		}
+	}
+
+	return tokens, nil
+}
+
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+}
+
+// Parse parses a search query, words are analyzed the way indexed text is
+func Parse(query string) (Query, error) {
+	tokens, err := lexQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &queryParser{tokens: tokens}
+	q, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if t, ok := p.peek(); ok {
+		return nil, errors.Wrapf(ErrSyntax, "at %d: unexpected %s", t.pos, t)
+	}
+
+	if q == nil {
+		return nil, errors.Wrap(ErrSyntax, "query has no words to search for")
+	}
+
+	return q, nil
+}
+
+func (p *queryParser) peek() (queryToken, bool) {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos], true
+	}
+
+	return queryToken{}, false
+}
+
+func (p *queryParser) parseOr() (Query, error) {
+	var queries []Query
+	for {
+		q, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+
+		if q != nil {
+			queries = append(queries, q)
+		}
+
+		t, ok := p.peek()
+		if !ok || !t.is("OR") {
+			break
+		}
+
+		p.pos++
+		if next, ok := p.peek(); !ok || next.is(")") {
+			return nil, errors.Wrapf(ErrSyntax, "at %d: OR has to be followed by a query", t.pos)
+		}
+	}
+
+	return combine(queries, func(qs []Query) Query { return &Or{Queries: qs} }), nil
+}
+
+func (p *queryParser) parseAnd() (Query, error) {
+	var queries []Query
+	for {
+		t, ok := p.peek()
+		if !ok || t.is("OR") || t.is(")") {
+			break
+		}
+
+		if t.is("AND") {
+			if len(queries) == 0 {
+				return nil, errors.Wrapf(ErrSyntax, "at %d: AND has to follow a query", t.pos)
+			}
+
+			p.pos++
+			if next, ok := p.peek(); !ok || next.is("OR") || next.is(")") || next.is("AND") {
+				return nil, errors.Wrapf(ErrSyntax, "at %d: AND has to be followed by a query", t.pos)
+			}
+			continue
+		}
+
+		q, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		if q != nil {
+			queries = append(queries, q)
+		}
+	}
+
+	if len(queries) == 0 {
+		if t, ok := p.peek(); ok && t.is("OR") {
+			return nil, errors.Wrapf(ErrSyntax, "at %d: OR has to follow a query", t.pos)
+		}
+	}
+
+	return combine(queries, func(qs []Query) Query { return &And{Queries: qs} }), nil
+}
+
+func (p *queryParser) parseUnary() (Query, error) {
+	t, _ := p.peek()
+	if !t.is("NOT") && !t.is("-") {
+		return p.parsePrimary()
+	}
+
+	p.pos++
+	if next, ok := p.peek(); !ok || next.is("OR") || next.is("AND") || next.is(")") {
+		return nil, errors.Wrapf(ErrSyntax, "at %d: %s has to be followed by a query", t.pos, t)
+	}
+
+	q, err := p.parseUnary()
+	if err != nil || q == nil {
+		return nil, err
+	}
+
+	// NOT NOT cancels itself
+	if n, ok := q.(*Not); ok {
+		return n.Query, nil
+	}
+
+	return &Not{Query: q}, nil
+}
+
+func (p *queryParser) parsePrimary() (Query, error) {
+	t, _ := p.peek()
+	p.pos++
+
+	if t.is("(") {
+		q, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		if closing, ok := p.peek(); !ok || !closing.is(")") {
+			return nil, errors.Wrapf(ErrSyntax, "at %d: parenthesis is not closed", t.pos)
+		}
+		p.pos++
+
+		return q, nil
+	}
+
+	tokens := Analyze(t.text)
+	switch len(tokens) {
+	case 0:
+		// words of punctuation only are ignored like they are when text is indexed
+		return nil, nil
+	case 1:
+		return &Term{Term: tokens[0].Term}, nil
+	default:
+		// words like e-mail are phrases of their parts
+		terms := make([]string, len(tokens))
+		for i, token := range tokens {
+			terms[i] = token.Term
+		}
+		return &Phrase{Terms: terms}, nil
+	}
+}
+
+func combine(queries []Query, create func([]Query) Query) Query {
+	switch len(queries) {
+	case 0:
+		return nil
+	case 1:
+		return queries[0]
+	default:
+		return create(queries)
+	}
+}
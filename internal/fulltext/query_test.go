@@ -0,0 +1,144 @@
+package fulltext
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	tt := []struct {
+		query    string
+		expected string
+		terms    []string
+	}{
+		{query: "keyboards", expected: "keyboard", terms: []string{"keyboard"}},
+		{query: "wireless keyboard", expected: "(wireless AND keyboard)", terms: []string{"wireless", "keyboard"}},
+		{query: "wireless AND keyboard", expected: "(wireless AND keyboard)", terms: []string{"wireless", "keyboard"}},
+		{
+			query:    "wireless (mouse OR keyboard) -refurbished",
+			expected: "(wireless AND (mous OR keyboard) AND NOT refurbish)",
+			terms:    []string{"wireless", "mous", "keyboard"},
+		},
+		{query: `"noise cancelling" headphones`, expected: `("nois cancel" AND headphon)`, terms: []string{"nois", "cancel", "headphon"}},
+		{query: `"and OR not"`, expected: `"and or not"`, terms: []string{"and", "or", "not"}},
+		{query: "e-mail", expected: `"e mail"`, terms: []string{"e", "mail"}},
+		{query: "NOT NOT mouse", expected: "mous", terms: []string{"mous"}},
+		{query: "mouse & keyboard", expected: "(mous AND keyboard)", terms: []string{"mous", "keyboard"}},
+		{query: "NOT mouse", expected: "NOT mous"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.query, func(t *testing.T) {
+			q, err := Parse(tc.query)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, q.String())
+			assert.Equal(t, tc.terms, Terms(q))
+		})
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	tt := []struct {
+		query string
+		err   string
+	}{
+		{query: "", err: "query has no words to search for"},
+		{query: "&&", err: "query has no words to search for"},
+		{query: `"mouse`, err: "at 0: unterminated phrase"},
+		{query: "(mouse", err: "at 0: parenthesis is not closed"},
+		{query: "mouse)", err: "at 5: unexpected ')'"},
+		{query: "OR mouse", err: "at 0: OR has to follow a query"},
+		{query: "mouse OR", err: "at 6: OR has to be followed by a query"},
+		{query: "AND mouse", err: "at 0: AND has to follow a query"},
+		{query: "mouse AND", err: "at 6: AND has to be followed by a query"},
+		{query: "mouse NOT", err: "at 6: 'NOT' has to be followed by a query"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.query, func(t *testing.T) {
+			_, err := Parse(tc.query)
+			require.Error(t, err)
+			assert.True(t, errors.Is(err, ErrSyntax))
+			assert.Contains(t, err.Error(), tc.err)
+		})
+	}
+}
+
+// memoryIndex indexes texts by key in memory
+type memoryIndex map[string]string
+
+func (ix memoryIndex) Postings(term string) (map[string][]int, error) {
+	postings := make(map[string][]int)
+	for key, text := range ix {
+		for _, t := range Analyze(text) {
+			if t.Term == term {
+				postings[key] = append(postings[key], t.Position)
+			}
+		}
+	}
+
+	return postings, nil
+}
+
+func (ix memoryIndex) Keys() ([]string, error) {
+	keys := make([]string, 0, len(ix))
+	for key := range ix {
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+func TestMatch(t *testing.T) {
+	ix := memoryIndex{
+		"p:1": "Wireless keyboard with noise cancelling keys",
+		"p:2": "Wireless mouse, refurbished",
+		"p:3": "Wired keyboard and mouse",
+		"p:4": "Headphones cancelling the noise",
+	}
+
+	tt := []struct {
+		query    string
+		expected []string
+	}{
+		{query: "wireless", expected: []string{"p:1", "p:2"}},
+		{query: "wireless mice", expected: nil},
+		{query: "wireless (mouse OR keyboard) -refurbished", expected: []string{"p:1"}},
+		{query: `"noise cancelling"`, expected: []string{"p:1"}},
+		{query: "noise cancelling", expected: []string{"p:1", "p:4"}},
+		{query: "NOT keyboard", expected: []string{"p:2", "p:4"}},
+		{query: "mouse OR headphones", expected: []string{"p:2", "p:3", "p:4"}},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.query, func(t *testing.T) {
+			q, err := Parse(tc.query)
+			require.NoError(t, err)
+
+			matched, err := Match(q, ix)
+			require.NoError(t, err)
+
+			var keys []string
+			for key := range matched {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+
+			assert.Equal(t, tc.expected, keys)
+		})
+	}
+}
+
+func TestBM25(t *testing.T) {
+	stats := Stats{Documents: 10, Tokens: 100}
+
+	// rare terms, repeated terms and short documents score higher
+	assert.Greater(t, BM25(1, 10, 1, stats), BM25(1, 10, 5, stats))
+	assert.Greater(t, BM25(3, 10, 1, stats), BM25(1, 10, 1, stats))
+	assert.Greater(t, BM25(1, 5, 1, stats), BM25(1, 20, 1, stats))
+	assert.Zero(t, BM25(0, 10, 1, stats))
+}
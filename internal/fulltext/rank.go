@@ -0,0 +1,116 @@
+package fulltext
+
+import (
+	"math"
+	"strings"
+)
+
+// BM25 parameters, k1 limits how much repeated terms add to a score
+// and b how much the score of long documents is lowered
+const (
+	K1 = 1.2
+	B  = 0.75
+)
+
+// Stats describe all documents of an index
+type Stats struct {
+	Documents int `json:"documents"`
+	// Tokens is the length of all documents together
+	Tokens int `json:"tokens"`
+}
+
+// BM25 scores a term found tf times in a document of docLen tokens,
+// df is the number of documents containing the term
+func BM25(tf, docLen, df int, stats Stats) float64 {
+	if tf == 0 || stats.Documents == 0 {
+		return 0
+	}
+
+	avgLen := float64(stats.Tokens) / float64(stats.Documents)
+	idf := math.Log(1 + (float64(stats.Documents-df)+0.5)/(float64(df)+0.5))
+	norm := 1 - B + B*float64(docLen)/avgLen
+
+	return idf * float64(tf) * (K1 + 1) / (float64(tf) + K1*norm)
+}
+
+// Highlight markers used when none are given
+const (
+	DefaultHighlightPre  = "<em>"
+	DefaultHighlightPost = "</em>"
+)
+
+// SnippetSize is the number of words of a snippet
+const SnippetSize = 30
+
+// Snippet returns the part of a text of at most size words containing the most of the
+// terms, with the words of the terms wrapped in pre and post, and an ellipsis where text is left out
+func Snippet(text string, terms []string, size int, pre, post string) string {
+	tokens := Analyze(text)
+	if len(tokens) == 0 {
+		return ""
+	}
+
+	wanted := make(map[string]bool, len(terms))
+	for _, t := range terms {
+		wanted[t] = true
+	}
+
+	matched := make([]bool, len(tokens))
+	for i, t := range tokens {
+		matched[i] = wanted[t.Term]
+	}
+
+	if size > len(tokens) {
+		size = len(tokens)
+	}
+
+	// the window of size tokens with the most matches, the first one of them on ties
+	best, count := 0, 0
+	for i := 0; i < size; i++ {
+		if matched[i] {
+			count++
+		}
+	}
+
+	bestCount := count
+	for start := 1; start+size <= len(tokens); start++ {
+		if matched[start-1] {
+			count--
+		}
+		if matched[start+size-1] {
+			count++
+		}
+		if count > bestCount {
+			best, bestCount = start, count
+		}
+	}
+
+	window := tokens[best : best+size]
+
+	var sb strings.Builder
+	from := 0
+	if best > 0 {
+		sb.WriteString("…")
+		from = window[0].Start
+	}
+
+	for i, t := range window {
+		sb.WriteString(text[from:t.Start])
+		if matched[best+i] {
+			sb.WriteString(pre)
+			sb.WriteString(text[t.Start:t.End])
+			sb.WriteString(post)
+		} else {
+			sb.WriteString(text[t.Start:t.End])
+		}
+		from = t.End
+	}
+
+	if best+size < len(tokens) {
+		sb.WriteString("…")
+	} else {
+		sb.WriteString(text[from:])
+	}
+
+	return sb.String()
+}
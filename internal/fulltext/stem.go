@@ -0,0 +1,230 @@
+package fulltext
+
+// Stem reduces an english word to its stem with the Porter algorithm, e.g. connections,
+// connected and connecting all become connect. Words are expected in lower case,
+// words of other letters than a-z and words of up to two letters are kept as they are.
+func Stem(word string) string {
+	if len(word) <= 2 {
+		return word
+	}
+
+	for i := 0; i < len(word); i++ {
+		if word[i] < 'a' || word[i] > 'z' {
+			return word
+		}
+	}
+
+	b := []byte(word)
+	b = step1a(b)
+	b = step1b(b)
+	b = step1c(b)
+	b = replaceSuffix(b, step2Rules, 0)
+	b = replaceSuffix(b, step3Rules, 0)
+	b = step4(b)
+	b = step5(b)
+
+	return string(b)
+}
+
+type suffixRule struct {
+	suffix, replacement string
+}
+
+// rules are listed with longer suffixes before the ones they end with, the first matching rule applies
+var step2Rules = []suffixRule{
+	{"ational", "ate"}, {"tional", "tion"}, {"enci", "ence"}, {"anci", "ance"}, {"izer", "ize"},
+	{"abli", "able"}, {"alli", "al"}, {"entli", "ent"}, {"eli", "e"}, {"ousli", "ous"},
+	{"ization", "ize"}, {"ation", "ate"}, {"ator", "ate"}, {"alism", "al"}, {"iveness", "ive"},
+	{"fulness", "ful"}, {"ousness", "ous"}, {"aliti", "al"}, {"iviti", "ive"}, {"biliti", "ble"},
+}
+
+var step3Rules = []suffixRule{
+	{"icate", "ic"}, {"ative", ""}, {"alize", "al"}, {"iciti", "ic"}, {"ical", "ic"}, {"ful", ""}, {"ness", ""},
+}
+
+var step4Suffixes = []string{
+	"al", "ance", "ence", "er", "ic", "able", "ible", "ant", "ement", "ment", "ent",
+	"ion", "ou", "ism", "ate", "iti", "ous", "ive", "ize",
+}
+
+func isConsonant(b []byte, i int) bool {
+	switch b[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		return i == 0 || !isConsonant(b, i-1)
+	default:
+		return true
+	}
+}
+
+// measure counts the vowel consonant sequences of a stem, m in [C](VC)^m[V]
+func measure(b []byte) int {
+	m, i := 0, 0
+	for i < len(b) && isConsonant(b, i) {
+		i++
+	}
+
+	for i < len(b) {
+		for i < len(b) && !isConsonant(b, i) {
+			i++
+		}
+
+		if i == len(b) {
+			break
+		}
+
+		m++
+		for i < len(b) && isConsonant(b, i) {
+			i++
+		}
+	}
+
+	return m
+}
+
+func hasVowel(b []byte) bool {
+	for i := range b {
+		if !isConsonant(b, i) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasSuffix(b []byte, suffix string) bool {
+	return len(b) >= len(suffix) && string(b[len(b)-len(suffix):]) == suffix
+}
+
+func endsWithDoubleConsonant(b []byte) bool {
+	n := len(b)
+	return n >= 2 && b[n-1] == b[n-2] && isConsonant(b, n-1)
+}
+
+// endsWithCVC reports whether a stem ends consonant vowel consonant, the last one not w, x or y
+func endsWithCVC(b []byte) bool {
+	n := len(b)
+	if n < 3 || !isConsonant(b, n-3) || isConsonant(b, n-2) || !isConsonant(b, n-1) {
+		return false
+	}
+
+	switch b[n-1] {
+	case 'w', 'x', 'y':
+		return false
+	default:
+		return true
+	}
+}
+
+func step1a(b []byte) []byte {
+	switch {
+	case hasSuffix(b, "sses"), hasSuffix(b, "ies"):
+		return b[:len(b)-2]
+	case hasSuffix(b, "ss"):
+		return b
+	case hasSuffix(b, "s"):
+		return b[:len(b)-1]
+	default:
+		return b
+	}
+}
+
+func step1b(b []byte) []byte {
+	if hasSuffix(b, "eed") {
+		if measure(b[:len(b)-3]) > 0 {
+			return b[:len(b)-1]
+		}
+		return b
+	}
+
+	var stem []byte
+	switch {
+	case hasSuffix(b, "ed") && hasVowel(b[:len(b)-2]):
+		stem = b[:len(b)-2]
+	case hasSuffix(b, "ing") && hasVowel(b[:len(b)-3]):
+		stem = b[:len(b)-3]
+	default:
+		return b
+	}
+
+	switch {
+	case hasSuffix(stem, "at"), hasSuffix(stem, "bl"), hasSuffix(stem, "iz"):
+		return append(stem, 'e')
+	case endsWithDoubleConsonant(stem):
+		switch stem[len(stem)-1] {
+		case 'l', 's', 'z':
+			return stem
+		default:
+			return stem[:len(stem)-1]
+		}
+	case measure(stem) == 1 && endsWithCVC(stem):
+		return append(stem, 'e')
+	default:
+		return stem
+	}
+}
+
+func step1c(b []byte) []byte {
+	if hasSuffix(b, "y") && hasVowel(b[:len(b)-1]) {
+		b[len(b)-1] = 'i'
+	}
+
+	return b
+}
+
+// replaceSuffix applies the first rule whose suffix the word ends with, when the measure of the stem
+// left without the suffix is greater than min
+func replaceSuffix(b []byte, rules []suffixRule, min int) []byte {
+	for _, r := range rules {
+		if !hasSuffix(b, r.suffix) {
+			continue
+		}
+
+		stem := b[:len(b)-len(r.suffix)]
+		if measure(stem) > min {
+			return append(stem, r.replacement...)
+		}
+
+		return b
+	}
+
+	return b
+}
+
+func step4(b []byte) []byte {
+	for _, suffix := range step4Suffixes {
+		if !hasSuffix(b, suffix) {
+			continue
+		}
+
+		stem := b[:len(b)-len(suffix)]
+		// ion is only removed after s or t
+		if suffix == "ion" && !hasSuffix(stem, "s") && !hasSuffix(stem, "t") {
+			continue
+		}
+
+		if measure(stem) > 1 {
+			return stem
+		}
+
+		return b
+	}
+
+	return b
+}
+
+func step5(b []byte) []byte {
+	if hasSuffix(b, "e") {
+		stem := b[:len(b)-1]
+		if m := measure(stem); m > 1 || m == 1 && !endsWithCVC(stem) {
+			b = stem
+		}
+	}
+
+	if measure(b) > 1 && endsWithDoubleConsonant(b) && hasSuffix(b, "l") {
+		b = b[:len(b)-1]
+	}
+
+	return b
+}
@@ -0,0 +1,327 @@
+package jsondoc
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidJSON = errors.New("invalid json")
+var ErrInvalidPatch = errors.New("invalid json patch")
+var ErrTestFailed = errors.New("json patch test operation failed")
+
+// Valid reports whether b is a valid JSON document
+func Valid(b []byte) bool {
+	return json.Valid(b)
+}
+
+func decode(b []byte) (interface{}, error) {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return nil, errors.Wrap(ErrInvalidJSON, err.Error())
+	}
+
+	if d.More() {
+		return nil, errors.Wrap(ErrInvalidJSON, "unexpected data after top-level value")
+	}
+
+	return v, nil
+}
+
+// MergePatch applies an RFC 7386 merge patch to the document
+func MergePatch(doc, patch []byte) ([]byte, error) {
+	target, err := decode(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := decode(patch)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidPatch, err.Error())
+	}
+
+	return json.Marshal(mergePatch(target, p))
+}
+
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+
+	for name, value := range p {
+		if value == nil {
+			delete(t, name)
+			continue
+		}
+
+		t[name] = mergePatch(t[name], value)
+	}
+
+	return t
+}
+
+type operation struct {
+	Op    string           `json:"op"`
+	Path  *string          `json:"path"`
+	From  *string          `json:"from"`
+	Value *json.RawMessage `json:"value"`
+}
+
+// ApplyPatch applies an RFC 6902 JSON patch to the document,
+// either all of the operations succeed or the original document is left intact
+func ApplyPatch(doc, patch []byte) ([]byte, error) {
+	target, err := decode(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var ops []operation
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil, errors.Wrap(ErrInvalidPatch, err.Error())
+	}
+
+	for i, op := range ops {
+		target, err = applyOperation(target, op)
+		if err != nil {
+			return nil, errors.Wrapf(err, "operation %d (%s)", i, op.Op)
+		}
+	}
+
+	return json.Marshal(target)
+}
+
+func applyOperation(doc interface{}, op operation) (interface{}, error) {
+	if op.Path == nil {
+		return nil, errors.Wrap(ErrInvalidPatch, "missing path")
+	}
+
+	path, err := ParsePointer(*op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.Op {
+	case "add", "replace", "test":
+		if op.Value == nil {
+			return nil, errors.Wrap(ErrInvalidPatch, "missing value")
+		}
+
+		value, err := decode(*op.Value)
+		if err != nil {
+			return nil, errors.Wrap(ErrInvalidPatch, err.Error())
+		}
+
+		switch op.Op {
+		case "add":
+			return add(doc, path, value)
+		case "replace":
+			if _, err := path.get(doc); err != nil {
+				return nil, err
+			}
+			doc, _, err = remove(doc, path)
+			if err != nil {
+				return nil, err
+			}
+			return add(doc, path, value)
+		default:
+			current, err := path.get(doc)
+			if err != nil {
+				return nil, err
+			}
+			if !equal(current, value) {
+				return nil, errors.Wrapf(ErrTestFailed, "value at %s differs", path)
+			}
+			return doc, nil
+		}
+	case "remove":
+		doc, _, err = remove(doc, path)
+		return doc, err
+	case "move", "copy":
+		if op.From == nil {
+			return nil, errors.Wrap(ErrInvalidPatch, "missing from")
+		}
+
+		from, err := ParsePointer(*op.From)
+		if err != nil {
+			return nil, err
+		}
+
+		if op.Op == "copy" {
+			value, err := from.get(doc)
+			if err != nil {
+				return nil, err
+			}
+			return add(doc, path, deepCopy(value))
+		}
+
+		if len(path) > len(from) && reflect.DeepEqual(path[:len(from)], from) {
+			return nil, errors.Wrap(ErrInvalidPatch, "cannot move a value into one of its children")
+		}
+
+		doc, value, err := remove(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, value)
+	default:
+		return nil, errors.Wrapf(ErrInvalidPatch, "unknown operation %s", op.Op)
+	}
+}
+
+func add(doc interface{}, path Pointer, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	parentPath, last := path.parent()
+	parent, err := parentPath.get(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	switch typed := parent.(type) {
+	case map[string]interface{}:
+		typed[last] = value
+		return doc, nil
+	case []interface{}:
+		idx := len(typed)
+		if last != "-" {
+			if idx, err = arrayIndex(last, len(typed)); err != nil {
+				return nil, err
+			}
+		}
+
+		arr := append(typed[:idx:idx], append([]interface{}{value}, typed[idx:]...)...)
+		return replaceAt(doc, parentPath, arr)
+	default:
+		return nil, errors.Wrapf(ErrPathNotFound, "%s", path)
+	}
+}
+
+func remove(doc interface{}, path Pointer) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, doc, nil
+	}
+
+	parentPath, last := path.parent()
+	parent, err := parentPath.get(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch typed := parent.(type) {
+	case map[string]interface{}:
+		value, ok := typed[last]
+		if !ok {
+			return nil, nil, errors.Wrapf(ErrPathNotFound, "%s", path)
+		}
+		delete(typed, last)
+		return doc, value, nil
+	case []interface{}:
+		idx, err := arrayIndex(last, len(typed)-1)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		value := typed[idx]
+		arr := append(typed[:idx:idx], typed[idx+1:]...)
+		doc, err = replaceAt(doc, parentPath, arr)
+		return doc, value, err
+	default:
+		return nil, nil, errors.Wrapf(ErrPathNotFound, "%s", path)
+	}
+}
+
+// replaceAt swaps the value at path, arrays have to be replaced in their parent when resized
+func replaceAt(doc interface{}, path Pointer, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	parentPath, last := path.parent()
+	parent, err := parentPath.get(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	switch typed := parent.(type) {
+	case map[string]interface{}:
+		typed[last] = value
+	case []interface{}:
+		idx, err := arrayIndex(last, len(typed)-1)
+		if err != nil {
+			return nil, err
+		}
+		typed[idx] = value
+	}
+
+	return doc, nil
+}
+
+func equal(a, b interface{}) bool {
+	an, aok := a.(json.Number)
+	bn, bok := b.(json.Number)
+	if aok && bok {
+		af, aerr := an.Float64()
+		bf, berr := bn.Float64()
+		if aerr == nil && berr == nil {
+			return af == bf
+		}
+	}
+
+	switch at := a.(type) {
+	case map[string]interface{}:
+		bt, ok := b.(map[string]interface{})
+		if !ok || len(at) != len(bt) {
+			return false
+		}
+		for k, v := range at {
+			if !equal(v, bt[k]) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		bt, ok := b.([]interface{})
+		if !ok || len(at) != len(bt) {
+			return false
+		}
+		for i := range at {
+			if !equal(at[i], bt[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(a, b)
+	}
+}
+
+func deepCopy(v interface{}) interface{} {
+	switch typed := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(typed))
+		for k, val := range typed {
+			m[k] = deepCopy(val)
+		}
+		return m
+	case []interface{}:
+		arr := make([]interface{}, len(typed))
+		for i, val := range typed {
+			arr[i] = deepCopy(val)
+		}
+		return arr
+	default:
+		return v
+	}
+}
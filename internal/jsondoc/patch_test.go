@@ -0,0 +1,91 @@
+package jsondoc
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_MergePatch(t *testing.T) {
+	// examples from RFC 7386 appendix A
+	tt := []struct {
+		doc, patch, exp string
+	}{
+		{doc: `{"a":"b"}`, patch: `{"a":"c"}`, exp: `{"a":"c"}`},
+		{doc: `{"a":"b"}`, patch: `{"b":"c"}`, exp: `{"a":"b","b":"c"}`},
+		{doc: `{"a":"b"}`, patch: `{"a":null}`, exp: `{}`},
+		{doc: `{"a":[{"b":"c"}]}`, patch: `{"a":[1]}`, exp: `{"a":[1]}`},
+		{doc: `["a","b"]`, patch: `{"a":"c"}`, exp: `{"a":"c"}`},
+		{doc: `{"e":null}`, patch: `{"a":1}`, exp: `{"a":1,"e":null}`},
+		{doc: `{}`, patch: `{"a":{"bb":{"ccc":null}}}`, exp: `{"a":{"bb":{}}}`},
+	}
+
+	for i, tc := range tt {
+		t.Run(fmt.Sprintf("Merge patch test case: %d", i), func(t *testing.T) {
+			result, err := MergePatch([]byte(tc.doc), []byte(tc.patch))
+			require.NoError(t, err)
+			assert.JSONEq(t, tc.exp, string(result))
+		})
+	}
+}
+
+func Test_ApplyPatch(t *testing.T) {
+	// examples from RFC 6902 appendix A
+	tt := []struct {
+		doc, patch, exp string
+	}{
+		{doc: `{"foo":"bar"}`, patch: `[{"op":"add","path":"/baz","value":"qux"}]`, exp: `{"baz":"qux","foo":"bar"}`},
+		{doc: `{"foo":["bar","baz"]}`, patch: `[{"op":"add","path":"/foo/1","value":"qux"}]`, exp: `{"foo":["bar","qux","baz"]}`},
+		{doc: `{"baz":"qux","foo":"bar"}`, patch: `[{"op":"remove","path":"/baz"}]`, exp: `{"foo":"bar"}`},
+		{doc: `{"foo":["bar","qux","baz"]}`, patch: `[{"op":"remove","path":"/foo/1"}]`, exp: `{"foo":["bar","baz"]}`},
+		{doc: `{"baz":"qux","foo":"bar"}`, patch: `[{"op":"replace","path":"/baz","value":"boo"}]`, exp: `{"baz":"boo","foo":"bar"}`},
+		{
+			doc:   `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`,
+			patch: `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+			exp:   `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`,
+		},
+		{doc: `{"foo":["all","grass","cows","eat"]}`, patch: `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, exp: `{"foo":["all","cows","eat","grass"]}`},
+		{doc: `{"foo":["bar"]}`, patch: `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`, exp: `{"foo":["bar",["abc","def"]]}`},
+		{doc: `{"foo":{"bar":1}}`, patch: `[{"op":"copy","from":"/foo","path":"/baz"}]`, exp: `{"foo":{"bar":1},"baz":{"bar":1}}`},
+		{doc: `{"baz":"qux","foo":["a",2,"c"]}`, patch: `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`, exp: `{"baz":"qux","foo":["a",2,"c"]}`},
+		{doc: `{"/":9,"~1":10}`, patch: `[{"op":"test","path":"/~01","value":10}]`, exp: `{"/":9,"~1":10}`},
+	}
+
+	for i, tc := range tt {
+		t.Run(fmt.Sprintf("JSON patch test case: %d", i), func(t *testing.T) {
+			result, err := ApplyPatch([]byte(tc.doc), []byte(tc.patch))
+			require.NoError(t, err)
+			assert.JSONEq(t, tc.exp, string(result))
+		})
+	}
+
+	failing := []struct {
+		doc, patch string
+		err        error
+	}{
+		{doc: `{"foo":"bar"}`, patch: `[{"op":"add","path":"/baz/bat","value":"qux"}]`, err: ErrPathNotFound},
+		{doc: `{"baz":"qux"}`, patch: `[{"op":"test","path":"/baz","value":"bar"}]`, err: ErrTestFailed},
+		{doc: `{"baz":"qux"}`, patch: `[{"op":"remove","path":"/baz"},{"op":"remove","path":"/baz"}]`, err: ErrPathNotFound},
+		{doc: `{"baz":"qux"}`, patch: `[{"op":"jump","path":"/baz"}]`, err: ErrInvalidPatch},
+	}
+
+	for i, tc := range failing {
+		t.Run(fmt.Sprintf("Failing JSON patch test case: %d", i), func(t *testing.T) {
+			_, err := ApplyPatch([]byte(tc.doc), []byte(tc.patch))
+			require.Error(t, err)
+			assert.True(t, errors.Is(err, tc.err), err.Error())
+		})
+	}
+}
+
+func Test_Project(t *testing.T) {
+	result, err := Project(
+		[]byte(`{"name":"foo","address":{"city":"bar","zip":"123"},"tags":["a","b"]}`),
+		[]string{"/name", "/address/city", "/tags/1", "/missing"},
+	)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"/name":"foo","/address/city":"bar","/tags/1":"b"}`, string(result))
+}
@@ -0,0 +1,83 @@
+package jsondoc
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidPointer = errors.New("invalid json pointer")
+var ErrPathNotFound = errors.New("json path not found")
+
+// Pointer is a parsed RFC 6901 JSON pointer
+type Pointer []string
+
+// ParsePointer parses a pointer like /a/b/0, the empty string points to the whole document
+func ParsePointer(s string) (Pointer, error) {
+	if s == "" {
+		return Pointer{}, nil
+	}
+
+	if !strings.HasPrefix(s, "/") {
+		return nil, errors.Wrapf(ErrInvalidPointer, "pointer %s must start with /", s)
+	}
+
+	parts := strings.Split(s[1:], "/")
+	for i, p := range parts {
+		parts[i] = strings.ReplaceAll(strings.ReplaceAll(p, "~1", "/"), "~0", "~")
+	}
+
+	return parts, nil
+}
+
+func (p Pointer) String() string {
+	var sb strings.Builder
+	for _, part := range p {
+		sb.WriteByte('/')
+		sb.WriteString(strings.ReplaceAll(strings.ReplaceAll(part, "~", "~0"), "/", "~1"))
+	}
+	return sb.String()
+}
+
+func (p Pointer) parent() (Pointer, string) {
+	return p[:len(p)-1], p[len(p)-1]
+}
+
+// get resolves the pointer inside a decoded document
+func (p Pointer) get(doc interface{}) (interface{}, error) {
+	node := doc
+	for _, part := range p {
+		switch typed := node.(type) {
+		case map[string]interface{}:
+			v, ok := typed[part]
+			if !ok {
+				return nil, errors.Wrapf(ErrPathNotFound, "%s", p)
+			}
+			node = v
+		case []interface{}:
+			idx, err := arrayIndex(part, len(typed)-1)
+			if err != nil {
+				return nil, errors.Wrapf(ErrPathNotFound, "%s", p)
+			}
+			node = typed[idx]
+		default:
+			return nil, errors.Wrapf(ErrPathNotFound, "%s", p)
+		}
+	}
+
+	return node, nil
+}
+
+func arrayIndex(part string, max int) (int, error) {
+	if part == "" || (len(part) > 1 && part[0] == '0') {
+		return 0, errors.Wrapf(ErrInvalidPointer, "invalid array index %s", part)
+	}
+
+	idx, err := strconv.Atoi(part)
+	if err != nil || idx < 0 || idx > max {
+		return 0, errors.Wrapf(ErrInvalidPointer, "array index %s out of range", part)
+	}
+
+	return idx, nil
+}
@@ -0,0 +1,33 @@
+package jsondoc
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// Project returns a json object holding the values found at the given pointers,
+// keyed by the pointers themselves, paths missing in the document are left out
+func Project(doc []byte, paths []string) ([]byte, error) {
+	target, err := decode(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]interface{}, len(paths))
+	for _, p := range paths {
+		ptr, err := ParsePointer(p)
+		if err != nil {
+			return nil, err
+		}
+
+		v, err := ptr.get(target)
+		if errors.Is(err, ErrPathNotFound) {
+			continue
+		}
+
+		result[p] = v
+	}
+
+	return json.Marshal(result)
+}
@@ -0,0 +1,495 @@
+package jsondoc
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidSchema = errors.New("invalid json schema")
+
+// Violation is a single place where a document does not conform to a schema
+type Violation struct {
+	// Path is the json pointer to the offending value, empty for the whole document
+	Path        string
+	Description string
+}
+
+// annotations are keywords that do not take part in validation
+var annotations = map[string]bool{
+	"$schema": true, "$id": true, "$comment": true, "title": true, "description": true,
+	"default": true, "examples": true, "format": true, "readOnly": true, "writeOnly": true,
+}
+
+// Schema is a compiled JSON Schema. The validation vocabulary of draft 2020-12 is
+// supported except for references, conditionals and dependent keywords,
+// which are rejected on compilation rather than silently ignored.
+type Schema struct {
+	raw json.RawMessage
+
+	never      bool
+	types      []string
+	enum       []interface{}
+	constValue interface{}
+	hasConst   bool
+
+	minimum, maximum                   *float64
+	exclusiveMinimum, exclusiveMaximum *float64
+	multipleOf                         *float64
+
+	minLength, maxLength *int
+	pattern              *regexp.Regexp
+
+	items              *Schema
+	minItems, maxItems *int
+	uniqueItems        bool
+
+	properties           map[string]*Schema
+	required             []string
+	additionalProperties *Schema
+	minProperties        *int
+	maxProperties        *int
+
+	allOf, anyOf, oneOf []*Schema
+	not                 *Schema
+}
+
+// CompileSchema parses and checks a JSON Schema document
+func CompileSchema(b []byte) (*Schema, error) {
+	v, err := decode(b)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidSchema, err.Error())
+	}
+
+	s, err := compile(v, Pointer{})
+	if err != nil {
+		return nil, err
+	}
+
+	s.raw = append(json.RawMessage{}, b...)
+
+	return s, nil
+}
+
+// Raw returns the schema document the schema was compiled from
+func (s *Schema) Raw() []byte {
+	return s.raw
+}
+
+func compile(v interface{}, at Pointer) (*Schema, error) {
+	invalid := func(format string, args ...interface{}) error {
+		return errors.Wrapf(ErrInvalidSchema, "%s: %s", at.String(), fmt.Sprintf(format, args...))
+	}
+
+	switch typed := v.(type) {
+	case bool:
+		return &Schema{never: !typed}, nil
+	case map[string]interface{}:
+	default:
+		return nil, invalid("schema must be an object or a boolean")
+	}
+
+	node := v.(map[string]interface{})
+	s := &Schema{}
+
+	keys := make([]string, 0, len(node))
+	for k := range node {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		kv := node[k]
+		var err error
+		switch {
+		case annotations[k]:
+		case k == "type":
+			s.types, err = compileTypes(kv)
+		case k == "enum":
+			arr, ok := kv.([]interface{})
+			if !ok {
+				err = errors.New("enum must be an array")
+			}
+			s.enum = arr
+		case k == "const":
+			s.constValue, s.hasConst = kv, true
+		case k == "minimum":
+			s.minimum, err = compileNumber(kv)
+		case k == "maximum":
+			s.maximum, err = compileNumber(kv)
+		case k == "exclusiveMinimum":
+			s.exclusiveMinimum, err = compileNumber(kv)
+		case k == "exclusiveMaximum":
+			s.exclusiveMaximum, err = compileNumber(kv)
+		case k == "multipleOf":
+			s.multipleOf, err = compileNumber(kv)
+			if err == nil && *s.multipleOf <= 0 {
+				err = errors.New("multipleOf must be positive")
+			}
+		case k == "minLength":
+			s.minLength, err = compileCount(kv)
+		case k == "maxLength":
+			s.maxLength, err = compileCount(kv)
+		case k == "pattern":
+			p, ok := kv.(string)
+			if !ok {
+				err = errors.New("pattern must be a string")
+				break
+			}
+			s.pattern, err = regexp.Compile(p)
+		case k == "items":
+			s.items, err = compile(kv, append(at, k))
+		case k == "minItems":
+			s.minItems, err = compileCount(kv)
+		case k == "maxItems":
+			s.maxItems, err = compileCount(kv)
+		case k == "uniqueItems":
+			b, ok := kv.(bool)
+			if !ok {
+				err = errors.New("uniqueItems must be a boolean")
+			}
+			s.uniqueItems = b
+		case k == "properties":
+			props, ok := kv.(map[string]interface{})
+			if !ok {
+				err = errors.New("properties must be an object")
+				break
+			}
+			s.properties = make(map[string]*Schema, len(props))
+			for name, ps := range props {
+				if s.properties[name], err = compile(ps, append(at, k, name)); err != nil {
+					return nil, err
+				}
+			}
+		case k == "required":
+			s.required, err = compileStrings(kv)
+		case k == "additionalProperties":
+			s.additionalProperties, err = compile(kv, append(at, k))
+		case k == "minProperties":
+			s.minProperties, err = compileCount(kv)
+		case k == "maxProperties":
+			s.maxProperties, err = compileCount(kv)
+		case k == "allOf" || k == "anyOf" || k == "oneOf":
+			var list []*Schema
+			list, err = compileList(kv, append(at, k))
+			switch k {
+			case "allOf":
+				s.allOf = list
+			case "anyOf":
+				s.anyOf = list
+			default:
+				s.oneOf = list
+			}
+		case k == "not":
+			s.not, err = compile(kv, append(at, k))
+		default:
+			return nil, invalid("keyword %s is not supported", k)
+		}
+
+		if err != nil {
+			if errors.Is(err, ErrInvalidSchema) {
+				return nil, err
+			}
+			return nil, invalid("%s", err)
+		}
+	}
+
+	return s, nil
+}
+
+var schemaTypes = map[string]bool{
+	"null": true, "boolean": true, "object": true, "array": true,
+	"number": true, "string": true, "integer": true,
+}
+
+func compileTypes(v interface{}) ([]string, error) {
+	if t, ok := v.(string); ok {
+		v = []interface{}{t}
+	}
+
+	types, err := compileStrings(v)
+	if err != nil {
+		return nil, errors.New("type must be a string or an array of strings")
+	}
+
+	for _, t := range types {
+		if !schemaTypes[t] {
+			return nil, errors.Errorf("unknown type %s", t)
+		}
+	}
+
+	return types, nil
+}
+
+func compileStrings(v interface{}) ([]string, error) {
+	arr, ok := v.([]interface{})
+	if !ok {
+		return nil, errors.New("must be an array of strings")
+	}
+
+	result := make([]string, len(arr))
+	for i, item := range arr {
+		s, ok := item.(string)
+		if !ok {
+			return nil, errors.New("must be an array of strings")
+		}
+		result[i] = s
+	}
+
+	return result, nil
+}
+
+func compileList(v interface{}, at Pointer) ([]*Schema, error) {
+	arr, ok := v.([]interface{})
+	if !ok || len(arr) == 0 {
+		return nil, errors.New("must be a non empty array of schemas")
+	}
+
+	list := make([]*Schema, len(arr))
+	for i, item := range arr {
+		s, err := compile(item, append(at, fmt.Sprint(i)))
+		if err != nil {
+			return nil, err
+		}
+		list[i] = s
+	}
+
+	return list, nil
+}
+
+func compileNumber(v interface{}) (*float64, error) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return nil, errors.New("must be a number")
+	}
+
+	f, err := n.Float64()
+	if err != nil {
+		return nil, err
+	}
+
+	return &f, nil
+}
+
+func compileCount(v interface{}) (*int, error) {
+	f, err := compileNumber(v)
+	if err != nil || *f < 0 || *f != math.Trunc(*f) {
+		return nil, errors.New("must be a non negative integer")
+	}
+
+	n := int(*f)
+	return &n, nil
+}
+
+// Validate checks a json document against the schema
+func (s *Schema) Validate(doc []byte) ([]Violation, error) {
+	v, err := decode(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.validate(v, Pointer{}), nil
+}
+
+func (s *Schema) validate(v interface{}, at Pointer) []Violation {
+	var violations []Violation
+	fail := func(format string, args ...interface{}) {
+		violations = append(violations, Violation{Path: at.String(), Description: fmt.Sprintf(format, args...)})
+	}
+
+	if s.never {
+		fail("no value is allowed here")
+		return violations
+	}
+
+	if len(s.types) > 0 && !hasType(v, s.types) {
+		fail("must be of type %s, got %s", strings.Join(s.types, " or "), typeOf(v))
+		return violations
+	}
+
+	if s.enum != nil && !containsEqual(s.enum, v) {
+		fail("must be one of the enumerated values")
+	}
+
+	if s.hasConst && !equal(s.constValue, v) {
+		fail("must be equal to the constant value")
+	}
+
+	switch typed := v.(type) {
+	case json.Number:
+		s.validateNumber(typed, fail)
+	case string:
+		n := utf8.RuneCountInString(typed)
+		if s.minLength != nil && n < *s.minLength {
+			fail("must be at least %d characters long", *s.minLength)
+		}
+		if s.maxLength != nil && n > *s.maxLength {
+			fail("must be at most %d characters long", *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(typed) {
+			fail("must match pattern %s", s.pattern.String())
+		}
+	case []interface{}:
+		if s.minItems != nil && len(typed) < *s.minItems {
+			fail("must have at least %d items", *s.minItems)
+		}
+		if s.maxItems != nil && len(typed) > *s.maxItems {
+			fail("must have at most %d items", *s.maxItems)
+		}
+		if s.uniqueItems && !unique(typed) {
+			fail("items must be unique")
+		}
+		if s.items != nil {
+			for i, item := range typed {
+				violations = append(violations, s.items.validate(item, append(at, fmt.Sprint(i)))...)
+			}
+		}
+	case map[string]interface{}:
+		if s.minProperties != nil && len(typed) < *s.minProperties {
+			fail("must have at least %d properties", *s.minProperties)
+		}
+		if s.maxProperties != nil && len(typed) > *s.maxProperties {
+			fail("must have at most %d properties", *s.maxProperties)
+		}
+		for _, name := range s.required {
+			if _, ok := typed[name]; !ok {
+				violations = append(violations, Violation{
+					Path:        append(at, name).String(),
+					Description: "is required",
+				})
+			}
+		}
+
+		names := make([]string, 0, len(typed))
+		for name := range typed {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			if ps, ok := s.properties[name]; ok {
+				violations = append(violations, ps.validate(typed[name], append(at, name))...)
+			} else if s.additionalProperties != nil {
+				violations = append(violations, s.additionalProperties.validate(typed[name], append(at, name))...)
+			}
+		}
+	}
+
+	for _, sub := range s.allOf {
+		violations = append(violations, sub.validate(v, at)...)
+	}
+
+	if s.anyOf != nil && s.matching(s.anyOf, v, at) == 0 {
+		fail("must match at least one schema of anyOf")
+	}
+
+	if s.oneOf != nil {
+		if n := s.matching(s.oneOf, v, at); n != 1 {
+			fail("must match exactly one schema of oneOf, matched %d", n)
+		}
+	}
+
+	if s.not != nil && len(s.not.validate(v, at)) == 0 {
+		fail("must not match the schema of not")
+	}
+
+	return violations
+}
+
+func (s *Schema) validateNumber(n json.Number, fail func(format string, args ...interface{})) {
+	f, err := n.Float64()
+	if err != nil {
+		fail("number %s is out of range", n)
+		return
+	}
+
+	if s.minimum != nil && f < *s.minimum {
+		fail("must be >= %v", *s.minimum)
+	}
+	if s.maximum != nil && f > *s.maximum {
+		fail("must be <= %v", *s.maximum)
+	}
+	if s.exclusiveMinimum != nil && f <= *s.exclusiveMinimum {
+		fail("must be > %v", *s.exclusiveMinimum)
+	}
+	if s.exclusiveMaximum != nil && f >= *s.exclusiveMaximum {
+		fail("must be < %v", *s.exclusiveMaximum)
+	}
+	if s.multipleOf != nil {
+		q := f / *s.multipleOf
+		if math.Abs(q-math.Round(q)) > 1e-9 {
+			fail("must be a multiple of %v", *s.multipleOf)
+		}
+	}
+}
+
+func (s *Schema) matching(list []*Schema, v interface{}, at Pointer) int {
+	n := 0
+	for _, sub := range list {
+		if len(sub.validate(v, at)) == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func typeOf(v interface{}) string {
+	switch typed := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if isInteger(typed) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+func hasType(v interface{}, types []string) bool {
+	actual := typeOf(v)
+	for _, t := range types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func isInteger(n json.Number) bool {
+	f, err := n.Float64()
+	return err == nil && f == math.Trunc(f) && !math.IsInf(f, 0)
+}
+
+func containsEqual(list []interface{}, v interface{}) bool {
+	for _, item := range list {
+		if equal(item, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func unique(items []interface{}) bool {
+	for i := range items {
+		for j := i + 1; j < len(items); j++ {
+			if equal(items[i], items[j]) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,92 @@
+package jsondoc
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const userSchema = `{
+	"$schema": "https://json-schema.org/draft/2020-12/schema",
+	"type": "object",
+	"required": ["name", "age"],
+	"properties": {
+		"name": {"type": "string", "minLength": 1},
+		"age": {"type": "integer", "minimum": 0},
+		"email": {"type": "string", "pattern": "^[^@]+@[^@]+$"},
+		"roles": {"type": "array", "items": {"enum": ["admin", "user"]}, "uniqueItems": true},
+		"address": {
+			"type": "object",
+			"properties": {"city": {"type": "string"}},
+			"additionalProperties": false
+		}
+	}
+}`
+
+func Test_Schema_Validate(t *testing.T) {
+	s, err := CompileSchema([]byte(userSchema))
+	require.NoError(t, err)
+
+	tt := []struct {
+		name string
+		doc  string
+		exp  []Violation
+	}{
+		{name: "valid", doc: `{"name":"foo","age":3,"roles":["admin"],"address":{"city":"bar"}}`},
+		{name: "not an object", doc: `[]`, exp: []Violation{{Path: "", Description: "must be of type object, got array"}}},
+		{
+			name: "missing required",
+			doc:  `{"name":"foo"}`,
+			exp:  []Violation{{Path: "/age", Description: "is required"}},
+		},
+		{
+			name: "nested violations",
+			doc:  `{"name":"","age":1.5,"email":"nope","roles":["admin","root","admin"],"address":{"zip":1}}`,
+			exp: []Violation{
+				{Path: "/address/zip", Description: "no value is allowed here"},
+				{Path: "/age", Description: "must be of type integer, got number"},
+				{Path: "/email", Description: "must match pattern ^[^@]+@[^@]+$"},
+				{Path: "/name", Description: "must be at least 1 characters long"},
+				{Path: "/roles", Description: "items must be unique"},
+				{Path: "/roles/1", Description: "must be one of the enumerated values"},
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			violations, err := s.Validate([]byte(tc.doc))
+			require.NoError(t, err)
+			assert.Equal(t, tc.exp, violations)
+		})
+	}
+}
+
+func Test_CompileSchema(t *testing.T) {
+	tt := []struct {
+		name   string
+		schema string
+		valid  bool
+	}{
+		{name: "boolean schema", schema: `true`, valid: true},
+		{name: "combinators", schema: `{"oneOf":[{"type":"string"},{"type":"integer"}],"not":{"const":"x"}}`, valid: true},
+		{name: "unknown type", schema: `{"type":"date"}`},
+		{name: "references are not supported", schema: `{"$ref":"#/$defs/a"}`},
+		{name: "invalid pattern", schema: `{"pattern":"("}`},
+		{name: "negative count", schema: `{"minItems":-1}`},
+		{name: "not json", schema: `{`},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := CompileSchema([]byte(tc.schema))
+			if tc.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.True(t, errors.Is(err, ErrInvalidSchema), "got %v", err)
+			}
+		})
+	}
+}
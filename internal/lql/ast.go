@@ -0,0 +1,161 @@
+package lql
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Statement is a parsed query, e.g.
+// FIND IN users WHERE key PREFIX "u:" AND tag.age >= 18 ORDER BY key DESC LIMIT 50,
+// documents are found in ascending key order unless ordered by key DESC
+type Statement struct {
+	// Explain asks for the plan of the query instead of its documents
+	Explain  bool
+	Database string
+	// Where conditions all have to match
+	Where   []Condition
+	OrderBy *OrderBy
+	// Limit is the maximum number of documents, zero means all of them
+	Limit int
+}
+
+func (s *Statement) String() string {
+	var sb strings.Builder
+	if s.Explain {
+		sb.WriteString("EXPLAIN ")
+	}
+
+	sb.WriteString("FIND IN ")
+	sb.WriteString(quoteName(s.Database))
+
+	for i, c := range s.Where {
+		if i == 0 {
+			sb.WriteString(" WHERE ")
+		} else {
+			sb.WriteString(" AND ")
+		}
+		sb.WriteString(c.String())
+	}
+
+	if s.OrderBy != nil {
+		sb.WriteString(" ORDER BY ")
+		sb.WriteString(s.OrderBy.String())
+	}
+
+	if s.Limit > 0 {
+		sb.WriteString(" LIMIT ")
+		sb.WriteString(strconv.Itoa(s.Limit))
+	}
+
+	return sb.String()
+}
+
+// Field is what a condition compares, the document key or one of its tags
+type Field struct {
+	// Tag is the name of the tag, empty for the key
+	Tag string
+}
+
+// IsKey reports whether the field is the document key
+func (f Field) IsKey() bool {
+	return f.Tag == ""
+}
+
+func (f Field) String() string {
+	if f.IsKey() {
+		return "key"
+	}
+
+	return "tag." + quoteName(f.Tag)
+}
+
+// Operator compares a field with a value
+type Operator int
+
+const (
+	Eq Operator = iota
+	Gt
+	Gte
+	Lt
+	Lte
+	// Prefix matches keys starting with a string
+	Prefix
+)
+
+func (o Operator) String() string {
+	switch o {
+	case Eq:
+		return "="
+	case Gt:
+		return ">"
+	case Gte:
+		return ">="
+	case Lt:
+		return "<"
+	case Lte:
+		return "<="
+	case Prefix:
+		return "PREFIX"
+	default:
+		return "?"
+	}
+}
+
+// Condition compares a field with a value, values are strings, ints,
+// float64s, bools and time.Time for timestamp literals
+type Condition struct {
+	Field Field
+	Op    Operator
+	Value interface{}
+}
+
+func (c Condition) String() string {
+	return c.Field.String() + " " + c.Op.String() + " " + formatValue(c.Value)
+}
+
+// OrderBy orders documents by key
+type OrderBy struct {
+	Desc bool
+}
+
+func (o *OrderBy) String() string {
+	if o.Desc {
+		return "key DESC"
+	}
+
+	return "key ASC"
+}
+
+var plainName = regexp.MustCompile(`^[0-9a-zA-Z_-]+$`)
+
+// quoteName quotes database and tag names that are not plain identifiers or clash with keywords
+func quoteName(name string) string {
+	if plainName.MatchString(name) && !isKeyword(name) {
+		return name
+	}
+
+	return strconv.Quote(name)
+}
+
+func formatValue(v interface{}) string {
+	switch typed := v.(type) {
+	case string:
+		return strconv.Quote(typed)
+	case int:
+		return strconv.Itoa(typed)
+	case float64:
+		s := strconv.FormatFloat(typed, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".eEnN") {
+			s += ".0"
+		}
+		return s
+	case bool:
+		return strings.ToUpper(strconv.FormatBool(typed))
+	case time.Time:
+		return "TIMESTAMP " + strconv.Quote(typed.Format(time.RFC3339Nano))
+	default:
+		return "?"
+	}
+}
@@ -0,0 +1,122 @@
+package lql
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var ErrSyntax = errors.New("lql syntax error")
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenOperator
+	tokenDot
+	tokenSemicolon
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	// pos is the byte offset of the token in the query
+	pos int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of query"
+	case tokenString:
+		return "string " + t.text
+	default:
+		return "'" + t.text + "'"
+	}
+}
+
+var keywords = map[string]bool{
+	"EXPLAIN": true, "FIND": true, "IN": true, "WHERE": true, "AND": true,
+	"ORDER": true, "BY": true, "ASC": true, "DESC": true, "LIMIT": true,
+	"KEY": true, "TAG": true, "PREFIX": true, "TRUE": true, "FALSE": true, "TIMESTAMP": true,
+}
+
+func isKeyword(s string) bool {
+	return keywords[strings.ToUpper(s)]
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '-' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// lex splits a query into tokens, string tokens keep their quotes
+func lex(query string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' || c == '\'':
+			end := i + 1
+			for end < len(query) && query[end] != c {
+				if query[end] == '\\' {
+					end++
+				}
+				end++
+			}
+
+			if end >= len(query) {
+				return nil, errors.Wrapf(ErrSyntax, "at %d: unterminated string", i)
+			}
+
+			tokens = append(tokens, token{kind: tokenString, text: query[i : end+1], pos: i})
+			i = end + 1
+		case isDigit(c) || (c == '-' || c == '+') && i+1 < len(query) && isDigit(query[i+1]):
+			end := i + 1
+			for end < len(query) && (isDigit(query[end]) || strings.IndexByte(".eE", query[end]) >= 0 ||
+				(query[end] == '-' || query[end] == '+') && (query[end-1] == 'e' || query[end-1] == 'E')) {
+				end++
+			}
+
+			tokens = append(tokens, token{kind: tokenNumber, text: query[i:end], pos: i})
+			i = end
+		case isIdentChar(c):
+			end := i + 1
+			for end < len(query) && isIdentChar(query[end]) {
+				end++
+			}
+
+			tokens = append(tokens, token{kind: tokenIdent, text: query[i:end], pos: i})
+			i = end
+		case c == '=':
+			tokens = append(tokens, token{kind: tokenOperator, text: "=", pos: i})
+			i++
+		case c == '<' || c == '>':
+			op := string(c)
+			if i+1 < len(query) && query[i+1] == '=' {
+				op += "="
+			}
+
+			tokens = append(tokens, token{kind: tokenOperator, text: op, pos: i})
+			i += len(op)
+		case c == '.':
+			tokens = append(tokens, token{kind: tokenDot, text: ".", pos: i})
+			i++
+		case c == ';':
+			tokens = append(tokens, token{kind: tokenSemicolon, text: ";", pos: i})
+			i++
+		default:
+			return nil, errors.Wrapf(ErrSyntax, "at %d: unexpected character %q", i, c)
+		}
+	}
+
+	return append(tokens, token{kind: tokenEOF, pos: len(query)}), nil
+}
@@ -0,0 +1,284 @@
+package lql
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Parse parses a query of the form
+//
+//	[EXPLAIN] FIND IN <database>
+//	  [WHERE <condition> [AND <condition>]...]
+//	  [ORDER BY key [ASC|DESC]]
+//	  [LIMIT <n>]
+//
+// where a condition is one of
+//
+//	key PREFIX "<string>"
+//	key <op> "<string>"
+//	tag.<name> <op> <literal>
+//
+// op is one of = > >= < <= and a literal is a string, a number, TRUE, FALSE or
+// TIMESTAMP "<RFC 3339 time>". Keywords are case insensitive, names that are not made
+// of letters, digits, - and _ or clash with keywords can be double quoted.
+func Parse(query string) (*Statement, error) {
+	tokens, err := lex(query)
+	if err != nil {
+		return nil, err
+	}
+
+	p := parser{tokens: tokens}
+	return p.statement()
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) errorf(t token, format string, args ...interface{}) error {
+	return errors.Wrapf(ErrSyntax, "at %d: "+format, append([]interface{}{t.pos}, args...)...)
+}
+
+// isKeyword reports whether the next token is the keyword
+func (p *parser) isKeyword(keyword string) bool {
+	t := p.peek()
+	return t.kind == tokenIdent && strings.EqualFold(t.text, keyword)
+}
+
+func (p *parser) keyword(keyword string) error {
+	if !p.isKeyword(keyword) {
+		return p.errorf(p.peek(), "expected %s, got %s", keyword, p.peek())
+	}
+
+	p.next()
+	return nil
+}
+
+// name parses a database or tag name, either a plain identifier or a string
+func (p *parser) name(what string) (string, error) {
+	t := p.next()
+	switch {
+	case t.kind == tokenString:
+		name, err := unquote(t.text)
+		if err != nil || name == "" {
+			return "", p.errorf(t, "invalid %s name %s", what, t.text)
+		}
+		return name, nil
+	case t.kind == tokenIdent && !isKeyword(t.text):
+		return t.text, nil
+	default:
+		return "", p.errorf(t, "expected %s name, got %s", what, t)
+	}
+}
+
+func (p *parser) statement() (*Statement, error) {
+	var s Statement
+	if p.isKeyword("EXPLAIN") {
+		p.next()
+		s.Explain = true
+	}
+
+	if err := p.keyword("FIND"); err != nil {
+		return nil, err
+	}
+
+	if err := p.keyword("IN"); err != nil {
+		return nil, err
+	}
+
+	db, err := p.name("database")
+	if err != nil {
+		return nil, err
+	}
+	s.Database = db
+
+	if p.isKeyword("WHERE") {
+		p.next()
+		for {
+			c, err := p.condition()
+			if err != nil {
+				return nil, err
+			}
+			s.Where = append(s.Where, c)
+
+			if !p.isKeyword("AND") {
+				break
+			}
+			p.next()
+		}
+	}
+
+	if p.isKeyword("ORDER") {
+		p.next()
+		if err := p.keyword("BY"); err != nil {
+			return nil, err
+		}
+
+		if !p.isKeyword("KEY") {
+			return nil, p.errorf(p.peek(), "documents can only be ordered by key, got %s", p.peek())
+		}
+		p.next()
+
+		s.OrderBy = &OrderBy{}
+		if p.isKeyword("DESC") {
+			p.next()
+			s.OrderBy.Desc = true
+		} else if p.isKeyword("ASC") {
+			p.next()
+		}
+	}
+
+	if p.isKeyword("LIMIT") {
+		p.next()
+		t := p.next()
+		n, err := strconv.Atoi(t.text)
+		if t.kind != tokenNumber || err != nil || n <= 0 {
+			return nil, p.errorf(t, "limit must be a positive integer, got %s", t)
+		}
+		s.Limit = n
+	}
+
+	if p.peek().kind == tokenSemicolon {
+		p.next()
+	}
+
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, p.errorf(t, "unexpected %s", t)
+	}
+
+	return &s, nil
+}
+
+func (p *parser) condition() (Condition, error) {
+	var c Condition
+	switch {
+	case p.isKeyword("KEY"):
+		p.next()
+	case p.isKeyword("TAG"):
+		p.next()
+		if t := p.next(); t.kind != tokenDot {
+			return c, p.errorf(t, "expected '.' after tag, got %s", t)
+		}
+
+		name, err := p.name("tag")
+		if err != nil {
+			return c, err
+		}
+		c.Field.Tag = name
+	default:
+		return c, p.errorf(p.peek(), "expected key or tag.<name>, got %s", p.peek())
+	}
+
+	op := p.next()
+	switch {
+	case op.kind == tokenOperator:
+		c.Op = map[string]Operator{"=": Eq, ">": Gt, ">=": Gte, "<": Lt, "<=": Lte}[op.text]
+	case op.kind == tokenIdent && strings.EqualFold(op.text, "PREFIX"):
+		if !c.Field.IsKey() {
+			return c, p.errorf(op, "PREFIX only applies to key")
+		}
+		c.Op = Prefix
+	default:
+		return c, p.errorf(op, "expected operator, got %s", op)
+	}
+
+	t := p.peek()
+	v, err := p.literal()
+	if err != nil {
+		return c, err
+	}
+
+	if _, ok := v.(string); c.Field.IsKey() && !ok {
+		return c, p.errorf(t, "key can only be compared with strings")
+	}
+	c.Value = v
+
+	return c, nil
+}
+
+func (p *parser) literal() (interface{}, error) {
+	t := p.next()
+	switch {
+	case t.kind == tokenString:
+		s, err := unquote(t.text)
+		if err != nil {
+			return nil, p.errorf(t, "invalid string %s", t.text)
+		}
+		return s, nil
+	case t.kind == tokenNumber:
+		if n, err := strconv.Atoi(t.text); err == nil {
+			return n, nil
+		}
+
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, p.errorf(t, "invalid number %s", t.text)
+		}
+		return f, nil
+	case t.kind == tokenIdent && strings.EqualFold(t.text, "TRUE"):
+		return true, nil
+	case t.kind == tokenIdent && strings.EqualFold(t.text, "FALSE"):
+		return false, nil
+	case t.kind == tokenIdent && strings.EqualFold(t.text, "TIMESTAMP"):
+		s := p.next()
+		if s.kind != tokenString {
+			return nil, p.errorf(s, "expected timestamp string, got %s", s)
+		}
+
+		text, err := unquote(s.text)
+		if err != nil {
+			return nil, p.errorf(s, "invalid string %s", s.text)
+		}
+
+		ts, err := time.Parse(time.RFC3339Nano, text)
+		if err != nil {
+			return nil, p.errorf(s, "timestamp %s is not an RFC 3339 time", s.text)
+		}
+		return ts.UTC(), nil
+	default:
+		return nil, p.errorf(t, "expected value, got %s", t)
+	}
+}
+
+// unquote decodes a double or single quoted string with Go escapes
+func unquote(s string) (string, error) {
+	if s[0] == '\'' {
+		var sb strings.Builder
+		sb.WriteByte('"')
+		body := s[1 : len(s)-1]
+		for i := 0; i < len(body); i++ {
+			switch {
+			case body[i] == '\\' && i+1 < len(body) && body[i+1] == '\'':
+				sb.WriteByte('\'')
+				i++
+			case body[i] == '\\' && i+1 < len(body):
+				sb.WriteString(body[i : i+2])
+				i++
+			case body[i] == '"':
+				sb.WriteString(`\"`)
+			default:
+				sb.WriteByte(body[i])
+			}
+		}
+		sb.WriteByte('"')
+		s = sb.String()
+	}
+
+	return strconv.Unquote(s)
+}
@@ -0,0 +1,109 @@
+package lql
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	tt := []struct {
+		query    string
+		expected Statement
+		// canonical is the String form, the query itself when empty
+		canonical string
+	}{
+		{
+			query:    "FIND IN users",
+			expected: Statement{Database: "users"},
+		},
+		{
+			query: `FIND IN users WHERE key PREFIX "u:" AND tag.age >= 18 ORDER BY key DESC LIMIT 50`,
+			expected: Statement{
+				Database: "users",
+				Where: []Condition{
+					{Field: Field{}, Op: Prefix, Value: "u:"},
+					{Field: Field{Tag: "age"}, Op: Gte, Value: 18},
+				},
+				OrderBy: &OrderBy{Desc: true},
+				Limit:   50,
+			},
+		},
+		{
+			query: `explain find in "my db" where tag."first name" = 'O\'Neil' and tag.score<-1.5e3 and tag.active = true order by key;`,
+			expected: Statement{
+				Explain:  true,
+				Database: "my db",
+				Where: []Condition{
+					{Field: Field{Tag: "first name"}, Op: Eq, Value: "O'Neil"},
+					{Field: Field{Tag: "score"}, Op: Lt, Value: -1500.0},
+					{Field: Field{Tag: "active"}, Op: Eq, Value: true},
+				},
+				OrderBy: &OrderBy{},
+			},
+			canonical: `EXPLAIN FIND IN "my db" WHERE tag."first name" = "O'Neil" AND tag.score < -1500.0 AND tag.active = TRUE ORDER BY key ASC`,
+		},
+		{
+			query: `FIND IN events WHERE key > "e:1" AND key <= "e:9" AND tag.at < TIMESTAMP "2021-10-01T12:00:00+02:00"`,
+			expected: Statement{
+				Database: "events",
+				Where: []Condition{
+					{Field: Field{}, Op: Gt, Value: "e:1"},
+					{Field: Field{}, Op: Lte, Value: "e:9"},
+					{Field: Field{Tag: "at"}, Op: Lt, Value: time.Date(2021, 10, 1, 10, 0, 0, 0, time.UTC)},
+				},
+			},
+			canonical: `FIND IN events WHERE key > "e:1" AND key <= "e:9" AND tag.at < TIMESTAMP "2021-10-01T10:00:00Z"`,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.query, func(t *testing.T) {
+			s, err := Parse(tc.query)
+			require.NoError(t, err)
+			assert.Equal(t, &tc.expected, s)
+
+			canonical := tc.canonical
+			if canonical == "" {
+				canonical = tc.query
+			}
+			assert.Equal(t, canonical, s.String())
+
+			reparsed, err := Parse(s.String())
+			require.NoError(t, err)
+			assert.Equal(t, s, reparsed)
+		})
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	tt := []struct {
+		query string
+		err   string
+	}{
+		{query: "", err: "at 0: expected FIND, got end of query"},
+		{query: "FIND users", err: "at 5: expected IN, got 'users'"},
+		{query: "FIND IN where", err: "at 8: expected database name, got 'where'"},
+		{query: `FIND IN users WHERE tag.age PREFIX "a"`, err: "at 28: PREFIX only applies to key"},
+		{query: "FIND IN users WHERE key = 1", err: "at 26: key can only be compared with strings"},
+		{query: "FIND IN users WHERE tag.age >= ", err: "at 31: expected value, got end of query"},
+		{query: "FIND IN users ORDER BY tag.age", err: "at 23: documents can only be ordered by key, got 'tag'"},
+		{query: "FIND IN users LIMIT 0", err: "at 20: limit must be a positive integer, got '0'"},
+		{query: `FIND IN users WHERE key = "u`, err: "at 26: unterminated string"},
+		{query: `FIND IN users WHERE tag.at = TIMESTAMP "yesterday"`, err: `at 39: timestamp "yesterday" is not an RFC 3339 time`},
+		{query: "FIND IN users LIMIT 5 5", err: "at 22: unexpected '5'"},
+		{query: "FIND IN users WHERE key != 1", err: "at 24: unexpected character '!'"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.query, func(t *testing.T) {
+			_, err := Parse(tc.query)
+			require.Error(t, err)
+			assert.True(t, errors.Is(err, ErrSyntax))
+			assert.Equal(t, tc.err+": "+ErrSyntax.Error(), err.Error())
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/denismitr/lemon"
+	"github.com/pkg/errors"
+)
+
+const (
+	journalFile = "channels.ldb"
+	// channelKeyPrefix keeps the first key segment from looking like an integer, which lemon orders numerically
+	channelKeyPrefix = "ch."
+	// replayBatch is the number of messages read at once, they are delivered outside of the transaction
+	replayBatch = 100
+)
+
+// journal stores the messages of durable channels in a lemon database, keyed by channel and sequence
+type journal struct {
+	db     *lemon.DB
+	closer lemon.Closer
+	max    int
+	// bounds are the first and last sequences of the channels read so far
+	bounds map[string]*bounds
+	mu     sync.Mutex
+}
+
+// bounds of a channel without messages have first = last+1
+type bounds struct {
+	first uint64
+	last  uint64
+}
+
+type journalEntry struct {
+	Payload     []byte    `json:"payload"`
+	PublishedAt time.Time `json:"published_at"`
+}
+
+func openJournal(dir string, max int) (*journal, error) {
+	if max <= 0 {
+		return nil, errors.Errorf("max messages %d must be positive", max)
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "could not create pubsub dir %s", dir)
+	}
+
+	db, closer, err := lemon.Open(filepath.Join(dir, journalFile))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open durable channels")
+	}
+
+	return &journal{db: db, closer: closer, max: max, bounds: make(map[string]*bounds)}, nil
+}
+
+func messageKey(channel string, seq uint64) string {
+	return fmt.Sprintf("%s%s:%d", channelKeyPrefix, channel, seq)
+}
+
+// channelBounds returns the sequences of the messages of a channel, reading them on first use
+func (j *journal) channelBounds(channel string) (*bounds, error) {
+	if b, ok := j.bounds[channel]; ok {
+		return b, nil
+	}
+
+	b := &bounds{first: 1}
+	prefix := messageKey(channel, 0)
+	prefix = prefix[:len(prefix)-1]
+
+	if err := j.db.View(context.Background(), func(tx *lemon.Tx) error {
+		return tx.Scan(lemon.Q().Prefix(prefix), func(d *lemon.Document) bool {
+			if !strings.HasPrefix(d.Key(), prefix) {
+				return false
+			}
+
+			seq, err := strconv.ParseUint(strings.TrimPrefix(d.Key(), prefix), 10, 64)
+			if err != nil {
+				return true
+			}
+
+			if b.last == 0 {
+				b.first = seq
+			}
+			b.last = seq
+			return true
+		})
+	}); err != nil {
+		return nil, errors.Wrapf(err, "could not read the messages of channel %s", channel)
+	}
+
+	j.bounds[channel] = b
+	return b, nil
+}
+
+// append stores a message with the next sequence of its channel and drops the oldest
+// messages above the maximum
+func (j *journal) append(m *Message) (uint64, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	b, err := j.channelBounds(m.Channel)
+	if err != nil {
+		return 0, err
+	}
+
+	value, err := json.Marshal(journalEntry{Payload: m.Payload, PublishedAt: m.PublishedAt})
+	if err != nil {
+		return 0, errors.Wrap(err, "could not encode message")
+	}
+
+	seq := b.last + 1
+	first := b.first
+	var trimmed []string
+	for ; seq-first >= uint64(j.max); first++ {
+		trimmed = append(trimmed, messageKey(m.Channel, first))
+	}
+
+	if err := j.db.Update(context.Background(), func(tx *lemon.Tx) error {
+		if err := tx.Insert(messageKey(m.Channel, seq), string(value)); err != nil {
+			return err
+		}
+
+		if len(trimmed) > 0 {
+			return tx.Remove(trimmed...)
+		}
+
+		return nil
+	}); err != nil {
+		return 0, errors.Wrapf(err, "could not store message of channel %s", m.Channel)
+	}
+
+	b.first, b.last = first, seq
+	return seq, nil
+}
+
+// read calls cb with the stored messages of a channel starting at sequence from
+func (j *journal) read(ctx context.Context, channel string, from uint64, cb func(m *Message) error) error {
+	j.mu.Lock()
+	b, err := j.channelBounds(channel)
+	var first, last uint64
+	if b != nil {
+		first, last = b.first, b.last
+	}
+	j.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if from < first {
+		from = first
+	}
+
+	for from <= last {
+		to := from + replayBatch - 1
+		if to > last {
+			to = last
+		}
+
+		var batch []*Message
+		if err := j.db.View(ctx, func(tx *lemon.Tx) error {
+			for seq := from; seq <= to; seq++ {
+				d, err := tx.Get(messageKey(channel, seq))
+				if errors.Is(err, lemon.ErrKeyDoesNotExist) {
+					// trimmed since the bounds were read
+					continue
+				} else if err != nil {
+					return err
+				}
+
+				var e journalEntry
+				if err := json.Unmarshal(d.Value(), &e); err != nil {
+					return errors.Wrapf(err, "could not decode message %s", d.Key())
+				}
+
+				batch = append(batch, &Message{
+					Channel:     channel,
+					Sequence:    seq,
+					Payload:     e.Payload,
+					PublishedAt: e.PublishedAt,
+				})
+			}
+
+			return nil
+		}); err != nil {
+			return errors.Wrapf(err, "could not read the messages of channel %s", channel)
+		}
+
+		for _, m := range batch {
+			if err := cb(m); err != nil {
+				return err
+			}
+		}
+
+		from = to + 1
+	}
+
+	return nil
+}
+
+func (j *journal) close() error {
+	return j.closer()
+}
@@ -0,0 +1,426 @@
+// Package pubsub delivers the messages published to named channels to the subscriptions of the
+// channels, or of patterns matching their names, and the changes of documents to the subscriptions
+// of their database.
+//
+// Delivery is at most once: every subscription buffers a number of messages, the messages arriving
+// while its buffer is full are dropped for it and counted in the next message it receives.
+// Messages of durable channels are also stored with a sequence number per channel, so that
+// subscribers can replay them, e.g. from the sequence following the last message they received.
+// Channels are local to a server, messages are neither replicated nor forwarded.
+package pubsub
+
+import (
+	"context"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/denismitr/lemon-server/internal/database"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrInvalidChannel      = errors.New("invalid channel")
+	ErrInvalidSubscription = errors.New("invalid subscription")
+	ErrClosed              = errors.New("broker is closed")
+)
+
+var (
+	// channelNameRegEx is what channel names consist of, they are the first key segment of stored messages
+	channelNameRegEx = regexp.MustCompile(`^[0-9a-zA-Z_.-]{1,200}$`)
+	// patternRegEx allows * for any characters and ? for a single one in channel names
+	patternRegEx = regexp.MustCompile(`^[0-9a-zA-Z_.*?-]{1,200}$`)
+)
+
+// Message is a message published to a channel, or the change of a document of a database
+type Message struct {
+	Channel string
+	// Pattern is the pattern of the subscription the message was received through, if any
+	Pattern string
+	// Sequence numbers the messages of a durable channel, it is zero for other channels
+	Sequence    uint64
+	Payload     []byte
+	PublishedAt time.Time
+	// Dropped is the number of messages the subscription missed before this one
+	Dropped uint64
+
+	// Database and Change are set for the changes of documents
+	Database string
+	Change   *database.Change
+}
+
+// DatabaseFilter selects the changes of the documents of a database whose keys start with KeyPrefix
+type DatabaseFilter struct {
+	Database  string
+	KeyPrefix string
+	// Deletes selects deleted documents as well
+	Deletes bool
+}
+
+func (f DatabaseFilter) matches(c database.Change) bool {
+	return strings.HasPrefix(c.Key, f.KeyPrefix) && (c.Document != nil || f.Deletes)
+}
+
+// Subscription names what a subscriber receives
+type Subscription struct {
+	Channels  []string
+	Patterns  []string
+	Databases []DatabaseFilter
+	// ReplayFrom maps durable channels of the subscription to the sequence their stored
+	// messages are replayed from, before new messages are received
+	ReplayFrom map[string]uint64
+}
+
+// Validate checks the names of a subscription, it does not check whether channels are durable
+func (s *Subscription) Validate() error {
+	if len(s.Channels) == 0 && len(s.Patterns) == 0 && len(s.Databases) == 0 {
+		return errors.Wrap(ErrInvalidSubscription, "subscription needs channels, patterns or databases")
+	}
+
+	for _, c := range s.Channels {
+		if !channelNameRegEx.MatchString(c) {
+			return errors.Wrapf(ErrInvalidChannel, "channel name %q", c)
+		}
+	}
+
+	for _, p := range s.Patterns {
+		if !patternRegEx.MatchString(p) {
+			return errors.Wrapf(ErrInvalidChannel, "channel pattern %q", p)
+		}
+	}
+
+	for _, f := range s.Databases {
+		if f.Database == "" || database.LogicalName(f.Database) != f.Database {
+			return errors.Wrapf(ErrInvalidSubscription, "database %q", f.Database)
+		}
+	}
+
+	for c := range s.ReplayFrom {
+		if !s.hasChannel(c) {
+			return errors.Wrapf(ErrInvalidSubscription, "channel %s is replayed, but not subscribed to", c)
+		}
+	}
+
+	return nil
+}
+
+func (s *Subscription) hasChannel(channel string) bool {
+	for _, c := range s.Channels {
+		if c == channel {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pattern returns how a subscription receives the messages of a channel, the pattern matching it
+// or an empty pattern when it is subscribed to the channel itself
+func (s *Subscription) pattern(channel string) (string, bool) {
+	if s.hasChannel(channel) {
+		return "", true
+	}
+
+	for _, p := range s.Patterns {
+		if matchPattern(p, channel) {
+			return p, true
+		}
+	}
+
+	return "", false
+}
+
+func matchPattern(pattern, channel string) bool {
+	// patterns only hold valid characters, so they cannot be malformed
+	ok, _ := path.Match(pattern, channel)
+	return ok
+}
+
+// ChangeSource reads the documents of keys written to a database
+type ChangeSource interface {
+	Changes(ctx context.Context, dbName string, keys []string) ([]database.Change, error)
+}
+
+// Config holds the settings of a broker
+type Config struct {
+	// BufferSize is the number of messages a subscription holds before further messages are dropped
+	BufferSize int
+	// Durable are the patterns of the channels whose messages are stored
+	Durable []string
+	// Dir holds the messages of durable channels
+	Dir string
+	// MaxMessages is the number of messages kept per durable channel
+	MaxMessages int
+}
+
+// Broker delivers published messages and database changes to subscribers
+type Broker struct {
+	cfg     Config
+	src     ChangeSource
+	journal *journal
+	lg      *zap.SugaredLogger
+
+	// publishing orders the messages of durable channels by their sequence
+	publishing  sync.Mutex
+	subscribers map[*subscriber]struct{}
+	closed      bool
+	mu          sync.RWMutex
+}
+
+type subscriber struct {
+	sub     Subscription
+	ch      chan *Message
+	dropped uint64
+}
+
+// NewBroker opens the journal of durable channels when there are any, changes of databases are read from src
+func NewBroker(cfg Config, src ChangeSource, lg *zap.SugaredLogger) (*Broker, error) {
+	if cfg.BufferSize <= 0 {
+		return nil, errors.Errorf("buffer size %d must be positive", cfg.BufferSize)
+	}
+
+	for _, p := range cfg.Durable {
+		if !patternRegEx.MatchString(p) {
+			return nil, errors.Wrapf(ErrInvalidChannel, "durable channel pattern %q", p)
+		}
+	}
+
+	b := &Broker{
+		cfg:         cfg,
+		src:         src,
+		lg:          lg,
+		subscribers: make(map[*subscriber]struct{}),
+	}
+
+	if len(cfg.Durable) > 0 {
+		j, err := openJournal(cfg.Dir, cfg.MaxMessages)
+		if err != nil {
+			return nil, err
+		}
+		b.journal = j
+	}
+
+	return b, nil
+}
+
+// Durable reports whether the messages of a channel are stored
+func (b *Broker) Durable(channel string) bool {
+	for _, p := range b.cfg.Durable {
+		if matchPattern(p, channel) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Publish delivers a message to the subscribers of a channel and stores it when the channel
+// is durable, returning the sequence of the message and the number of subscriptions it was
+// delivered to
+func (b *Broker) Publish(channel string, payload []byte) (uint64, int, error) {
+	if !channelNameRegEx.MatchString(channel) {
+		return 0, 0, errors.Wrapf(ErrInvalidChannel, "channel name %q", channel)
+	}
+
+	m := &Message{Channel: channel, Payload: payload, PublishedAt: time.Now()}
+	if b.Durable(channel) {
+		b.publishing.Lock()
+		defer b.publishing.Unlock()
+
+		// the journal is closed once the broker is
+		b.mu.RLock()
+		closed := b.closed
+		b.mu.RUnlock()
+		if closed {
+			return 0, 0, ErrClosed
+		}
+
+		seq, err := b.journal.append(m)
+		if err != nil {
+			return 0, 0, err
+		}
+		m.Sequence = seq
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		return 0, 0, ErrClosed
+	}
+
+	receivers := 0
+	for s := range b.subscribers {
+		if pattern, ok := s.sub.pattern(channel); ok {
+			received := *m
+			received.Pattern = pattern
+			if s.send(&received) {
+				receivers++
+			}
+		}
+	}
+
+	return m.Sequence, receivers, nil
+}
+
+// Capture delivers the documents of keys as they are after a commit to the subscribers of
+// their database, it is meant to be an engine change hook
+func (b *Broker) Capture(dbName string, keys []string) {
+	logical := database.LogicalName(dbName)
+
+	b.mu.RLock()
+	var subscribers []*subscriber
+	var filters [][]DatabaseFilter
+	for s := range b.subscribers {
+		var matching []DatabaseFilter
+		for _, f := range s.sub.Databases {
+			if f.Database == logical {
+				matching = append(matching, f)
+			}
+		}
+
+		if matching != nil {
+			subscribers = append(subscribers, s)
+			filters = append(filters, matching)
+		}
+	}
+	b.mu.RUnlock()
+
+	if subscribers == nil {
+		return
+	}
+
+	changes, err := b.src.Changes(context.Background(), dbName, keys)
+	if err != nil {
+		b.lg.Errorf("could not read the changes of database %s for subscribers: %v", logical, err)
+		return
+	}
+
+	now := time.Now()
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for i, s := range subscribers {
+		if _, ok := b.subscribers[s]; !ok {
+			continue
+		}
+
+		for j := range changes {
+			for _, f := range filters[i] {
+				if f.matches(changes[j]) {
+					s.send(&Message{Database: logical, Change: &changes[j], PublishedAt: now})
+					break
+				}
+			}
+		}
+	}
+}
+
+// Subscribe calls deliver with the messages of a subscription until ctx is done, deliver fails
+// or the broker is closed. Stored messages of replayed channels come first, followed by the
+// messages published since that were not replayed
+func (b *Broker) Subscribe(ctx context.Context, sub Subscription, deliver func(*Message) error) error {
+	if err := sub.Validate(); err != nil {
+		return err
+	}
+
+	for c := range sub.ReplayFrom {
+		if !b.Durable(c) {
+			return errors.Wrapf(ErrInvalidSubscription, "channel %s is not durable, it cannot be replayed", c)
+		}
+	}
+
+	s := &subscriber{sub: sub, ch: make(chan *Message, b.cfg.BufferSize)}
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return ErrClosed
+	}
+	b.subscribers[s] = struct{}{}
+	b.mu.Unlock()
+
+	defer b.unsubscribe(s)
+
+	replayed := make(map[string]uint64, len(sub.ReplayFrom))
+	for c, from := range sub.ReplayFrom {
+		if err := b.journal.read(ctx, c, from, func(m *Message) error {
+			replayed[c] = m.Sequence
+			return deliver(m)
+		}); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case m, ok := <-s.ch:
+			if !ok {
+				return ErrClosed
+			}
+
+			if m.Sequence > 0 && m.Sequence <= replayed[m.Channel] {
+				continue
+			}
+
+			if err := deliver(m); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (b *Broker) unsubscribe(s *subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subscribers[s]; ok {
+		delete(b.subscribers, s)
+		close(s.ch)
+	}
+}
+
+// send hands a message to a subscriber without waiting, it is dropped when the buffer is full,
+// the broker has to be read locked
+func (s *subscriber) send(m *Message) bool {
+	m.Dropped = s.dropped
+	select {
+	case s.ch <- m:
+		s.dropped = 0
+		return true
+	default:
+		s.dropped++
+		return false
+	}
+}
+
+// Close ends all subscriptions and closes the journal
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+
+	b.closed = true
+	for s := range b.subscribers {
+		delete(b.subscribers, s)
+		close(s.ch)
+	}
+	b.mu.Unlock()
+
+	if b.journal == nil {
+		return nil
+	}
+
+	b.publishing.Lock()
+	defer b.publishing.Unlock()
+
+	return b.journal.close()
+}
@@ -0,0 +1,202 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/denismitr/lemon-server/internal/database"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func newTestBroker(t *testing.T, cfg Config) (*Broker, *database.LemonEngine) {
+	store := database.NewStore(t.TempDir(), time.Minute)
+	t.Cleanup(func() {
+		_ = store.Close()
+	})
+	le := database.NewEngine(store, nil, zap.NewNop().Sugar())
+
+	b, err := NewBroker(cfg, le, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = b.Close()
+	})
+	le.AddChangeHook(b.Capture)
+
+	return b, le
+}
+
+// subscribe collects the messages of a subscription until the test ends
+func subscribe(t *testing.T, b *Broker, sub Subscription) <-chan *Message {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	b.mu.RLock()
+	before := len(b.subscribers)
+	b.mu.RUnlock()
+
+	received := make(chan *Message, 100)
+	go func() {
+		_ = b.Subscribe(ctx, sub, func(m *Message) error {
+			received <- m
+			return nil
+		})
+	}()
+
+	require.Eventually(t, func() bool {
+		b.mu.RLock()
+		defer b.mu.RUnlock()
+		return len(b.subscribers) > before
+	}, time.Second, time.Millisecond)
+
+	return received
+}
+
+func next(t *testing.T, received <-chan *Message) *Message {
+	select {
+	case m := <-received:
+		return m
+	case <-time.After(time.Second):
+		require.FailNow(t, "no message received")
+		return nil
+	}
+}
+
+func Test_Broker_Publish(t *testing.T) {
+	b, _ := newTestBroker(t, Config{BufferSize: 2})
+
+	t.Run("messages reach subscribers of their channel or a matching pattern", func(t *testing.T) {
+		orders := subscribe(t, b, Subscription{Channels: []string{"orders.eu"}})
+		all := subscribe(t, b, Subscription{Patterns: []string{"orders.*"}})
+
+		_, receivers, err := b.Publish("orders.eu", []byte("first"))
+		require.NoError(t, err)
+		assert.Equal(t, 2, receivers)
+
+		m := next(t, orders)
+		assert.Equal(t, "orders.eu", m.Channel)
+		assert.Equal(t, "", m.Pattern)
+		assert.Equal(t, "first", string(m.Payload))
+		assert.Equal(t, "orders.*", next(t, all).Pattern)
+
+		_, receivers, err = b.Publish("orders.us", []byte("second"))
+		require.NoError(t, err)
+		assert.Equal(t, 1, receivers)
+		assert.Equal(t, "orders.us", next(t, all).Channel)
+	})
+
+	t.Run("messages to full subscriptions are dropped and counted", func(t *testing.T) {
+		blocked := make(chan struct{})
+		t.Cleanup(func() { close(blocked) })
+		received := make(chan *Message, 10)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		go func() {
+			_ = b.Subscribe(ctx, Subscription{Channels: []string{"slow"}}, func(m *Message) error {
+				received <- m
+				<-blocked
+				return nil
+			})
+		}()
+		require.Eventually(t, func() bool {
+			_, n, err := b.Publish("slow", []byte("0"))
+			return err == nil && n == 1
+		}, time.Second, time.Millisecond)
+		next(t, received)
+
+		var delivered int
+		for i := 1; i <= 5; i++ {
+			_, n, err := b.Publish("slow", []byte(fmt.Sprint(i)))
+			require.NoError(t, err)
+			delivered += n
+		}
+		assert.Equal(t, 2, delivered)
+	})
+
+	t.Run("names are validated", func(t *testing.T) {
+		_, _, err := b.Publish("orders:eu", nil)
+		assert.True(t, errors.Is(err, ErrInvalidChannel))
+
+		err = b.Subscribe(context.Background(), Subscription{}, nil)
+		assert.True(t, errors.Is(err, ErrInvalidSubscription))
+
+		err = b.Subscribe(context.Background(), Subscription{
+			Channels:   []string{"orders.eu"},
+			ReplayFrom: map[string]uint64{"orders.eu": 1},
+		}, nil)
+		assert.True(t, errors.Is(err, ErrInvalidSubscription))
+	})
+}
+
+func Test_Broker_Durable(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{BufferSize: 10, Durable: []string{"events.*"}, Dir: dir, MaxMessages: 3}
+
+	b, _ := newTestBroker(t, cfg)
+	for i := 1; i <= 5; i++ {
+		seq, _, err := b.Publish("events.audit", []byte(fmt.Sprint(i)))
+		require.NoError(t, err)
+		assert.Equal(t, uint64(i), seq)
+	}
+	require.NoError(t, b.Close())
+
+	_, _, err := b.Publish("events.audit", nil)
+	assert.True(t, errors.Is(err, ErrClosed))
+
+	// messages outlive the broker, the oldest above the maximum are dropped
+	b, _ = newTestBroker(t, cfg)
+	received := subscribe(t, b, Subscription{
+		Channels:   []string{"events.audit"},
+		ReplayFrom: map[string]uint64{"events.audit": 1},
+	})
+
+	for i := 3; i <= 5; i++ {
+		m := next(t, received)
+		assert.Equal(t, uint64(i), m.Sequence)
+		assert.Equal(t, fmt.Sprint(i), string(m.Payload))
+	}
+
+	seq, _, err := b.Publish("events.audit", []byte("6"))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(6), seq)
+	assert.Equal(t, uint64(6), next(t, received).Sequence)
+}
+
+func Test_Broker_Capture(t *testing.T) {
+	b, le := newTestBroker(t, Config{BufferSize: 10})
+	ctx := context.Background()
+
+	upserts := subscribe(t, b, Subscription{Databases: []DatabaseFilter{{Database: "users", KeyPrefix: "u:"}}})
+	all := subscribe(t, b, Subscription{Databases: []DatabaseFilter{{Database: "users", Deletes: true}}})
+
+	_, err := le.BatchUpsert(ctx, "users", database.BatchUpsert{
+		{Key: "u:1", Value: "ann"},
+		{Key: "admin", Value: "bob"},
+	})
+	require.NoError(t, err)
+
+	m := next(t, upserts)
+	assert.Equal(t, "users", m.Database)
+	assert.Equal(t, "u:1", m.Change.Key)
+	assert.Equal(t, "ann", m.Change.Document.RawString())
+	next(t, all)
+	next(t, all)
+
+	_, err = le.BatchDeleteByKey(ctx, "users", database.BatchDeleteByKey{"u:1"})
+	require.NoError(t, err)
+
+	m = next(t, all)
+	assert.Equal(t, "u:1", m.Change.Key)
+	assert.Nil(t, m.Change.Document)
+
+	select {
+	case m := <-upserts:
+		assert.Failf(t, "deletes are not subscribed to", "received %s", m.Change.Key)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,324 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/denismitr/lemon-server/internal/database"
+	"github.com/denismitr/lemon-server/pkg/command"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+// Sink is the engine of a follower
+type Sink interface {
+	Databases() ([]string, error)
+	ApplyChanges(ctx context.Context, dbName string, changes []database.Change) error
+	Prune(ctx context.Context, dbName string, keep func(key string) bool) (int, error)
+	// DisableSharding keeps databases unsharded, their layout is not replicated
+	DisableSharding() error
+}
+
+// Follower applies the mutations streamed by a primary to its engine
+type Follower struct {
+	sink      Sink
+	primary   string
+	token     string
+	statePath string
+	retry     time.Duration
+	lg        *zap.SugaredLogger
+
+	state           followerState
+	connected       bool
+	primarySequence uint64
+	mu              sync.Mutex
+}
+
+// followerState is persisted, so that a restarted follower resumes where it stopped
+type followerState struct {
+	PrimaryID string `json:"primary_id"`
+	Sequence  uint64 `json:"sequence"`
+	// CommittedAt is the time the last applied mutation was committed on the primary
+	CommittedAt time.Time `json:"committed_at"`
+}
+
+// snapshot collects the keys sent in a snapshot, the others get pruned once it ends
+type snapshot struct {
+	databases []string
+	keys      map[string]map[string]bool
+	startedAt time.Time
+}
+
+func NewFollower(
+	sink Sink,
+	primary, token, statePath string,
+	retry time.Duration,
+	lg *zap.SugaredLogger,
+) (*Follower, error) {
+	if primary == "" {
+		return nil, errors.New("primary address is empty")
+	}
+
+	if err := sink.DisableSharding(); err != nil {
+		return nil, errors.Wrap(err, "sharded databases cannot be replicated")
+	}
+
+	f := &Follower{
+		sink:      sink,
+		primary:   primary,
+		token:     token,
+		statePath: statePath,
+		retry:     retry,
+		lg:        lg,
+	}
+
+	b, err := os.ReadFile(statePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, errors.Wrapf(err, "could not read replication state %s", statePath)
+	}
+
+	if err == nil {
+		if err := json.Unmarshal(b, &f.state); err != nil {
+			return nil, errors.Wrapf(err, "could not parse replication state %s", statePath)
+		}
+	}
+
+	return f, nil
+}
+
+// Run replicates until ctx is done, reconnecting to the primary after failures
+func (f *Follower) Run(ctx context.Context) {
+	for {
+		err := f.replicate(ctx)
+		f.disconnected()
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		f.lg.Errorf("replication from primary %s failed, retrying in %s: %v", f.primary, f.retry, err)
+
+		select {
+		case <-time.After(f.retry):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (f *Follower) replicate(ctx context.Context) error {
+	conn, err := grpc.DialContext(ctx, f.primary, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return errors.Wrapf(err, "could not connect to primary %s", f.primary)
+	}
+	defer conn.Close()
+
+	if f.token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+f.token)
+	}
+
+	state := f.current()
+	stream, err := command.NewReplicationClient(conn).Replicate(ctx, &command.ReplicateRequest{
+		PrimaryId: state.PrimaryID,
+		Sequence:  state.Sequence,
+	})
+	if err != nil {
+		return err
+	}
+
+	var snap *snapshot
+	for {
+		batch, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+
+		f.received(batch)
+
+		switch {
+		case batch.SnapshotStart != nil:
+			snap = &snapshot{
+				databases: batch.SnapshotStart.Databases,
+				keys:      make(map[string]map[string]bool),
+				startedAt: batch.SentAt.AsTime(),
+			}
+			f.lg.Infof("receiving snapshot of %d databases from primary %s", len(snap.databases), f.primary)
+		case batch.SnapshotEnd != nil:
+			if snap == nil {
+				return errors.New("snapshot ended before it started")
+			}
+
+			if err := f.prune(ctx, snap); err != nil {
+				return err
+			}
+
+			if err := f.save(followerState{
+				PrimaryID:   batch.PrimaryId,
+				Sequence:    batch.SnapshotEnd.Sequence,
+				CommittedAt: snap.startedAt,
+			}); err != nil {
+				return err
+			}
+
+			f.lg.Infof("applied snapshot of primary %s at sequence %d", f.primary, batch.SnapshotEnd.Sequence)
+			snap = nil
+		case len(batch.Mutations) > 0:
+			if err := f.apply(ctx, batch.Mutations, snap); err != nil {
+				return err
+			}
+
+			if snap != nil {
+				continue
+			}
+
+			last := batch.Mutations[len(batch.Mutations)-1]
+			if err := f.save(followerState{
+				PrimaryID:   batch.PrimaryId,
+				Sequence:    last.Sequence,
+				CommittedAt: last.CommittedAt.AsTime(),
+			}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// apply writes mutations in order, consecutive mutations of a database in one transaction
+func (f *Follower) apply(ctx context.Context, ms []*command.Mutation, snap *snapshot) error {
+	for len(ms) > 0 {
+		dbName := ms[0].Database
+		n := 1
+		for n < len(ms) && ms[n].Database == dbName {
+			n++
+		}
+
+		changes := make([]database.Change, n)
+		for i, m := range ms[:n] {
+			c, err := database.ConvertGrpcMutationToChange(m)
+			if err != nil {
+				return errors.Wrapf(err, "could not convert mutation of key %s", m.Key)
+			}
+			changes[i] = c
+
+			if snap != nil && c.Document != nil {
+				if snap.keys[dbName] == nil {
+					snap.keys[dbName] = make(map[string]bool)
+				}
+				snap.keys[dbName][c.Key] = true
+			}
+		}
+
+		if err := f.sink.ApplyChanges(ctx, dbName, changes); err != nil {
+			return errors.Wrapf(err, "could not apply mutations to database %s", dbName)
+		}
+
+		ms = ms[n:]
+	}
+
+	return nil
+}
+
+// prune removes the documents the snapshot did not contain from all databases
+func (f *Follower) prune(ctx context.Context, snap *snapshot) error {
+	local, err := f.sink.Databases()
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range append(local, snap.databases...) {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		keys := snap.keys[name]
+		n, err := f.sink.Prune(ctx, name, func(key string) bool {
+			return keys[key]
+		})
+		if err != nil {
+			return errors.Wrapf(err, "could not prune database %s", name)
+		}
+
+		if n > 0 {
+			f.lg.Infof("pruned %d documents of database %s missing from the snapshot", n, name)
+		}
+	}
+
+	return nil
+}
+
+func (f *Follower) current() followerState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.state
+}
+
+func (f *Follower) received(batch *command.ReplicationBatch) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.connected = true
+	f.primarySequence = batch.PrimarySequence
+}
+
+func (f *Follower) disconnected() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.connected = false
+}
+
+func (f *Follower) save(state followerState) error {
+	f.mu.Lock()
+	f.state = state
+	f.mu.Unlock()
+
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(f.statePath), 0755); err != nil {
+		return errors.Wrapf(err, "could not create directory of %s", f.statePath)
+	}
+
+	tmp := f.statePath + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return errors.Wrapf(err, "could not write replication state %s", tmp)
+	}
+
+	if err := os.Rename(tmp, f.statePath); err != nil {
+		return errors.Wrapf(err, "could not rename file %s", tmp)
+	}
+
+	return nil
+}
+
+func (f *Follower) Status() Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s := Status{
+		Role:            RoleFollower,
+		PrimaryID:       f.state.PrimaryID,
+		Sequence:        f.state.Sequence,
+		Primary:         f.primary,
+		Connected:       f.connected,
+		PrimarySequence: f.primarySequence,
+	}
+
+	if f.primarySequence > f.state.Sequence {
+		s.LagMutations = f.primarySequence - f.state.Sequence
+		if !f.state.CommittedAt.IsZero() {
+			s.Lag = time.Since(f.state.CommittedAt)
+		}
+	}
+
+	return s
+}
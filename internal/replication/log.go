@@ -0,0 +1,114 @@
+package replication
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+
+	"github.com/denismitr/lemon-server/pkg/command"
+	"github.com/pkg/errors"
+)
+
+var ErrNotInLog = errors.New("sequence is not in the log")
+
+// Log keeps the most recent mutations of a primary in memory for followers to catch up from,
+// followers asking for mutations it does not keep anymore get a snapshot instead
+type Log struct {
+	// id changes on every start, the sequences of another run mean nothing
+	id      string
+	size    int
+	entries []*command.Mutation
+	// first is the sequence of entries[0], last+1 when there are none
+	first  uint64
+	last   uint64
+	notify chan struct{}
+	mu     sync.Mutex
+}
+
+func NewLog(size int) (*Log, error) {
+	if size <= 0 {
+		return nil, errors.Errorf("log size %d must be positive", size)
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, errors.Wrap(err, "could not generate primary id")
+	}
+
+	return &Log{
+		id:     hex.EncodeToString(b),
+		size:   size,
+		first:  1,
+		notify: make(chan struct{}),
+	}, nil
+}
+
+func (l *Log) ID() string {
+	return l.id
+}
+
+// Last returns the sequence of the last mutation, zero when nothing has been logged yet
+func (l *Log) Last() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.last
+}
+
+// Append assigns sequences to mutations and wakes up readers waiting for them
+func (l *Log) Append(ms []*command.Mutation) {
+	if len(ms) == 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, m := range ms {
+		l.last++
+		m.Sequence = l.last
+		l.entries = append(l.entries, m)
+	}
+
+	if drop := len(l.entries) - l.size; drop > 0 {
+		// copied, so that the dropped mutations do not stay reachable
+		l.entries = append([]*command.Mutation(nil), l.entries[drop:]...)
+		l.first += uint64(drop)
+	}
+
+	close(l.notify)
+	l.notify = make(chan struct{})
+}
+
+// Reset drops all mutations and skips a sequence, so that every follower gets a snapshot,
+// it is used when a write could not be logged
+func (l *Log) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.last++
+	l.first = l.last + 1
+	l.entries = nil
+
+	close(l.notify)
+	l.notify = make(chan struct{})
+}
+
+// Read returns at most max mutations following the one with sequence after, together
+// with a channel that is closed once more are appended, it fails with ErrNotInLog when
+// some of the following mutations are not kept anymore
+func (l *Log) Read(after uint64, max int) ([]*command.Mutation, <-chan struct{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if after+1 < l.first || after > l.last {
+		return nil, nil, errors.Wrapf(ErrNotInLog, "sequence %d, the log holds %d to %d", after, l.first, l.last)
+	}
+
+	from := int(after + 1 - l.first)
+	to := len(l.entries)
+	if to-from > max {
+		to = from + max
+	}
+
+	return l.entries[from:to], l.notify, nil
+}
@@ -0,0 +1,61 @@
+package replication
+
+import (
+	"testing"
+
+	"github.com/denismitr/lemon-server/pkg/command"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mutations(keys ...string) []*command.Mutation {
+	ms := make([]*command.Mutation, len(keys))
+	for i, key := range keys {
+		ms[i] = &command.Mutation{Database: "db", Key: key}
+	}
+	return ms
+}
+
+func Test_Log(t *testing.T) {
+	l, err := NewLog(3)
+	require.NoError(t, err)
+
+	ms, more, err := l.Read(0, 10)
+	require.NoError(t, err)
+	assert.Empty(t, ms)
+
+	l.Append(mutations("a", "b"))
+	select {
+	case <-more:
+	default:
+		t.Fatal("readers were not woken up")
+	}
+
+	ms, _, err = l.Read(0, 1)
+	require.NoError(t, err)
+	require.Len(t, ms, 1)
+	assert.Equal(t, uint64(1), ms[0].Sequence)
+
+	l.Append(mutations("c", "d"))
+	assert.Equal(t, uint64(4), l.Last())
+
+	_, _, err = l.Read(0, 10)
+	assert.True(t, errors.Is(err, ErrNotInLog))
+
+	ms, _, err = l.Read(1, 10)
+	require.NoError(t, err)
+	require.Len(t, ms, 3)
+	assert.Equal(t, "d", ms[2].Key)
+
+	_, _, err = l.Read(5, 10)
+	assert.True(t, errors.Is(err, ErrNotInLog))
+
+	l.Reset()
+	_, _, err = l.Read(4, 10)
+	assert.True(t, errors.Is(err, ErrNotInLog))
+
+	ms, _, err = l.Read(5, 10)
+	require.NoError(t, err)
+	assert.Empty(t, ms)
+}
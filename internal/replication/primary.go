@@ -0,0 +1,250 @@
+package replication
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/denismitr/lemon-server/internal/database"
+	"github.com/denismitr/lemon-server/pkg/command"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Source is the engine of a primary
+type Source interface {
+	Databases() ([]string, error)
+	Changes(ctx context.Context, dbName string, keys []string) ([]database.Change, error)
+	Snapshot(ctx context.Context, dbName string, emit func([]database.Change) error) error
+	// DisableSharding keeps databases unsharded, their layout is not replicated
+	DisableSharding() error
+}
+
+// Primary logs the writes of its engine and serves them to followers
+type Primary struct {
+	src Source
+	log *Log
+	lg  *zap.SugaredLogger
+	// capturing keeps the log in the order documents were read in
+	capturing sync.Mutex
+	followers map[*followerStream]struct{}
+	mu        sync.Mutex
+}
+
+type followerStream struct {
+	peer        string
+	sequence    uint64
+	connectedAt time.Time
+}
+
+func NewPrimary(src Source, logSize int, lg *zap.SugaredLogger) (*Primary, error) {
+	if err := src.DisableSharding(); err != nil {
+		return nil, errors.Wrap(err, "sharded databases cannot be replicated")
+	}
+
+	log, err := NewLog(logSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Primary{
+		src:       src,
+		log:       log,
+		lg:        lg,
+		followers: make(map[*followerStream]struct{}),
+	}, nil
+}
+
+// Capture logs the documents of keys as they are after a commit, it is meant to be
+// an engine commit hook, the last capture of a key always reads its latest write
+func (p *Primary) Capture(dbName string, keys []string) {
+	p.capturing.Lock()
+	defer p.capturing.Unlock()
+
+	changes, err := p.src.Changes(context.Background(), dbName, keys)
+	if err != nil {
+		p.lg.Errorf("could not capture writes to database %s, followers get a snapshot: %v", dbName, err)
+		p.log.Reset()
+		return
+	}
+
+	committedAt := timestamppb.Now()
+	ms := make([]*command.Mutation, len(changes))
+	for i, c := range changes {
+		m, err := database.ConvertChangeToGrpcMutation(dbName, c)
+		if err != nil {
+			p.lg.Errorf("could not capture writes to database %s, followers get a snapshot: %v", dbName, err)
+			p.log.Reset()
+			return
+		}
+
+		m.CommittedAt = committedAt
+		ms[i] = m
+	}
+
+	p.log.Append(ms)
+}
+
+// Replicate streams mutations to a follower, starting with a snapshot
+// when the follower is at a sequence the log does not hold
+func (p *Primary) Replicate(req *command.ReplicateRequest, stream command.Replication_ReplicateServer) error {
+	ctx := stream.Context()
+	f := p.connect(ctx)
+	defer p.disconnect(f)
+
+	seq := req.Sequence
+	snapshot := req.PrimaryId != p.log.ID()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		if snapshot {
+			var err error
+			if seq, err = p.sendSnapshot(ctx, stream, f); err != nil {
+				return err
+			}
+			snapshot = false
+		}
+
+		ms, more, err := p.log.Read(seq, maxBatchSize)
+		if errors.Is(err, ErrNotInLog) {
+			p.lg.Infof("follower %s is at sequence %d the log does not hold, sending a snapshot", f.peer, seq)
+			snapshot = true
+			continue
+		}
+
+		if len(ms) > 0 {
+			if err := stream.Send(p.batch(ms)); err != nil {
+				return err
+			}
+
+			seq = ms[len(ms)-1].Sequence
+			p.sent(f, seq)
+			continue
+		}
+
+		select {
+		case <-more:
+		case <-heartbeat.C:
+			if err := stream.Send(p.batch(nil)); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// sendSnapshot streams all documents, returning the sequence the snapshot is consistent with
+func (p *Primary) sendSnapshot(ctx context.Context, stream command.Replication_ReplicateServer, f *followerStream) (uint64, error) {
+	// mutations logged up to here were read before the documents of the snapshot
+	seq := p.log.Last()
+
+	names, err := p.src.Databases()
+	if err != nil {
+		return 0, err
+	}
+
+	start := p.batch(nil)
+	start.SnapshotStart = &command.SnapshotStart{Databases: names}
+	if err := stream.Send(start); err != nil {
+		return 0, err
+	}
+
+	documents := 0
+	for _, name := range names {
+		if err := p.src.Snapshot(ctx, name, func(changes []database.Change) error {
+			ms := make([]*command.Mutation, len(changes))
+			for i, c := range changes {
+				m, err := database.ConvertChangeToGrpcMutation(name, c)
+				if err != nil {
+					return err
+				}
+				ms[i] = m
+			}
+
+			documents += len(ms)
+			return stream.Send(p.batch(ms))
+		}); err != nil {
+			return 0, errors.Wrapf(err, "could not send snapshot of database %s", name)
+		}
+	}
+
+	end := p.batch(nil)
+	end.SnapshotEnd = &command.SnapshotEnd{Sequence: seq}
+	if err := stream.Send(end); err != nil {
+		return 0, err
+	}
+
+	p.sent(f, seq)
+	p.lg.Infof("sent snapshot of %d documents in %d databases to follower %s", documents, len(names), f.peer)
+
+	return seq, nil
+}
+
+func (p *Primary) batch(ms []*command.Mutation) *command.ReplicationBatch {
+	return &command.ReplicationBatch{
+		PrimaryId:       p.log.ID(),
+		PrimarySequence: p.log.Last(),
+		SentAt:          timestamppb.Now(),
+		Mutations:       ms,
+	}
+}
+
+func (p *Primary) connect(ctx context.Context) *followerStream {
+	f := &followerStream{connectedAt: time.Now()}
+	if pr, ok := peer.FromContext(ctx); ok && pr.Addr != nil {
+		f.peer = pr.Addr.String()
+	}
+
+	p.mu.Lock()
+	p.followers[f] = struct{}{}
+	p.mu.Unlock()
+
+	p.lg.Infof("follower %s connected", f.peer)
+
+	return f
+}
+
+func (p *Primary) disconnect(f *followerStream) {
+	p.mu.Lock()
+	delete(p.followers, f)
+	p.mu.Unlock()
+
+	p.lg.Infof("follower %s disconnected", f.peer)
+}
+
+func (p *Primary) sent(f *followerStream, seq uint64) {
+	p.mu.Lock()
+	f.sequence = seq
+	p.mu.Unlock()
+}
+
+func (p *Primary) Status() Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := Status{
+		Role:      RolePrimary,
+		PrimaryID: p.log.ID(),
+		Sequence:  p.log.Last(),
+	}
+
+	for f := range p.followers {
+		s.Followers = append(s.Followers, FollowerStatus{
+			Peer:        f.peer,
+			Sequence:    f.sequence,
+			ConnectedAt: f.connectedAt,
+		})
+	}
+
+	sort.Slice(s.Followers, func(i, j int) bool {
+		return s.Followers[i].ConnectedAt.Before(s.Followers[j].ConnectedAt)
+	})
+
+	return s
+}
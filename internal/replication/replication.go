@@ -0,0 +1,50 @@
+// Package replication streams the committed writes of a primary lemon-server to followers.
+//
+// A primary captures the documents written by every commit as mutations, which get
+// sequence numbers in an in-memory log. Followers stream the mutations following the
+// last one they applied and apply them in order. A follower the log cannot serve anymore,
+// because it is too far behind or the primary has restarted since, gets a snapshot of all
+// documents first. Replication is asynchronous, primaries never wait for followers.
+package replication
+
+import (
+	"time"
+)
+
+const (
+	RoleStandalone = "standalone"
+	RolePrimary    = "primary"
+	RoleFollower   = "follower"
+)
+
+// heartbeatInterval is the time after which an idle primary tells followers its last sequence
+const heartbeatInterval = time.Second
+
+// maxBatchSize is the number of mutations sent in one batch at most
+const maxBatchSize = 500
+
+// Status describes the replication of a server
+type Status struct {
+	Role      string
+	PrimaryID string
+	// Sequence is the last mutation logged by a primary, or applied by a follower
+	Sequence uint64
+
+	// Primary is the address the follower replicates from
+	Primary         string
+	Connected       bool
+	PrimarySequence uint64
+	LagMutations    uint64
+	// Lag is the time since the last mutation applied by a follower was committed, while it is behind
+	Lag time.Duration
+
+	Followers []FollowerStatus
+}
+
+// FollowerStatus describes a follower connected to a primary
+type FollowerStatus struct {
+	Peer string
+	// Sequence is the last mutation sent to the follower
+	Sequence    uint64
+	ConnectedAt time.Time
+}
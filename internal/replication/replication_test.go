@@ -0,0 +1,193 @@
+package replication
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/denismitr/lemon-server/internal/database"
+	"github.com/denismitr/lemon-server/pkg/command"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+func newTestEngine(t *testing.T, dir string) *database.LemonEngine {
+	store := database.NewStore(dir, time.Minute)
+	t.Cleanup(func() {
+		_ = store.Close()
+	})
+
+	return database.NewEngine(store, nil, zap.NewNop().Sugar())
+}
+
+// startPrimary serves replication of a new engine on a localhost port
+func startPrimary(t *testing.T, logSize int) (*database.LemonEngine, *Primary, string) {
+	le := newTestEngine(t, t.TempDir())
+	p, err := NewPrimary(le, logSize, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	le.AddCommitHook(p.Capture)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := grpc.NewServer()
+	command.RegisterReplicationServer(srv, p)
+	go func() {
+		_ = srv.Serve(lis)
+	}()
+	t.Cleanup(srv.Stop)
+
+	return le, p, lis.Addr().String()
+}
+
+// startFollower replicates into an engine on dir until the test ends
+func startFollower(t *testing.T, dir, primary string) (*database.LemonEngine, *Follower) {
+	le := newTestEngine(t, dir)
+	f, err := NewFollower(le, primary, "", filepath.Join(dir, "replication.json"), 10*time.Millisecond, zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return le, f
+}
+
+func caughtUp(t *testing.T, p *Primary, fs ...*Follower) {
+	require.Eventually(t, func() bool {
+		for _, f := range fs {
+			s := f.Status()
+			if !s.Connected || s.PrimaryID != p.log.ID() || s.Sequence != p.log.Last() {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func Test_Replication(t *testing.T) {
+	ctx := context.Background()
+	primary, p, addr := startPrimary(t, 4)
+
+	_, err := primary.BatchUpsert(ctx, "users", database.BatchUpsert{
+		{Key: "u:1", Value: `{"name":"ann"}`, ContentType: "json", Tags: []database.Tag{{Name: "age", Value: 30}}},
+		{Key: "u:2", Value: "bob"},
+	})
+	require.NoError(t, err)
+
+	t.Run("followers get a snapshot and then live writes", func(t *testing.T) {
+		followerA, fa := startFollower(t, t.TempDir(), addr)
+		followerB, fb := startFollower(t, t.TempDir(), addr)
+		caughtUp(t, p, fa, fb)
+
+		_, err := primary.BatchUpsert(ctx, "users", database.BatchUpsert{{Key: "u:3", Value: 42}})
+		require.NoError(t, err)
+		_, err = primary.BatchDeleteByKey(ctx, "users", database.BatchDeleteByKey{"u:2"})
+		require.NoError(t, err)
+		caughtUp(t, p, fa, fb)
+
+		want, err := primary.MGet(ctx, "users", []string{"u:1", "u:2", "u:3"}, time.Time{})
+		require.NoError(t, err)
+		require.Len(t, want, 2)
+
+		for _, follower := range []*database.LemonEngine{followerA, followerB} {
+			got, err := follower.MGet(ctx, "users", []string{"u:1", "u:2", "u:3"}, time.Time{})
+			require.NoError(t, err)
+			require.Len(t, got, 2)
+
+			for key, d := range want {
+				assert.Equal(t, d.RawString(), got[key].RawString())
+				assert.Equal(t, d.ContentType(), got[key].ContentType())
+				assert.Equal(t, d.Tags(), got[key].Tags())
+				assert.Equal(t, d.Revision(), got[key].Revision())
+				assert.Equal(t, d.UpdatedAt().UnixMilli(), got[key].UpdatedAt().UnixMilli())
+			}
+		}
+
+		s := p.Status()
+		assert.Equal(t, RolePrimary, s.Role)
+		assert.Len(t, s.Followers, 2)
+		assert.Zero(t, fa.Status().LagMutations)
+	})
+
+	t.Run("followers too far behind catch up from a snapshot", func(t *testing.T) {
+		dir := t.TempDir()
+
+		// a follower that stopped before these writes, with a document deleted since
+		stale := newTestEngine(t, dir)
+		_, err := stale.BatchUpsert(ctx, "users", database.BatchUpsert{{Key: "u:9", Value: "gone"}})
+		require.NoError(t, err)
+
+		for i := 0; i < 10; i++ {
+			_, err := primary.BatchUpsert(ctx, "users", database.BatchUpsert{{Key: "u:1", Value: i}})
+			require.NoError(t, err)
+		}
+
+		f, err := NewFollower(stale, addr, "", filepath.Join(dir, "replication.json"), 10*time.Millisecond, zap.NewNop().Sugar())
+		require.NoError(t, err)
+		// the log holds 4 mutations only
+		require.NoError(t, f.save(followerState{PrimaryID: p.log.ID(), Sequence: 1}))
+
+		runCtx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			f.Run(runCtx)
+		}()
+		defer func() {
+			cancel()
+			<-done
+		}()
+		caughtUp(t, p, f)
+
+		docs, err := stale.MGet(ctx, "users", []string{"u:1", "u:9"}, time.Time{})
+		require.NoError(t, err)
+		require.Contains(t, docs, "u:1")
+		assert.NotContains(t, docs, "u:9")
+		assert.Equal(t, "9", docs["u:1"].RawString())
+	})
+}
+
+func Test_ReplicationSharding(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("sharded databases cannot be replicated", func(t *testing.T) {
+		le := newTestEngine(t, t.TempDir())
+		_, err := le.BatchUpsert(ctx, "users", database.BatchUpsert{{Key: "u:1", Value: "ann"}})
+		require.NoError(t, err)
+		require.NoError(t, le.Reshard(ctx, "users", 2))
+		require.Eventually(t, func() bool {
+			d, err := le.Describe(ctx, "users")
+			return err == nil && d.Shards == 2 && d.ReshardingFrom == 0
+		}, 5*time.Second, 10*time.Millisecond)
+
+		_, err = NewPrimary(le, 4, zap.NewNop().Sugar())
+		assert.ErrorIs(t, err, database.ErrShardingDisabled)
+
+		_, err = NewFollower(le, "127.0.0.1:1", "", filepath.Join(t.TempDir(), "replication.json"), time.Second, zap.NewNop().Sugar())
+		assert.ErrorIs(t, err, database.ErrShardingDisabled)
+	})
+
+	t.Run("replicating databases cannot be sharded", func(t *testing.T) {
+		primary, p, addr := startPrimary(t, 4)
+		follower, f := startFollower(t, t.TempDir(), addr)
+
+		_, err := primary.BatchUpsert(ctx, "users", database.BatchUpsert{{Key: "u:1", Value: "ann"}})
+		require.NoError(t, err)
+		caughtUp(t, p, f)
+
+		assert.ErrorIs(t, primary.Reshard(ctx, "users", 2), database.ErrShardingDisabled)
+		assert.ErrorIs(t, follower.Reshard(ctx, "users", 2), database.ErrShardingDisabled)
+	})
+}
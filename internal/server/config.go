@@ -5,11 +5,16 @@ import (
 	"github.com/ardanlabs/conf/v2/yaml"
 	"github.com/joho/godotenv"
 	"github.com/pkg/errors"
+	"go.uber.org/zap/zapcore"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
 )
 
 var ErrHelpRequested = errors.New("help requested")
+var ErrInvalidConfig = errors.New("invalid config")
 
 type Environment string
 
@@ -34,8 +39,21 @@ func CreateEnvironment(env string) (Environment, error) {
 
 type Config struct {
 	conf.Version
-	Environment Environment `conf:"-" yaml:"-"`
-	Grpc        GrpcConfig  `yaml:"grpc"`
+	Environment Environment       `conf:"-" yaml:"-"`
+	Grpc        GrpcConfig        `yaml:"grpc"`
+	Log         LogConfig         `yaml:"log"`
+	Auth        AuthConfig        `yaml:"auth"`
+	Store       StoreConfig       `yaml:"store"`
+	Limits      LimitsConfig      `yaml:"limits"`
+	Pages       PagesConfig       `yaml:"pages"`
+	Audit       AuditConfig       `yaml:"audit"`
+	Keys        KeysConfig        `yaml:"keys"`
+	Encryption  EncryptionConfig  `yaml:"encryption"`
+	Replication ReplicationConfig `yaml:"replication"`
+	Cluster     ClusterConfig     `yaml:"cluster"`
+	PubSub      PubSubConfig      `yaml:"pubsub"`
+
+	origins Origins
 }
 
 type GrpcConfig struct {
@@ -45,13 +63,317 @@ type GrpcConfig struct {
 	Version    string `conf:"default:1,env:GRPC_VERSION" yaml:"version"`
 }
 
-// todo: add validation for GrpcConfig
+type LogConfig struct {
+	// Level defaults to debug in dev and test environments and to info in prod
+	Level string `conf:"env:LOG_LEVEL" yaml:"level"`
+}
 
+type AuthConfig struct {
+	// Tokens are principal:token pairs (separated by ; in env and flags),
+	// authentication is disabled when empty
+	Tokens []string `conf:"env:AUTH_TOKENS,mask" yaml:"tokens"`
+	// Admins are the principals allowed to add and remove cluster nodes
+	// when authentication is enabled, nobody is when empty
+	Admins []string `conf:"env:AUTH_ADMINS" yaml:"admins"`
+}
+
+type StoreConfig struct {
+	// Dir holds the database files together with their settings
+	Dir string `conf:"default:data,env:STORE_DIR" yaml:"dir"`
+	// IdleTimeout is the time after which an unused database gets closed
+	IdleTimeout time.Duration `conf:"default:10m,env:STORE_IDLE_TIMEOUT" yaml:"idle_timeout"`
+	// JanitorInterval is the time between runs of background jobs such as purging trash
+	JanitorInterval time.Duration `conf:"default:1m,env:STORE_JANITOR_INTERVAL" yaml:"janitor_interval"`
+	// TombstoneRetention is the time the revisions of deleted documents are kept for, so that
+	// documents created again under their key continue from them, zero keeps them forever
+	TombstoneRetention time.Duration `conf:"default:720h,env:STORE_TOMBSTONE_RETENTION" yaml:"tombstone_retention"`
+}
+
+type KeysConfig struct {
+	// MaxLength is the length of keys in bytes at most
+	MaxLength int `conf:"default:255,env:KEYS_MAX_LENGTH" yaml:"max_length"`
+	// AllowedChars is a regex character class e.g. a-zA-Z0-9:_- any printable character is allowed when empty
+	AllowedChars string `conf:"env:KEYS_ALLOWED_CHARS" yaml:"allowed_chars"`
+	// UpsertDuplicates is either reject or last-wins
+	UpsertDuplicates string `conf:"default:reject,env:KEYS_UPSERT_DUPLICATES" yaml:"upsert_duplicates"`
+}
+
+type EncryptionConfig struct {
+	// Keyfile holds key-id:base64-key pairs, one per line, used to wrap the data keys
+	// of encrypted databases, databases cannot be encrypted when empty
+	Keyfile string `conf:"env:ENCRYPTION_KEYFILE" yaml:"keyfile"`
+}
+
+// ReplicationConfig makes the server a primary streaming its writes to followers,
+// or a read-only follower of a primary, servers are standalone when Role is empty
+type ReplicationConfig struct {
+	// Role is either primary or follower
+	Role string `conf:"env:REPLICATION_ROLE" yaml:"role"`
+	// Primary is the host:port a follower replicates from
+	Primary string `conf:"env:REPLICATION_PRIMARY" yaml:"primary"`
+	// PrimaryToken authenticates a follower to its primary
+	PrimaryToken string `conf:"env:REPLICATION_PRIMARY_TOKEN,mask" yaml:"primary_token"`
+	// LogSize is the number of mutations a primary keeps for followers to catch up from,
+	// followers further behind get a snapshot
+	LogSize int `conf:"default:10000,env:REPLICATION_LOG_SIZE" yaml:"log_size"`
+	// RetryInterval is the time a follower waits before reconnecting to its primary
+	RetryInterval time.Duration `conf:"default:1s,env:REPLICATION_RETRY_INTERVAL" yaml:"retry_interval"`
+}
+
+// ClusterConfig makes the server a node of a raft cluster, writes are then logged by
+// a majority of nodes before they are applied, and forwarded to the leader by other nodes
+type ClusterConfig struct {
+	Enabled bool   `conf:"default:false,env:CLUSTER_ENABLED" yaml:"enabled"`
+	NodeID  string `conf:"env:CLUSTER_NODE_ID" yaml:"node_id"`
+	// RaftAddress is the host:port the raft transport listens on and other nodes connect to
+	RaftAddress string `conf:"default:127.0.0.1:3199,env:CLUSTER_RAFT_ADDRESS" yaml:"raft_address"`
+	// Address is the host:port other nodes forward writes to, it defaults to localhost and the grpc port
+	Address string `conf:"env:CLUSTER_ADDRESS" yaml:"address"`
+	// Dir holds the raft log and snapshots
+	Dir string `conf:"default:data/raft,env:CLUSTER_DIR" yaml:"dir"`
+	// Bootstrap starts a new cluster with this node as its only member, other nodes are added
+	// to it with the AddClusterNode admin rpc
+	Bootstrap bool `conf:"default:false,env:CLUSTER_BOOTSTRAP" yaml:"bootstrap"`
+	// ApplyTimeout is the time a write waits to be logged by a majority of nodes
+	ApplyTimeout time.Duration `conf:"default:10s,env:CLUSTER_APPLY_TIMEOUT" yaml:"apply_timeout"`
+}
+
+// PubSubConfig holds the settings of publish/subscribe channels, messages are delivered at most once
+// unless their channel is durable
+type PubSubConfig struct {
+	// BufferSize is the number of messages a subscription holds before further messages are dropped
+	BufferSize int `conf:"default:256,env:PUBSUB_BUFFER_SIZE" yaml:"buffer_size"`
+	// Durable are patterns e.g. orders.* of the channels whose messages are stored and can be replayed
+	Durable []string `conf:"env:PUBSUB_DURABLE" yaml:"durable"`
+	// Dir holds the messages of durable channels
+	Dir string `conf:"default:data/pubsub,env:PUBSUB_DIR" yaml:"dir"`
+	// MaxMessages is the number of messages kept per durable channel
+	MaxMessages int `conf:"default:10000,env:PUBSUB_MAX_MESSAGES" yaml:"max_messages"`
+}
+
+type AuditConfig struct {
+	Enabled bool   `conf:"default:true,env:AUDIT_ENABLED" yaml:"enabled"`
+	Dir     string `conf:"default:data/audit,env:AUDIT_DIR" yaml:"dir"`
+	// MaxSize is the size in bytes after which the audit file gets rotated
+	MaxSize int64 `conf:"default:10485760,env:AUDIT_MAX_SIZE" yaml:"max_size"`
+}
+
+// LimitsConfig holds admission control settings, rates are given per second
+// and a zero value disables the corresponding limit or quota. Streams are
+// admitted by the request opening them
+type LimitsConfig struct {
+	PrincipalRequests   float64 `conf:"env:LIMITS_PRINCIPAL_REQUESTS" yaml:"principal_requests"`
+	PrincipalStatements float64 `conf:"env:LIMITS_PRINCIPAL_STATEMENTS" yaml:"principal_statements"`
+	PeerRequests        float64 `conf:"env:LIMITS_PEER_REQUESTS" yaml:"peer_requests"`
+	PeerStatements      float64 `conf:"env:LIMITS_PEER_STATEMENTS" yaml:"peer_statements"`
+	DatabaseRequests    float64 `conf:"env:LIMITS_DATABASE_REQUESTS" yaml:"database_requests"`
+	DatabaseStatements  float64 `conf:"env:LIMITS_DATABASE_STATEMENTS" yaml:"database_statements"`
+	// Burst is how many seconds worth of tokens a bucket can accumulate
+	Burst float64 `conf:"default:1,env:LIMITS_BURST" yaml:"burst"`
+
+	MaxBatchSize            int `conf:"env:LIMITS_MAX_BATCH_SIZE" yaml:"max_batch_size"`
+	MaxValueSize            int `conf:"env:LIMITS_MAX_VALUE_SIZE" yaml:"max_value_size"`
+	MaxDocumentsPerDatabase int `conf:"env:LIMITS_MAX_DOCUMENTS_PER_DATABASE" yaml:"max_documents_per_database"`
+}
+
+// PagesConfig holds the settings of paginated reads
+type PagesConfig struct {
+	// MaxSize caps the number of documents of a page, larger and unset page sizes are reduced to it
+	MaxSize int `conf:"default:1000,env:PAGES_MAX_SIZE" yaml:"max_size"`
+	// TokenSecret signs page tokens, a random secret is generated at startup when empty,
+	// so that tokens of previous runs are stale
+	TokenSecret string `conf:"env:PAGES_TOKEN_SECRET,mask" yaml:"token_secret"`
+	// TokenTTL is the time after which page tokens are stale
+	TokenTTL time.Duration `conf:"default:1h,env:PAGES_TOKEN_TTL" yaml:"token_ttl"`
+}
+
+// Validate checks the config values that conf cannot check by itself
+func (cfg *Config) Validate() error {
+	if cfg.Grpc.Port <= 0 || cfg.Grpc.Port > 65535 {
+		return errors.Wrapf(ErrInvalidConfig, "grpc port %d is out of range", cfg.Grpc.Port)
+	}
+
+	if cfg.Log.Level != "" {
+		var lvl zapcore.Level
+		if err := lvl.UnmarshalText([]byte(cfg.Log.Level)); err != nil {
+			return errors.Wrapf(ErrInvalidConfig, "log level %s is unknown", cfg.Log.Level)
+		}
+	}
+
+	principals, err := cfg.Auth.Principals()
+	if err != nil {
+		return err
+	}
+
+	for _, admin := range cfg.Auth.Admins {
+		if !hasPrincipal(principals, admin) {
+			return errors.Wrapf(ErrInvalidConfig, "auth admin %s has no token", admin)
+		}
+	}
+
+	if cfg.Store.Dir == "" {
+		return errors.Wrap(ErrInvalidConfig, "store dir may not be empty")
+	}
+
+	if cfg.Store.IdleTimeout <= 0 {
+		return errors.Wrap(ErrInvalidConfig, "store idle timeout must be positive")
+	}
+
+	if cfg.Store.JanitorInterval <= 0 {
+		return errors.Wrap(ErrInvalidConfig, "store janitor interval must be positive")
+	}
+
+	if cfg.Store.TombstoneRetention < 0 {
+		return errors.Wrap(ErrInvalidConfig, "store tombstone retention may not be negative")
+	}
+
+	if cfg.Keys.MaxLength <= 0 {
+		return errors.Wrap(ErrInvalidConfig, "max key length must be positive")
+	}
+
+	if cfg.Keys.UpsertDuplicates != "reject" && cfg.Keys.UpsertDuplicates != "last-wins" {
+		return errors.Wrapf(ErrInvalidConfig, "unknown upsert duplicates policy %s", cfg.Keys.UpsertDuplicates)
+	}
+
+	if cfg.Keys.AllowedChars != "" {
+		if _, err := regexp.Compile("^[" + cfg.Keys.AllowedChars + "]+$"); err != nil {
+			return errors.Wrapf(ErrInvalidConfig, "allowed key characters %s are not a valid character class", cfg.Keys.AllowedChars)
+		}
+	}
+
+	l := cfg.Limits
+	for _, rate := range []float64{
+		l.PrincipalRequests, l.PrincipalStatements,
+		l.PeerRequests, l.PeerStatements,
+		l.DatabaseRequests, l.DatabaseStatements,
+	} {
+		if rate < 0 {
+			return errors.Wrap(ErrInvalidConfig, "rate limits may not be negative")
+		}
+	}
+
+	if l.Burst <= 0 {
+		return errors.Wrap(ErrInvalidConfig, "rate limit burst must be positive")
+	}
+
+	if l.MaxBatchSize < 0 || l.MaxValueSize < 0 || l.MaxDocumentsPerDatabase < 0 {
+		return errors.Wrap(ErrInvalidConfig, "quotas may not be negative")
+	}
+
+	if cfg.Pages.MaxSize <= 0 {
+		return errors.Wrap(ErrInvalidConfig, "max page size must be positive")
+	}
+
+	if cfg.Pages.TokenTTL <= 0 {
+		return errors.Wrap(ErrInvalidConfig, "page token ttl must be positive")
+	}
+
+	r := cfg.Replication
+	switch r.Role {
+	case "", "primary":
+	case "follower":
+		if r.Primary == "" {
+			return errors.Wrap(ErrInvalidConfig, "replication primary may not be empty on followers")
+		}
+	default:
+		return errors.Wrapf(ErrInvalidConfig, "unknown replication role %s", r.Role)
+	}
+
+	if r.LogSize <= 0 {
+		return errors.Wrap(ErrInvalidConfig, "replication log size must be positive")
+	}
+
+	if r.RetryInterval <= 0 {
+		return errors.Wrap(ErrInvalidConfig, "replication retry interval must be positive")
+	}
+
+	if c := cfg.Cluster; c.Enabled {
+		if c.NodeID == "" {
+			return errors.Wrap(ErrInvalidConfig, "cluster node id may not be empty")
+		}
+
+		if c.RaftAddress == "" {
+			return errors.Wrap(ErrInvalidConfig, "cluster raft address may not be empty")
+		}
+
+		if c.Dir == "" || filepath.Clean(c.Dir) == filepath.Clean(cfg.Store.Dir) {
+			return errors.Wrap(ErrInvalidConfig, "cluster dir must be a directory other than the store dir")
+		}
+
+		if c.ApplyTimeout <= 0 {
+			return errors.Wrap(ErrInvalidConfig, "cluster apply timeout must be positive")
+		}
+
+		if r.Role != "" {
+			return errors.Wrap(ErrInvalidConfig, "cluster nodes cannot have a replication role")
+		}
+	}
+
+	p := cfg.PubSub
+	if p.BufferSize <= 0 {
+		return errors.Wrap(ErrInvalidConfig, "pubsub buffer size must be positive")
+	}
+
+	if len(p.Durable) > 0 {
+		if p.MaxMessages <= 0 {
+			return errors.Wrap(ErrInvalidConfig, "pubsub max messages must be positive")
+		}
+
+		if p.Dir == "" || filepath.Clean(p.Dir) == filepath.Clean(cfg.Store.Dir) {
+			return errors.Wrap(ErrInvalidConfig, "pubsub dir must be a directory other than the store dir")
+		}
+	}
+
+	return nil
+}
+
+// Principals maps auth tokens to the principals they belong to
+func (ac AuthConfig) Principals() (map[string]string, error) {
+	principals := make(map[string]string, len(ac.Tokens))
+	for i, pair := range ac.Tokens {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.Wrapf(ErrInvalidConfig, "auth token #%d must be in principal:token format", i)
+		}
+
+		principals[parts[1]] = parts[0]
+	}
+
+	return principals, nil
+}
+
+func hasPrincipal(principals map[string]string, name string) bool {
+	for _, p := range principals {
+		if p == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NewConfig builds the configuration from layered sources, each one overriding
+// the previous: defaults, yaml file, dotenv file, environment variables and
+// finally command line flags
 func NewConfig(env Environment, buildVersion string, yamlPath, dotenvPath string) (*Config, error) {
+	var yamlData []byte
+	if yamlPath != "" {
+		data, err := readYamlFile(yamlPath)
+		if err != nil {
+			return nil, err
+		}
+
+		yamlData = data
+	}
+
+	var dotenv map[string]string
 	if dotenvPath != "" {
-		if err := godotenv.Load(); err != nil {
+		m, err := godotenv.Read(dotenvPath)
+		if err != nil {
 			return nil, errors.Wrapf(err, "could not load .env file %s", dotenvPath)
 		}
+
+		dotenv = m
 	}
 
 	cfg := Config{
@@ -62,23 +384,42 @@ func NewConfig(env Environment, buildVersion string, yamlPath, dotenvPath string
 	}
 
 	var parsers []conf.Parsers
-	if yamlPath != "" {
-		yamlData, err := readYamlFile(yamlPath)
-		if err != nil {
-			return nil, err
-		}
-
+	if yamlData != nil {
 		parsers = append(parsers, yaml.WithData(yamlData))
 	}
 
+	if dotenv != nil {
+		parsers = append(parsers, dotenvParser(dotenv))
+	}
+
 	_, err := conf.Parse("", &cfg, parsers...)
 	if err != nil {
+		if errors.Is(err, conf.ErrHelpWanted) {
+			return nil, ErrHelpRequested
+		}
+
 		return nil, errors.Wrap(err, "could not process config")
 	}
 
+	origins, err := resolveOrigins(&cfg, yamlData, dotenv, commandLineArgs())
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.origins = origins
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
 	return &cfg, nil
 }
 
+// Origins returns the source each configuration value was taken from
+func (cfg *Config) Origins() Origins {
+	return cfg.origins
+}
+
 func readYamlFile(path string) ([]byte, error) {
 	absPath, err := filepath.Abs(path)
 	if err != nil {
@@ -92,3 +433,11 @@ func readYamlFile(path string) ([]byte, error) {
 
 	return data, nil
 }
+
+func commandLineArgs() []string {
+	if len(os.Args) > 1 {
+		return os.Args[1:]
+	}
+
+	return nil
+}
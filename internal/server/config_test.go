@@ -0,0 +1,67 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, name, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0600))
+	return path
+}
+
+func Test_NewConfig_Layers(t *testing.T) {
+	yamlPath := writeFile(t, "cfg.yaml", "grpc:\n  port: 4000\n  reflection_enabled: false\n  version: \"2\"\n")
+	dotenvPath := writeFile(t, ".env", "GRPC_VERSION=3\nGRPC_PORT=5000\nAUDIT_ENABLED=false\n")
+
+	t.Setenv("GRPC_PORT", "6000")
+
+	cfg, err := NewConfig(Test, "test-build", yamlPath, dotenvPath)
+	require.NoError(t, err)
+
+	assert.Equal(t, true, cfg.Grpc.Enabled)
+	assert.Equal(t, false, cfg.Grpc.Reflection, "explicit false in yaml must not be replaced by the default")
+	assert.Equal(t, "3", cfg.Grpc.Version)
+	assert.Equal(t, 6000, cfg.Grpc.Port)
+	assert.Equal(t, false, cfg.Audit.Enabled, "explicit false in dotenv must not be replaced by the default")
+
+	_, exported := os.LookupEnv("GRPC_VERSION")
+	assert.False(t, exported, "dotenv values must not leak into the process environment")
+
+	origins := cfg.Origins()
+	assert.Equal(t, SourceDefault, origins["grpc-enabled"])
+	assert.Equal(t, SourceYaml, origins["grpc-reflection"])
+	assert.Equal(t, SourceDotenv, origins["grpc-version"])
+	assert.Equal(t, SourceEnv, origins["grpc-port"])
+	assert.Equal(t, SourceDotenv, origins["audit-enabled"])
+}
+
+func Test_Config_Print(t *testing.T) {
+	cfg, err := NewConfig(Test, "test-build", "", "")
+	require.NoError(t, err)
+
+	out := cfg.Print()
+	assert.NotContains(t, out, "test-build")
+	assert.Contains(t, out, "--auth-tokens= (unset)\n")
+
+	cfg.Auth.Tokens = []string{"alice:hunter2"}
+	out = cfg.Print()
+	assert.NotContains(t, out, "hunter2")
+	assert.Contains(t, out, "--auth-tokens=xxxxxx (unset)\n")
+}
+
+func Test_resolveOrigins_Flags(t *testing.T) {
+	cfg := Config{}
+	cfg.Grpc.Port = 7000
+
+	origins, err := resolveOrigins(&cfg, []byte("grpc:\n  port: 4000\n"), nil, []string{"--yaml-config", "x.yaml", "--grpc-port=7000"})
+	require.NoError(t, err)
+	assert.Equal(t, SourceFlag, origins["grpc-port"])
+	assert.Equal(t, 7000, cfg.Grpc.Port)
+}
@@ -0,0 +1,172 @@
+package serverpb
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/denismitr/lemon-server/internal/audit"
+	"github.com/denismitr/lemon-server/pkg/command"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const maxLoggedKeys = 10
+
+// destructiveMethods are recorded in the audit log
+var destructiveMethods = map[string]bool{
+	"/command.Receiver/BatchDeleteByKey":         true,
+	"/command.Receiver/CrossDatabaseTransaction": true,
+	"/command.Receiver/Undelete":                 true,
+	"/command.Admin/SetDatabaseOptions":          true,
+	"/command.Admin/RotateDatabaseKey":           true,
+	"/command.Admin/ReshardDatabase":             true,
+}
+
+// purgeTrashMethod is recorded for the documents the janitor purges from the trash, there is no rpc for it
+const (
+	purgeTrashMethod    = "PurgeTrash"
+	purgeTrashPrincipal = "janitor"
+)
+
+func createAccessLogInterceptor(lg *zap.SugaredLogger) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (resp interface{}, err error) {
+		start := time.Now()
+		resp, err = handler(ctx, req)
+
+		database := requestDatabase(req)
+
+		lg.Infow("access",
+			"method", info.FullMethod,
+			"peer", peerAddress(ctx),
+			"principal", PrincipalFromContext(ctx),
+			"database", database,
+			"statements", statementCount(req),
+			"keys", truncateKeys(requestKeys(req), maxLoggedKeys),
+			"status", status.Code(err).String(),
+			"latency", time.Since(start),
+		)
+
+		return resp, err
+	}
+}
+
+func createAuditInterceptor(al *audit.Log, lg *zap.SugaredLogger) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (resp interface{}, err error) {
+		if !destructiveMethods[info.FullMethod] {
+			return handler(ctx, req)
+		}
+
+		resp, err = handler(ctx, req)
+
+		r := audit.Record{
+			Time:      time.Now().UTC(),
+			Principal: PrincipalFromContext(ctx),
+			Peer:      peerAddress(ctx),
+			Method:    info.FullMethod,
+			Keys:      requestKeys(req),
+			Status:    status.Code(err).String(),
+		}
+
+		r.Database = requestDatabase(req)
+
+		if err != nil {
+			r.Error = err.Error()
+		}
+
+		if auditErr := al.Append(r); auditErr != nil {
+			lg.Errorf("could not write audit record for %s: %s", info.FullMethod, auditErr)
+		}
+
+		return resp, err
+	}
+}
+
+// auditPurge records the documents purged from the trash of a database
+func auditPurge(al *audit.Log, lg *zap.SugaredLogger) func(dbName string, keys []string) {
+	return func(dbName string, keys []string) {
+		r := audit.Record{
+			Time:      time.Now().UTC(),
+			Principal: purgeTrashPrincipal,
+			Method:    purgeTrashMethod,
+			Database:  dbName,
+			Keys:      keys,
+			Status:    codes.OK.String(),
+		}
+
+		if err := al.Append(r); err != nil {
+			lg.Errorf("could not write audit record for %s: %s", purgeTrashMethod, err)
+		}
+	}
+}
+
+// requestKeys lists document keys a request touches
+func requestKeys(req interface{}) []string {
+	switch r := req.(type) {
+	case *command.BatchInsertRequest:
+		keys := make([]string, len(r.Stmt))
+		for i := range r.Stmt {
+			keys[i] = r.Stmt[i].Key
+		}
+		return keys
+	case *command.BatchUpsertRequest:
+		keys := make([]string, len(r.Stmt))
+		for i := range r.Stmt {
+			keys[i] = r.Stmt[i].Key
+		}
+		return keys
+	case *command.PatchRequest:
+		keys := make([]string, len(r.Stmt))
+		for i := range r.Stmt {
+			keys[i] = r.Stmt[i].Key
+		}
+		return keys
+	case *command.BatchDeleteByKeyRequest:
+		return r.Keys
+	case *command.UndeleteRequest:
+		return r.Keys
+	case *command.MultiGetQueryRequest:
+		return r.Keys
+	case *command.ExistsRequest:
+		return r.Keys
+	case *command.CrossDatabaseTransactionRequest:
+		var keys []string
+		for _, w := range r.Writes {
+			for _, stmt := range w.Inserts {
+				keys = append(keys, w.Database+"/"+stmt.Key)
+			}
+			for _, stmt := range w.Upserts {
+				keys = append(keys, w.Database+"/"+stmt.Key)
+			}
+			for _, k := range w.Deletes {
+				keys = append(keys, w.Database+"/"+k)
+			}
+		}
+		return keys
+	case *command.HistoryQuery:
+		return []string{r.Key}
+	default:
+		return nil
+	}
+}
+
+func truncateKeys(keys []string, max int) string {
+	if len(keys) <= max {
+		return strings.Join(keys, ",")
+	}
+
+	return fmt.Sprintf("%s,...(+%d)", strings.Join(keys[:max], ","), len(keys)-max)
+}
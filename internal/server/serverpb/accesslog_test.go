@@ -0,0 +1,113 @@
+package serverpb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/denismitr/lemon-server/internal/audit"
+	"github.com/denismitr/lemon-server/pkg/command"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+func Test_createAuditInterceptor(t *testing.T) {
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	}
+
+	tt := []struct {
+		method   string
+		req      interface{}
+		database string
+		keys     []string
+	}{
+		{
+			method:   "/command.Receiver/BatchDeleteByKey",
+			req:      &command.BatchDeleteByKeyRequest{Database: "users", Keys: []string{"u:1"}},
+			database: "users",
+			keys:     []string{"u:1"},
+		},
+		{
+			method: "/command.Receiver/CrossDatabaseTransaction",
+			req: &command.CrossDatabaseTransactionRequest{Writes: []*command.TransactionWrite{
+				{Database: "orders", Deletes: []string{"o:1"}},
+			}},
+			keys: []string{"orders/o:1"},
+		},
+		{
+			method:   "/command.Receiver/Undelete",
+			req:      &command.UndeleteRequest{Database: "users", Keys: []string{"u:2"}},
+			database: "users",
+			keys:     []string{"u:2"},
+		},
+		{
+			method:   "/command.Admin/SetDatabaseOptions",
+			req:      &command.DatabaseOptions{Database: "users"},
+			database: "users",
+		},
+		{
+			method:   "/command.Admin/RotateDatabaseKey",
+			req:      &command.RotateDatabaseKeyRequest{Database: "users", KeyId: "k2"},
+			database: "users",
+		},
+		{
+			method:   "/command.Admin/ReshardDatabase",
+			req:      &command.ReshardDatabaseRequest{Database: "users", Shards: 2},
+			database: "users",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.method, func(t *testing.T) {
+			al, err := audit.Open(t.TempDir(), 1<<20)
+			require.NoError(t, err)
+			defer al.Close()
+
+			interceptor := createAuditInterceptor(al, zap.NewNop().Sugar())
+			_, err = interceptor(context.Background(), tc.req, &grpc.UnaryServerInfo{FullMethod: tc.method}, handler)
+			require.NoError(t, err)
+
+			records, err := al.Query(time.Time{}, time.Now().Add(time.Minute), 10)
+			require.NoError(t, err)
+			require.Len(t, records, 1)
+			assert.Equal(t, tc.method, records[0].Method)
+			assert.Equal(t, tc.database, records[0].Database)
+			assert.Equal(t, tc.keys, records[0].Keys)
+			assert.Equal(t, "OK", records[0].Status)
+		})
+	}
+
+	t.Run("reads are not recorded", func(t *testing.T) {
+		al, err := audit.Open(t.TempDir(), 1<<20)
+		require.NoError(t, err)
+		defer al.Close()
+
+		interceptor := createAuditInterceptor(al, zap.NewNop().Sugar())
+		req := &command.MultiGetQueryRequest{Database: "users", Keys: []string{"u:1"}}
+		_, err = interceptor(context.Background(), req, &grpc.UnaryServerInfo{FullMethod: "/command.Receiver/MGet"}, handler)
+		require.NoError(t, err)
+
+		records, err := al.Query(time.Time{}, time.Now().Add(time.Minute), 10)
+		require.NoError(t, err)
+		assert.Empty(t, records)
+	})
+}
+
+func Test_auditPurge(t *testing.T) {
+	al, err := audit.Open(t.TempDir(), 1<<20)
+	require.NoError(t, err)
+	defer al.Close()
+
+	auditPurge(al, zap.NewNop().Sugar())("users", []string{"u:1", "u:2"})
+
+	records, err := al.Query(time.Time{}, time.Now().Add(time.Minute), 10)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, purgeTrashMethod, records[0].Method)
+	assert.Equal(t, purgeTrashPrincipal, records[0].Principal)
+	assert.Equal(t, "users", records[0].Database)
+	assert.Equal(t, []string{"u:1", "u:2"}, records[0].Keys)
+}
@@ -0,0 +1,382 @@
+package serverpb
+
+import (
+	"context"
+	"time"
+
+	"github.com/denismitr/lemon-server/internal/audit"
+	"github.com/denismitr/lemon-server/internal/cluster"
+	"github.com/denismitr/lemon-server/internal/database"
+	"github.com/denismitr/lemon-server/internal/replication"
+	"github.com/denismitr/lemon-server/pkg/command"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// ReplicationStatusProvider is the primary or follower a server replicates with
+type ReplicationStatusProvider interface {
+	Status() replication.Status
+}
+
+// ClusterMembership is the raft node of a server in cluster mode
+type ClusterMembership interface {
+	AddNode(ctx context.Context, id, raftAddress, address string) error
+	RemoveNode(ctx context.Context, id string) error
+	Status() (cluster.Status, error)
+}
+
+type AdminHandlers struct {
+	lg          *zap.SugaredLogger
+	db          database.Engine
+	audit       *audit.Log
+	replication ReplicationStatusProvider
+	cluster     ClusterMembership
+}
+
+// NewAdminHandlers creates the admin handlers, rs is nil on standalone servers
+// and cm is nil unless the server is a cluster node
+func NewAdminHandlers(
+	lg *zap.SugaredLogger,
+	db database.Engine,
+	al *audit.Log,
+	rs ReplicationStatusProvider,
+	cm ClusterMembership,
+) *AdminHandlers {
+	return &AdminHandlers{
+		lg:          lg,
+		db:          db,
+		audit:       al,
+		replication: rs,
+		cluster:     cm,
+	}
+}
+
+// SetDatabaseSchema - attaches a json schema and required tag rules to a database
+func (a *AdminHandlers) SetDatabaseSchema(
+	ctx context.Context,
+	request *command.DatabaseSchema,
+) (*command.DatabaseSchema, error) {
+	schema, err := database.ConvertGrpcToSchema(request)
+	if err != nil {
+		a.lg.Error(err)
+		var fieldErr *database.FieldError
+		if errors.As(err, &fieldErr) {
+			return nil, createFieldGrpcError(codes.InvalidArgument, fieldErr)
+		}
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if err := a.db.SetSchema(ctx, request.Database, schema); err != nil {
+		a.lg.Error(err)
+		return nil, createAdminGrpcError(err)
+	}
+
+	return database.ConvertSchemaToGrpc(request.Database, schema), nil
+}
+
+// GetDatabaseSchema - returns the schema of a database, which is empty when none is attached
+func (a *AdminHandlers) GetDatabaseSchema(
+	ctx context.Context,
+	request *command.DatabaseSchemaQuery,
+) (*command.DatabaseSchema, error) {
+	schema, err := a.db.Schema(ctx, request.Database)
+	if err != nil {
+		a.lg.Error(err)
+		return nil, createAdminGrpcError(err)
+	}
+
+	return database.ConvertSchemaToGrpc(request.Database, schema), nil
+}
+
+// QueryAuditLog - returns audit records of destructive operations within a time range
+func (a *AdminHandlers) QueryAuditLog(
+	ctx context.Context,
+	request *command.AuditLogQuery,
+) (*command.AuditLogResult, error) {
+	start := time.Now()
+
+	if a.audit == nil {
+		return nil, status.Error(codes.FailedPrecondition, "audit log is disabled")
+	}
+
+	var from, to time.Time
+	if request.From != nil {
+		from = request.From.AsTime()
+	}
+
+	if request.To != nil {
+		to = request.To.AsTime()
+	}
+
+	records, err := a.audit.Query(from, to, int(request.Limit))
+	if err != nil {
+		a.lg.Error(err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	result := command.AuditLogResult{
+		Records: make([]*command.AuditRecord, len(records)),
+	}
+
+	for i, r := range records {
+		result.Records[i] = &command.AuditRecord{
+			Time:      timestamppb.New(r.Time),
+			Principal: r.Principal,
+			Peer:      r.Peer,
+			Method:    r.Method,
+			Database:  r.Database,
+			Keys:      r.Keys,
+			Status:    r.Status,
+			Error:     r.Error,
+		}
+	}
+
+	result.Elapsed = time.Since(start).Milliseconds()
+
+	return &result, nil
+}
+
+// SetDatabaseOptions - changes storage options like compression of a database
+func (a *AdminHandlers) SetDatabaseOptions(
+	ctx context.Context,
+	request *command.DatabaseOptions,
+) (*command.DatabaseOptions, error) {
+	opts, err := database.ConvertGrpcToOptions(request)
+	if err != nil {
+		a.lg.Error(err)
+		var fieldErr *database.FieldError
+		if errors.As(err, &fieldErr) {
+			return nil, createFieldGrpcError(codes.InvalidArgument, fieldErr)
+		}
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if err := a.db.SetOptions(ctx, request.Database, opts); err != nil {
+		a.lg.Error(err)
+		return nil, createAdminGrpcError(err)
+	}
+
+	return database.ConvertOptionsToGrpc(request.Database, opts), nil
+}
+
+// GetDatabaseOptions - returns storage options of a database
+func (a *AdminHandlers) GetDatabaseOptions(
+	ctx context.Context,
+	request *command.DatabaseOptionsQuery,
+) (*command.DatabaseOptions, error) {
+	opts, err := a.db.Options(ctx, request.Database)
+	if err != nil {
+		a.lg.Error(err)
+		return nil, createAdminGrpcError(err)
+	}
+
+	return database.ConvertOptionsToGrpc(request.Database, opts), nil
+}
+
+// DescribeDatabase - returns options and document stats of a database
+func (a *AdminHandlers) DescribeDatabase(
+	ctx context.Context,
+	request *command.DescribeDatabaseRequest,
+) (*command.DatabaseDescription, error) {
+	start := time.Now()
+
+	d, err := a.db.Describe(ctx, request.Database)
+	if err != nil {
+		a.lg.Error(err)
+		return nil, createAdminGrpcError(err)
+	}
+
+	result := database.ConvertDescriptionToGrpc(request.Database, d)
+	result.Elapsed = time.Since(start).Milliseconds()
+
+	return result, nil
+}
+
+// SetDatabaseIndexes - declares the tags a database is indexed on, new indexes are built in the background
+func (a *AdminHandlers) SetDatabaseIndexes(
+	ctx context.Context,
+	request *command.DatabaseIndexes,
+) (*command.DatabaseIndexes, error) {
+	indexes, err := a.db.SetIndexes(ctx, request.Database, database.ConvertGrpcToIndexTags(request))
+	if err != nil {
+		a.lg.Error(err)
+		return nil, createAdminGrpcError(err)
+	}
+
+	return database.ConvertIndexesToGrpc(request.Database, indexes), nil
+}
+
+// GetDatabaseIndexes - returns the indexes of a database and whether they are ready
+func (a *AdminHandlers) GetDatabaseIndexes(
+	ctx context.Context,
+	request *command.DatabaseIndexesQuery,
+) (*command.DatabaseIndexes, error) {
+	indexes, err := a.db.Indexes(ctx, request.Database)
+	if err != nil {
+		a.lg.Error(err)
+		return nil, createAdminGrpcError(err)
+	}
+
+	return database.ConvertIndexesToGrpc(request.Database, indexes), nil
+}
+
+// RotateDatabaseKey - creates a new data key for an encrypted database, documents get re-encrypted in the background
+func (a *AdminHandlers) RotateDatabaseKey(
+	ctx context.Context,
+	request *command.RotateDatabaseKeyRequest,
+) (*command.DatabaseDescription, error) {
+	start := time.Now()
+
+	if err := a.db.RotateKey(ctx, request.Database, request.KeyId); err != nil {
+		a.lg.Error(err)
+		return nil, createAdminGrpcError(err)
+	}
+
+	d, err := a.db.Describe(ctx, request.Database)
+	if err != nil {
+		a.lg.Error(err)
+		return nil, createAdminGrpcError(err)
+	}
+
+	result := database.ConvertDescriptionToGrpc(request.Database, d)
+	result.Elapsed = time.Since(start).Milliseconds()
+
+	return result, nil
+}
+
+// ReshardDatabase - changes the number of shards of a database, documents get moved to their new shards in the background
+func (a *AdminHandlers) ReshardDatabase(
+	ctx context.Context,
+	request *command.ReshardDatabaseRequest,
+) (*command.DatabaseDescription, error) {
+	start := time.Now()
+
+	if err := a.db.Reshard(ctx, request.Database, int(request.Shards)); err != nil {
+		a.lg.Error(err)
+		return nil, createAdminGrpcError(err)
+	}
+
+	d, err := a.db.Describe(ctx, request.Database)
+	if err != nil {
+		a.lg.Error(err)
+		return nil, createAdminGrpcError(err)
+	}
+
+	result := database.ConvertDescriptionToGrpc(request.Database, d)
+	result.Elapsed = time.Since(start).Milliseconds()
+
+	return result, nil
+}
+
+// GetReplicationStatus - returns the role of the server, its followers or its lag behind the primary
+func (a *AdminHandlers) GetReplicationStatus(
+	ctx context.Context,
+	request *command.ReplicationStatusQuery,
+) (*command.ReplicationStatus, error) {
+	if a.replication == nil {
+		return &command.ReplicationStatus{Role: replication.RoleStandalone}, nil
+	}
+
+	s := a.replication.Status()
+	result := command.ReplicationStatus{
+		Role:            s.Role,
+		PrimaryId:       s.PrimaryID,
+		Sequence:        s.Sequence,
+		Primary:         s.Primary,
+		Connected:       s.Connected,
+		PrimarySequence: s.PrimarySequence,
+		LagMutations:    s.LagMutations,
+		Lag:             durationpb.New(s.Lag),
+		Followers:       make([]*command.FollowerStatus, len(s.Followers)),
+	}
+
+	for i, f := range s.Followers {
+		result.Followers[i] = &command.FollowerStatus{
+			Peer:        f.Peer,
+			Sequence:    f.Sequence,
+			ConnectedAt: timestamppb.New(f.ConnectedAt),
+		}
+	}
+
+	return &result, nil
+}
+
+// AddClusterNode - makes a node started without bootstrapping a voting member of the cluster
+func (a *AdminHandlers) AddClusterNode(
+	ctx context.Context,
+	request *command.AddClusterNodeRequest,
+) (*command.ClusterStatus, error) {
+	if a.cluster == nil {
+		return nil, status.Error(codes.FailedPrecondition, "cluster mode is disabled")
+	}
+
+	if err := a.cluster.AddNode(ctx, request.Id, request.RaftAddress, request.Address); err != nil {
+		a.lg.Error(err)
+		return nil, createClusterGrpcError(err)
+	}
+
+	return a.clusterStatus()
+}
+
+// RemoveClusterNode - removes a member from the cluster, removing the leader triggers an election
+func (a *AdminHandlers) RemoveClusterNode(
+	ctx context.Context,
+	request *command.RemoveClusterNodeRequest,
+) (*command.ClusterStatus, error) {
+	if a.cluster == nil {
+		return nil, status.Error(codes.FailedPrecondition, "cluster mode is disabled")
+	}
+
+	if err := a.cluster.RemoveNode(ctx, request.Id); err != nil {
+		a.lg.Error(err)
+		return nil, createClusterGrpcError(err)
+	}
+
+	return a.clusterStatus()
+}
+
+// GetClusterStatus - returns the raft state of the server and the members of its cluster
+func (a *AdminHandlers) GetClusterStatus(
+	ctx context.Context,
+	request *command.ClusterStatusQuery,
+) (*command.ClusterStatus, error) {
+	if a.cluster == nil {
+		return nil, status.Error(codes.FailedPrecondition, "cluster mode is disabled")
+	}
+
+	return a.clusterStatus()
+}
+
+func (a *AdminHandlers) clusterStatus() (*command.ClusterStatus, error) {
+	s, err := a.cluster.Status()
+	if err != nil {
+		a.lg.Error(err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	result := command.ClusterStatus{
+		NodeId:       s.NodeID,
+		State:        s.State,
+		LeaderId:     s.LeaderID,
+		Term:         s.Term,
+		LastIndex:    s.LastIndex,
+		AppliedIndex: s.AppliedIndex,
+		Nodes:        make([]*command.ClusterNode, len(s.Nodes)),
+	}
+
+	for i, n := range s.Nodes {
+		result.Nodes[i] = &command.ClusterNode{
+			Id:          n.ID,
+			RaftAddress: n.RaftAddress,
+			Address:     n.Address,
+			Voter:       n.Voter,
+			Leader:      n.Leader,
+		}
+	}
+
+	return &result, nil
+}
@@ -0,0 +1,136 @@
+package serverpb
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const anonymous = "anonymous"
+
+type principalCtxKey struct{}
+
+// PrincipalFromContext returns the authenticated principal of the request
+func PrincipalFromContext(ctx context.Context) string {
+	if p, ok := ctx.Value(principalCtxKey{}).(string); ok {
+		return p
+	}
+
+	return anonymous
+}
+
+// adminMethods may only be called by admin principals when authentication is enabled
+var adminMethods = map[string]bool{
+	"/command.Admin/AddClusterNode":    true,
+	"/command.Admin/RemoveClusterNode": true,
+}
+
+// authenticator resolves bearer tokens to principals, tokens can be swapped at runtime
+type authenticator struct {
+	mu         sync.RWMutex
+	principals map[string]string
+	admins     map[string]bool
+}
+
+func newAuthenticator(principals map[string]string, admins []string) *authenticator {
+	a := &authenticator{}
+	a.set(principals, admins)
+	return a
+}
+
+func (a *authenticator) set(principals map[string]string, admins []string) {
+	set := make(map[string]bool, len(admins))
+	for _, admin := range admins {
+		set[admin] = true
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.principals = principals
+	a.admins = set
+}
+
+func (a *authenticator) authenticate(ctx context.Context) (context.Context, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if len(a.principals) == 0 {
+		return context.WithValue(ctx, principalCtxKey{}, anonymous), nil
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		token := strings.TrimSpace(strings.TrimPrefix(v, "Bearer "))
+		if p, ok := a.principals[token]; ok {
+			return context.WithValue(ctx, principalCtxKey{}, p), nil
+		}
+	}
+
+	return nil, status.Error(codes.Unauthenticated, "missing or invalid bearer token")
+}
+
+// authorize checks that the authenticated principal of ctx may call the method
+func (a *authenticator) authorize(ctx context.Context, method string) error {
+	if !adminMethods[method] {
+		return nil
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if len(a.principals) == 0 || a.admins[PrincipalFromContext(ctx)] {
+		return nil
+	}
+
+	return status.Errorf(codes.PermissionDenied, "%s may only be called by admins", method)
+}
+
+func createAuthInterceptor(a *authenticator) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (resp interface{}, err error) {
+		ctx, err = a.authenticate(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := a.authorize(ctx, info.FullMethod); err != nil {
+			return nil, err
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+func createAuthStreamInterceptor(a *authenticator) grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		ss grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		ctx, err := a.authenticate(ss.Context())
+		if err != nil {
+			return err
+		}
+
+		return handler(srv, &authenticatedStream{ServerStream: ss, ctx: ctx})
+	}
+}
@@ -0,0 +1,144 @@
+package serverpb
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/denismitr/lemon-server/internal/cluster"
+	"github.com/denismitr/lemon-server/pkg/command"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// forwardedHeader marks requests forwarded by a cluster node, the leader serves them
+// itself instead of forwarding them again when it lost its leadership meanwhile
+const forwardedHeader = "x-lemon-forwarded"
+
+// leaderReplies maps the methods only the leader of a cluster may serve to their replies
+var leaderReplies = map[string]func() interface{}{
+	"/command.Receiver/BatchUpsert":              func() interface{} { return new(command.ExecuteResult) },
+	"/command.Receiver/BatchInsert":              func() interface{} { return new(command.ExecuteResult) },
+	"/command.Receiver/BatchDeleteByKey":         func() interface{} { return new(command.ExecuteResult) },
+	"/command.Receiver/Patch":                    func() interface{} { return new(command.ExecuteResult) },
+	"/command.Receiver/Undelete":                 func() interface{} { return new(command.ExecuteResult) },
+	"/command.Receiver/CrossDatabaseTransaction": func() interface{} { return new(command.CrossDatabaseTransactionResult) },
+	"/command.Admin/SetDatabaseSchema":           func() interface{} { return new(command.DatabaseSchema) },
+	"/command.Admin/SetDatabaseOptions":          func() interface{} { return new(command.DatabaseOptions) },
+	"/command.Admin/SetDatabaseIndexes":          func() interface{} { return new(command.DatabaseIndexes) },
+	"/command.Admin/RotateDatabaseKey":           func() interface{} { return new(command.DatabaseDescription) },
+	"/command.Admin/ReshardDatabase":             func() interface{} { return new(command.DatabaseDescription) },
+	"/command.Admin/AddClusterNode":              func() interface{} { return new(command.ClusterStatus) },
+	"/command.Admin/RemoveClusterNode":           func() interface{} { return new(command.ClusterStatus) },
+}
+
+// forwarder sends writes received by followers to the leader, over a connection per leader
+type forwarder struct {
+	node  *cluster.Node
+	lg    *zap.SugaredLogger
+	mu    sync.Mutex
+	conns map[string]*grpc.ClientConn
+}
+
+func newForwarder(node *cluster.Node, lg *zap.SugaredLogger) *forwarder {
+	return &forwarder{
+		node:  node,
+		lg:    lg,
+		conns: make(map[string]*grpc.ClientConn),
+	}
+}
+
+func (f *forwarder) conn(address string) (*grpc.ClientConn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if conn, ok := f.conns[address]; ok {
+		return conn, nil
+	}
+
+	conn, err := grpc.Dial(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not connect to cluster leader at %s", address)
+	}
+
+	f.conns[address] = conn
+
+	return conn, nil
+}
+
+// forward invokes a method on the leader with the metadata of the request, so that
+// the leader authenticates the client itself
+func (f *forwarder) forward(ctx context.Context, method string, req interface{}) (interface{}, error) {
+	id, address := f.node.Leader()
+	if id == "" || address == "" {
+		return nil, status.Error(codes.Unavailable, "cluster has no leader, retry later")
+	}
+
+	conn, err := f.conn(address)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+
+	md := metadata.MD{}
+	if in, ok := metadata.FromIncomingContext(ctx); ok {
+		for k, v := range in {
+			// pseudo headers belong to the incoming connection
+			if !strings.HasPrefix(k, ":") {
+				md[k] = v
+			}
+		}
+	}
+	md.Set(forwardedHeader, f.node.ID())
+
+	reply := leaderReplies[method]()
+	if err := conn.Invoke(metadata.NewOutgoingContext(ctx, md), method, req, reply); err != nil {
+		f.lg.Debugf("forwarding %s to cluster leader %s at %s failed: %v", method, id, address, err)
+		return nil, err
+	}
+
+	return reply, nil
+}
+
+func (f *forwarder) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for address, conn := range f.conns {
+		if err := conn.Close(); err != nil {
+			f.lg.Error(err)
+		}
+		delete(f.conns, address)
+	}
+}
+
+// createForwardInterceptor makes followers forward writes to the leader of the cluster
+func createForwardInterceptor(f *forwarder) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		if _, ok := leaderReplies[info.FullMethod]; !ok {
+			return handler(ctx, req)
+		}
+
+		md, _ := metadata.FromIncomingContext(ctx)
+		if !f.node.IsLeader() && len(md.Get(forwardedHeader)) == 0 {
+			return f.forward(ctx, info.FullMethod, req)
+		}
+
+		resp, err := handler(ctx, req)
+		if errors.Is(err, cluster.ErrNotLeader) {
+			// leadership was lost while the write was logged
+			return nil, status.Error(codes.Unavailable, err.Error())
+		}
+
+		return resp, err
+	}
+}
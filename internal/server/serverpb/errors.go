@@ -1,11 +1,17 @@
 package serverpb
 
 import (
+	"github.com/denismitr/lemon-server/internal/cluster"
 	"github.com/denismitr/lemon-server/internal/database"
+	"github.com/denismitr/lemon-server/internal/jsondoc"
+	"github.com/denismitr/lemon-server/internal/pubsub"
 	"github.com/pkg/errors"
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"strings"
+	"time"
 )
 
 func createBatchInsertGrpcError(err error) error {
@@ -14,7 +20,7 @@ func createBatchInsertGrpcError(err error) error {
 		ds, err := errorStatus.WithDetails(
 			&errdetails.BadRequest_FieldViolation{
 				Field:       "Value",
-				Description: "Must be of type string, bytes, int64 or bool",
+				Description: "Must be of type string, bytes, int64, bool, float64 or timestamp",
 			},
 		)
 
@@ -25,12 +31,17 @@ func createBatchInsertGrpcError(err error) error {
 		return ds.Err()
 	}
 
-	if errors.Is(err, database.ErrInvalidTagValue) {
-		errorStatus := status.New(codes.InvalidArgument, "invalid tag value type")
+	var fieldErr *database.FieldError
+	if errors.As(err, &fieldErr) {
+		return createFieldGrpcError(codes.InvalidArgument, fieldErr)
+	}
+
+	if errors.Is(err, database.ErrReservedTagName) {
+		errorStatus := status.New(codes.InvalidArgument, "reserved tag name")
 		ds, err := errorStatus.WithDetails(
 			&errdetails.BadRequest_FieldViolation{
-				Field:       "Tags.Value",
-				Description: "Must be of type string, float64, int64 or bool",
+				Field:       "Tags.Name",
+				Description: err.Error(),
 			},
 		)
 
@@ -41,16 +52,16 @@ func createBatchInsertGrpcError(err error) error {
 		return ds.Err()
 	}
 
-	return err
-}
+	if errors.Is(err, database.ErrEncryptionKeyMissing) {
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
 
-func createBatchDeleteByKeyGrpcError(err error) error {
-	if errors.Is(err, database.ErrInvalidKey) {
-		errorStatus := status.New(codes.InvalidArgument, "invalid lemon DB key")
+	if errors.Is(err, database.ErrInvalidTagValue) {
+		errorStatus := status.New(codes.InvalidArgument, "invalid tag value type")
 		ds, err := errorStatus.WithDetails(
 			&errdetails.BadRequest_FieldViolation{
-				Field:       "Keys",
-				Description: err.Error(),
+				Field:       "Tags.Value",
+				Description: "Must be of type string, float64, int64, bool or timestamp",
 			},
 		)
 
@@ -61,6 +72,10 @@ func createBatchDeleteByKeyGrpcError(err error) error {
 		return ds.Err()
 	}
 
+	return err
+}
+
+func createBatchDeleteByKeyGrpcError(err error) error {
 	if errors.Is(err, database.ErrEmptyInput) {
 		errorStatus := status.New(codes.InvalidArgument, "empty request")
 		ds, err := errorStatus.WithDetails(
@@ -79,3 +94,200 @@ func createBatchDeleteByKeyGrpcError(err error) error {
 
 	return err
 }
+
+func createResourceExhaustedGrpcError(
+	msg string,
+	violations []*errdetails.QuotaFailure_Violation,
+	retryAfter time.Duration,
+) error {
+	errorStatus := status.New(codes.ResourceExhausted, msg)
+
+	var ds *status.Status
+	var err error
+	if retryAfter > 0 {
+		ds, err = errorStatus.WithDetails(
+			&errdetails.QuotaFailure{Violations: violations},
+			&errdetails.RetryInfo{RetryDelay: durationpb.New(retryAfter)},
+		)
+	} else {
+		ds, err = errorStatus.WithDetails(&errdetails.QuotaFailure{Violations: violations})
+	}
+
+	if err != nil {
+		return errorStatus.Err()
+	}
+
+	return ds.Err()
+}
+
+func createQuotaExceededGrpcError(err error) error {
+	return createResourceExhaustedGrpcError(
+		"quota exceeded",
+		[]*errdetails.QuotaFailure_Violation{{Subject: "database", Description: err.Error()}},
+		0,
+	)
+}
+
+func createInvalidKeyGrpcError(keyErr *database.KeyError) error {
+	errorStatus := status.New(codes.InvalidArgument, "invalid lemon DB key")
+
+	violations := make([]*errdetails.BadRequest_FieldViolation, len(keyErr.Violations))
+	for i, v := range keyErr.Violations {
+		violations[i] = &errdetails.BadRequest_FieldViolation{
+			Field:       v.Field,
+			Description: v.Description,
+		}
+	}
+
+	ds, err := errorStatus.WithDetails(&errdetails.BadRequest{FieldViolations: violations})
+	if err != nil {
+		return errorStatus.Err()
+	}
+
+	return ds.Err()
+}
+
+func createFieldGrpcError(code codes.Code, fieldErr *database.FieldError) error {
+	errorStatus := status.New(code, fieldErr.Err.Error())
+	ds, err := errorStatus.WithDetails(&errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{
+			{Field: fieldErr.Field, Description: fieldErr.Description},
+		},
+	})
+
+	if err != nil {
+		return errorStatus.Err()
+	}
+
+	return ds.Err()
+}
+
+func createPatchGrpcError(err error) error {
+	var fieldErr *database.FieldError
+	var schemaErr *database.SchemaError
+	switch {
+	case errors.As(err, &schemaErr):
+		return createSchemaViolationGrpcError(schemaErr)
+	case errors.Is(err, jsondoc.ErrTestFailed) && errors.As(err, &fieldErr):
+		return createFieldGrpcError(codes.FailedPrecondition, fieldErr)
+	case errors.As(err, &fieldErr):
+		return createFieldGrpcError(codes.InvalidArgument, fieldErr)
+	case errors.Is(err, database.ErrEmptyInput):
+		return createBatchDeleteByKeyGrpcError(err)
+	case errors.Is(err, database.ErrDocumentNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, database.ErrRevisionMismatch):
+		return status.Error(codes.Aborted, err.Error())
+	case errors.Is(err, database.ErrNotJSONDocument), errors.Is(err, database.ErrEncryptionKeyMissing):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+func createUndeleteGrpcError(err error) error {
+	switch {
+	case errors.Is(err, database.ErrDocumentNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, database.ErrDocumentExists):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, database.ErrQuotaExceeded):
+		return createQuotaExceededGrpcError(err)
+	case errors.Is(err, database.ErrEncryptionKeyMissing):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+func createTransactionGrpcError(err error) error {
+	var fieldErr *database.FieldError
+	var schemaErr *database.SchemaError
+	switch {
+	case errors.As(err, &schemaErr):
+		return createSchemaViolationGrpcError(schemaErr)
+	case errors.As(err, &fieldErr):
+		return createFieldGrpcError(codes.InvalidArgument, fieldErr)
+	case errors.Is(err, database.ErrEmptyInput), errors.Is(err, database.ErrInvalidDatabaseName):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, database.ErrInvalidDocumentValue):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, database.ErrQuotaExceeded):
+		return createQuotaExceededGrpcError(err)
+	case errors.Is(err, database.ErrRevisionMismatch):
+		return status.Error(codes.Aborted, err.Error())
+	case errors.Is(err, database.ErrEncryptionKeyMissing):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+func createAdminGrpcError(err error) error {
+	var fieldErr *database.FieldError
+	switch {
+	case errors.Is(err, database.ErrInvalidDatabaseName):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.As(err, &fieldErr):
+		return createFieldGrpcError(codes.InvalidArgument, fieldErr)
+	case errors.Is(err, database.ErrEncryptionKeyMissing),
+		errors.Is(err, database.ErrEncryptionUnavailable),
+		errors.Is(err, database.ErrReshardInProgress),
+		errors.Is(err, database.ErrShardingDisabled):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, cluster.ErrNotLeader):
+		return status.Error(codes.Unavailable, err.Error())
+	}
+
+	return status.Error(codes.Internal, err.Error())
+}
+
+func createClusterGrpcError(err error) error {
+	switch {
+	case errors.Is(err, database.ErrInvalidInput):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, cluster.ErrNotLeader):
+		return status.Error(codes.Unavailable, err.Error())
+	}
+
+	return status.Error(codes.Internal, err.Error())
+}
+
+func createPubSubGrpcError(err error) error {
+	switch {
+	case errors.Is(err, pubsub.ErrInvalidChannel), errors.Is(err, pubsub.ErrInvalidSubscription):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, pubsub.ErrClosed):
+		return status.Error(codes.Unavailable, err.Error())
+	}
+
+	return status.Error(codes.Internal, err.Error())
+}
+
+func createSchemaViolationGrpcError(schemaErr *database.SchemaError) error {
+	errorStatus := status.New(codes.InvalidArgument, "documents do not conform to the database schema")
+
+	violations := make([]*errdetails.BadRequest_FieldViolation, len(schemaErr.Violations))
+	for i, v := range schemaErr.Violations {
+		violations[i] = &errdetails.BadRequest_FieldViolation{
+			Field:       v.Field,
+			Description: v.Description,
+		}
+	}
+
+	ds, err := errorStatus.WithDetails(&errdetails.BadRequest{FieldViolations: violations})
+	if err != nil {
+		return errorStatus.Err()
+	}
+
+	return ds.Err()
+}
+
+// createPageTokenGrpcError reports a rejected page token as an invalid page_token field
+func createPageTokenGrpcError(err error) error {
+	return createFieldGrpcError(codes.InvalidArgument, &database.FieldError{
+		Field:       "page_token",
+		Description: strings.TrimSuffix(err.Error(), ": "+ErrInvalidPageToken.Error()),
+		Err:         ErrInvalidPageToken,
+	})
+}
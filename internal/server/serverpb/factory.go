@@ -1,16 +1,28 @@
 package serverpb
 
 import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/denismitr/lemon-server/internal/audit"
+	"github.com/denismitr/lemon-server/internal/cluster"
 	"github.com/denismitr/lemon-server/internal/database"
+	"github.com/denismitr/lemon-server/internal/pubsub"
+	"github.com/denismitr/lemon-server/internal/replication"
 	"github.com/denismitr/lemon-server/internal/server"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 //var ErrNoConfigSource = errors.New("no configuration source specified e.g. yaml config path")
 
 var ErrDisabled = errors.New("grpc server is disabled in configuration")
 
+// replicationStateFile keeps the position of a follower in the store dir
+const replicationStateFile = "replication.json"
+
 type Factory struct {
 	yamlConfigPath string
 	dotenvPath     string
@@ -45,34 +57,184 @@ func (f *Factory) WithBuildVersion(build string) *Factory {
 	return f
 }
 
+// BuildConfig loads the configuration from all the sources given to the factory
+func (f *Factory) BuildConfig() (*server.Config, error) {
+	return server.NewConfig(f.env, f.build, f.yamlConfigPath, f.dotenvPath)
+}
+
 func (f *Factory) BuildGrpcServer() (*GrpcServer, error) {
-	var slg *zap.SugaredLogger
+	cfg, err := f.BuildConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if !cfg.Grpc.Enabled {
+		return nil, ErrDisabled
+	}
+
+	lvl, err := logLevelFor(f.env, cfg.Log.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	var zapCfg zap.Config
 	if f.env == server.Dev || f.env == server.Test {
-		if lg, err := zap.NewDevelopmentConfig().Build(); err != nil {
+		zapCfg = zap.NewDevelopmentConfig()
+	} else {
+		zapCfg = zap.NewProductionConfig()
+	}
+
+	zapCfg.Level.SetLevel(lvl)
+
+	lg, err := zapCfg.Build()
+	if err != nil {
+		return nil, err
+	}
+
+	slg := lg.Sugar()
+
+	var kp database.KeyProvider
+	if cfg.Encryption.Keyfile != "" {
+		if kp, err = database.NewKeyfileProvider(cfg.Encryption.Keyfile); err != nil {
 			return nil, err
-		} else {
-			slg = lg.Sugar()
 		}
-	} else {
-		if lg, err := zap.NewProductionConfig().Build(); err != nil {
+	}
+
+	s := database.NewStore(cfg.Store.Dir, cfg.Store.IdleTimeout)
+	db := database.NewEngine(s, kp, slg)
+	s.SetJanitorInterval(cfg.Store.JanitorInterval)
+	db.SetTombstoneRetention(cfg.Store.TombstoneRetention)
+
+	// transactions left in doubt by a crash have to be completed before any request is served
+	if err := db.RecoverTransactions(context.Background()); err != nil {
+		return nil, err
+	}
+
+	// writes of cluster nodes are proposed through the raft log, which replaces the store on start
+	var engine database.Engine = db
+	var node *cluster.Node
+	var cm ClusterMembership
+	if cfg.Cluster.Enabled {
+		address := cfg.Cluster.Address
+		if address == "" {
+			address = fmt.Sprintf("127.0.0.1:%d", cfg.Grpc.Port)
+		}
+
+		if node, err = cluster.NewNode(cluster.Config{
+			NodeID:       cfg.Cluster.NodeID,
+			RaftAddress:  cfg.Cluster.RaftAddress,
+			Address:      address,
+			Dir:          cfg.Cluster.Dir,
+			Bootstrap:    cfg.Cluster.Bootstrap,
+			ApplyTimeout: cfg.Cluster.ApplyTimeout,
+		}, db, slg); err != nil {
+			return nil, err
+		}
+		engine = cluster.NewEngine(db, node)
+		cm = node
+	}
+
+	var al *audit.Log
+	if cfg.Audit.Enabled {
+		if al, err = audit.Open(cfg.Audit.Dir, cfg.Audit.MaxSize); err != nil {
 			return nil, err
-		} else {
-			slg = lg.Sugar()
 		}
 	}
 
-	cfg, err := server.NewConfig(f.env, f.build, f.yamlConfigPath, f.dotenvPath)
+	var purged func(dbName string, keys []string)
+	if al != nil {
+		purged = auditPurge(al, slg)
+	}
+	s.StartJanitor(func() {
+		db.PurgeTrash(purged)
+		db.PurgeTombstones()
+	})
+
+	keys, err := database.NewKeyValidator(
+		cfg.Keys.MaxLength,
+		cfg.Keys.AllowedChars,
+		database.DuplicatePolicy(cfg.Keys.UpsertDuplicates),
+	)
 	if err != nil {
 		return nil, err
 	}
 
-	if !cfg.Grpc.Enabled {
-		return nil, ErrDisabled
+	pages, err := newPager(cfg.Pages)
+	if err != nil {
+		return nil, err
+	}
+
+	var primary *replication.Primary
+	var follower *replication.Follower
+	var rs ReplicationStatusProvider
+	switch cfg.Replication.Role {
+	case replication.RolePrimary:
+		if primary, err = replication.NewPrimary(db, cfg.Replication.LogSize, slg); err != nil {
+			return nil, err
+		}
+		db.AddCommitHook(primary.Capture)
+		rs = primary
+	case replication.RoleFollower:
+		if follower, err = replication.NewFollower(
+			db,
+			cfg.Replication.Primary,
+			cfg.Replication.PrimaryToken,
+			filepath.Join(cfg.Store.Dir, replicationStateFile),
+			cfg.Replication.RetryInterval,
+			slg,
+		); err != nil {
+			return nil, err
+		}
+		rs = follower
+	}
+
+	// subscribers of databases get the writes applied by this server, including those of a primary or leader
+	broker, err := pubsub.NewBroker(pubsub.Config{
+		BufferSize:  cfg.PubSub.BufferSize,
+		Durable:     cfg.PubSub.Durable,
+		Dir:         cfg.PubSub.Dir,
+		MaxMessages: cfg.PubSub.MaxMessages,
+	}, db, slg)
+	if err != nil {
+		return nil, err
 	}
+	db.AddChangeHook(broker.Capture)
 
-	s := database.NewStore()
-	db := database.NewEngine(s, slg)
+	grpcHandlers := NewHandlers(slg, engine, keys, pages)
+	adminHandlers := NewAdminHandlers(slg, engine, al, rs, cm)
+	return New(Dependencies{
+		Env:        f.env,
+		Config:     cfg,
+		Logger:     slg,
+		LogLevel:   zapCfg.Level,
+		Store:      s,
+		Engine:     db,
+		Receiver:   grpcHandlers,
+		Admin:      adminHandlers,
+		Broker:     broker,
+		Audit:      al,
+		Primary:    primary,
+		Follower:   follower,
+		Node:       node,
+		LoadConfig: f.BuildConfig,
+	})
+}
+
+// logLevelFor resolves the configured log level, falling back to
+// debug in dev and test environments and to info in prod
+func logLevelFor(env server.Environment, level string) (zapcore.Level, error) {
+	if level == "" {
+		if env == server.Prod {
+			return zapcore.InfoLevel, nil
+		}
+
+		return zapcore.DebugLevel, nil
+	}
+
+	var lvl zapcore.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return lvl, errors.Wrapf(server.ErrInvalidConfig, "log level %s is unknown", level)
+	}
 
-	grpcHandlers := NewHandlers(slg, db)
-	return New(f.env, cfg, slg, grpcHandlers), nil
+	return lvl, nil
 }
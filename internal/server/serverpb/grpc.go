@@ -3,43 +3,117 @@ package serverpb
 import (
 	"context"
 	"fmt"
+	"github.com/denismitr/lemon-server/internal/audit"
+	"github.com/denismitr/lemon-server/internal/cluster"
+	"github.com/denismitr/lemon-server/internal/database"
+	"github.com/denismitr/lemon-server/internal/pubsub"
+	"github.com/denismitr/lemon-server/internal/replication"
 	"github.com/denismitr/lemon-server/internal/server"
 	"github.com/denismitr/lemon-server/pkg/command"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
 	"net"
 	"os"
 	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 )
 
+const reflectionServicePrefix = "/grpc.reflection."
+
+// ConfigLoader re-reads the configuration from its sources
+type ConfigLoader func() (*server.Config, error)
+
 type GrpcServer struct {
-	env      server.Environment
-	cfg      *server.Config
-	receiver *GrpcHandlers
-	lg       *zap.SugaredLogger
-	stopCh   chan struct{}
+	env        server.Environment
+	cfg        *server.Config
+	receiver   *GrpcHandlers
+	admin      *AdminHandlers
+	pubsub     *PubSubHandlers
+	broker     *pubsub.Broker
+	audit      *audit.Log
+	lg         *zap.SugaredLogger
+	logLevel   zap.AtomicLevel
+	store      *database.Store
+	engine     *database.LemonEngine
+	primary    *replication.Primary
+	follower   *replication.Follower
+	node       *cluster.Node
+	forwarder  *forwarder
+	auth       *authenticator
+	limiter    *rateLimiter
+	reflection int32
+	loadConfig ConfigLoader
+	mu         sync.RWMutex
+	stopCh     chan struct{}
+}
+
+// Dependencies are what a server is built of, the audit log, replication and cluster ones
+// are nil when they are disabled
+type Dependencies struct {
+	Env        server.Environment
+	Config     *server.Config
+	Logger     *zap.SugaredLogger
+	LogLevel   zap.AtomicLevel
+	Store      *database.Store
+	Engine     *database.LemonEngine
+	Receiver   *GrpcHandlers
+	Admin      *AdminHandlers
+	Broker     *pubsub.Broker
+	Audit      *audit.Log
+	Primary    *replication.Primary
+	Follower   *replication.Follower
+	Node       *cluster.Node
+	LoadConfig ConfigLoader
 }
 
-func New(
-	env server.Environment,
-	cfg *server.Config,
-	lg *zap.SugaredLogger,
-	receiver *GrpcHandlers,
-) *GrpcServer {
-	return &GrpcServer{
-		env:      env,
-		cfg:      cfg,
-		lg:       lg,
-		receiver: receiver,
-		stopCh:   make(chan struct{}),
+func New(deps Dependencies) (*GrpcServer, error) {
+	cfg := deps.Config
+	principals, err := cfg.Auth.Principals()
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &GrpcServer{
+		env:        deps.Env,
+		cfg:        cfg,
+		lg:         deps.Logger,
+		logLevel:   deps.LogLevel,
+		store:      deps.Store,
+		engine:     deps.Engine,
+		primary:    deps.Primary,
+		follower:   deps.Follower,
+		node:       deps.Node,
+		auth:       newAuthenticator(principals, cfg.Auth.Admins),
+		limiter:    newRateLimiter(cfg.Limits),
+		receiver:   deps.Receiver,
+		admin:      deps.Admin,
+		pubsub:     NewPubSubHandlers(deps.Logger, deps.Broker),
+		broker:     deps.Broker,
+		audit:      deps.Audit,
+		loadConfig: deps.LoadConfig,
+		stopCh:     make(chan struct{}),
+	}
+
+	if deps.Node != nil {
+		srv.forwarder = newForwarder(deps.Node, deps.Logger)
 	}
+
+	srv.setReflection(cfg.Grpc.Reflection)
+	deps.Engine.SetMaxDocuments(cfg.Limits.MaxDocumentsPerDatabase)
+
+	return srv, nil
 }
 
 func (srv *GrpcServer) RunUntilTerminated() error {
-	signalCh := make(chan os.Signal)
+	signalCh := make(chan os.Signal, 1)
 
 	errCh := make(chan error)
 	go func() {
@@ -52,49 +126,103 @@ func (srv *GrpcServer) RunUntilTerminated() error {
 	}()
 
 	go func() {
-		<-signalCh
-		srv.Shutdown()
+		for sig := range signalCh {
+			if sig == syscall.SIGHUP {
+				if err := srv.Reload(); err != nil {
+					srv.lg.Errorf("configuration reload failed, keeping current configuration: %s", err)
+				}
+				continue
+			}
+
+			signal.Stop(signalCh)
+			srv.Shutdown()
+			return
+		}
 	}()
 
-	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGHUP)
 
 	return <-errCh
 }
 
 func (srv *GrpcServer) Start() error {
-	i := createRequestLoggerInterceptor(srv.lg)
+	grpcSrv := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(srv.unaryInterceptors()...),
+		grpc.ChainStreamInterceptor(
+			createReflectionSwitchInterceptor(srv),
+			createAuthStreamInterceptor(srv.auth),
+			createRateLimitStreamInterceptor(srv.limiter),
+		),
+	)
 
-	grpcSrv := grpc.NewServer(grpc.UnaryInterceptor(i))
 	command.RegisterReceiverServer(grpcSrv, srv.receiver)
-
-	if srv.cfg.Grpc.Reflection {
-		reflection.Register(grpcSrv)
+	command.RegisterAdminServer(grpcSrv, srv.admin)
+	command.RegisterPubSubServer(grpcSrv, srv.pubsub)
+	if srv.primary != nil {
+		command.RegisterReplicationServer(grpcSrv, srv.primary)
 	}
 
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", srv.cfg.Grpc.Port))
+	// reflection is always registered, so that it can be switched on and off on reload
+	reflection.Register(grpcSrv)
+
+	cfg := srv.config()
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.Grpc.Port))
 	if err != nil {
 		return err
 	}
 
 	fatalErrCh := make(chan error)
 
+	replicating, stopReplicating := context.WithCancel(context.Background())
+	defer stopReplicating()
+
+	followerDone := make(chan struct{})
+	if srv.follower != nil {
+		go func() {
+			defer close(followerDone)
+			srv.follower.Run(replicating)
+		}()
+	} else {
+		close(followerDone)
+	}
+
 	go func() {
 		srv.lg.Debugf(
 			"Starting LemonDB GRPC server: build %s, API version '%s', port :%d in '%s' environment",
-			srv.cfg.Version.Build, srv.cfg.Grpc.Version, srv.cfg.Grpc.Port, srv.env,
+			cfg.Version.Build, cfg.Grpc.Version, cfg.Grpc.Port, srv.env,
 		)
 
 		if err := grpcSrv.Serve(listener); err != nil {
 			fatalErrCh <- err
 		}
 
-		srv.lg.Debugf("Stopping LemonDB GRPC server on port :%d", srv.cfg.Grpc.Port)
+		srv.lg.Debugf("Stopping LemonDB GRPC server on port :%d", cfg.Grpc.Port)
 	}()
 
 	for {
 		select {
 		case <-srv.stopCh:
+			// subscriptions last until they are ended, the graceful stop would wait for them
+			if err := srv.broker.Close(); err != nil {
+				srv.lg.Error(err)
+			}
 			grpcSrv.GracefulStop()
+			stopReplicating()
+			<-followerDone
+			if srv.node != nil {
+				srv.forwarder.close()
+				if err := srv.node.Shutdown(); err != nil {
+					srv.lg.Error(err)
+				}
+			}
+			if srv.audit != nil {
+				if err := srv.audit.Close(); err != nil {
+					srv.lg.Error(err)
+				}
+			}
+			if err := srv.store.Close(); err != nil {
+				srv.lg.Error(err)
+			}
 			return nil
 		case err := <-fatalErrCh:
 			if err == nil {
@@ -110,14 +238,198 @@ func (srv *GrpcServer) Shutdown() {
 	close(srv.stopCh)
 }
 
-func createRequestLoggerInterceptor(lg *zap.SugaredLogger) grpc.UnaryServerInterceptor {
+// Reload re-reads the configuration and applies the settings that can be
+// changed at runtime, open connections and databases are left intact
+func (srv *GrpcServer) Reload() error {
+	if srv.loadConfig == nil {
+		return errors.New("no configuration loader")
+	}
+
+	next, err := srv.loadConfig()
+	if err != nil {
+		return err
+	}
+
+	return srv.apply(next)
+}
+
+func (srv *GrpcServer) apply(next *server.Config) error {
+	principals, err := next.Auth.Principals()
+	if err != nil {
+		return err
+	}
+
+	lvl, err := logLevelFor(srv.env, next.Log.Level)
+	if err != nil {
+		return err
+	}
+
+	srv.logLevel.SetLevel(lvl)
+	srv.auth.set(principals, next.Auth.Admins)
+	srv.setReflection(next.Grpc.Reflection)
+	srv.store.SetIdleTimeout(next.Store.IdleTimeout)
+	srv.store.SetJanitorInterval(next.Store.JanitorInterval)
+	srv.engine.SetTombstoneRetention(next.Store.TombstoneRetention)
+	srv.limiter.configure(next.Limits)
+	srv.receiver.pages.configure(next.Pages)
+	srv.engine.SetMaxDocuments(next.Limits.MaxDocumentsPerDatabase)
+
+	srv.mu.Lock()
+	prev := srv.cfg
+	changes := restartRequired(prev, next)
+	// settings bound at startup stay in effect until restart
+	next.Grpc.Enabled = prev.Grpc.Enabled
+	next.Grpc.Port = prev.Grpc.Port
+	next.Grpc.Version = prev.Grpc.Version
+	next.Store.Dir = prev.Store.Dir
+	next.Replication = prev.Replication
+	next.Cluster = prev.Cluster
+	next.PubSub = prev.PubSub
+	next.Keys = prev.Keys
+	next.Audit = prev.Audit
+	next.Encryption = prev.Encryption
+	srv.cfg = next
+	srv.mu.Unlock()
+
+	for _, change := range changes {
+		srv.lg.Warnf("configuration change of %s requires a restart to take effect", change)
+	}
+
+	srv.lg.Infof("configuration reloaded")
+
+	return nil
+}
+
+func restartRequired(prev, next *server.Config) []string {
+	var changes []string
+
+	if prev.Grpc.Port != next.Grpc.Port {
+		changes = append(changes, "grpc port")
+	}
+
+	if prev.Grpc.Enabled != next.Grpc.Enabled {
+		changes = append(changes, "grpc enabled")
+	}
+
+	if prev.Grpc.Version != next.Grpc.Version {
+		changes = append(changes, "grpc version")
+	}
+
+	if prev.Store.Dir != next.Store.Dir {
+		changes = append(changes, "store dir")
+	}
+
+	if prev.Replication != next.Replication {
+		changes = append(changes, "replication")
+	}
+
+	if prev.Cluster != next.Cluster {
+		changes = append(changes, "cluster")
+	}
+
+	if !reflect.DeepEqual(prev.PubSub, next.PubSub) {
+		changes = append(changes, "pubsub")
+	}
+
+	if prev.Keys != next.Keys {
+		changes = append(changes, "keys")
+	}
+
+	if prev.Audit != next.Audit {
+		changes = append(changes, "audit")
+	}
+
+	if prev.Encryption != next.Encryption {
+		changes = append(changes, "encryption")
+	}
+
+	return changes
+}
+
+func (srv *GrpcServer) config() *server.Config {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+	return srv.cfg
+}
+
+func (srv *GrpcServer) setReflection(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&srv.reflection, v)
+}
+
+func (srv *GrpcServer) reflectionEnabled() bool {
+	return atomic.LoadInt32(&srv.reflection) == 1
+}
+
+// unaryInterceptors limits the requests of principals right after authenticating them,
+// so that requests over their limits are neither forwarded nor audited
+func (srv *GrpcServer) unaryInterceptors() []grpc.UnaryServerInterceptor {
+	interceptors := []grpc.UnaryServerInterceptor{
+		createAuthInterceptor(srv.auth),
+		createRateLimitInterceptor(srv.limiter),
+		createAccessLogInterceptor(srv.lg),
+	}
+
+	if srv.follower != nil {
+		interceptors = append(interceptors, createReadOnlyInterceptor())
+	}
+
+	if srv.forwarder != nil {
+		interceptors = append(interceptors, createForwardInterceptor(srv.forwarder))
+	}
+
+	if srv.audit != nil {
+		interceptors = append(interceptors, createAuditInterceptor(srv.audit, srv.lg))
+	}
+
+	return interceptors
+}
+
+// writeMethods change documents or databases, which only the primary may do when replicating
+var writeMethods = map[string]bool{
+	"/command.Receiver/BatchUpsert":              true,
+	"/command.Receiver/BatchInsert":              true,
+	"/command.Receiver/BatchDeleteByKey":         true,
+	"/command.Receiver/Patch":                    true,
+	"/command.Receiver/CrossDatabaseTransaction": true,
+	"/command.Receiver/Undelete":                 true,
+	"/command.Admin/SetDatabaseSchema":           true,
+	"/command.Admin/SetDatabaseOptions":          true,
+	"/command.Admin/SetDatabaseIndexes":          true,
+	"/command.Admin/RotateDatabaseKey":           true,
+	"/command.Admin/ReshardDatabase":             true,
+}
+
+// createReadOnlyInterceptor rejects writes on followers, their documents are those of the primary
+func createReadOnlyInterceptor() grpc.UnaryServerInterceptor {
 	return func(
 		ctx context.Context,
 		req interface{},
 		info *grpc.UnaryServerInfo,
 		handler grpc.UnaryHandler,
-	) (resp interface{}, err error) {
-		lg.Debugf("grpc server got request for method %s", info.FullMethod)
+	) (interface{}, error) {
+		if writeMethods[info.FullMethod] {
+			return nil, status.Error(codes.FailedPrecondition, "server is a read-only replication follower, write to the primary")
+		}
+
 		return handler(ctx, req)
 	}
 }
+
+func createReflectionSwitchInterceptor(srv *GrpcServer) grpc.StreamServerInterceptor {
+	return func(
+		s interface{},
+		ss grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		if strings.HasPrefix(info.FullMethod, reflectionServicePrefix) && !srv.reflectionEnabled() {
+			return status.Error(codes.Unimplemented, "server reflection is disabled")
+		}
+
+		return handler(s, ss)
+	}
+}
@@ -0,0 +1,305 @@
+package serverpb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/denismitr/lemon-server/internal/database"
+	"github.com/denismitr/lemon-server/internal/server"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func testConfig(t *testing.T) *server.Config {
+	return &server.Config{
+		Grpc:    server.GrpcConfig{Enabled: true, Port: 3099, Version: "1"},
+		Log:     server.LogConfig{Level: "info"},
+		Store:   server.StoreConfig{Dir: t.TempDir(), IdleTimeout: time.Minute, JanitorInterval: time.Minute},
+		Limits:  server.LimitsConfig{Burst: 1},
+		Pages:   server.PagesConfig{MaxSize: 100, TokenTTL: time.Hour},
+		PubSub:  server.PubSubConfig{BufferSize: 16},
+		Cluster: server.ClusterConfig{RaftAddress: "127.0.0.1:3199"},
+	}
+}
+
+// newReloadableServer returns a server of cfg, not started, with the warnings it logs
+func newReloadableServer(t *testing.T, cfg *server.Config) (*GrpcServer, *observer.ObservedLogs) {
+	core, logs := observer.New(zapcore.WarnLevel)
+	lg := zap.New(core).Sugar()
+
+	store := database.NewStore(cfg.Store.Dir, cfg.Store.IdleTimeout)
+	t.Cleanup(func() {
+		_ = store.Close()
+	})
+	engine := database.NewEngine(store, nil, lg)
+
+	pages, err := newPager(cfg.Pages)
+	require.NoError(t, err)
+
+	lvl, err := logLevelFor(server.Test, cfg.Log.Level)
+	require.NoError(t, err)
+
+	srv, err := New(Dependencies{
+		Env:      server.Test,
+		Config:   cfg,
+		Logger:   lg,
+		LogLevel: zap.NewAtomicLevelAt(lvl),
+		Store:    store,
+		Engine:   engine,
+		Receiver: NewHandlers(lg, engine, nil, pages),
+	})
+	require.NoError(t, err)
+
+	return srv, logs
+}
+
+func Test_GrpcServer_apply(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("settings are reloaded", func(t *testing.T) {
+		tt := []struct {
+			name   string
+			change func(cfg *server.Config)
+			check  func(t *testing.T, srv *GrpcServer)
+		}{
+			{
+				name:   "log level",
+				change: func(cfg *server.Config) { cfg.Log.Level = "error" },
+				check: func(t *testing.T, srv *GrpcServer) {
+					assert.Equal(t, zapcore.ErrorLevel, srv.logLevel.Level())
+				},
+			},
+			{
+				name:   "auth principals",
+				change: func(cfg *server.Config) { cfg.Auth.Tokens = []string{"alice:secret"} },
+				check: func(t *testing.T, srv *GrpcServer) {
+					_, err := srv.auth.authenticate(ctx)
+					assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+					authenticated, err := srv.auth.authenticate(metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "Bearer secret")))
+					require.NoError(t, err)
+					assert.Equal(t, "alice", PrincipalFromContext(authenticated))
+				},
+			},
+			{
+				name:   "reflection",
+				change: func(cfg *server.Config) { cfg.Grpc.Reflection = true },
+				check: func(t *testing.T, srv *GrpcServer) {
+					assert.True(t, srv.reflectionEnabled())
+				},
+			},
+			{
+				name:   "limits",
+				change: func(cfg *server.Config) { cfg.Limits.PrincipalRequests = 5 },
+				check: func(t *testing.T, srv *GrpcServer) {
+					assert.Equal(t, float64(5), srv.limiter.limits().PrincipalRequests)
+				},
+			},
+			{
+				name:   "pages",
+				change: func(cfg *server.Config) { cfg.Pages.MaxSize = 10 },
+				check: func(t *testing.T, srv *GrpcServer) {
+					assert.Equal(t, 10, srv.receiver.pages.size(0))
+				},
+			},
+			{
+				name:   "max documents",
+				change: func(cfg *server.Config) { cfg.Limits.MaxDocumentsPerDatabase = 1 },
+				check: func(t *testing.T, srv *GrpcServer) {
+					_, err := srv.engine.BatchUpsert(ctx, "users", database.BatchUpsert{{Key: "u:1", Value: 1}, {Key: "u:2", Value: 2}})
+					assert.True(t, errors.Is(err, database.ErrQuotaExceeded))
+				},
+			},
+		}
+
+		for _, tc := range tt {
+			t.Run(tc.name, func(t *testing.T) {
+				cfg := testConfig(t)
+				srv, logs := newReloadableServer(t, cfg)
+
+				next := *cfg
+				tc.change(&next)
+				require.NoError(t, srv.apply(&next))
+
+				tc.check(t, srv)
+				assert.Equal(t, &next, srv.config())
+				assert.Zero(t, logs.Len(), "no restart is required")
+			})
+		}
+	})
+
+	t.Run("restart-only settings are kept until restart", func(t *testing.T) {
+		tt := []struct {
+			change  func(cfg *server.Config)
+			warning string
+		}{
+			{change: func(cfg *server.Config) { cfg.Grpc.Port = 4000 }, warning: "grpc port"},
+			{change: func(cfg *server.Config) { cfg.Grpc.Enabled = false }, warning: "grpc enabled"},
+			{change: func(cfg *server.Config) { cfg.Grpc.Version = "2" }, warning: "grpc version"},
+			{change: func(cfg *server.Config) { cfg.Store.Dir = "elsewhere" }, warning: "store dir"},
+			{change: func(cfg *server.Config) { cfg.Replication.Role = "primary" }, warning: "replication"},
+			{change: func(cfg *server.Config) { cfg.Cluster.Enabled = true }, warning: "cluster"},
+			{change: func(cfg *server.Config) { cfg.PubSub.Durable = []string{"orders.*"} }, warning: "pubsub"},
+			{change: func(cfg *server.Config) { cfg.Keys.MaxLength = 16 }, warning: "keys"},
+			{change: func(cfg *server.Config) { cfg.Keys.AllowedChars = "a-z" }, warning: "keys"},
+			{change: func(cfg *server.Config) { cfg.Keys.UpsertDuplicates = "last-wins" }, warning: "keys"},
+			{change: func(cfg *server.Config) { cfg.Audit.MaxSize = 1024 }, warning: "audit"},
+			{change: func(cfg *server.Config) { cfg.Encryption.Keyfile = "keys.txt" }, warning: "encryption"},
+		}
+
+		for _, tc := range tt {
+			t.Run(tc.warning, func(t *testing.T) {
+				cfg := testConfig(t)
+				srv, logs := newReloadableServer(t, cfg)
+
+				next := *cfg
+				tc.change(&next)
+				require.NoError(t, srv.apply(&next))
+
+				warnings := logs.FilterMessageSnippet("requires a restart").All()
+				require.Len(t, warnings, 1)
+				assert.Equal(t, "configuration change of "+tc.warning+" requires a restart to take effect", warnings[0].Message)
+
+				assert.Equal(t, cfg, srv.config())
+			})
+		}
+	})
+
+	t.Run("invalid settings are not applied", func(t *testing.T) {
+		cfg := testConfig(t)
+		srv, _ := newReloadableServer(t, cfg)
+
+		next := *cfg
+		next.Log.Level = "loud"
+		next.Pages.MaxSize = 10
+		require.Error(t, srv.apply(&next))
+
+		assert.Equal(t, zapcore.InfoLevel, srv.logLevel.Level())
+		assert.Equal(t, 100, srv.receiver.pages.size(0))
+		assert.Same(t, cfg, srv.config())
+	})
+}
+
+func Test_restartRequired(t *testing.T) {
+	prev := &server.Config{
+		Grpc:  server.GrpcConfig{Enabled: true, Port: 3099, Version: "1"},
+		Store: server.StoreConfig{Dir: "data"},
+	}
+
+	tt := []struct {
+		name    string
+		change  func(cfg *server.Config)
+		changes []string
+	}{
+		{name: "nothing", change: func(cfg *server.Config) {}},
+		{name: "hot reloadable", change: func(cfg *server.Config) {
+			cfg.Log.Level = "error"
+			cfg.Grpc.Reflection = true
+			cfg.Limits.MaxBatchSize = 10
+		}},
+		{name: "grpc", change: func(cfg *server.Config) {
+			cfg.Grpc.Port = 4000
+			cfg.Grpc.Enabled = false
+			cfg.Grpc.Version = "2"
+		}, changes: []string{"grpc port", "grpc enabled", "grpc version"}},
+		{name: "store and replication", change: func(cfg *server.Config) {
+			cfg.Store.Dir = "elsewhere"
+			cfg.Replication.Primary = "primary:3099"
+		}, changes: []string{"store dir", "replication"}},
+		{name: "cluster and pubsub", change: func(cfg *server.Config) {
+			cfg.Cluster.NodeID = "n2"
+			cfg.PubSub.MaxMessages = 10
+		}, changes: []string{"cluster", "pubsub"}},
+		{name: "keys, audit and encryption", change: func(cfg *server.Config) {
+			cfg.Keys.MaxLength = 16
+			cfg.Audit.Dir = "audit"
+			cfg.Encryption.Keyfile = "keys.txt"
+		}, changes: []string{"keys", "audit", "encryption"}},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			next := *prev
+			tc.change(&next)
+			assert.Equal(t, tc.changes, restartRequired(prev, &next))
+		})
+	}
+}
+
+func Test_createReadOnlyInterceptor(t *testing.T) {
+	interceptor := createReadOnlyInterceptor()
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "handled", nil
+	}
+
+	tt := []struct {
+		method  string
+		allowed bool
+	}{
+		{method: "/command.Receiver/BatchUpsert"},
+		{method: "/command.Receiver/Undelete"},
+		{method: "/command.Admin/SetDatabaseSchema"},
+		{method: "/command.Admin/SetDatabaseOptions"},
+		{method: "/command.Admin/SetDatabaseIndexes"},
+		{method: "/command.Admin/RotateDatabaseKey"},
+		{method: "/command.Admin/ReshardDatabase"},
+		{method: "/command.Receiver/MGet", allowed: true},
+		{method: "/command.Admin/GetDatabaseOptions", allowed: true},
+		{method: "/command.Admin/GetReplicationStatus", allowed: true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.method, func(t *testing.T) {
+			res, err := interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: tc.method}, handler)
+			if tc.allowed {
+				assert.NoError(t, err)
+				assert.Equal(t, "handled", res)
+				return
+			}
+
+			assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+		})
+	}
+}
+
+func Test_createAuthInterceptor(t *testing.T) {
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return PrincipalFromContext(ctx), nil
+	}
+
+	bearer := func(token string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token))
+	}
+
+	tt := []struct {
+		name       string
+		principals map[string]string
+		ctx        context.Context
+		method     string
+		code       codes.Code
+	}{
+		{name: "admin adds node", principals: map[string]string{"s1": "root", "s2": "app"}, ctx: bearer("s1"), method: "/command.Admin/AddClusterNode", code: codes.OK},
+		{name: "principal adds node", principals: map[string]string{"s1": "root", "s2": "app"}, ctx: bearer("s2"), method: "/command.Admin/AddClusterNode", code: codes.PermissionDenied},
+		{name: "principal removes node", principals: map[string]string{"s1": "root", "s2": "app"}, ctx: bearer("s2"), method: "/command.Admin/RemoveClusterNode", code: codes.PermissionDenied},
+		{name: "principal writes", principals: map[string]string{"s1": "root", "s2": "app"}, ctx: bearer("s2"), method: "/command.Receiver/BatchUpsert", code: codes.OK},
+		{name: "unknown token", principals: map[string]string{"s1": "root"}, ctx: bearer("s2"), method: "/command.Receiver/MGet", code: codes.Unauthenticated},
+		{name: "auth disabled", ctx: context.Background(), method: "/command.Admin/RemoveClusterNode", code: codes.OK},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			interceptor := createAuthInterceptor(newAuthenticator(tc.principals, []string{"root"}))
+			_, err := interceptor(tc.ctx, nil, &grpc.UnaryServerInfo{FullMethod: tc.method}, handler)
+			assert.Equal(t, tc.code, status.Code(err))
+		})
+	}
+}
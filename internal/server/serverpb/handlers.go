@@ -6,7 +6,10 @@ import (
 	"time"
 
 	"github.com/denismitr/lemon-server/internal/database"
+	"github.com/denismitr/lemon-server/internal/fulltext"
+	"github.com/denismitr/lemon-server/internal/lql"
 	"github.com/denismitr/lemon-server/pkg/command"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
@@ -14,15 +17,19 @@ import (
 )
 
 type GrpcHandlers struct {
-	lg *zap.SugaredLogger
-	db database.Engine
+	lg    *zap.SugaredLogger
+	db    database.Engine
+	keys  *database.KeyValidator
+	pages *pager
 	//command.UnimplementedReceiverServer
 }
 
-func NewHandlers(lg *zap.SugaredLogger, db database.Engine) *GrpcHandlers {
+func NewHandlers(lg *zap.SugaredLogger, db database.Engine, keys *database.KeyValidator, pages *pager) *GrpcHandlers {
 	return &GrpcHandlers{
-		lg: lg,
-		db: db,
+		lg:    lg,
+		db:    db,
+		keys:  keys,
+		pages: pages,
 	}
 }
 
@@ -39,8 +46,27 @@ func (g GrpcHandlers) BatchUpsert(
 		return nil, grpcErr
 	}
 
+	bi, err = g.keys.Upsert(bi)
+	if err != nil {
+		return nil, g.createKeyError(err)
+	}
+
 	ir, err := g.db.BatchUpsert(ctx, request.Database, bi)
 	if err != nil {
+		if errors.Is(err, database.ErrQuotaExceeded) {
+			return nil, createQuotaExceededGrpcError(err)
+		}
+
+		if errors.Is(err, database.ErrRevisionMismatch) {
+			return nil, status.Error(codes.Aborted, err.Error())
+		}
+
+		var schemaErr *database.SchemaError
+		if errors.As(err, &schemaErr) {
+			g.lg.Error(err)
+			return nil, createSchemaViolationGrpcError(schemaErr)
+		}
+
 		// todo: handle key already exists
 		errorStatus := status.New(codes.Internal, err.Error())
 		return nil, errorStatus.Err()
@@ -65,8 +91,22 @@ func (g *GrpcHandlers) BatchInsert(
 		return nil, grpcErr
 	}
 
+	if err := g.keys.Insert(bi); err != nil {
+		return nil, g.createKeyError(err)
+	}
+
 	ir, err := g.db.BatchInsert(ctx, request.Database, bi)
 	if err != nil {
+		if errors.Is(err, database.ErrQuotaExceeded) {
+			return nil, createQuotaExceededGrpcError(err)
+		}
+
+		var schemaErr *database.SchemaError
+		if errors.As(err, &schemaErr) {
+			g.lg.Error(err)
+			return nil, createSchemaViolationGrpcError(schemaErr)
+		}
+
 		// todo: handle key already exists
 		errorStatus := status.New(codes.Internal, err.Error())
 		return nil, errorStatus.Err()
@@ -92,7 +132,11 @@ func (g GrpcHandlers) BatchDeleteByKey(
 		return nil, grpcErr
 	}
 
-	dr, err := g.db.BatchDeleteByKey(ctx, request.Database, keys)
+	if err := g.keys.Keys(request.Keys); err != nil {
+		return nil, g.createKeyError(err)
+	}
+
+	dr, err := g.db.BatchDeleteByKey(database.WithPrincipal(ctx, PrincipalFromContext(ctx)), request.Database, keys)
 	if err != nil {
 		// todo: handle key already exists
 		errorStatus := status.New(codes.Internal, err.Error())
@@ -105,6 +149,102 @@ func (g GrpcHandlers) BatchDeleteByKey(
 	}, nil
 }
 
+// Undelete - restores soft deleted documents from the trash, atomically for the whole request
+func (g *GrpcHandlers) Undelete(
+	ctx context.Context,
+	request *command.UndeleteRequest,
+) (*command.ExecuteResult, error) {
+	start := time.Now()
+
+	if len(request.Keys) == 0 {
+		return nil, createBatchDeleteByKeyGrpcError(database.ErrEmptyInput)
+	}
+
+	if err := g.keys.Keys(request.Keys); err != nil {
+		return nil, g.createKeyError(err)
+	}
+
+	ur, err := g.db.Undelete(ctx, request.Database, request.Keys, request.IgnoreMissing)
+	if err != nil {
+		g.lg.Error(err)
+		return nil, createUndeleteGrpcError(err)
+	}
+
+	return &command.ExecuteResult{
+		DocumentsAffected: ur.RowsAffected,
+		Elapsed:           time.Since(start).Milliseconds(),
+	}, nil
+}
+
+// Patch - applies json merge patches or json patches to json documents, atomically for the whole request
+func (g *GrpcHandlers) Patch(
+	ctx context.Context,
+	request *command.PatchRequest,
+) (*command.ExecuteResult, error) {
+	start := time.Now()
+
+	bp, err := database.ConvertGrpcToLemonBatchPatch(request)
+	if err != nil {
+		g.lg.Error(err)
+		return nil, createPatchGrpcError(err)
+	}
+
+	if err := g.keys.Patch(bp); err != nil {
+		return nil, g.createKeyError(err)
+	}
+
+	pr, err := g.db.BatchPatch(ctx, request.Database, bp)
+	if err != nil {
+		g.lg.Error(err)
+		return nil, createPatchGrpcError(err)
+	}
+
+	return &command.ExecuteResult{
+		DocumentsAffected: pr.RowsAffected,
+		Elapsed:           time.Since(start).Milliseconds(),
+	}, nil
+}
+
+// CrossDatabaseTransaction - writes to several databases, all of them or none
+func (g *GrpcHandlers) CrossDatabaseTransaction(
+	ctx context.Context,
+	request *command.CrossDatabaseTransactionRequest,
+) (*command.CrossDatabaseTransactionResult, error) {
+	start := time.Now()
+
+	writes, err := database.ConvertGrpcToLemonTransaction(request)
+	if err != nil {
+		g.lg.Error(err)
+		return nil, createBatchInsertGrpcError(err)
+	}
+
+	for i := range writes {
+		if err := g.keys.Insert(writes[i].Inserts); err != nil {
+			return nil, g.createKeyError(err)
+		}
+
+		if writes[i].Upserts, err = g.keys.Upsert(writes[i].Upserts); err != nil {
+			return nil, g.createKeyError(err)
+		}
+
+		if err := g.keys.Keys(writes[i].Deletes); err != nil {
+			return nil, g.createKeyError(err)
+		}
+	}
+
+	tr, err := g.db.CrossDatabaseTransaction(database.WithPrincipal(ctx, PrincipalFromContext(ctx)), writes)
+	if err != nil {
+		g.lg.Error(err)
+		return nil, createTransactionGrpcError(err)
+	}
+
+	return &command.CrossDatabaseTransactionResult{
+		TransactionId:     tr.ID,
+		DocumentsAffected: tr.RowsAffected,
+		Elapsed:           time.Since(start).Milliseconds(),
+	}, nil
+}
+
 // MGet - multi get by keys
 func (g *GrpcHandlers) MGet(
 	ctx context.Context,
@@ -112,19 +252,63 @@ func (g *GrpcHandlers) MGet(
 ) (*command.QueryResult, error) {
 	start := time.Now()
 
-	documents, err := g.db.MGet(ctx, request.Database, request.Keys)
+	if err := g.keys.Keys(request.Keys); err != nil {
+		return nil, g.createKeyError(err)
+	}
+
+	opts := database.ReadOptions{
+		Mode:           request.ValueMode,
+		JSONProjection: request.JsonProjection,
+		MetadataOnly:   request.Projection == command.Projection_PROJECTION_METADATA,
+	}
+
+	if err := opts.Validate(); err != nil {
+		g.lg.Error(err)
+		var fieldErr *database.FieldError
+		if errors.As(err, &fieldErr) {
+			return nil, createFieldGrpcError(codes.InvalidArgument, fieldErr)
+		}
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	var asOf time.Time
+	if request.AsOf != nil {
+		if err := request.AsOf.CheckValid(); err != nil {
+			return nil, status.Error(codes.InvalidArgument, "as_of: "+err.Error())
+		}
+		asOf = request.AsOf.AsTime()
+	}
+
+	token, err := g.pages.resume(ctx, request, request.PageToken)
+	if err != nil {
+		return nil, createPageTokenGrpcError(err)
+	}
+
+	// all the keys are read at once unless the request pages through them
+	size := len(request.Keys)
+	if request.PageSize > 0 {
+		size = g.pages.size(request.PageSize)
+	}
+	keys, more := keysPage(request.Keys, token.LastKey, size)
+
+	documents, err := g.db.MGet(ctx, request.Database, keys, asOf)
 	if err != nil {
+		if errors.Is(err, database.ErrEncryptionKeyMissing) {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+
 		errorStatus := status.New(codes.Internal, err.Error())
 		return nil, errorStatus.Err()
 	}
 
-	if !request.IgnoreMissing && len(request.Keys) != len(documents) {
+	// keys of a page are distinct, so keys requested more than once are not counted as missing
+	if !request.IgnoreMissing && len(keys) != len(documents) {
 		errorStatus := status.New(codes.NotFound, "some keys are missing, cannot ignore missing")
 		ds, err := errorStatus.WithDetails(
 			&errdetails.ErrorInfo{
 				Reason: "request required not to ignore missing keys",
 				Metadata: map[string]string{
-					"expected": fmt.Sprintf("%d keys", len(request.Keys)),
+					"expected": fmt.Sprintf("%d keys", len(keys)),
 					"got":      fmt.Sprintf("%d keys", len(documents)),
 				},
 			},
@@ -139,17 +323,30 @@ func (g *GrpcHandlers) MGet(
 	}
 
 	result := command.QueryResult{
-		Documents: make(map[string]*command.Document, len(documents)),
+		Documents:        make(map[string]*command.Document, len(documents)),
+		OrderedDocuments: make([]*command.Document, 0, len(documents)),
 	}
 
-	for key, document := range documents {
-		grpcDoc, err := database.ConvertLemonToGrpcDocument(document)
+	for _, key := range keys {
+		document, ok := documents[key]
+		if !ok {
+			continue
+		}
+
+		grpcDoc, err := database.ConvertLemonToGrpcDocument(document, opts)
 		if err != nil {
 			g.lg.Error(err)
 			result.Errors = append(result.Errors, err.Error())
 			continue
 		}
 		result.Documents[key] = grpcDoc
+		result.OrderedDocuments = append(result.OrderedDocuments, grpcDoc)
+	}
+
+	if more {
+		if result.NextPageToken, err = g.pages.issue(ctx, request, keys[len(keys)-1], 0); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
 	}
 
 	result.Elapsed = time.Since(start).Milliseconds()
@@ -157,6 +354,341 @@ func (g *GrpcHandlers) MGet(
 	return &result, nil
 }
 
+// Exists - reports whether documents exist without reading them
+func (g *GrpcHandlers) Exists(
+	ctx context.Context,
+	request *command.ExistsRequest,
+) (*command.ExistsResult, error) {
+	start := time.Now()
+
+	if err := g.keys.Keys(request.Keys); err != nil {
+		return nil, g.createKeyError(err)
+	}
+
+	exists, err := g.db.Exists(ctx, request.Database, request.Keys)
+	if err != nil {
+		g.lg.Error(err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &command.ExistsResult{
+		Exists:  exists,
+		Elapsed: time.Since(start).Milliseconds(),
+	}, nil
+}
+
+// FindByTags - returns documents matching a key prefix and tag predicates
+func (g *GrpcHandlers) FindByTags(
+	ctx context.Context,
+	request *command.TagQueryRequest,
+) (*command.QueryResult, error) {
+	start := time.Now()
+
+	q, err := database.ConvertGrpcToTagQuery(request)
+	if err != nil {
+		g.lg.Error(err)
+		var fieldErr *database.FieldError
+		if errors.As(err, &fieldErr) {
+			return nil, createFieldGrpcError(codes.InvalidArgument, fieldErr)
+		}
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	documents, next, err := g.pages.read(ctx, request, request.PageToken, request.PageSize, q.Limit,
+		func(page database.Page) ([]*database.Document, error) {
+			return g.db.FindByTags(ctx, request.Database, q, page)
+		},
+	)
+	if err != nil {
+		if errors.Is(err, ErrInvalidPageToken) {
+			return nil, createPageTokenGrpcError(err)
+		}
+
+		g.lg.Error(err)
+		if errors.Is(err, database.ErrEncryptionKeyMissing) {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	opts := database.ReadOptions{Mode: request.ValueMode}
+	result := command.QueryResult{
+		Documents:        make(map[string]*command.Document, len(documents)),
+		OrderedDocuments: make([]*command.Document, 0, len(documents)),
+		NextPageToken:    next,
+	}
+
+	for _, document := range documents {
+		grpcDoc, err := database.ConvertLemonToGrpcDocument(document, opts)
+		if err != nil {
+			g.lg.Error(err)
+			result.Errors = append(result.Errors, err.Error())
+			continue
+		}
+		result.Documents[document.Key()] = grpcDoc
+		result.OrderedDocuments = append(result.OrderedDocuments, grpcDoc)
+	}
+
+	result.Elapsed = time.Since(start).Milliseconds()
+
+	return &result, nil
+}
+
+// Aggregate - streams aggregations over documents matching a key prefix and tag predicates,
+// partial results are sent while large databases are scanned and the final result last
+func (g *GrpcHandlers) Aggregate(request *command.AggregateRequest, stream command.Receiver_AggregateServer) error {
+	start := time.Now()
+
+	q, err := database.ConvertGrpcToAggregateQuery(request)
+	if err != nil {
+		g.lg.Error(err)
+		var fieldErr *database.FieldError
+		if errors.As(err, &fieldErr) {
+			return createFieldGrpcError(codes.InvalidArgument, fieldErr)
+		}
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if err := g.db.Aggregate(stream.Context(), request.Database, q, func(r *database.AggregateResult) error {
+		result, err := database.ConvertAggregateResultToGrpc(request.GroupBy, r)
+		if err != nil {
+			return err
+		}
+
+		result.Elapsed = time.Since(start).Milliseconds()
+		return stream.Send(result)
+	}); err != nil {
+		g.lg.Error(err)
+		if errors.Is(err, database.ErrEncryptionKeyMissing) {
+			return status.Error(codes.FailedPrecondition, err.Error())
+		}
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	return nil
+}
+
+// Query - executes a query in the lemon query language, returning a page of documents in key order
+// or only the plan of EXPLAIN queries
+func (g *GrpcHandlers) Query(
+	ctx context.Context,
+	request *command.LqlQuery,
+) (*command.LqlResult, error) {
+	start := time.Now()
+
+	stmt, err := lql.Parse(request.Query)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	var plan *database.QueryPlan
+	documents, next, err := g.pages.read(ctx, request, request.PageToken, request.PageSize, stmt.Limit,
+		func(page database.Page) ([]*database.Document, error) {
+			qr, err := g.db.Query(ctx, stmt, page)
+			if err != nil {
+				return nil, err
+			}
+
+			plan = qr.Plan
+			return qr.Documents, nil
+		},
+	)
+	if err != nil {
+		if errors.Is(err, ErrInvalidPageToken) {
+			return nil, createPageTokenGrpcError(err)
+		}
+
+		g.lg.Error(err)
+		var fieldErr *database.FieldError
+		if errors.As(err, &fieldErr) {
+			return nil, createFieldGrpcError(codes.InvalidArgument, fieldErr)
+		}
+		if errors.Is(err, database.ErrInvalidDatabaseName) {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if errors.Is(err, database.ErrEncryptionKeyMissing) {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	opts := database.ReadOptions{Mode: request.ValueMode}
+	result := command.LqlResult{
+		Documents:     make([]*command.Document, 0, len(documents)),
+		NextPageToken: next,
+	}
+
+	if stmt.Explain && plan != nil {
+		result.Plan = plan.String()
+	}
+
+	for _, document := range documents {
+		grpcDoc, err := database.ConvertLemonToGrpcDocument(document, opts)
+		if err != nil {
+			g.lg.Error(err)
+			result.Errors = append(result.Errors, err.Error())
+			continue
+		}
+		result.Documents = append(result.Documents, grpcDoc)
+	}
+
+	result.Elapsed = time.Since(start).Milliseconds()
+
+	return &result, nil
+}
+
+// Search - returns a page of the documents matching a full-text query, best matches first
+func (g *GrpcHandlers) Search(
+	ctx context.Context,
+	request *command.SearchRequest,
+) (*command.SearchResult, error) {
+	start := time.Now()
+
+	q, err := fulltext.Parse(request.Query)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// hits are ranked, so tokens carry the number of hits returned before instead of a key
+	token, err := g.pages.resume(ctx, request, request.PageToken)
+	if err != nil {
+		return nil, createPageTokenGrpcError(err)
+	}
+
+	limit := int(request.Limit)
+	size := g.pages.size(request.PageSize)
+	if limit > 0 && limit-token.Returned < size {
+		size = limit - token.Returned
+	}
+
+	sq := database.SearchQuery{
+		Query:         q,
+		Offset:        token.Returned,
+		Size:          size,
+		HighlightPre:  request.HighlightPre,
+		HighlightPost: request.HighlightPost,
+	}
+
+	if sq.HighlightPre == "" && sq.HighlightPost == "" {
+		sq.HighlightPre, sq.HighlightPost = fulltext.DefaultHighlightPre, fulltext.DefaultHighlightPost
+	}
+
+	var found *database.SearchResult
+	if size > 0 {
+		if found, err = g.db.Search(ctx, request.Database, sq); err != nil {
+			g.lg.Error(err)
+			switch {
+			case errors.Is(err, database.ErrInvalidDatabaseName):
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			case errors.Is(err, database.ErrSearchDisabled),
+				errors.Is(err, database.ErrSearchNotReady),
+				errors.Is(err, database.ErrEncryptionKeyMissing):
+				return nil, status.Error(codes.FailedPrecondition, err.Error())
+			default:
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+		}
+	} else {
+		found = &database.SearchResult{}
+	}
+
+	opts := database.ReadOptions{
+		Mode:         request.ValueMode,
+		MetadataOnly: request.Projection == command.Projection_PROJECTION_METADATA,
+	}
+
+	result := command.SearchResult{
+		Hits:  make([]*command.SearchHit, 0, len(found.Hits)),
+		Total: uint64(found.Total),
+	}
+
+	for _, hit := range found.Hits {
+		grpcDoc, err := database.ConvertLemonToGrpcDocument(hit.Document, opts)
+		if err != nil {
+			g.lg.Error(err)
+			result.Errors = append(result.Errors, err.Error())
+			continue
+		}
+		result.Hits = append(result.Hits, &command.SearchHit{Document: grpcDoc, Score: hit.Score, Snippet: hit.Snippet})
+	}
+
+	returned := token.Returned + size
+	if returned < found.Total && (limit == 0 || returned < limit) {
+		if result.NextPageToken, err = g.pages.issue(ctx, request, "", returned); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	result.Elapsed = time.Since(start).Milliseconds()
+
+	return &result, nil
+}
+
+// GetHistory - returns the current and previous versions of a document
+func (g *GrpcHandlers) GetHistory(
+	ctx context.Context,
+	request *command.HistoryQuery,
+) (*command.HistoryResult, error) {
+	start := time.Now()
+
+	if err := g.keys.Key(request.Key); err != nil {
+		return nil, g.createKeyError(err)
+	}
+
+	opts := database.ReadOptions{
+		Mode:           request.ValueMode,
+		JSONProjection: request.JsonProjection,
+	}
+
+	if err := opts.Validate(); err != nil {
+		g.lg.Error(err)
+		var fieldErr *database.FieldError
+		if errors.As(err, &fieldErr) {
+			return nil, createFieldGrpcError(codes.InvalidArgument, fieldErr)
+		}
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	versions, err := g.db.History(ctx, request.Database, request.Key, int(request.Limit))
+	if err != nil {
+		g.lg.Error(err)
+		if errors.Is(err, database.ErrEncryptionKeyMissing) {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if len(versions) == 0 {
+		return nil, status.Errorf(codes.NotFound, "key %s has no versions", request.Key)
+	}
+
+	result := command.HistoryResult{Versions: make([]*command.DocumentVersion, len(versions))}
+	for i, v := range versions {
+		if result.Versions[i], err = database.ConvertVersionToGrpc(v, opts); err != nil {
+			g.lg.Error(err)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	result.Elapsed = time.Since(start).Milliseconds()
+
+	return &result, nil
+}
+
+func (g *GrpcHandlers) createKeyError(err error) error {
+	g.lg.Error(err)
+
+	var keyErr *database.KeyError
+	if errors.As(err, &keyErr) {
+		return createInvalidKeyGrpcError(keyErr)
+	}
+
+	return status.Error(codes.Internal, err.Error())
+}
+
 func (g GrpcHandlers) PingPong(ctx context.Context, ping *command.Ping) (*command.Pong, error) {
 	return &command.Pong{
 		Message: "pong",
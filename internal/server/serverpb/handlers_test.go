@@ -0,0 +1,70 @@
+package serverpb
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/denismitr/lemon-server/internal/database"
+	"github.com/denismitr/lemon-server/internal/server"
+	"github.com/denismitr/lemon-server/pkg/command"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func Test_GrpcHandlers_MGet(t *testing.T) {
+	ctx := context.Background()
+	lg := zap.NewNop().Sugar()
+
+	store := database.NewStore(t.TempDir(), time.Minute)
+	t.Cleanup(func() {
+		_ = store.Close()
+	})
+	engine := database.NewEngine(store, nil, lg)
+
+	keys, err := database.NewKeyValidator(0, "", database.RejectDuplicates)
+	require.NoError(t, err)
+	pages, err := newPager(server.PagesConfig{MaxSize: 10, TokenTTL: time.Hour})
+	require.NoError(t, err)
+	h := NewHandlers(lg, engine, keys, pages)
+
+	_, err = engine.BatchUpsert(ctx, "users", database.BatchUpsert{{Key: "u:1", Value: "ann"}, {Key: "u:2", Value: "bob"}})
+	require.NoError(t, err)
+
+	t.Run("keys requested more than once are not missing", func(t *testing.T) {
+		result, err := h.MGet(ctx, &command.MultiGetQueryRequest{Database: "users", Keys: []string{"u:1", "u:2", "u:1"}})
+		require.NoError(t, err)
+		assert.Len(t, result.Documents, 2)
+		assert.Len(t, result.OrderedDocuments, 2)
+	})
+
+	t.Run("missing keys are reported", func(t *testing.T) {
+		_, err := h.MGet(ctx, &command.MultiGetQueryRequest{Database: "users", Keys: []string{"u:1", "u:3", "u:1"}})
+		assert.Equal(t, codes.NotFound, status.Code(err))
+
+		result, err := h.MGet(ctx, &command.MultiGetQueryRequest{Database: "users", Keys: []string{"u:1", "u:3", "u:1"}, IgnoreMissing: true})
+		require.NoError(t, err)
+		assert.Len(t, result.Documents, 1)
+	})
+
+	t.Run("keys are paged only when a page size is set", func(t *testing.T) {
+		var many []string
+		for i := 0; i < 12; i++ {
+			many = append(many, fmt.Sprintf("u:%d", i))
+		}
+
+		result, err := h.MGet(ctx, &command.MultiGetQueryRequest{Database: "users", Keys: many, IgnoreMissing: true})
+		require.NoError(t, err)
+		assert.Len(t, result.Documents, 2)
+		assert.Empty(t, result.NextPageToken)
+
+		result, err = h.MGet(ctx, &command.MultiGetQueryRequest{Database: "users", Keys: many, IgnoreMissing: true, PageSize: 20})
+		require.NoError(t, err)
+		assert.Len(t, result.Documents, 2)
+		assert.NotEmpty(t, result.NextPageToken)
+	})
+}
@@ -0,0 +1,398 @@
+package serverpb
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/denismitr/lemon-server/internal/lql"
+	"github.com/denismitr/lemon-server/internal/server"
+	"github.com/denismitr/lemon-server/pkg/command"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+)
+
+const idleBucketTTL = 10 * time.Minute
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// bucketDemand is the number of tokens a request needs from a single bucket
+type bucketDemand struct {
+	key     string
+	subject string
+	what    string
+	rate    float64
+	cost    float64
+}
+
+// rateLimiter is a set of token buckets keyed by principal, peer address and database,
+// each of them limiting requests per second and statements per second separately
+type rateLimiter struct {
+	mu        sync.Mutex
+	cfg       server.LimitsConfig
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func newRateLimiter(cfg server.LimitsConfig) *rateLimiter {
+	return &rateLimiter{
+		cfg:     cfg,
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+func (rl *rateLimiter) configure(cfg server.LimitsConfig) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.cfg = cfg
+}
+
+func (rl *rateLimiter) limits() server.LimitsConfig {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.cfg
+}
+
+// admit takes tokens for a request from every bucket it falls into, either
+// all of them or none, and reports the violated limits and when to retry
+func (rl *rateLimiter) admit(
+	principal, peerAddr, database string,
+	statements int,
+) ([]*errdetails.QuotaFailure_Violation, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	demands := rl.demands(principal, peerAddr, database, float64(statements))
+	if len(demands) == 0 {
+		return nil, 0
+	}
+
+	now := rl.now()
+	rl.sweep(now)
+
+	var violations []*errdetails.QuotaFailure_Violation
+	var retryAfter time.Duration
+	for _, d := range demands {
+		b := rl.refill(d, now)
+		if b.tokens >= d.cost {
+			continue
+		}
+
+		violations = append(violations, &errdetails.QuotaFailure_Violation{
+			Subject:     d.subject,
+			Description: fmt.Sprintf("%s rate limit of %g per second exceeded", d.what, d.rate),
+		})
+
+		if d.cost > rl.capacity(d.rate) {
+			// can never be satisfied, retrying will not help
+			continue
+		}
+
+		wait := time.Duration((d.cost - b.tokens) / d.rate * float64(time.Second))
+		if wait > retryAfter {
+			retryAfter = wait
+		}
+	}
+
+	if len(violations) > 0 {
+		return violations, retryAfter
+	}
+
+	for _, d := range demands {
+		rl.buckets[d.key].tokens -= d.cost
+	}
+
+	return nil, 0
+}
+
+func (rl *rateLimiter) demands(principal, peerAddr, database string, statements float64) []bucketDemand {
+	var demands []bucketDemand
+	add := func(kind, subject, what string, rate, cost float64) {
+		if rate <= 0 || cost <= 0 || subject == "" {
+			return
+		}
+
+		demands = append(demands, bucketDemand{
+			key:     kind + ":" + what + ":" + subject,
+			subject: kind + ":" + subject,
+			what:    what,
+			rate:    rate,
+			cost:    cost,
+		})
+	}
+
+	add("principal", principal, "requests", rl.cfg.PrincipalRequests, 1)
+	add("principal", principal, "statements", rl.cfg.PrincipalStatements, statements)
+	add("peer", peerAddr, "requests", rl.cfg.PeerRequests, 1)
+	add("peer", peerAddr, "statements", rl.cfg.PeerStatements, statements)
+	add("database", database, "requests", rl.cfg.DatabaseRequests, 1)
+	add("database", database, "statements", rl.cfg.DatabaseStatements, statements)
+
+	return demands
+}
+
+func (rl *rateLimiter) capacity(rate float64) float64 {
+	return math.Max(rate*rl.cfg.Burst, 1)
+}
+
+func (rl *rateLimiter) refill(d bucketDemand, now time.Time) *tokenBucket {
+	capacity := rl.capacity(d.rate)
+
+	b, ok := rl.buckets[d.key]
+	if !ok {
+		b = &tokenBucket{tokens: capacity, last: now}
+		rl.buckets[d.key] = b
+		return b
+	}
+
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*d.rate)
+	b.last = now
+
+	return b
+}
+
+// sweep drops buckets that have not been used for a while, they would be full anyway
+func (rl *rateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < time.Minute {
+		return
+	}
+
+	for k, b := range rl.buckets {
+		if now.Sub(b.last) > idleBucketTTL {
+			delete(rl.buckets, k)
+		}
+	}
+
+	rl.lastSweep = now
+}
+
+// checkQuotas enforces hard limits on the shape of a request
+func checkQuotas(req interface{}, cfg server.LimitsConfig) []*errdetails.QuotaFailure_Violation {
+	var violations []*errdetails.QuotaFailure_Violation
+
+	if cfg.MaxBatchSize > 0 {
+		if n := statementCount(req); n > cfg.MaxBatchSize {
+			violations = append(violations, &errdetails.QuotaFailure_Violation{
+				Subject:     "batch",
+				Description: fmt.Sprintf("batch of %d statements exceeds maximum of %d", n, cfg.MaxBatchSize),
+			})
+		}
+	}
+
+	if cfg.MaxValueSize > 0 {
+		for _, v := range valueSizes(req) {
+			if v.size > cfg.MaxValueSize {
+				violations = append(violations, &errdetails.QuotaFailure_Violation{
+					Subject:     v.field,
+					Description: fmt.Sprintf("value of %d bytes exceeds maximum of %d", v.size, cfg.MaxValueSize),
+				})
+			}
+		}
+	}
+
+	return violations
+}
+
+// statementCount is the number of statements or keys a request operates on
+func statementCount(req interface{}) int {
+	switch r := req.(type) {
+	case *command.BatchInsertRequest:
+		return len(r.Stmt)
+	case *command.BatchUpsertRequest:
+		return len(r.Stmt)
+	case *command.PatchRequest:
+		return len(r.Stmt)
+	case *command.BatchDeleteByKeyRequest:
+		return len(r.Keys)
+	case *command.UndeleteRequest:
+		return len(r.Keys)
+	case *command.CrossDatabaseTransactionRequest:
+		n := 0
+		for _, w := range r.Writes {
+			n += len(w.Inserts) + len(w.Upserts) + len(w.Deletes)
+		}
+		return n
+	default:
+		return 0
+	}
+}
+
+// valueSize is the size of a string or bytes value of a statement
+type valueSize struct {
+	field string
+	size  int
+}
+
+func valueSizes(req interface{}) []valueSize {
+	switch r := req.(type) {
+	case *command.BatchInsertRequest:
+		return insertValueSizes("stmt", r.Stmt)
+	case *command.BatchUpsertRequest:
+		return upsertValueSizes("stmt", r.Stmt)
+	case *command.PatchRequest:
+		return patchValueSizes("stmt", r.Stmt)
+	case *command.CrossDatabaseTransactionRequest:
+		var sizes []valueSize
+		for i, w := range r.Writes {
+			sizes = append(sizes, insertValueSizes(fmt.Sprintf("writes[%d].inserts", i), w.Inserts)...)
+			sizes = append(sizes, upsertValueSizes(fmt.Sprintf("writes[%d].upserts", i), w.Upserts)...)
+		}
+		return sizes
+	case *command.PublishRequest:
+		return []valueSize{{field: "payload", size: len(r.Payload)}}
+	default:
+		return nil
+	}
+}
+
+func insertValueSizes(field string, stmts []*command.InsertStatement) []valueSize {
+	sizes := make([]valueSize, len(stmts))
+	for i, stmt := range stmts {
+		sizes[i].field = fmt.Sprintf("%s[%d].value", field, i)
+		switch v := stmt.Value.(type) {
+		case *command.InsertStatement_Str:
+			sizes[i].size = len(v.Str)
+		case *command.InsertStatement_Blob:
+			sizes[i].size = len(v.Blob)
+		}
+	}
+	return sizes
+}
+
+func upsertValueSizes(field string, stmts []*command.UpsertStatement) []valueSize {
+	sizes := make([]valueSize, len(stmts))
+	for i, stmt := range stmts {
+		sizes[i].field = fmt.Sprintf("%s[%d].value", field, i)
+		switch v := stmt.Value.(type) {
+		case *command.UpsertStatement_Str:
+			sizes[i].size = len(v.Str)
+		case *command.UpsertStatement_Blob:
+			sizes[i].size = len(v.Blob)
+		}
+	}
+	return sizes
+}
+
+// patchValueSizes are the sizes of the patches, which hold the values they set
+func patchValueSizes(field string, stmts []*command.PatchStatement) []valueSize {
+	sizes := make([]valueSize, len(stmts))
+	for i, stmt := range stmts {
+		switch p := stmt.Patch.(type) {
+		case *command.PatchStatement_MergePatch:
+			sizes[i] = valueSize{field: fmt.Sprintf("%s[%d].merge_patch", field, i), size: len(p.MergePatch)}
+		case *command.PatchStatement_JsonPatch:
+			sizes[i] = valueSize{field: fmt.Sprintf("%s[%d].json_patch", field, i), size: len(p.JsonPatch)}
+		}
+	}
+	return sizes
+}
+
+func peerAddress(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+
+	return host
+}
+
+type databaseRequest interface {
+	GetDatabase() string
+}
+
+// requestDatabase returns the database a request operates on, queries name it in their text
+func requestDatabase(req interface{}) string {
+	if q, ok := req.(*command.LqlQuery); ok {
+		if stmt, err := lql.Parse(q.Query); err == nil {
+			return stmt.Database
+		}
+		return ""
+	}
+
+	if dr, ok := req.(databaseRequest); ok {
+		return dr.GetDatabase()
+	}
+
+	return ""
+}
+
+// check enforces the quotas and rate limits on a request
+func (rl *rateLimiter) check(ctx context.Context, req interface{}) error {
+	if violations := checkQuotas(req, rl.limits()); len(violations) > 0 {
+		return createResourceExhaustedGrpcError("request exceeds quota", violations, 0)
+	}
+
+	violations, retryAfter := rl.admit(
+		PrincipalFromContext(ctx),
+		peerAddress(ctx),
+		requestDatabase(req),
+		statementCount(req),
+	)
+
+	if len(violations) > 0 {
+		return createResourceExhaustedGrpcError("rate limit exceeded", violations, retryAfter)
+	}
+
+	return nil
+}
+
+func createRateLimitInterceptor(rl *rateLimiter) grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler,
+	) (resp interface{}, err error) {
+		if err := rl.check(ctx, req); err != nil {
+			return nil, err
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// limitedStream checks the first message a stream receives, which is the request of server
+// streams such as Subscribe, Aggregate and Replicate, messages sent once it is open are not limited
+type limitedStream struct {
+	grpc.ServerStream
+	rl      *rateLimiter
+	checked bool
+}
+
+func (s *limitedStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+
+	if s.checked {
+		return nil
+	}
+
+	s.checked = true
+	return s.rl.check(s.Context(), m)
+}
+
+func createRateLimitStreamInterceptor(rl *rateLimiter) grpc.StreamServerInterceptor {
+	return func(
+		srv interface{},
+		ss grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler,
+	) error {
+		return handler(srv, &limitedStream{ServerStream: ss, rl: rl})
+	}
+}
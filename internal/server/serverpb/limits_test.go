@@ -0,0 +1,123 @@
+package serverpb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/denismitr/lemon-server/internal/server"
+	"github.com/denismitr/lemon-server/pkg/command"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func Test_rateLimiter_admit(t *testing.T) {
+	now := time.Unix(1000, 0)
+	rl := newRateLimiter(server.LimitsConfig{
+		PrincipalRequests:  2,
+		DatabaseStatements: 10,
+		Burst:              1,
+	})
+	rl.now = func() time.Time { return now }
+
+	t.Run("requests are limited per principal", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			violations, _ := rl.admit("alice", "127.0.0.1", "", 0)
+			require.Empty(t, violations)
+		}
+
+		violations, retryAfter := rl.admit("alice", "127.0.0.1", "", 0)
+		require.Len(t, violations, 1)
+		assert.Equal(t, "principal:alice", violations[0].Subject)
+		assert.Equal(t, 500*time.Millisecond, retryAfter)
+
+		violations, _ = rl.admit("bob", "127.0.0.1", "", 0)
+		assert.Empty(t, violations)
+
+		now = now.Add(500 * time.Millisecond)
+		violations, _ = rl.admit("alice", "127.0.0.1", "", 0)
+		assert.Empty(t, violations)
+	})
+
+	t.Run("statements are limited per database", func(t *testing.T) {
+		violations, _ := rl.admit("carol", "", "users", 8)
+		require.Empty(t, violations)
+
+		violations, retryAfter := rl.admit("dave", "", "users", 4)
+		require.Len(t, violations, 1)
+		assert.Equal(t, "database:users", violations[0].Subject)
+		assert.Equal(t, 200*time.Millisecond, retryAfter)
+
+		violations, retryAfter = rl.admit("dave", "", "orders", 11)
+		require.Len(t, violations, 1)
+		assert.Zero(t, retryAfter, "batch larger than the bucket can never be admitted")
+	})
+}
+
+func Test_checkQuotas(t *testing.T) {
+	req := &command.BatchUpsertRequest{
+		Database: "foo",
+		Stmt: []*command.UpsertStatement{
+			{Key: "a", Value: &command.UpsertStatement_Str{Str: "short"}},
+			{Key: "b", Value: &command.UpsertStatement_Blob{Blob: make([]byte, 100)}},
+			{Key: "c", Value: &command.UpsertStatement_Int{Int: 1}},
+		},
+	}
+
+	assert.Empty(t, checkQuotas(req, server.LimitsConfig{MaxBatchSize: 3, MaxValueSize: 100}))
+
+	violations := checkQuotas(req, server.LimitsConfig{MaxBatchSize: 2, MaxValueSize: 10})
+	require.Len(t, violations, 2)
+	assert.Equal(t, "batch", violations[0].Subject)
+	assert.Equal(t, "stmt[1].value", violations[1].Subject)
+
+	violations = checkQuotas(&command.PublishRequest{Channel: "c", Payload: make([]byte, 11)}, server.LimitsConfig{MaxValueSize: 10})
+	require.Len(t, violations, 1)
+	assert.Equal(t, "payload", violations[0].Subject)
+
+	violations = checkQuotas(&command.PatchRequest{
+		Database: "foo",
+		Stmt: []*command.PatchStatement{
+			{Key: "a", Patch: &command.PatchStatement_MergePatch{MergePatch: `{"a":1}`}},
+			{Key: "b", Patch: &command.PatchStatement_JsonPatch{JsonPatch: `[{"op":"add","path":"/a","value":"long"}]`}},
+		},
+	}, server.LimitsConfig{MaxValueSize: 10})
+	require.Len(t, violations, 1)
+	assert.Equal(t, "stmt[1].json_patch", violations[0].Subject)
+}
+
+// requestStream receives the same subscribe request on every call
+type requestStream struct {
+	grpc.ServerStream
+}
+
+func (s *requestStream) Context() context.Context {
+	return context.WithValue(context.Background(), principalCtxKey{}, "alice")
+}
+
+func (s *requestStream) RecvMsg(m interface{}) error {
+	m.(*command.SubscribeRequest).Channels = []string{"news"}
+	return nil
+}
+
+func Test_createRateLimitStreamInterceptor(t *testing.T) {
+	interceptor := createRateLimitStreamInterceptor(newRateLimiter(server.LimitsConfig{PrincipalRequests: 1, Burst: 1}))
+	handler := func(srv interface{}, ss grpc.ServerStream) error {
+		for i := 0; i < 3; i++ {
+			if err := ss.RecvMsg(&command.SubscribeRequest{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	info := &grpc.StreamServerInfo{FullMethod: "/command.PubSub/Subscribe", IsServerStream: true}
+	// only the request opening the stream is counted
+	require.NoError(t, interceptor(nil, &requestStream{}, info, handler))
+
+	err := interceptor(nil, &requestStream{}, info, handler)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
@@ -0,0 +1,254 @@
+package serverpb
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/denismitr/lemon-server/internal/database"
+	"github.com/denismitr/lemon-server/internal/server"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+var ErrInvalidPageToken = errors.New("invalid page token")
+
+// paginationFields are left out of request fingerprints, so that they stay the same for all pages
+var paginationFields = []protoreflect.Name{"page_size", "page_token"}
+
+// pageToken is the state of a paginated read carried from one page to the next
+type pageToken struct {
+	// LastKey is the key of the last document of the previous page
+	LastKey string `json:"k"`
+	// Returned is the number of documents of all previous pages, so that limits span pages
+	Returned int `json:"n"`
+	// Fingerprint identifies the request the token was issued for
+	Fingerprint string `json:"f"`
+	IssuedAt    int64  `json:"t"`
+}
+
+// pager caps page sizes and issues page tokens signed with a secret, so that clients cannot
+// forge them, and bound to the request they were issued for
+type pager struct {
+	mu     sync.RWMutex
+	cfg    server.PagesConfig
+	secret []byte
+	random []byte
+	now    func() time.Time
+}
+
+func newPager(cfg server.PagesConfig) (*pager, error) {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return nil, errors.Wrap(err, "could not generate page token secret")
+	}
+
+	p := &pager{random: random, now: time.Now}
+	p.configure(cfg)
+
+	return p, nil
+}
+
+func (p *pager) configure(cfg server.PagesConfig) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.cfg = cfg
+	p.secret = p.random
+	if cfg.TokenSecret != "" {
+		p.secret = []byte(cfg.TokenSecret)
+	}
+}
+
+// size returns the page size of a request, the requested one up to the configured maximum
+func (p *pager) size(requested uint32) int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if requested == 0 || int(requested) > p.cfg.MaxSize {
+		return p.cfg.MaxSize
+	}
+
+	return int(requested)
+}
+
+// issue returns the token of the page following the last key of a request
+func (p *pager) issue(ctx context.Context, req proto.Message, lastKey string, returned int) (string, error) {
+	fingerprint, err := requestFingerprint(PrincipalFromContext(ctx), req)
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(pageToken{
+		LastKey:     lastKey,
+		Returned:    returned,
+		Fingerprint: fingerprint,
+		IssuedAt:    p.now().Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return encodeTokenPart(payload) + "." + encodeTokenPart(p.sign(payload)), nil
+}
+
+// resume checks the page token of a request, returning an empty token for the first page,
+// tokens that were tampered with, issued for other requests or principals or expired are rejected
+func (p *pager) resume(ctx context.Context, req proto.Message, token string) (*pageToken, error) {
+	if token == "" {
+		return &pageToken{}, nil
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, errors.Wrap(ErrInvalidPageToken, "malformed token")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidPageToken, "malformed token")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidPageToken, "malformed token")
+	}
+
+	p.mu.RLock()
+	valid := hmac.Equal(signature, p.sign(payload))
+	ttl := p.cfg.TokenTTL
+	p.mu.RUnlock()
+
+	if !valid {
+		return nil, errors.Wrap(ErrInvalidPageToken, "token was not issued by this server")
+	}
+
+	var t pageToken
+	if err := json.Unmarshal(payload, &t); err != nil {
+		return nil, errors.Wrap(ErrInvalidPageToken, "malformed token")
+	}
+
+	fingerprint, err := requestFingerprint(PrincipalFromContext(ctx), req)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.Fingerprint != fingerprint {
+		return nil, errors.Wrap(ErrInvalidPageToken, "token was issued for another request")
+	}
+
+	if p.now().Sub(time.Unix(t.IssuedAt, 0)) > ttl {
+		return nil, errors.Wrap(ErrInvalidPageToken, "token expired")
+	}
+
+	return &t, nil
+}
+
+func (p *pager) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+func encodeTokenPart(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// requestFingerprint hashes the principal and a request without its pagination fields
+func requestFingerprint(principal string, req proto.Message) (string, error) {
+	clone := proto.Clone(req)
+	m := clone.ProtoReflect()
+	for _, name := range paginationFields {
+		if fd := m.Descriptor().Fields().ByName(name); fd != nil {
+			m.Clear(fd)
+		}
+	}
+
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(clone)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(append([]byte(principal+"\x00"), b...))
+	return encodeTokenPart(sum[:16]), nil
+}
+
+// read reads the page of a request following the one of its page token, limit is the maximum number
+// of documents of all pages, the returned token of the next page is empty when there are no more
+func (p *pager) read(
+	ctx context.Context,
+	req proto.Message,
+	token string,
+	pageSize uint32,
+	limit int,
+	read func(page database.Page) ([]*database.Document, error),
+) ([]*database.Document, string, error) {
+	t, err := p.resume(ctx, req, token)
+	if err != nil {
+		return nil, "", err
+	}
+
+	size := p.size(pageSize)
+	if limit > 0 && limit-t.Returned < size {
+		size = limit - t.Returned
+	}
+
+	if size <= 0 {
+		return nil, "", nil
+	}
+
+	// one more document than fits the page tells whether there is a next page
+	documents, err := read(database.Page{After: t.LastKey, Size: size + 1})
+	if err != nil || len(documents) <= size {
+		return documents, "", err
+	}
+
+	documents = documents[:size]
+	if limit > 0 && t.Returned+size >= limit {
+		return documents, "", nil
+	}
+
+	next, err := p.issue(ctx, req, documents[size-1].Key(), t.Returned+size)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return documents, next, nil
+}
+
+// keysPage returns the keys of the page of a multi get following the last key of the previous page
+// and whether more keys follow, keys given more than once are read on the page of their first occurrence
+func keysPage(keys []string, lastKey string, size int) ([]string, bool) {
+	seen := make(map[string]bool, len(keys))
+	started := lastKey == ""
+
+	var page []string
+	for _, k := range keys {
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+
+		if !started {
+			started = k == lastKey
+			continue
+		}
+
+		if len(page) == size {
+			return page, true
+		}
+		page = append(page, k)
+	}
+
+	return page, false
+}
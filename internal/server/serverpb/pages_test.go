@@ -0,0 +1,120 @@
+package serverpb
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/denismitr/lemon-server/internal/server"
+	"github.com/denismitr/lemon-server/pkg/command"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_keysPage(t *testing.T) {
+	keys := []string{"a", "b", "a", "c", "d", "b", "e"}
+
+	tt := []struct {
+		lastKey  string
+		size     int
+		expected []string
+		more     bool
+	}{
+		{lastKey: "", size: 2, expected: []string{"a", "b"}, more: true},
+		{lastKey: "b", size: 2, expected: []string{"c", "d"}, more: true},
+		{lastKey: "d", size: 2, expected: []string{"e"}, more: false},
+		{lastKey: "", size: 5, expected: []string{"a", "b", "c", "d", "e"}, more: false},
+		{lastKey: "e", size: 2, expected: nil, more: false},
+	}
+
+	for _, tc := range tt {
+		page, more := keysPage(keys, tc.lastKey, tc.size)
+		assert.Equal(t, tc.expected, page, "after %q", tc.lastKey)
+		assert.Equal(t, tc.more, more, "after %q", tc.lastKey)
+	}
+}
+
+func Test_pager(t *testing.T) {
+	p, err := newPager(server.PagesConfig{MaxSize: 3, TokenTTL: time.Hour})
+	require.NoError(t, err)
+
+	now := time.Date(2021, 11, 1, 12, 0, 0, 0, time.UTC)
+	p.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	req := &command.TagQueryRequest{Database: "users", KeyPrefix: "u:"}
+
+	t.Run("page sizes are capped", func(t *testing.T) {
+		assert.Equal(t, 3, p.size(0))
+		assert.Equal(t, 2, p.size(2))
+		assert.Equal(t, 3, p.size(100))
+	})
+
+	t.Run("round trip", func(t *testing.T) {
+		token, err := p.issue(ctx, req, "u:7", 6)
+		require.NoError(t, err)
+
+		// page fields are not part of the request a token is bound to
+		next := &command.TagQueryRequest{Database: "users", KeyPrefix: "u:", PageSize: 10, PageToken: token}
+		resumed, err := p.resume(ctx, next, token)
+		require.NoError(t, err)
+		assert.Equal(t, "u:7", resumed.LastKey)
+		assert.Equal(t, 6, resumed.Returned)
+	})
+
+	t.Run("rejected tokens", func(t *testing.T) {
+		token, err := p.issue(ctx, req, "u:7", 6)
+		require.NoError(t, err)
+
+		other, err := newPager(server.PagesConfig{MaxSize: 3, TokenTTL: time.Hour})
+		require.NoError(t, err)
+
+		payload := strings.Split(token, ".")[0]
+		tampered := strings.Replace(token, payload, encodeTokenPart([]byte(`{"k":"v:1","n":0}`)), 1)
+
+		tt := []struct {
+			name  string
+			p     *pager
+			ctx   context.Context
+			req   *command.TagQueryRequest
+			token string
+			err   string
+		}{
+			{name: "malformed", p: p, ctx: ctx, req: req, token: "abc", err: "malformed token"},
+			{name: "tampered", p: p, ctx: ctx, req: req, token: tampered, err: "token was not issued by this server"},
+			{name: "foreign", p: other, ctx: ctx, req: req, token: token, err: "token was not issued by this server"},
+			{
+				name:  "other request",
+				p:     p,
+				ctx:   ctx,
+				req:   &command.TagQueryRequest{Database: "users", KeyPrefix: "v:"},
+				token: token,
+				err:   "token was issued for another request",
+			},
+			{
+				name:  "other principal",
+				p:     p,
+				ctx:   context.WithValue(ctx, principalCtxKey{}, "bob"),
+				req:   req,
+				token: token,
+				err:   "token was issued for another request",
+			},
+		}
+
+		for _, tc := range tt {
+			t.Run(tc.name, func(t *testing.T) {
+				_, err := tc.p.resume(tc.ctx, tc.req, tc.token)
+				require.Error(t, err)
+				assert.True(t, errors.Is(err, ErrInvalidPageToken))
+				assert.Contains(t, err.Error(), tc.err)
+			})
+		}
+
+		now = now.Add(2 * time.Hour)
+		_, err = p.resume(ctx, req, token)
+		assert.True(t, errors.Is(err, ErrInvalidPageToken))
+		assert.Contains(t, err.Error(), "token expired")
+	})
+}
@@ -0,0 +1,100 @@
+package serverpb
+
+import (
+	"context"
+	"time"
+
+	"github.com/denismitr/lemon-server/internal/database"
+	"github.com/denismitr/lemon-server/internal/pubsub"
+	"github.com/denismitr/lemon-server/pkg/command"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+type PubSubHandlers struct {
+	lg     *zap.SugaredLogger
+	broker *pubsub.Broker
+}
+
+func NewPubSubHandlers(lg *zap.SugaredLogger, broker *pubsub.Broker) *PubSubHandlers {
+	return &PubSubHandlers{
+		lg:     lg,
+		broker: broker,
+	}
+}
+
+// Publish - delivers a message to the current subscribers of a channel, storing it first when the channel is durable
+func (h *PubSubHandlers) Publish(_ context.Context, request *command.PublishRequest) (*command.PublishResult, error) {
+	start := time.Now()
+
+	seq, receivers, err := h.broker.Publish(request.Channel, request.Payload)
+	if err != nil {
+		h.lg.Error(err)
+		return nil, createPubSubGrpcError(err)
+	}
+
+	return &command.PublishResult{
+		Sequence:  seq,
+		Receivers: uint32(receivers),
+		Elapsed:   time.Since(start).Milliseconds(),
+	}, nil
+}
+
+// Subscribe - streams the messages of channels, of channels matching patterns and the documents written
+// to databases until the client cancels, stored messages of durable channels are replayed first
+func (h *PubSubHandlers) Subscribe(request *command.SubscribeRequest, stream command.PubSub_SubscribeServer) error {
+	sub := pubsub.Subscription{
+		Channels:   request.Channels,
+		Patterns:   request.Patterns,
+		ReplayFrom: request.ReplayFrom,
+	}
+
+	for _, d := range request.Databases {
+		sub.Databases = append(sub.Databases, pubsub.DatabaseFilter{
+			Database:  d.Database,
+			KeyPrefix: d.KeyPrefix,
+			Deletes:   d.IncludeDeletes,
+		})
+	}
+
+	if err := h.broker.Subscribe(stream.Context(), sub, func(m *pubsub.Message) error {
+		msg, err := convertMessageToGrpc(m)
+		if err != nil {
+			return err
+		}
+
+		return stream.Send(msg)
+	}); err != nil {
+		h.lg.Error(err)
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		return createPubSubGrpcError(err)
+	}
+
+	return nil
+}
+
+func convertMessageToGrpc(m *pubsub.Message) (*command.ChannelMessage, error) {
+	msg := &command.ChannelMessage{
+		Channel:     m.Channel,
+		Pattern:     m.Pattern,
+		Sequence:    m.Sequence,
+		Payload:     m.Payload,
+		PublishedAt: timestamppb.New(m.PublishedAt),
+		Dropped:     m.Dropped,
+	}
+
+	if m.Change != nil {
+		change, err := database.ConvertChangeToGrpcMutation(m.Database, *m.Change)
+		if err != nil {
+			return nil, err
+		}
+
+		change.CommittedAt = msg.PublishedAt
+		msg.Change = change
+	}
+
+	return msg, nil
+}
@@ -0,0 +1,331 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/ardanlabs/conf/v2"
+	"github.com/pkg/errors"
+	yamlv2 "gopkg.in/yaml.v2"
+)
+
+// Source identifies the configuration layer a value was taken from
+type Source string
+
+const (
+	SourceDefault Source = "default"
+	SourceYaml    Source = "yaml"
+	SourceDotenv  Source = "dotenv"
+	SourceEnv     Source = "env"
+	SourceFlag    Source = "flag"
+	SourceUnset   Source = "unset"
+)
+
+// Origins maps configuration keys (in their command line flag form, e.g. grpc-port)
+// to the source the effective value came from
+type Origins map[string]Source
+
+const redacted = "xxxxxx"
+
+// versionType describes the build of the server rather than its configuration
+var versionType = reflect.TypeOf(conf.Version{})
+
+type configField struct {
+	flagKey    string
+	envKey     string
+	yamlPath   []string
+	hasDefault bool
+	mask       bool
+	noprint    bool
+	value      reflect.Value
+}
+
+// dotenvParser sets the values of a dotenv file, environment variables and
+// flags are applied on top of them, so that the process environment always wins
+type dotenvParser map[string]string
+
+func (dp dotenvParser) Process(_ string, cfg interface{}) error {
+	for _, f := range collectConfigFields(reflect.ValueOf(cfg).Elem(), nil, nil) {
+		v, ok := dp[f.envKey]
+		if !ok {
+			continue
+		}
+
+		if err := setField(f.value, v); err != nil {
+			return errors.Wrapf(err, "could not set %s from dotenv", f.envKey)
+		}
+	}
+
+	return nil
+}
+
+// setField parses a value the way conf parses environment variables, slices are separated by ;
+func setField(field reflect.Value, value string) error {
+	if field.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+
+		field.SetInt(int64(d))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 0, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(value, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetFloat(n)
+	case reflect.Slice:
+		values := strings.Split(value, ";")
+		sl := reflect.MakeSlice(field.Type(), len(values), len(values))
+		for i, v := range values {
+			if err := setField(sl.Index(i), v); err != nil {
+				return err
+			}
+		}
+		field.Set(sl)
+	default:
+		return errors.Errorf("unsupported type %s", field.Type())
+	}
+
+	return nil
+}
+
+// resolveOrigins figures out which source provided each config value. It also
+// restores values explicitly set to zero in yaml or dotenv (e.g. enabled: false), because
+// conf treats zero values as missing and applies defaults on top of them.
+func resolveOrigins(cfg *Config, yamlData []byte, dotenv map[string]string, args []string) (Origins, error) {
+	yamlTree := make(map[interface{}]interface{})
+	fromYaml := Config{}
+	if yamlData != nil {
+		if err := yamlv2.Unmarshal(yamlData, &yamlTree); err != nil {
+			return nil, errors.Wrap(err, "could not parse yaml config")
+		}
+
+		if err := yamlv2.Unmarshal(yamlData, &fromYaml); err != nil {
+			return nil, errors.Wrap(err, "could not parse yaml config")
+		}
+	}
+
+	flags := parseFlagNames(args)
+	fields := collectConfigFields(reflect.ValueOf(cfg).Elem(), nil, nil)
+	yamlFields := collectConfigFields(reflect.ValueOf(&fromYaml).Elem(), nil, nil)
+
+	origins := make(Origins, len(fields))
+	for i, f := range fields {
+		switch {
+		case flags[f.flagKey]:
+			origins[f.flagKey] = SourceFlag
+		case hasEnv(f.envKey):
+			origins[f.flagKey] = SourceEnv
+		case hasKey(dotenv, f.envKey):
+			origins[f.flagKey] = SourceDotenv
+			if err := setField(f.value, dotenv[f.envKey]); err != nil {
+				return nil, errors.Wrapf(err, "could not set %s from dotenv", f.envKey)
+			}
+		case hasYamlPath(yamlTree, f.yamlPath):
+			origins[f.flagKey] = SourceYaml
+			f.value.Set(yamlFields[i].value)
+		case f.hasDefault || !f.value.IsZero():
+			origins[f.flagKey] = SourceDefault
+		default:
+			origins[f.flagKey] = SourceUnset
+		}
+	}
+
+	return origins, nil
+}
+
+// Print renders the effective configuration, one value per line
+// together with its source, with masked values redacted
+func (cfg *Config) Print() string {
+	fields := collectConfigFields(reflect.ValueOf(cfg).Elem(), nil, nil)
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].flagKey < fields[j].flagKey
+	})
+
+	var sb strings.Builder
+	for _, f := range fields {
+		if f.noprint {
+			continue
+		}
+
+		v := fmt.Sprintf("%v", f.value.Interface())
+		if f.mask {
+			v = ""
+			if !f.value.IsZero() && (f.value.Kind() != reflect.Slice || f.value.Len() > 0) {
+				v = redacted
+			}
+		}
+
+		src := cfg.origins[f.flagKey]
+		if src == "" {
+			src = SourceUnset
+		}
+
+		sb.WriteString(fmt.Sprintf("--%s=%s (%s)\n", f.flagKey, v, src))
+	}
+
+	return sb.String()
+}
+
+// collectConfigFields walks the config struct the same way conf does,
+// deriving flag and env keys from field names unless overridden in tags
+func collectConfigFields(v reflect.Value, prefix []string, yamlPrefix []string) []configField {
+	var fields []configField
+
+	t := v.Type()
+	for i := 0; i < v.NumField(); i++ {
+		sf := t.Field(i)
+		fv := v.Field(i)
+
+		confTag := sf.Tag.Get("conf")
+		if !fv.CanSet() || confTag == "-" || fv.Type() == versionType {
+			continue
+		}
+
+		key := append(append([]string{}, prefix...), camelSplit(sf.Name)...)
+		yamlKey := append(append([]string{}, yamlPrefix...), yamlName(sf))
+
+		if fv.Kind() == reflect.Struct && fv.Type().PkgPath() != "time" {
+			innerPrefix := key
+			if sf.Anonymous {
+				innerPrefix = prefix
+			}
+
+			fields = append(fields, collectConfigFields(fv, innerPrefix, yamlKey)...)
+			continue
+		}
+
+		f := configField{
+			flagKey:  strings.ToLower(strings.Join(key, "-")),
+			envKey:   strings.ToUpper(strings.Join(key, "_")),
+			yamlPath: yamlKey,
+			value:    fv,
+		}
+
+		for _, opt := range strings.Split(confTag, ",") {
+			parts := strings.SplitN(opt, ":", 2)
+			switch {
+			case parts[0] == "mask":
+				f.mask = true
+			case parts[0] == "noprint":
+				f.noprint = true
+			case parts[0] == "default" && len(parts) == 2:
+				f.hasDefault = true
+			case parts[0] == "env" && len(parts) == 2:
+				f.envKey = strings.TrimSpace(parts[1])
+			case parts[0] == "flag" && len(parts) == 2:
+				f.flagKey = strings.TrimSpace(parts[1])
+			}
+		}
+
+		fields = append(fields, f)
+	}
+
+	return fields
+}
+
+func yamlName(sf reflect.StructField) string {
+	if tag := sf.Tag.Get("yaml"); tag != "" {
+		if name := strings.Split(tag, ",")[0]; name != "" {
+			return name
+		}
+	}
+
+	return strings.ToLower(sf.Name)
+}
+
+func hasYamlPath(tree map[interface{}]interface{}, path []string) bool {
+	node := tree
+	for i, p := range path {
+		v, ok := node[p]
+		if !ok {
+			return false
+		}
+
+		if i == len(path)-1 {
+			return true
+		}
+
+		next, ok := v.(map[interface{}]interface{})
+		if !ok {
+			return false
+		}
+
+		node = next
+	}
+
+	return false
+}
+
+func hasEnv(key string) bool {
+	_, ok := os.LookupEnv(key)
+	return ok
+}
+
+func hasKey(m map[string]string, key string) bool {
+	_, ok := m[key]
+	return ok
+}
+
+// parseFlagNames collects flag names given as --name, --name=value or --name value
+func parseFlagNames(args []string) map[string]bool {
+	flags := make(map[string]bool)
+	for _, arg := range args {
+		if arg == "--" {
+			break
+		}
+
+		if len(arg) < 2 || arg[0] != '-' {
+			continue
+		}
+
+		name := strings.TrimLeft(arg, "-")
+		if idx := strings.Index(name, "="); idx >= 0 {
+			name = name[:idx]
+		}
+
+		flags[strings.ToLower(name)] = true
+	}
+
+	return flags
+}
+
+func camelSplit(s string) []string {
+	var words []string
+	runes := []rune(s)
+	start := 0
+	for i := 1; i < len(runes); i++ {
+		if unicode.IsUpper(runes[i]) && (unicode.IsLower(runes[i-1]) ||
+			(i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+			words = append(words, string(runes[start:i]))
+			start = i
+		}
+	}
+
+	return append(words, string(runes[start:]))
+}
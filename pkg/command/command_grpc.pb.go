@@ -22,6 +22,18 @@ type ReceiverClient interface {
 	BatchInsert(ctx context.Context, in *BatchInsertRequest, opts ...grpc.CallOption) (*ExecuteResult, error)
 	BatchDeleteByKey(ctx context.Context, in *BatchDeleteByKeyRequest, opts ...grpc.CallOption) (*ExecuteResult, error)
 	MGet(ctx context.Context, in *MultiGetQueryRequest, opts ...grpc.CallOption) (*QueryResult, error)
+	Exists(ctx context.Context, in *ExistsRequest, opts ...grpc.CallOption) (*ExistsResult, error)
+	Patch(ctx context.Context, in *PatchRequest, opts ...grpc.CallOption) (*ExecuteResult, error)
+	// CrossDatabaseTransaction commits writes to several databases with a two-phase commit,
+	// transactions interrupted by a crash are completed when the server starts
+	CrossDatabaseTransaction(ctx context.Context, in *CrossDatabaseTransactionRequest, opts ...grpc.CallOption) (*CrossDatabaseTransactionResult, error)
+	GetHistory(ctx context.Context, in *HistoryQuery, opts ...grpc.CallOption) (*HistoryResult, error)
+	// Undelete restores soft deleted documents from the trash of their database
+	Undelete(ctx context.Context, in *UndeleteRequest, opts ...grpc.CallOption) (*ExecuteResult, error)
+	FindByTags(ctx context.Context, in *TagQueryRequest, opts ...grpc.CallOption) (*QueryResult, error)
+	Aggregate(ctx context.Context, in *AggregateRequest, opts ...grpc.CallOption) (Receiver_AggregateClient, error)
+	Query(ctx context.Context, in *LqlQuery, opts ...grpc.CallOption) (*LqlResult, error)
+	Search(ctx context.Context, in *SearchRequest, opts ...grpc.CallOption) (*SearchResult, error)
 	PingPong(ctx context.Context, in *Ping, opts ...grpc.CallOption) (*Pong, error)
 }
 
@@ -69,6 +81,110 @@ func (c *receiverClient) MGet(ctx context.Context, in *MultiGetQueryRequest, opt
 	return out, nil
 }
 
+func (c *receiverClient) Exists(ctx context.Context, in *ExistsRequest, opts ...grpc.CallOption) (*ExistsResult, error) {
+	out := new(ExistsResult)
+	err := c.cc.Invoke(ctx, "/command.Receiver/Exists", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *receiverClient) Patch(ctx context.Context, in *PatchRequest, opts ...grpc.CallOption) (*ExecuteResult, error) {
+	out := new(ExecuteResult)
+	err := c.cc.Invoke(ctx, "/command.Receiver/Patch", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *receiverClient) CrossDatabaseTransaction(ctx context.Context, in *CrossDatabaseTransactionRequest, opts ...grpc.CallOption) (*CrossDatabaseTransactionResult, error) {
+	out := new(CrossDatabaseTransactionResult)
+	err := c.cc.Invoke(ctx, "/command.Receiver/CrossDatabaseTransaction", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *receiverClient) GetHistory(ctx context.Context, in *HistoryQuery, opts ...grpc.CallOption) (*HistoryResult, error) {
+	out := new(HistoryResult)
+	err := c.cc.Invoke(ctx, "/command.Receiver/GetHistory", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *receiverClient) Undelete(ctx context.Context, in *UndeleteRequest, opts ...grpc.CallOption) (*ExecuteResult, error) {
+	out := new(ExecuteResult)
+	err := c.cc.Invoke(ctx, "/command.Receiver/Undelete", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *receiverClient) FindByTags(ctx context.Context, in *TagQueryRequest, opts ...grpc.CallOption) (*QueryResult, error) {
+	out := new(QueryResult)
+	err := c.cc.Invoke(ctx, "/command.Receiver/FindByTags", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *receiverClient) Aggregate(ctx context.Context, in *AggregateRequest, opts ...grpc.CallOption) (Receiver_AggregateClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Receiver_ServiceDesc.Streams[0], "/command.Receiver/Aggregate", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &receiverAggregateClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Receiver_AggregateClient interface {
+	Recv() (*AggregateResult, error)
+	grpc.ClientStream
+}
+
+type receiverAggregateClient struct {
+	grpc.ClientStream
+}
+
+func (x *receiverAggregateClient) Recv() (*AggregateResult, error) {
+	m := new(AggregateResult)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *receiverClient) Query(ctx context.Context, in *LqlQuery, opts ...grpc.CallOption) (*LqlResult, error) {
+	out := new(LqlResult)
+	err := c.cc.Invoke(ctx, "/command.Receiver/Query", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *receiverClient) Search(ctx context.Context, in *SearchRequest, opts ...grpc.CallOption) (*SearchResult, error) {
+	out := new(SearchResult)
+	err := c.cc.Invoke(ctx, "/command.Receiver/Search", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *receiverClient) PingPong(ctx context.Context, in *Ping, opts ...grpc.CallOption) (*Pong, error) {
 	out := new(Pong)
 	err := c.cc.Invoke(ctx, "/command.Receiver/PingPong", in, out, opts...)
@@ -86,6 +202,18 @@ type ReceiverServer interface {
 	BatchInsert(context.Context, *BatchInsertRequest) (*ExecuteResult, error)
 	BatchDeleteByKey(context.Context, *BatchDeleteByKeyRequest) (*ExecuteResult, error)
 	MGet(context.Context, *MultiGetQueryRequest) (*QueryResult, error)
+	Exists(context.Context, *ExistsRequest) (*ExistsResult, error)
+	Patch(context.Context, *PatchRequest) (*ExecuteResult, error)
+	// CrossDatabaseTransaction commits writes to several databases with a two-phase commit,
+	// transactions interrupted by a crash are completed when the server starts
+	CrossDatabaseTransaction(context.Context, *CrossDatabaseTransactionRequest) (*CrossDatabaseTransactionResult, error)
+	GetHistory(context.Context, *HistoryQuery) (*HistoryResult, error)
+	// Undelete restores soft deleted documents from the trash of their database
+	Undelete(context.Context, *UndeleteRequest) (*ExecuteResult, error)
+	FindByTags(context.Context, *TagQueryRequest) (*QueryResult, error)
+	Aggregate(*AggregateRequest, Receiver_AggregateServer) error
+	Query(context.Context, *LqlQuery) (*LqlResult, error)
+	Search(context.Context, *SearchRequest) (*SearchResult, error)
 	PingPong(context.Context, *Ping) (*Pong, error)
 }
 
@@ -105,6 +233,33 @@ func (UnimplementedReceiverServer) BatchDeleteByKey(context.Context, *BatchDelet
 func (UnimplementedReceiverServer) MGet(context.Context, *MultiGetQueryRequest) (*QueryResult, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method MGet not implemented")
 }
+func (UnimplementedReceiverServer) Exists(context.Context, *ExistsRequest) (*ExistsResult, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Exists not implemented")
+}
+func (UnimplementedReceiverServer) Patch(context.Context, *PatchRequest) (*ExecuteResult, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Patch not implemented")
+}
+func (UnimplementedReceiverServer) CrossDatabaseTransaction(context.Context, *CrossDatabaseTransactionRequest) (*CrossDatabaseTransactionResult, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CrossDatabaseTransaction not implemented")
+}
+func (UnimplementedReceiverServer) GetHistory(context.Context, *HistoryQuery) (*HistoryResult, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetHistory not implemented")
+}
+func (UnimplementedReceiverServer) Undelete(context.Context, *UndeleteRequest) (*ExecuteResult, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Undelete not implemented")
+}
+func (UnimplementedReceiverServer) FindByTags(context.Context, *TagQueryRequest) (*QueryResult, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method FindByTags not implemented")
+}
+func (UnimplementedReceiverServer) Aggregate(*AggregateRequest, Receiver_AggregateServer) error {
+	return status.Errorf(codes.Unimplemented, "method Aggregate not implemented")
+}
+func (UnimplementedReceiverServer) Query(context.Context, *LqlQuery) (*LqlResult, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Query not implemented")
+}
+func (UnimplementedReceiverServer) Search(context.Context, *SearchRequest) (*SearchResult, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Search not implemented")
+}
 func (UnimplementedReceiverServer) PingPong(context.Context, *Ping) (*Pong, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method PingPong not implemented")
 }
@@ -192,6 +347,171 @@ func _Receiver_MGet_Handler(srv interface{}, ctx context.Context, dec func(inter
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Receiver_Exists_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ExistsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ReceiverServer).Exists(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/command.Receiver/Exists",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ReceiverServer).Exists(ctx, req.(*ExistsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Receiver_Patch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PatchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ReceiverServer).Patch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/command.Receiver/Patch",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ReceiverServer).Patch(ctx, req.(*PatchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Receiver_CrossDatabaseTransaction_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CrossDatabaseTransactionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ReceiverServer).CrossDatabaseTransaction(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/command.Receiver/CrossDatabaseTransaction",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ReceiverServer).CrossDatabaseTransaction(ctx, req.(*CrossDatabaseTransactionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Receiver_GetHistory_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(HistoryQuery)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ReceiverServer).GetHistory(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/command.Receiver/GetHistory",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ReceiverServer).GetHistory(ctx, req.(*HistoryQuery))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Receiver_Undelete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UndeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ReceiverServer).Undelete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/command.Receiver/Undelete",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ReceiverServer).Undelete(ctx, req.(*UndeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Receiver_FindByTags_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TagQueryRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ReceiverServer).FindByTags(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/command.Receiver/FindByTags",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ReceiverServer).FindByTags(ctx, req.(*TagQueryRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Receiver_Aggregate_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(AggregateRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ReceiverServer).Aggregate(m, &receiverAggregateServer{stream})
+}
+
+type Receiver_AggregateServer interface {
+	Send(*AggregateResult) error
+	grpc.ServerStream
+}
+
+type receiverAggregateServer struct {
+	grpc.ServerStream
+}
+
+func (x *receiverAggregateServer) Send(m *AggregateResult) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Receiver_Query_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LqlQuery)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ReceiverServer).Query(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/command.Receiver/Query",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ReceiverServer).Query(ctx, req.(*LqlQuery))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Receiver_Search_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SearchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ReceiverServer).Search(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/command.Receiver/Search",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ReceiverServer).Search(ctx, req.(*SearchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _Receiver_PingPong_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(Ping)
 	if err := dec(in); err != nil {
@@ -233,11 +553,878 @@ var Receiver_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "MGet",
 			Handler:    _Receiver_MGet_Handler,
 		},
+		{
+			MethodName: "Exists",
+			Handler:    _Receiver_Exists_Handler,
+		},
+		{
+			MethodName: "Patch",
+			Handler:    _Receiver_Patch_Handler,
+		},
+		{
+			MethodName: "CrossDatabaseTransaction",
+			Handler:    _Receiver_CrossDatabaseTransaction_Handler,
+		},
+		{
+			MethodName: "GetHistory",
+			Handler:    _Receiver_GetHistory_Handler,
+		},
+		{
+			MethodName: "Undelete",
+			Handler:    _Receiver_Undelete_Handler,
+		},
+		{
+			MethodName: "FindByTags",
+			Handler:    _Receiver_FindByTags_Handler,
+		},
+		{
+			MethodName: "Query",
+			Handler:    _Receiver_Query_Handler,
+		},
+		{
+			MethodName: "Search",
+			Handler:    _Receiver_Search_Handler,
+		},
 		{
 			MethodName: "PingPong",
 			Handler:    _Receiver_PingPong_Handler,
 		},
 	},
-	Streams:  []grpc.StreamDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Aggregate",
+			Handler:       _Receiver_Aggregate_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "pkg/command/command.proto",
+}
+
+// AdminClient is the client API for Admin service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type AdminClient interface {
+	QueryAuditLog(ctx context.Context, in *AuditLogQuery, opts ...grpc.CallOption) (*AuditLogResult, error)
+	// SetDatabaseSchema replaces the schema of a database, an empty schema removes it
+	SetDatabaseSchema(ctx context.Context, in *DatabaseSchema, opts ...grpc.CallOption) (*DatabaseSchema, error)
+	GetDatabaseSchema(ctx context.Context, in *DatabaseSchemaQuery, opts ...grpc.CallOption) (*DatabaseSchema, error)
+	// SetDatabaseOptions changes storage options, documents written before keep their
+	// compression, but get re-encrypted in the background when encryption changes
+	SetDatabaseOptions(ctx context.Context, in *DatabaseOptions, opts ...grpc.CallOption) (*DatabaseOptions, error)
+	GetDatabaseOptions(ctx context.Context, in *DatabaseOptionsQuery, opts ...grpc.CallOption) (*DatabaseOptions, error)
+	DescribeDatabase(ctx context.Context, in *DescribeDatabaseRequest, opts ...grpc.CallOption) (*DatabaseDescription, error)
+	// SetDatabaseIndexes declares the tags a database is indexed on, new indexes are built
+	// in the background, indexes missing from the request are dropped
+	SetDatabaseIndexes(ctx context.Context, in *DatabaseIndexes, opts ...grpc.CallOption) (*DatabaseIndexes, error)
+	GetDatabaseIndexes(ctx context.Context, in *DatabaseIndexesQuery, opts ...grpc.CallOption) (*DatabaseIndexes, error)
+	// RotateDatabaseKey re-encrypts all documents with a new data key in the background
+	RotateDatabaseKey(ctx context.Context, in *RotateDatabaseKeyRequest, opts ...grpc.CallOption) (*DatabaseDescription, error)
+	// ReshardDatabase changes the number of shards of a database, another reshard fails until it is done
+	ReshardDatabase(ctx context.Context, in *ReshardDatabaseRequest, opts ...grpc.CallOption) (*DatabaseDescription, error)
+	GetReplicationStatus(ctx context.Context, in *ReplicationStatusQuery, opts ...grpc.CallOption) (*ReplicationStatus, error)
+	// AddClusterNode makes a node a voting member of the cluster, RemoveClusterNode removes it
+	AddClusterNode(ctx context.Context, in *AddClusterNodeRequest, opts ...grpc.CallOption) (*ClusterStatus, error)
+	RemoveClusterNode(ctx context.Context, in *RemoveClusterNodeRequest, opts ...grpc.CallOption) (*ClusterStatus, error)
+	GetClusterStatus(ctx context.Context, in *ClusterStatusQuery, opts ...grpc.CallOption) (*ClusterStatus, error)
+}
+
+type adminClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAdminClient(cc grpc.ClientConnInterface) AdminClient {
+	return &adminClient{cc}
+}
+
+func (c *adminClient) QueryAuditLog(ctx context.Context, in *AuditLogQuery, opts ...grpc.CallOption) (*AuditLogResult, error) {
+	out := new(AuditLogResult)
+	err := c.cc.Invoke(ctx, "/command.Admin/QueryAuditLog", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) SetDatabaseSchema(ctx context.Context, in *DatabaseSchema, opts ...grpc.CallOption) (*DatabaseSchema, error) {
+	out := new(DatabaseSchema)
+	err := c.cc.Invoke(ctx, "/command.Admin/SetDatabaseSchema", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) GetDatabaseSchema(ctx context.Context, in *DatabaseSchemaQuery, opts ...grpc.CallOption) (*DatabaseSchema, error) {
+	out := new(DatabaseSchema)
+	err := c.cc.Invoke(ctx, "/command.Admin/GetDatabaseSchema", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) SetDatabaseOptions(ctx context.Context, in *DatabaseOptions, opts ...grpc.CallOption) (*DatabaseOptions, error) {
+	out := new(DatabaseOptions)
+	err := c.cc.Invoke(ctx, "/command.Admin/SetDatabaseOptions", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) GetDatabaseOptions(ctx context.Context, in *DatabaseOptionsQuery, opts ...grpc.CallOption) (*DatabaseOptions, error) {
+	out := new(DatabaseOptions)
+	err := c.cc.Invoke(ctx, "/command.Admin/GetDatabaseOptions", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) DescribeDatabase(ctx context.Context, in *DescribeDatabaseRequest, opts ...grpc.CallOption) (*DatabaseDescription, error) {
+	out := new(DatabaseDescription)
+	err := c.cc.Invoke(ctx, "/command.Admin/DescribeDatabase", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) SetDatabaseIndexes(ctx context.Context, in *DatabaseIndexes, opts ...grpc.CallOption) (*DatabaseIndexes, error) {
+	out := new(DatabaseIndexes)
+	err := c.cc.Invoke(ctx, "/command.Admin/SetDatabaseIndexes", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) GetDatabaseIndexes(ctx context.Context, in *DatabaseIndexesQuery, opts ...grpc.CallOption) (*DatabaseIndexes, error) {
+	out := new(DatabaseIndexes)
+	err := c.cc.Invoke(ctx, "/command.Admin/GetDatabaseIndexes", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) RotateDatabaseKey(ctx context.Context, in *RotateDatabaseKeyRequest, opts ...grpc.CallOption) (*DatabaseDescription, error) {
+	out := new(DatabaseDescription)
+	err := c.cc.Invoke(ctx, "/command.Admin/RotateDatabaseKey", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) ReshardDatabase(ctx context.Context, in *ReshardDatabaseRequest, opts ...grpc.CallOption) (*DatabaseDescription, error) {
+	out := new(DatabaseDescription)
+	err := c.cc.Invoke(ctx, "/command.Admin/ReshardDatabase", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) GetReplicationStatus(ctx context.Context, in *ReplicationStatusQuery, opts ...grpc.CallOption) (*ReplicationStatus, error) {
+	out := new(ReplicationStatus)
+	err := c.cc.Invoke(ctx, "/command.Admin/GetReplicationStatus", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) AddClusterNode(ctx context.Context, in *AddClusterNodeRequest, opts ...grpc.CallOption) (*ClusterStatus, error) {
+	out := new(ClusterStatus)
+	err := c.cc.Invoke(ctx, "/command.Admin/AddClusterNode", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) RemoveClusterNode(ctx context.Context, in *RemoveClusterNodeRequest, opts ...grpc.CallOption) (*ClusterStatus, error) {
+	out := new(ClusterStatus)
+	err := c.cc.Invoke(ctx, "/command.Admin/RemoveClusterNode", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) GetClusterStatus(ctx context.Context, in *ClusterStatusQuery, opts ...grpc.CallOption) (*ClusterStatus, error) {
+	out := new(ClusterStatus)
+	err := c.cc.Invoke(ctx, "/command.Admin/GetClusterStatus", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AdminServer is the server API for Admin service.
+// All implementations should embed UnimplementedAdminServer
+// for forward compatibility
+type AdminServer interface {
+	QueryAuditLog(context.Context, *AuditLogQuery) (*AuditLogResult, error)
+	// SetDatabaseSchema replaces the schema of a database, an empty schema removes it
+	SetDatabaseSchema(context.Context, *DatabaseSchema) (*DatabaseSchema, error)
+	GetDatabaseSchema(context.Context, *DatabaseSchemaQuery) (*DatabaseSchema, error)
+	// SetDatabaseOptions changes storage options, documents written before keep their
+	// compression, but get re-encrypted in the background when encryption changes
+	SetDatabaseOptions(context.Context, *DatabaseOptions) (*DatabaseOptions, error)
+	GetDatabaseOptions(context.Context, *DatabaseOptionsQuery) (*DatabaseOptions, error)
+	DescribeDatabase(context.Context, *DescribeDatabaseRequest) (*DatabaseDescription, error)
+	// SetDatabaseIndexes declares the tags a database is indexed on, new indexes are built
+	// in the background, indexes missing from the request are dropped
+	SetDatabaseIndexes(context.Context, *DatabaseIndexes) (*DatabaseIndexes, error)
+	GetDatabaseIndexes(context.Context, *DatabaseIndexesQuery) (*DatabaseIndexes, error)
+	// RotateDatabaseKey re-encrypts all documents with a new data key in the background
+	RotateDatabaseKey(context.Context, *RotateDatabaseKeyRequest) (*DatabaseDescription, error)
+	// ReshardDatabase changes the number of shards of a database, another reshard fails until it is done
+	ReshardDatabase(context.Context, *ReshardDatabaseRequest) (*DatabaseDescription, error)
+	GetReplicationStatus(context.Context, *ReplicationStatusQuery) (*ReplicationStatus, error)
+	// AddClusterNode makes a node a voting member of the cluster, RemoveClusterNode removes it
+	AddClusterNode(context.Context, *AddClusterNodeRequest) (*ClusterStatus, error)
+	RemoveClusterNode(context.Context, *RemoveClusterNodeRequest) (*ClusterStatus, error)
+	GetClusterStatus(context.Context, *ClusterStatusQuery) (*ClusterStatus, error)
+}
+
+// UnimplementedAdminServer should be embedded to have forward compatible implementations.
+type UnimplementedAdminServer struct {
+}
+
+func (UnimplementedAdminServer) QueryAuditLog(context.Context, *AuditLogQuery) (*AuditLogResult, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method QueryAuditLog not implemented")
+}
+func (UnimplementedAdminServer) SetDatabaseSchema(context.Context, *DatabaseSchema) (*DatabaseSchema, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetDatabaseSchema not implemented")
+}
+func (UnimplementedAdminServer) GetDatabaseSchema(context.Context, *DatabaseSchemaQuery) (*DatabaseSchema, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetDatabaseSchema not implemented")
+}
+func (UnimplementedAdminServer) SetDatabaseOptions(context.Context, *DatabaseOptions) (*DatabaseOptions, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetDatabaseOptions not implemented")
+}
+func (UnimplementedAdminServer) GetDatabaseOptions(context.Context, *DatabaseOptionsQuery) (*DatabaseOptions, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetDatabaseOptions not implemented")
+}
+func (UnimplementedAdminServer) DescribeDatabase(context.Context, *DescribeDatabaseRequest) (*DatabaseDescription, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DescribeDatabase not implemented")
+}
+func (UnimplementedAdminServer) SetDatabaseIndexes(context.Context, *DatabaseIndexes) (*DatabaseIndexes, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetDatabaseIndexes not implemented")
+}
+func (UnimplementedAdminServer) GetDatabaseIndexes(context.Context, *DatabaseIndexesQuery) (*DatabaseIndexes, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetDatabaseIndexes not implemented")
+}
+func (UnimplementedAdminServer) RotateDatabaseKey(context.Context, *RotateDatabaseKeyRequest) (*DatabaseDescription, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RotateDatabaseKey not implemented")
+}
+func (UnimplementedAdminServer) ReshardDatabase(context.Context, *ReshardDatabaseRequest) (*DatabaseDescription, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReshardDatabase not implemented")
+}
+func (UnimplementedAdminServer) GetReplicationStatus(context.Context, *ReplicationStatusQuery) (*ReplicationStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetReplicationStatus not implemented")
+}
+func (UnimplementedAdminServer) AddClusterNode(context.Context, *AddClusterNodeRequest) (*ClusterStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddClusterNode not implemented")
+}
+func (UnimplementedAdminServer) RemoveClusterNode(context.Context, *RemoveClusterNodeRequest) (*ClusterStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RemoveClusterNode not implemented")
+}
+func (UnimplementedAdminServer) GetClusterStatus(context.Context, *ClusterStatusQuery) (*ClusterStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetClusterStatus not implemented")
+}
+
+// UnsafeAdminServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AdminServer will
+// result in compilation errors.
+type UnsafeAdminServer interface {
+	mustEmbedUnimplementedAdminServer()
+}
+
+func RegisterAdminServer(s grpc.ServiceRegistrar, srv AdminServer) {
+	s.RegisterService(&Admin_ServiceDesc, srv)
+}
+
+func _Admin_QueryAuditLog_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AuditLogQuery)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).QueryAuditLog(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/command.Admin/QueryAuditLog",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).QueryAuditLog(ctx, req.(*AuditLogQuery))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_SetDatabaseSchema_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DatabaseSchema)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).SetDatabaseSchema(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/command.Admin/SetDatabaseSchema",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).SetDatabaseSchema(ctx, req.(*DatabaseSchema))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_GetDatabaseSchema_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DatabaseSchemaQuery)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).GetDatabaseSchema(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/command.Admin/GetDatabaseSchema",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).GetDatabaseSchema(ctx, req.(*DatabaseSchemaQuery))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_SetDatabaseOptions_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DatabaseOptions)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).SetDatabaseOptions(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/command.Admin/SetDatabaseOptions",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).SetDatabaseOptions(ctx, req.(*DatabaseOptions))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_GetDatabaseOptions_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DatabaseOptionsQuery)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).GetDatabaseOptions(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/command.Admin/GetDatabaseOptions",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).GetDatabaseOptions(ctx, req.(*DatabaseOptionsQuery))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_DescribeDatabase_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DescribeDatabaseRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).DescribeDatabase(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/command.Admin/DescribeDatabase",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).DescribeDatabase(ctx, req.(*DescribeDatabaseRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_SetDatabaseIndexes_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DatabaseIndexes)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).SetDatabaseIndexes(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/command.Admin/SetDatabaseIndexes",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).SetDatabaseIndexes(ctx, req.(*DatabaseIndexes))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_GetDatabaseIndexes_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DatabaseIndexesQuery)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).GetDatabaseIndexes(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/command.Admin/GetDatabaseIndexes",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).GetDatabaseIndexes(ctx, req.(*DatabaseIndexesQuery))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_RotateDatabaseKey_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RotateDatabaseKeyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).RotateDatabaseKey(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/command.Admin/RotateDatabaseKey",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).RotateDatabaseKey(ctx, req.(*RotateDatabaseKeyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_ReshardDatabase_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReshardDatabaseRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).ReshardDatabase(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/command.Admin/ReshardDatabase",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).ReshardDatabase(ctx, req.(*ReshardDatabaseRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_GetReplicationStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReplicationStatusQuery)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).GetReplicationStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/command.Admin/GetReplicationStatus",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).GetReplicationStatus(ctx, req.(*ReplicationStatusQuery))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_AddClusterNode_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddClusterNodeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).AddClusterNode(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/command.Admin/AddClusterNode",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).AddClusterNode(ctx, req.(*AddClusterNodeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_RemoveClusterNode_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RemoveClusterNodeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).RemoveClusterNode(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/command.Admin/RemoveClusterNode",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).RemoveClusterNode(ctx, req.(*RemoveClusterNodeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_GetClusterStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ClusterStatusQuery)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).GetClusterStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/command.Admin/GetClusterStatus",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).GetClusterStatus(ctx, req.(*ClusterStatusQuery))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Admin_ServiceDesc is the grpc.ServiceDesc for Admin service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Admin_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "command.Admin",
+	HandlerType: (*AdminServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "QueryAuditLog",
+			Handler:    _Admin_QueryAuditLog_Handler,
+		},
+		{
+			MethodName: "SetDatabaseSchema",
+			Handler:    _Admin_SetDatabaseSchema_Handler,
+		},
+		{
+			MethodName: "GetDatabaseSchema",
+			Handler:    _Admin_GetDatabaseSchema_Handler,
+		},
+		{
+			MethodName: "SetDatabaseOptions",
+			Handler:    _Admin_SetDatabaseOptions_Handler,
+		},
+		{
+			MethodName: "GetDatabaseOptions",
+			Handler:    _Admin_GetDatabaseOptions_Handler,
+		},
+		{
+			MethodName: "DescribeDatabase",
+			Handler:    _Admin_DescribeDatabase_Handler,
+		},
+		{
+			MethodName: "SetDatabaseIndexes",
+			Handler:    _Admin_SetDatabaseIndexes_Handler,
+		},
+		{
+			MethodName: "GetDatabaseIndexes",
+			Handler:    _Admin_GetDatabaseIndexes_Handler,
+		},
+		{
+			MethodName: "RotateDatabaseKey",
+			Handler:    _Admin_RotateDatabaseKey_Handler,
+		},
+		{
+			MethodName: "ReshardDatabase",
+			Handler:    _Admin_ReshardDatabase_Handler,
+		},
+		{
+			MethodName: "GetReplicationStatus",
+			Handler:    _Admin_GetReplicationStatus_Handler,
+		},
+		{
+			MethodName: "AddClusterNode",
+			Handler:    _Admin_AddClusterNode_Handler,
+		},
+		{
+			MethodName: "RemoveClusterNode",
+			Handler:    _Admin_RemoveClusterNode_Handler,
+		},
+		{
+			MethodName: "GetClusterStatus",
+			Handler:    _Admin_GetClusterStatus_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "pkg/command/command.proto",
+}
+
+// ReplicationClient is the client API for Replication service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ReplicationClient interface {
+	// Replicate streams the committed mutations of a primary to a follower
+	Replicate(ctx context.Context, in *ReplicateRequest, opts ...grpc.CallOption) (Replication_ReplicateClient, error)
+}
+
+type replicationClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewReplicationClient(cc grpc.ClientConnInterface) ReplicationClient {
+	return &replicationClient{cc}
+}
+
+func (c *replicationClient) Replicate(ctx context.Context, in *ReplicateRequest, opts ...grpc.CallOption) (Replication_ReplicateClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Replication_ServiceDesc.Streams[0], "/command.Replication/Replicate", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &replicationReplicateClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Replication_ReplicateClient interface {
+	Recv() (*ReplicationBatch, error)
+	grpc.ClientStream
+}
+
+type replicationReplicateClient struct {
+	grpc.ClientStream
+}
+
+func (x *replicationReplicateClient) Recv() (*ReplicationBatch, error) {
+	m := new(ReplicationBatch)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ReplicationServer is the server API for Replication service.
+// All implementations should embed UnimplementedReplicationServer
+// for forward compatibility
+type ReplicationServer interface {
+	// Replicate streams the committed mutations of a primary to a follower
+	Replicate(*ReplicateRequest, Replication_ReplicateServer) error
+}
+
+// UnimplementedReplicationServer should be embedded to have forward compatible implementations.
+type UnimplementedReplicationServer struct {
+}
+
+func (UnimplementedReplicationServer) Replicate(*ReplicateRequest, Replication_ReplicateServer) error {
+	return status.Errorf(codes.Unimplemented, "method Replicate not implemented")
+}
+
+// UnsafeReplicationServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ReplicationServer will
+// result in compilation errors.
+type UnsafeReplicationServer interface {
+	mustEmbedUnimplementedReplicationServer()
+}
+
+func RegisterReplicationServer(s grpc.ServiceRegistrar, srv ReplicationServer) {
+	s.RegisterService(&Replication_ServiceDesc, srv)
+}
+
+func _Replication_Replicate_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ReplicateRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ReplicationServer).Replicate(m, &replicationReplicateServer{stream})
+}
+
+type Replication_ReplicateServer interface {
+	Send(*ReplicationBatch) error
+	grpc.ServerStream
+}
+
+type replicationReplicateServer struct {
+	grpc.ServerStream
+}
+
+func (x *replicationReplicateServer) Send(m *ReplicationBatch) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Replication_ServiceDesc is the grpc.ServiceDesc for Replication service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Replication_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "command.Replication",
+	HandlerType: (*ReplicationServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Replicate",
+			Handler:       _Replication_Replicate_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "pkg/command/command.proto",
+}
+
+// PubSubClient is the client API for PubSub service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type PubSubClient interface {
+	Publish(ctx context.Context, in *PublishRequest, opts ...grpc.CallOption) (*PublishResult, error)
+	Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (PubSub_SubscribeClient, error)
+}
+
+type pubSubClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewPubSubClient(cc grpc.ClientConnInterface) PubSubClient {
+	return &pubSubClient{cc}
+}
+
+func (c *pubSubClient) Publish(ctx context.Context, in *PublishRequest, opts ...grpc.CallOption) (*PublishResult, error) {
+	out := new(PublishResult)
+	err := c.cc.Invoke(ctx, "/command.PubSub/Publish", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pubSubClient) Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (PubSub_SubscribeClient, error) {
+	stream, err := c.cc.NewStream(ctx, &PubSub_ServiceDesc.Streams[0], "/command.PubSub/Subscribe", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &pubSubSubscribeClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type PubSub_SubscribeClient interface {
+	Recv() (*ChannelMessage, error)
+	grpc.ClientStream
+}
+
+type pubSubSubscribeClient struct {
+	grpc.ClientStream
+}
+
+func (x *pubSubSubscribeClient) Recv() (*ChannelMessage, error) {
+	m := new(ChannelMessage)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// PubSubServer is the server API for PubSub service.
+// All implementations should embed UnimplementedPubSubServer
+// for forward compatibility
+type PubSubServer interface {
+	Publish(context.Context, *PublishRequest) (*PublishResult, error)
+	Subscribe(*SubscribeRequest, PubSub_SubscribeServer) error
+}
+
+// UnimplementedPubSubServer should be embedded to have forward compatible implementations.
+type UnimplementedPubSubServer struct {
+}
+
+func (UnimplementedPubSubServer) Publish(context.Context, *PublishRequest) (*PublishResult, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Publish not implemented")
+}
+func (UnimplementedPubSubServer) Subscribe(*SubscribeRequest, PubSub_SubscribeServer) error {
+	return status.Errorf(codes.Unimplemented, "method Subscribe not implemented")
+}
+
+// UnsafePubSubServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to PubSubServer will
+// result in compilation errors.
+type UnsafePubSubServer interface {
+	mustEmbedUnimplementedPubSubServer()
+}
+
+func RegisterPubSubServer(s grpc.ServiceRegistrar, srv PubSubServer) {
+	s.RegisterService(&PubSub_ServiceDesc, srv)
+}
+
+func _PubSub_Publish_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PublishRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PubSubServer).Publish(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/command.PubSub/Publish",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PubSubServer).Publish(ctx, req.(*PublishRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PubSub_Subscribe_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(PubSubServer).Subscribe(m, &pubSubSubscribeServer{stream})
+}
+
+type PubSub_SubscribeServer interface {
+	Send(*ChannelMessage) error
+	grpc.ServerStream
+}
+
+type pubSubSubscribeServer struct {
+	grpc.ServerStream
+}
+
+func (x *pubSubSubscribeServer) Send(m *ChannelMessage) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// PubSub_ServiceDesc is the grpc.ServiceDesc for PubSub service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var PubSub_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "command.PubSub",
+	HandlerType: (*PubSubServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Publish",
+			Handler:    _PubSub_Publish_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Subscribe",
+			Handler:       _PubSub_Subscribe_Handler,
+			ServerStreams: true,
+		},
+	},
 	Metadata: "pkg/command/command.proto",
 }